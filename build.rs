@@ -0,0 +1,17 @@
+use std::process::Command;
+
+/// Record the version of the compiler, so it can be shown by the version command.
+fn main() {
+    let rustc = std::env::var("RUSTC").unwrap_or_else(|_| "rustc".to_string());
+    let version = Command::new(rustc)
+        .arg("--version")
+        .output()
+        .ok()
+        .filter(|output| output.status.success())
+        .and_then(|output| String::from_utf8(output.stdout).ok())
+        .map(|version| version.trim().trim_start_matches("rustc ").to_string())
+        .unwrap_or_else(|| "unknown".to_string());
+
+    println!("cargo:rustc-env=RUSTC_VERSION={version}");
+    println!("cargo:rerun-if-env-changed=RUSTC");
+}
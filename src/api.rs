@@ -1,178 +1,887 @@
-use crate::error::Error;
-use crate::{types::*, version};
-use reqwest::{Client, header, header::HeaderMap, header::HeaderName, header::HeaderValue};
-use tracing::{debug, info};
-
-/// Get an installation token for the GitHub App.
-/// API endpoint: POST /app/installations/{installation_id}/access_tokens
-pub async fn get_installation_token(
-    endpoint: &str,
-    token: &str,
-    installation_id: u64,
-) -> Result<TokenResponse, Error> {
-    let url = format!("{endpoint}/app/installations/{installation_id}/access_tokens");
-    info!("Fetching installation token from '{url}'");
-
-    let client = new_client_with_common_headers(token)?;
-    let response = send_request(client.post(&url)).await?;
-
-    let token: TokenResponse = response
-        .json()
-        .await
-        .map_err(|e| Error::Parse("get_installation_token", Box::new(e)))?;
+use crate::error::{ApiError, Error};
+use crate::{client::ClientOptions, client::clock::Clock, metrics::Metrics, types::*, version};
+use reqwest::{
+    Client, StatusCode, header, header::HeaderMap, header::HeaderName, header::HeaderValue,
+};
+use std::collections::hash_map::RandomState;
+use std::hash::BuildHasher;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tokio::sync::Semaphore;
+use tracing::{Instrument, debug, info, info_span, warn};
+
+/// Initial delay before retrying a failed request, doubled with every attempt
+const RETRY_BASE_DELAY: Duration = Duration::from_millis(500);
+/// Maximum delay between retries of a failed request
+const RETRY_MAX_DELAY: Duration = Duration::from_secs(30);
+
+/// Maximum page size supported by the GitHub API for list endpoints
+const MAX_PER_PAGE: u32 = 100;
 
-    Ok(token)
+/// Http client and settings used for calling the GitHub API.
+pub struct Api {
+    http: Client,
+    endpoint: String,
+    max_attempts: u32,
+    rate_limit_max_wait: Duration,
+    user_agent: HeaderValue,
+    dry_run: bool,
+    metrics: Arc<Metrics>,
+    /// Limits the number of requests in flight, may be shared with other clients
+    request_limiter: Arc<Semaphore>,
+    /// Clock of the client, used for the time until the rate limit resets
+    clock: Arc<dyn Clock>,
 }
 
-/// Fetch all check runs for a commit.
-/// API endpoint: GET /repos/{owner}/{repo}/commits/{ref}/check-runs
-pub async fn get_check_runs(
-    endpoint: &str,
-    token: &str,
-    repo: &str,
-    commit: &str,
-) -> Result<Vec<CheckRun>, Error> {
-    let url = format!("{endpoint}/repos/{repo}/commits/{commit}/check-runs");
-    info!("Fetching check runs from '{url}'");
-
-    let client = new_client_with_common_headers(token)?;
-    let response = send_request(client.get(&url)).await?;
-    let response = receive_body(response).await?;
-
-    let check_runs: CheckRunsResponse = match serde_json::from_str(&response) {
-        Ok(check_runs) => check_runs,
-        Err(e) => {
-            debug!("Response body: '{}'", response);
-            return Err(Error::Parse("get_check_runs", Box::new(e)));
-        }
-    };
-
-    Ok(check_runs.check_runs)
+/// Create a limiter allowing the given number of requests in flight at the same time.
+pub fn new_request_limiter(max_concurrent_requests: usize) -> Arc<Semaphore> {
+    Arc::new(Semaphore::new(max_concurrent_requests.max(1)))
 }
 
-/// Create a check run for a specific commit.
-/// API endpoint: POST /repos/{owner}/{repo}/check-runs
-pub async fn create_check_run(
-    endpoint: &str,
-    token: &str,
-    repo: &str,
-    payload: &CheckRun,
-) -> Result<(), Error> {
-    let url = format!("{endpoint}/repos/{repo}/check-runs");
-    info!("Creating check-run for '{}' at '{url}'", payload.head_sha);
-
-    let client = new_client_with_common_headers(token)?;
-    let response = send_request(client.post(&url).json(payload)).await?;
-    let response = receive_body(response).await?;
-
-    match serde_json::from_str::<CheckRun>(&response) {
-        Ok(check_run) => {
-            info!(
-                "Created check-run '{}' for commit '{}'",
-                check_run.id, check_run.head_sha,
-            );
-            Ok(())
+impl Api {
+    /// Create a new API client with the endpoint and retry settings from the options.
+    /// All requests are recorded in the given metrics registry and limited by the given request limiter.
+    pub fn new(
+        http: Client,
+        options: &ClientOptions,
+        metrics: Arc<Metrics>,
+        request_limiter: Arc<Semaphore>,
+        clock: Arc<dyn Clock>,
+    ) -> Self {
+        Self {
+            http,
+            // Allow a trailing slash in the configured URL, e.g. "https://<host>/api/v3/"
+            endpoint: options.api.trim_end_matches('/').to_string(),
+            max_attempts: options.max_attempts.max(1),
+            rate_limit_max_wait: Duration::from_secs(options.rate_limit_max_wait),
+            user_agent: user_agent_header(&options.user_agent),
+            dry_run: options.dry_run,
+            metrics,
+            request_limiter,
+            clock,
         }
-        Err(e) => {
-            debug!("Response body: '{}'", response);
-            Err(Error::Parse("create_check_run", Box::new(e)))
+    }
+
+    /// Return the request limiter, to share it with other clients.
+    pub fn request_limiter(&self) -> Arc<Semaphore> {
+        self.request_limiter.clone()
+    }
+
+    /// Get an installation token for the GitHub App.
+    /// API endpoint: POST /app/installations/{installation_id}/access_tokens
+    pub async fn get_installation_token(
+        &self,
+        token: &str,
+        installation_id: u64,
+    ) -> Result<TokenResponse, Error> {
+        let url = format!(
+            "{}/app/installations/{installation_id}/access_tokens",
+            self.endpoint
+        );
+        info!("Fetching installation token from '{url}'");
+
+        let headers = self.common_headers(token)?;
+        let response = self
+            .send(
+                "get_installation_token",
+                self.http.post(&url).headers(headers),
+            )
+            .await?;
+
+        let token: TokenResponse = response
+            .json()
+            .await
+            .map_err(|e| Error::Parse("get_installation_token", Box::new(e)))?;
+
+        Ok(token)
+    }
+
+    /// Fetch all check runs for a commit.
+    /// API endpoint: GET /repos/{owner}/{repo}/commits/{ref}/check-runs
+    pub async fn get_check_runs(
+        &self,
+        token: &str,
+        repo: &str,
+        commit: &str,
+    ) -> Result<Vec<CheckRun>, Error> {
+        let url = format!(
+            "{}/repos/{repo}/commits/{commit}/check-runs?per_page={MAX_PER_PAGE}",
+            self.endpoint
+        );
+        info!("Fetching check runs from '{url}'");
+
+        self.get_all_pages("get_check_runs", token, url, |page: CheckRunsResponse| {
+            page.check_runs
+        })
+        .await
+    }
+
+    /// Fetch all pull requests associated with a commit.
+    /// API endpoint: GET /repos/{owner}/{repo}/commits/{commit_sha}/pulls
+    pub async fn get_commit_pull_requests(
+        &self,
+        token: &str,
+        repo: &str,
+        commit: &str,
+    ) -> Result<Vec<PullRequestResponse>, Error> {
+        let url = format!(
+            "{}/repos/{repo}/commits/{commit}/pulls?per_page={MAX_PER_PAGE}",
+            self.endpoint
+        );
+        info!("Fetching pull requests from '{url}'");
+
+        self.get_all_pages(
+            "get_commit_pull_requests",
+            token,
+            url,
+            |page: Vec<PullRequestResponse>| page,
+        )
+        .await
+    }
+
+    /// Fetch all commit statuses reported via the legacy Statuses API for a commit.
+    /// Only contains the latest status for each context.
+    /// API endpoint: GET /repos/{owner}/{repo}/commits/{ref}/status
+    pub async fn get_commit_statuses(
+        &self,
+        token: &str,
+        repo: &str,
+        commit: &str,
+    ) -> Result<Vec<CommitStatus>, Error> {
+        let url = format!(
+            "{}/repos/{repo}/commits/{commit}/status?per_page={MAX_PER_PAGE}",
+            self.endpoint
+        );
+        info!("Fetching commit statuses from '{url}'");
+
+        self.get_all_pages(
+            "get_commit_statuses",
+            token,
+            url,
+            |page: CombinedStatusResponse| page.statuses,
+        )
+        .await
+    }
+
+    /// Create a check run for a specific commit.
+    /// Returns the created check run, including the ID assigned by GitHub.
+    /// API endpoint: POST /repos/{owner}/{repo}/check-runs
+    pub async fn create_check_run(
+        &self,
+        token: &str,
+        repo: &str,
+        payload: &CheckRun,
+    ) -> Result<CheckRun, Error> {
+        let url = format!("{}/repos/{repo}/check-runs", self.endpoint);
+        if self.dry_run {
+            log_dry_run("POST", &url, payload);
+            return Ok(payload.clone());
+        }
+        info!("Creating check-run for '{}' at '{url}'", payload.head_sha);
+
+        let headers = self.common_headers(token)?;
+        let response = self
+            .send(
+                "create_check_run",
+                self.http.post(&url).headers(headers).json(payload),
+            )
+            .await?;
+        let response = receive_body(response).await?;
+
+        match serde_json::from_str::<CheckRun>(&response) {
+            Ok(check_run) => {
+                info!(
+                    "Created check-run '{}' for commit '{}'",
+                    check_run.id, check_run.head_sha,
+                );
+                self.metrics.observe_check_run("created");
+                Ok(check_run)
+            }
+            Err(e) => {
+                debug!("Response body: '{}'", response);
+                Err(Error::Parse("create_check_run", Box::new(e)))
+            }
+        }
+    }
+
+    /// Update a check run for a specific commit.
+    /// API endpoint: PATCH /repos/{owner}/{repo}/check-runs/{check_run_id}
+    pub async fn update_check_run(
+        &self,
+        token: &str,
+        repo: &str,
+        payload: &CheckRun,
+    ) -> Result<(), Error> {
+        let url = format!("{}/repos/{repo}/check-runs/{}", self.endpoint, payload.id);
+        if self.dry_run {
+            log_dry_run("PATCH", &url, payload);
+            return Ok(());
+        }
+        info!("Updating check-run for '{}' at '{url}'", payload.head_sha);
+
+        let headers = self.common_headers(token)?;
+        let response = self
+            .send(
+                "update_check_run",
+                self.http.patch(&url).headers(headers).json(payload),
+            )
+            .await?;
+        let response = receive_body(response).await?;
+
+        match serde_json::from_str::<CheckRun>(&response) {
+            Ok(check_run) => {
+                info!(
+                    "Updated check-run '{}' for commit '{}'",
+                    check_run.id, check_run.head_sha,
+                );
+                self.metrics.observe_check_run("updated");
+                Ok(())
+            }
+            Err(e) => {
+                debug!("Response body: '{}'", response);
+                Err(Error::Parse("update_check_run", Box::new(e)))
+            }
         }
     }
-}
 
-/// Update a check run for a specific commit.
-/// API endpoint: PATCH /repos/{owner}/{repo}/check-runs/{check_run_id}
-pub async fn update_check_run(
-    endpoint: &str,
-    token: &str,
-    repo: &str,
-    payload: &CheckRun,
-) -> Result<(), Error> {
-    let url = format!("{endpoint}/repos/{repo}/check-runs/{}", payload.id);
-    info!("Updating check-run for '{}' at '{url}'", payload.head_sha);
-
-    let client = new_client_with_common_headers(token)?;
-    let response = send_request(client.patch(&url).json(payload)).await?;
-    let response = receive_body(response).await?;
-
-    match serde_json::from_str::<CheckRun>(&response) {
-        Ok(check_run) => {
-            info!(
-                "Updated check-run '{}' for commit '{}'",
-                check_run.id, check_run.head_sha,
+    /// Re-request a check run, triggering the app that created it to run the check again.
+    /// API endpoint: POST /repos/{owner}/{repo}/check-runs/{check_run_id}/rerequest
+    pub async fn rerequest_check_run(
+        &self,
+        token: &str,
+        repo: &str,
+        check_run_id: u64,
+    ) -> Result<(), Error> {
+        let url = format!(
+            "{}/repos/{repo}/check-runs/{check_run_id}/rerequest",
+            self.endpoint
+        );
+        if self.dry_run {
+            info!("Dry-run: skipping POST '{url}'");
+            return Ok(());
+        }
+        info!("Re-requesting check-run '{check_run_id}' at '{url}'");
+
+        let headers = self.common_headers(token)?;
+        self.send("rerequest_check_run", self.http.post(&url).headers(headers))
+            .await?;
+        self.metrics.observe_check_run("rerequested");
+        Ok(())
+    }
+
+    /// Create a comment on an issue or pull request.
+    /// API endpoint: POST /repos/{owner}/{repo}/issues/{issue_number}/comments
+    pub async fn create_issue_comment(
+        &self,
+        token: &str,
+        repo: &str,
+        issue_number: u64,
+        body: &str,
+    ) -> Result<(), Error> {
+        let url = format!(
+            "{}/repos/{repo}/issues/{issue_number}/comments",
+            self.endpoint
+        );
+        if self.dry_run {
+            info!("Dry-run: skipping POST '{url}' with comment '{body}'");
+            return Ok(());
+        }
+        info!("Creating comment on '{repo}#{issue_number}' at '{url}'");
+
+        let headers = self.common_headers(token)?;
+        let payload = IssueComment {
+            body: body.to_string(),
+        };
+        self.send(
+            "create_issue_comment",
+            self.http.post(&url).headers(headers).json(&payload),
+        )
+        .await?;
+        Ok(())
+    }
+
+    /// Get the current status of a pull request.
+    /// API endpoint: GET /repos/{owner}/{repo}/pulls/{pull_number}
+    pub async fn get_pull_request(
+        &self,
+        token: &str,
+        repo: &str,
+        pull_number: u64,
+    ) -> Result<PullRequestResponse, Error> {
+        let url = format!("{}/repos/{repo}/pulls/{pull_number}", self.endpoint);
+        info!("Fetching pull request from '{url}'");
+
+        let headers = self.common_headers(token)?;
+        let response = self
+            .send("get_pull_request", self.http.get(&url).headers(headers))
+            .await?;
+        let response = receive_body(response).await?;
+
+        match serde_json::from_str::<PullRequestResponse>(&response) {
+            Ok(pull_request) => Ok(pull_request),
+            Err(e) => {
+                debug!("Response body: '{}'", response);
+                Err(Error::Parse("get_pull_request", Box::new(e)))
+            }
+        }
+    }
+
+    /// Get the GitHub App the token belongs to.
+    /// Needs to use a JWT to authenticate.
+    /// API endpoint: GET /app
+    pub async fn get_app(&self, token: &str) -> Result<App, Error> {
+        let url = format!("{}/app", self.endpoint);
+        debug!("Fetching app from '{url}'");
+
+        let headers = self.common_headers(token)?;
+        let response = self
+            .send("get_app", self.http.get(&url).headers(headers))
+            .await?;
+
+        response
+            .json()
+            .await
+            .map_err(|e| Error::Parse("get_app", Box::new(e)))
+    }
+
+    /// Get the current rate limit status.
+    /// Needs to use a JWT to authenticate.
+    /// API endpoint: GET /rate_limit
+    pub async fn get_rate_limit(&self, token: &str) -> Result<RateLimitResponse, Error> {
+        let url = format!("{}/rate_limit", self.endpoint);
+        debug!("Fetching rate limit from '{url}'");
+
+        let headers = self.common_headers(token)?;
+        let response = self
+            .send("get_rate_limit", self.http.get(&url).headers(headers))
+            .await?;
+
+        response
+            .json()
+            .await
+            .map_err(|e| Error::Parse("get_rate_limit", Box::new(e)))
+    }
+
+    /// List all installations of the GitHub App.
+    /// Needs to use a JWT to authenticate.
+    /// API endpoint: GET /app/installations
+    pub async fn list_installations(&self, token: &str) -> Result<Vec<Installation>, Error> {
+        let url = format!(
+            "{}/app/installations?per_page={MAX_PER_PAGE}",
+            self.endpoint
+        );
+        debug!("Fetching installations from '{url}'");
+
+        self.get_all_pages(
+            "list_installations",
+            token,
+            url,
+            |page: Vec<Installation>| page,
+        )
+        .await
+    }
+
+    /// Get the installation of the GitHub App on a repository.
+    /// Needs to use a JWT to authenticate.
+    /// API endpoint: GET /repos/{owner}/{repo}/installation
+    pub async fn get_repo_installation(
+        &self,
+        token: &str,
+        repo: &str,
+    ) -> Result<Installation, Error> {
+        let url = format!("{}/repos/{repo}/installation", self.endpoint);
+        debug!("Fetching installation from '{url}'");
+
+        let headers = self.common_headers(token)?;
+        let response = self
+            .send(
+                "get_repo_installation",
+                self.http.get(&url).headers(headers),
+            )
+            .await?;
+
+        response
+            .json()
+            .await
+            .map_err(|e| Error::Parse("get_repo_installation", Box::new(e)))
+    }
+
+    /// Fetch a list from the API, following the "Link" header until all pages have been collected.
+    /// The items are extracted from each page with the given function.
+    async fn get_all_pages<P, T>(
+        &self,
+        endpoint: &'static str,
+        token: &str,
+        mut url: String,
+        items: impl Fn(P) -> Vec<T>,
+    ) -> Result<Vec<T>, Error>
+    where
+        P: serde::de::DeserializeOwned,
+    {
+        let mut result = Vec::new();
+
+        loop {
+            let headers = self.common_headers(token)?;
+            let response = self
+                .send(endpoint, self.http.get(&url).headers(headers))
+                .await?;
+            let next = next_page(&response);
+            let response = receive_body(response).await?;
+
+            let page: P = match serde_json::from_str(&response) {
+                Ok(page) => page,
+                Err(e) => {
+                    debug!("Response body: '{}'", response);
+                    return Err(Error::Parse(endpoint, Box::new(e)));
+                }
+            };
+            result.extend(items(page));
+
+            match next {
+                Some(next) => {
+                    debug!("Fetching next page from '{next}'");
+                    url = next;
+                }
+                None => break,
+            }
+        }
+
+        Ok(result)
+    }
+
+    /// Headers sent with every request, including the token when it is not empty.
+    fn common_headers(&self, token: &str) -> Result<HeaderMap, Error> {
+        let mut headers = HeaderMap::new();
+        headers.insert(
+            header::ACCEPT,
+            HeaderValue::from_static("application/vnd.github+json"),
+        );
+        headers.insert(
+            HeaderName::from_static("x-github-api-version"),
+            HeaderValue::from_static("2022-11-28"),
+        );
+        headers.insert(header::USER_AGENT, self.user_agent.clone());
+        if !token.is_empty() {
+            let bearer = format!("Bearer {token}");
+            let bearer = HeaderValue::from_str(&bearer).map_err(|_| Error::InvalidBearerToken())?;
+            headers.insert(header::AUTHORIZATION, bearer);
+        }
+        Ok(headers)
+    }
+
+    /// Send the request and retry transient failures with exponential backoff.
+    /// POST requests are only retried when they did not reach GitHub or were rate limited, see Error::is_retryable.
+    /// The endpoint is the name used for the request in the metrics.
+    async fn send(
+        &self,
+        endpoint: &str,
+        builder: reqwest::RequestBuilder,
+    ) -> Result<reqwest::Response, Error> {
+        let (http, request) = builder.build_split();
+        let request = request.map_err(Error::CreateRequest)?;
+        let mut attempt = 1;
+        loop {
+            let next = match request.try_clone() {
+                Some(next) => next,
+                None => return self.send_request(endpoint, &http, request).await,
+            };
+            let err = match self.send_request(endpoint, &http, next).await {
+                Ok(response) => return Ok(response),
+                Err(err) => err,
+            };
+            if attempt >= self.max_attempts || !err.is_retryable(request.method()) {
+                return Err(err);
+            }
+
+            let delay = match err.rate_limit_reset() {
+                Some(wait) if wait > self.rate_limit_max_wait => {
+                    warn!(
+                        "Rate limit resets in {wait:?}, which exceeds the maximum wait time of {:?}",
+                        self.rate_limit_max_wait
+                    );
+                    return Err(err);
+                }
+                Some(wait) => wait,
+                None => retry_delay(attempt),
+            };
+            warn!(
+                "Request failed (attempt {attempt}/{}), retrying in {delay:?}: {err}",
+                self.max_attempts
             );
-            Ok(())
+            tokio::time::sleep(delay).await;
+            attempt += 1;
         }
-        Err(e) => {
-            debug!("Response body: '{}'", response);
-            Err(Error::Parse("update_check_run", Box::new(e)))
+    }
+
+    /// Send a single request and record it in the metrics.
+    async fn send_request(
+        &self,
+        endpoint: &str,
+        http: &Client,
+        request: reqwest::Request,
+    ) -> Result<reqwest::Response, Error> {
+        let method = request.method().to_string();
+        // Child of the span of the webhook delivery, if any. Info level like the webhook span,
+        // so both are exported to OpenTelemetry with the default log level.
+        let span = info_span!(
+            "github_request",
+            endpoint,
+            method = method.as_str(),
+            status = tracing::field::Empty
+        );
+
+        if self.request_limiter.available_permits() == 0 {
+            debug!("Too many requests in flight, waiting for a free slot");
+        }
+        // The semaphore is never closed. Waiting for a slot is not part of the request duration.
+        let _permit = self.request_limiter.acquire().await;
+        let start = Instant::now();
+        let result = http.execute(request).instrument(span.clone()).await;
+        let status = match &result {
+            Ok(response) => response.status().as_str().to_string(),
+            Err(_) => "error".to_string(),
+        };
+        span.record("status", status.as_str());
+        self.metrics
+            .observe_api_request(endpoint, &status, start.elapsed());
+        let response = result.map_err(Error::Send)?;
+
+        if !response.status().is_success() {
+            let status = response.status();
+            let url = response.url().to_string();
+            let wait = rate_limit_wait(response.headers(), self.clock.now().timestamp());
+            let body = response.text().await.unwrap_or_default();
+
+            debug!("Request failed with: status='{}', body='{}'", status, body);
+
+            if (status == StatusCode::FORBIDDEN || status == StatusCode::TOO_MANY_REQUESTS)
+                && (wait.is_some()
+                    || status == StatusCode::TOO_MANY_REQUESTS
+                    || body.contains("rate limit"))
+            {
+                return Err(Error::RateLimited(url, wait));
+            }
+            return Err(Error::Api(ApiError::new(&method, &url, status, &body)));
         }
+        Ok(response)
     }
 }
 
-/// Get the current status of a pull request.
-/// API endpoint: GET /repos/{owner}/{repo}/pulls/{pull_number}
-pub async fn get_pull_request(
-    endpoint: &str,
-    token: &str,
-    repo: &str,
-    pull_number: u64,
-) -> Result<PullRequestResponse, Error> {
-    let url = format!("{endpoint}/repos/{repo}/pulls/{pull_number}");
-    info!("Fetching pull request from '{url}'");
+/// Log a mutating request that is skipped because of dry-run mode.
+fn log_dry_run(method: &str, url: &str, payload: &CheckRun) {
+    let payload = serde_json::to_string(payload).unwrap_or_default();
+    info!("Dry-run: skipping {method} '{url}' with payload '{payload}'");
+}
+
+async fn receive_body(response: reqwest::Response) -> Result<String, Error> {
+    response.text().await.map_err(Error::ReceiveBody)
+}
 
-    let client = new_client_with_common_headers(token)?;
-    let response = send_request(client.get(&url)).await?;
-    let response = receive_body(response).await?;
+/// Return the url of the next page from the "Link" header, if there is one.
+/// Relative urls are resolved against the url of the response.
+fn next_page(response: &reqwest::Response) -> Option<String> {
+    let link = response.headers().get(header::LINK)?.to_str().ok()?;
+    let next = parse_next_link(link)?;
+    response.url().join(next).ok().map(|url| url.to_string())
+}
 
-    match serde_json::from_str::<PullRequestResponse>(&response) {
-        Ok(pull_request) => Ok(pull_request),
-        Err(e) => {
-            debug!("Response body: '{}'", response);
-            Err(Error::Parse("get_pull_request", Box::new(e)))
+/// Use the configured User-Agent, falling back to the default when it is empty or invalid.
+fn user_agent_header(user_agent: &str) -> HeaderValue {
+    if !user_agent.is_empty() {
+        match HeaderValue::from_str(user_agent) {
+            Ok(value) => return value,
+            Err(_) => warn!("Invalid user-agent '{user_agent}', using the default"),
         }
     }
+    HeaderValue::from_str(&version::user_agent())
+        .expect("Default user-agent should be a valid header value")
+}
+
+/// Extract the target of the link with rel="next" from a "Link" header value.
+/// Example: <https://api.github.com/resource?page=2>; rel="next", <...>; rel="last"
+fn parse_next_link(link: &str) -> Option<&str> {
+    link.split(',').find_map(|entry| {
+        let mut parts = entry.split(';').map(str::trim);
+        let target = parts.next()?.strip_prefix('<')?.strip_suffix('>')?;
+        parts
+            .any(|param| param == r#"rel="next""#)
+            .then_some(target)
+    })
+}
+
+/// Check the response headers for an exceeded rate limit and return the time until it resets.
+/// Uses "Retry-After" for secondary rate limits and "X-RateLimit-Reset" for the primary rate limit.
+fn rate_limit_wait(headers: &HeaderMap, now: i64) -> Option<Duration> {
+    let header_value = |name: &str| headers.get(name).and_then(|value| value.to_str().ok());
+
+    if let Some(retry_after) = header_value("retry-after").and_then(|v| v.parse::<u64>().ok()) {
+        return Some(Duration::from_secs(retry_after));
+    }
+    if header_value("x-ratelimit-remaining") != Some("0") {
+        return None;
+    }
+    let reset = header_value("x-ratelimit-reset")?.parse::<i64>().ok()?;
+    Some(Duration::from_secs(reset.saturating_sub(now).max(0) as u64))
 }
 
-fn new_client_with_common_headers(token: &str) -> Result<Client, Error> {
-    let mut headers = HeaderMap::new();
-    headers.insert(
-        header::ACCEPT,
-        HeaderValue::from_static("application/vnd.github+json"),
-    );
-    headers.insert(
-        HeaderName::from_static("x-github-api-version"),
-        HeaderValue::from_static("2022-11-28"),
-    );
-    headers.insert(header::USER_AGENT, HeaderValue::from_static(version::NAME));
-    if !token.is_empty() {
-        let bearer = format!("Bearer {token}");
-        let bearer = HeaderValue::from_str(&bearer).map_err(|_| Error::InvalidBearerToken())?;
-        headers.insert(header::AUTHORIZATION, bearer);
-    }
-    Client::builder()
-        .default_headers(headers)
-        .build()
-        .map_err(Error::CreateRequest)
+/// Calculate the delay before the next attempt.
+/// Grows exponentially with up to 50% jitter, capped at RETRY_MAX_DELAY.
+fn retry_delay(attempt: u32) -> Duration {
+    let delay = RETRY_BASE_DELAY.saturating_mul(2u32.saturating_pow(attempt.saturating_sub(1)));
+    let jitter = (RandomState::new().hash_one(attempt) % 1000) as f64 / 2000.0;
+    (delay + delay.mul_f64(jitter)).min(RETRY_MAX_DELAY)
 }
 
-async fn send_request(builder: reqwest::RequestBuilder) -> Result<reqwest::Response, Error> {
-    let response = builder.send().await.map_err(Error::Send)?;
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::client::clock::{FixedClock, SystemClock};
+
+    #[test]
+    fn test_retry_delay_grows_exponentially() {
+        for attempt in 1..5 {
+            let base = RETRY_BASE_DELAY * 2u32.pow(attempt - 1);
+            let delay = retry_delay(attempt);
+            assert!(delay >= base, "Delay {delay:?} should be at least {base:?}");
+            assert!(
+                delay <= base + base / 2,
+                "Delay {delay:?} should have at most 50% jitter"
+            );
+        }
+    }
+
+    #[test]
+    fn test_rate_limit_wait() {
+        let now = 1_700_000_000;
+        let mut headers = HeaderMap::new();
+        assert_eq!(
+            None,
+            rate_limit_wait(&headers, now),
+            "No rate limit headers"
+        );
+
+        headers.insert("x-ratelimit-remaining", HeaderValue::from_static("10"));
+        headers.insert("x-ratelimit-reset", HeaderValue::from_static("1700000042"));
+        assert_eq!(
+            None,
+            rate_limit_wait(&headers, now),
+            "Rate limit not exceeded"
+        );
+
+        headers.insert("x-ratelimit-remaining", HeaderValue::from_static("0"));
+        assert_eq!(
+            Some(Duration::from_secs(42)),
+            rate_limit_wait(&headers, now),
+            "Should wait until the primary rate limit resets"
+        );
+        assert_eq!(
+            Some(Duration::ZERO),
+            rate_limit_wait(&headers, now + 100),
+            "Reset in the past should not wait"
+        );
+
+        headers.insert("retry-after", HeaderValue::from_static("7"));
+        assert_eq!(
+            Some(Duration::from_secs(7)),
+            rate_limit_wait(&headers, now),
+            "Retry-After should take precedence"
+        );
+    }
+
+    #[test]
+    fn test_parse_next_link() {
+        let link = r#"<https://api.github.com/repositories/1/commits/abc/check-runs?page=2>; rel="next", <https://api.github.com/repositories/1/commits/abc/check-runs?page=3>; rel="last""#;
+        assert_eq!(
+            Some("https://api.github.com/repositories/1/commits/abc/check-runs?page=2"),
+            parse_next_link(link)
+        );
+
+        let link = r#"<https://api.github.com/resource?page=1>; rel="prev", <https://api.github.com/resource?page=1>; rel="first""#;
+        assert_eq!(None, parse_next_link(link), "Last page has no next link");
+        assert_eq!(None, parse_next_link(""), "Empty header");
+        assert_eq!(None, parse_next_link("garbage"), "Malformed header");
+    }
+
+    #[test]
+    fn test_retry_delay_is_capped() {
+        assert_eq!(RETRY_MAX_DELAY, retry_delay(20));
+        assert_eq!(RETRY_MAX_DELAY, retry_delay(u32::MAX));
+    }
+
+    #[test]
+    fn test_common_headers_user_agent() {
+        let tests = [
+            (String::new(), version::user_agent()),
+            ("my-fork/1.0".to_string(), "my-fork/1.0".to_string()),
+            ("invalid\nagent".to_string(), version::user_agent()),
+        ];
+        for (user_agent, expected) in tests {
+            let options = ClientOptions {
+                user_agent,
+                ..Default::default()
+            };
+            let api = Api::new(
+                Client::new(),
+                &options,
+                Arc::new(Metrics::new()),
+                new_request_limiter(1),
+                Arc::new(SystemClock),
+            );
+
+            let headers = api.common_headers("token").unwrap();
+            assert_eq!(expected, headers[header::USER_AGENT].to_str().unwrap());
+            assert_eq!("Bearer token", headers[header::AUTHORIZATION]);
+        }
+        assert!(version::user_agent().starts_with("cerberus-mergeguard/"));
+    }
+
+    #[tokio::test]
+    async fn test_send_does_not_retry_timed_out_post() {
+        use std::sync::atomic::{AtomicUsize, Ordering};
+
+        let hits = Arc::new(AtomicUsize::new(0));
+        let handler = {
+            let hits = hits.clone();
+            move || async move {
+                hits.fetch_add(1, Ordering::SeqCst);
+                tokio::time::sleep(Duration::from_millis(500)).await;
+                "ok"
+            }
+        };
+        let router =
+            axum::Router::new().route("/", axum::routing::get(handler.clone()).post(handler));
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move { axum::serve(listener, router).await });
+
+        let options = ClientOptions {
+            api: format!("http://{addr}"),
+            max_attempts: 2,
+            ..Default::default()
+        };
+        let http = Client::builder()
+            .timeout(Duration::from_millis(100))
+            .build()
+            .unwrap();
+        let api = Api::new(
+            http,
+            &options,
+            Arc::new(Metrics::new()),
+            new_request_limiter(1),
+            Arc::new(SystemClock),
+        );
+        let url = format!("{}/", api.endpoint);
+
+        let result = api.send("test", api.http.post(&url).body("{}")).await;
+        assert!(
+            matches!(&result, Err(Error::Send(err)) if err.is_timeout()),
+            "POST should time out: {result:?}"
+        );
+        assert_eq!(
+            1,
+            hits.load(Ordering::SeqCst),
+            "Should not send the timed out POST twice"
+        );
+
+        let result = api.send("test", api.http.get(&url)).await;
+        assert!(result.is_err(), "GET should time out: {result:?}");
+        assert_eq!(
+            3,
+            hits.load(Ordering::SeqCst),
+            "Should retry the timed out GET"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_rate_limit_wait_uses_clock() {
+        let now = chrono::DateTime::from_timestamp(1_700_000_000, 0).unwrap();
+        let handler = || async {
+            (
+                StatusCode::FORBIDDEN,
+                [
+                    ("x-ratelimit-remaining", "0"),
+                    ("x-ratelimit-reset", "1700000042"),
+                ],
+                "API rate limit exceeded",
+            )
+        };
+        let router = axum::Router::new().route("/", axum::routing::get(handler));
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move { axum::serve(listener, router).await });
 
-    if !response.status().is_success() {
-        let status = response.status();
-        let url = response.url().to_string();
+        let options = ClientOptions {
+            api: format!("http://{addr}"),
+            max_attempts: 1,
+            ..Default::default()
+        };
+        let api = Api::new(
+            Client::new(),
+            &options,
+            Arc::new(Metrics::new()),
+            new_request_limiter(1),
+            Arc::new(FixedClock(now)),
+        );
+        let url = format!("{}/", api.endpoint);
 
-        debug!(
-            "Request failed with: status='{}', body='{}'",
-            status,
-            response.text().await.unwrap_or_default(),
+        let result = api.send("test", api.http.get(&url)).await;
+        assert!(
+            matches!(&result, Err(Error::RateLimited(_, Some(wait))) if *wait == Duration::from_secs(42)),
+            "Should wait until the reset relative to the clock: {result:?}"
         );
-        return Err(Error::NonOkStatus(url, status));
     }
-    Ok(response)
-}
 
-async fn receive_body(response: reqwest::Response) -> Result<String, Error> {
-    response.text().await.map_err(Error::ReceiveBody)
+    #[tokio::test]
+    async fn test_request_limiter_caps_concurrent_requests() {
+        use std::sync::atomic::{AtomicUsize, Ordering};
+
+        let in_flight = Arc::new(AtomicUsize::new(0));
+        let max_in_flight = Arc::new(AtomicUsize::new(0));
+        let handler = {
+            let in_flight = in_flight.clone();
+            let max_in_flight = max_in_flight.clone();
+            move || async move {
+                let current = in_flight.fetch_add(1, Ordering::SeqCst) + 1;
+                max_in_flight.fetch_max(current, Ordering::SeqCst);
+                tokio::time::sleep(Duration::from_millis(50)).await;
+                in_flight.fetch_sub(1, Ordering::SeqCst);
+                "ok"
+            }
+        };
+        let router = axum::Router::new().route("/", axum::routing::get(handler));
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move { axum::serve(listener, router).await });
+
+        let options = ClientOptions {
+            api: format!("http://{addr}"),
+            ..Default::default()
+        };
+        let api = Arc::new(Api::new(
+            Client::new(),
+            &options,
+            Arc::new(Metrics::new()),
+            new_request_limiter(2),
+            Arc::new(SystemClock),
+        ));
+
+        let mut requests = tokio::task::JoinSet::new();
+        for _ in 0..8 {
+            let api = api.clone();
+            requests.spawn(async move {
+                let url = format!("{}/", api.endpoint);
+                api.send("test", api.http.get(url)).await
+            });
+        }
+        while let Some(result) = requests.join_next().await {
+            let response = result.expect("Request task should not panic");
+            assert!(response.is_ok(), "Request should succeed: {response:?}");
+        }
+
+        assert_eq!(
+            2,
+            max_in_flight.load(Ordering::SeqCst),
+            "Should never have more than 2 requests in flight"
+        );
+    }
 }
@@ -1,13 +1,29 @@
 use crate::{
     api,
-    error::Error,
-    types::{CHECK_RUN_CONCLUSION, CHECK_RUN_NEUTRAL, CHECK_RUN_SKIPPED, CheckRun, TokenResponse},
+    error::{ConfigError, Error},
+    metrics::Metrics,
+    store::{self, MemoryStore, StateStore},
+    types::{
+        App, CHECK_RUN_ACTION_REQUIRED, CHECK_RUN_COMPLETED_STATUS, CHECK_RUN_CONCLUSION,
+        CHECK_RUN_CONCLUSIONS, CHECK_RUN_INITIAL_STATUS, CHECK_RUN_NAME, CHECK_RUN_NEUTRAL,
+        CHECK_RUN_PENDING_STATUSES, CHECK_RUN_SKIPPED, COMMIT_STATUS_PENDING,
+        COMMIT_STATUS_SUCCESS, CheckResult, CheckRun, CheckRunsStatus, CommitStatus, Installation,
+        PULL_REQUEST_OPEN, PullRequestResponse, RateLimitResponse, TokenResponse,
+        template::SummaryTemplate,
+    },
 };
+use chrono::{DateTime, Utc};
+use clock::{Clock, SystemClock};
 use serde::{Deserialize, Serialize};
 use std::collections::HashMap;
-use tokio::sync::Mutex;
-use tracing::{debug, warn};
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::sync::{Mutex, Semaphore};
+use tracing::{debug, error, info, warn};
 
+mod base64;
+pub mod clock;
+pub mod glob;
 #[cfg(test)]
 mod test;
 
@@ -18,48 +34,638 @@ pub struct ClientOptions {
     /// Client ID for the GitHub App
     pub client_id: String,
 
-    /// Private key for the GitHub App
+    /// Path to the private key file for the GitHub App
+    #[serde(default, skip_serializing_if = "str::is_empty")]
     pub private_key: String,
 
+    /// Private key for the GitHub App as inline PEM, e.g. from an environment variable.
+    /// Mutually exclusive with private_key and private_key_base64.
+    #[serde(default, skip_serializing_if = "str::is_empty")]
+    pub private_key_data: String,
+
+    /// Private key for the GitHub App as base64 encoded PEM.
+    /// Allows passing the key as a single line, e.g. in an environment variable.
+    /// Mutually exclusive with private_key and private_key_data.
+    #[serde(default, skip_serializing_if = "str::is_empty")]
+    pub private_key_base64: String,
+
     /// URL to github api, defaults to "https://api.github.com"
+    /// For GitHub Enterprise Server, use "https://<host>/api/v3".
     #[serde(skip_serializing_if = "str::is_empty", default = "default_api_url")]
     pub api: String,
+
+    /// Maximum number of attempts for requests to the github api, including the first one.
+    /// Network errors, server errors and secondary rate limits are retried with exponential backoff.
+    /// Requests creating something, e.g. check runs and comments, are only retried when they did not reach the api.
+    #[serde(default = "default_max_attempts")]
+    pub max_attempts: u32,
+
+    /// Maximum time to wait for an exceeded rate limit to reset before retrying a request.
+    /// If the rate limit resets later, the request fails with a rate limit error.
+    /// Unit is in seconds.
+    #[serde(default = "default_rate_limit_max_wait")]
+    pub rate_limit_max_wait: u64,
+
+    /// Maximum number of requests to the github api in flight at the same time.
+    /// Further requests wait for a free slot, smoothing bursts that could trip secondary rate limits.
+    /// Additional apps share the limit of the main app, their own value is ignored.
+    #[serde(default = "default_max_concurrent_requests")]
+    pub max_concurrent_requests: usize,
+
+    /// Seconds the issued time of the JWT is set into the past, to tolerate clocks running ahead of GitHub.
+    /// Increase it when GitHub rejects the JWT as issued in the future, at most 120 seconds.
+    #[serde(default = "default_jwt_clock_skew")]
+    pub jwt_clock_skew: u64,
+
+    /// Name of the check run created by the bot, defaults to "cerberus-mergeguard".
+    /// Use different names when running multiple instances on the same repositories.
+    #[serde(default = "default_check_name")]
+    pub check_name: String,
+
+    /// Status of the check run while other checks are pending, either "queued" or "in_progress".
+    /// The GitHub UI shows "in_progress" with a spinner.
+    #[serde(default = "default_initial_status")]
+    pub initial_status: String,
+
+    /// Template for the details URL of the check run, linked from the check in the GitHub UI.
+    /// Supports the placeholders "{owner}", "{repo}" (without the owner) and "{sha}", e.g. "https://ci.example.org/{owner}/{repo}/{sha}".
+    /// Empty to not set a details URL.
+    #[serde(default, skip_serializing_if = "str::is_empty")]
+    pub details_url: String,
+
+    /// Template for the summary of the check run output, receiving the considered checks and the conclusion.
+    /// Uses a subset of the mustache syntax, see the example configuration for the available variables.
+    /// Empty to use the built-in summary.
+    #[serde(default, skip_serializing_if = "str::is_empty")]
+    pub summary_template: String,
+
+    /// Path to a file containing the summary template, mutually exclusive with summary-template.
+    #[serde(default, skip_serializing_if = "str::is_empty")]
+    pub summary_template_file: String,
+
+    /// Names of check runs or commit status contexts that must be present and passing.
+    /// The guard stays pending while any of them has not been reported yet.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub required_checks: Vec<String>,
+
+    /// Labels that all open pull requests of the commit must have.
+    /// The guard stays pending while any of them is missing, e.g. for a manual QA approval.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub required_labels: Vec<String>,
+
+    /// Glob patterns for names of check runs or commit status contexts to ignore.
+    /// Matching checks are excluded from the pass/fail aggregation, e.g. optional or flaky jobs.
+    /// Supports "*" for any number of characters and "?" for a single character.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub ignored_checks: Vec<String>,
+
+    /// Glob patterns for names of check runs that are known to be flaky.
+    /// Failed check runs matching them are re-requested and count as pending instead of failed.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub rerun_flaky_checks: Vec<String>,
+
+    /// Maximum number of times a flaky check run is re-requested for the same commit.
+    /// Once reached, the check run counts as failed, so a broken check does not cause a loop.
+    #[serde(default = "default_max_flaky_reruns")]
+    pub max_flaky_reruns: u32,
+
+    /// Conclusions of check runs that count as passed, all others count as failed.
+    /// Defaults to "success", "skipped" and "neutral". Allows treating e.g. "action_required" as passed.
+    /// "cancelled" and "timed_out" count as failed by default, as the check did not verify the commit.
+    #[serde(default = "default_passing_conclusions")]
+    pub passing_conclusions: Vec<String>,
+
+    /// Treatment of conclusions for specific check runs, taking precedence over the passing conclusions.
+    /// Allows e.g. one check to report warnings as "neutral", while "neutral" means a failure for another.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub conclusion_overrides: Vec<ConclusionOverride>,
+
+    /// Block the guard while check runs conclude with "action_required", e.g. while waiting for a deployment approval.
+    /// When disabled, "action_required" counts as passed, regardless of the passing conclusions.
+    #[serde(default = "default_action_required_blocks")]
+    pub action_required_blocks: bool,
+
+    /// Keep the guard pending while no other check runs or commit statuses have been reported.
+    /// Otherwise a commit without any checks, e.g. before the CI has started, passes immediately.
+    #[serde(default = "default_require_at_least_one_check")]
+    pub require_at_least_one_check: bool,
+
+    /// Comment on the open pull requests of a commit once the guard fails, listing the failed checks.
+    /// Only one comment is created per commit, further failures of the same commit are not commented again.
+    #[serde(default)]
+    pub comment_on_failure: bool,
+
+    /// Log the check runs that would be created, updated or re-requested, without sending the requests.
+    /// All other requests are still made, so the decisions can be validated against real pull requests.
+    #[serde(default)]
+    pub dry_run: bool,
+
+    /// User-Agent sent with all requests to the GitHub API, empty for "cerberus-mergeguard/<version>".
+    /// Allows forks to identify their own traffic.
+    #[serde(default, skip_serializing_if = "str::is_empty")]
+    pub user_agent: String,
+
+    /// Proxy for all requests to the github api, e.g. "http://proxy.example.org:3128" or "socks5://proxy.example.org:1080".
+    /// When set, the proxy environment variables are not used for requests to the github api.
+    #[serde(default, skip_serializing_if = "str::is_empty")]
+    pub proxy_url: String,
+}
+
+/// Treatment of the conclusions of check runs matching a pattern
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+#[serde(rename_all = "kebab-case")]
+pub struct ConclusionOverride {
+    /// Glob pattern for the names of the check runs
+    pub check: String,
+
+    /// Conclusions the treatment applies to, defaults to "neutral"
+    #[serde(default = "default_override_conclusions")]
+    pub conclusions: Vec<String>,
+
+    /// How the check run counts towards the guard when it concludes with one of the conclusions
+    pub treat_as: ConclusionTreatment,
+}
+
+/// How a check run with an overridden conclusion counts towards the guard
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq)]
+#[serde(rename_all = "kebab-case")]
+pub enum ConclusionTreatment {
+    /// Count the check run as passed
+    Pass,
+    /// Count the check run as failed
+    Fail,
+    /// Ignore the check run, as if it matched the ignored checks
+    Ignore,
 }
 
+/// Schemes supported for the proxy url
+const PROXY_SCHEMES: [&str; 4] = ["http", "https", "socks5", "socks5h"];
+
+impl Default for ClientOptions {
+    fn default() -> Self {
+        Self {
+            client_id: String::new(),
+            private_key: String::new(),
+            private_key_data: String::new(),
+            private_key_base64: String::new(),
+            api: default_api_url(),
+            max_attempts: default_max_attempts(),
+            rate_limit_max_wait: default_rate_limit_max_wait(),
+            max_concurrent_requests: default_max_concurrent_requests(),
+            jwt_clock_skew: default_jwt_clock_skew(),
+            check_name: default_check_name(),
+            initial_status: default_initial_status(),
+            details_url: String::new(),
+            summary_template: String::new(),
+            summary_template_file: String::new(),
+            required_checks: Vec::new(),
+            required_labels: Vec::new(),
+            ignored_checks: Vec::new(),
+            rerun_flaky_checks: Vec::new(),
+            max_flaky_reruns: default_max_flaky_reruns(),
+            passing_conclusions: default_passing_conclusions(),
+            conclusion_overrides: Vec::new(),
+            action_required_blocks: default_action_required_blocks(),
+            require_at_least_one_check: default_require_at_least_one_check(),
+            comment_on_failure: false,
+            dry_run: false,
+            user_agent: String::new(),
+            proxy_url: String::new(),
+        }
+    }
+}
+
+/// Timeout for requests to the GitHub API when using the default http client
+const DEFAULT_HTTP_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// Signing algorithm of the JWT. GitHub only accepts RS256, so it is fixed and never read from any input.
+const JWT_ALGORITHM: jsonwebtoken::Algorithm = jsonwebtoken::Algorithm::RS256;
+
+/// Name of the pending check added while no other checks have been reported
+const NO_CHECKS_REPORTED: &str = "at least one check";
+
+/// Maximum number of pending guards tracked per client, the least recently updated one is dropped first
+const MAX_TRACKED_GUARDS: usize = 1000;
+
+/// Time the rate limit status is cached, so frequent requests to the debug endpoint do not count against the rate limit.
+/// Unit is in seconds.
+const RATE_LIMIT_CACHE_DURATION: i64 = 10;
+
+/// Time the number of reruns of a flaky check is remembered, long enough for all checks of a commit to complete
+const FLAKY_RERUNS_TTL: Duration = Duration::from_secs(24 * 60 * 60);
+
+/// Time a comment on the failure of a commit is remembered, so it is not repeated for late failures of other checks
+const FAILURE_COMMENT_TTL: Duration = Duration::from_secs(7 * 24 * 60 * 60);
+
+/// Time the guard of a commit is remembered, so duplicate and late redelivered events do not create another one
+const GUARD_TTL: Duration = Duration::from_secs(7 * 24 * 60 * 60);
+
+/// Time before its expiry a JWT is no longer reused, so it does not expire while a request is in flight.
+/// Unit is in seconds.
+const JWT_REFRESH_MARGIN: i64 = 30;
+
+/// Upper limit for the configurable number of attempts per request
+const MAX_ATTEMPTS_LIMIT: u32 = 5;
+
+/// Maximum clock skew tolerated for the JWT, GitHub rejects JWTs expiring more than 10 minutes after they were issued
+const MAX_JWT_CLOCK_SKEW: u64 = 120;
+
 fn default_api_url() -> String {
     "https://api.github.com".to_string()
 }
 
+fn default_max_attempts() -> u32 {
+    3
+}
+
+fn default_rate_limit_max_wait() -> u64 {
+    60
+}
+
+fn default_max_concurrent_requests() -> usize {
+    8
+}
+
+fn default_jwt_clock_skew() -> u64 {
+    30
+}
+
+fn default_max_flaky_reruns() -> u32 {
+    1
+}
+
+fn default_passing_conclusions() -> Vec<String> {
+    [CHECK_RUN_CONCLUSION, CHECK_RUN_SKIPPED, CHECK_RUN_NEUTRAL]
+        .map(String::from)
+        .to_vec()
+}
+
+fn default_override_conclusions() -> Vec<String> {
+    vec![CHECK_RUN_NEUTRAL.to_string()]
+}
+
+fn default_action_required_blocks() -> bool {
+    true
+}
+
+fn default_require_at_least_one_check() -> bool {
+    true
+}
+
+fn default_initial_status() -> String {
+    CHECK_RUN_INITIAL_STATUS.to_string()
+}
+
+fn default_check_name() -> String {
+    CHECK_RUN_NAME.to_string()
+}
+
 impl ClientOptions {
-    /// Validate the client options
-    pub fn validate(&self) -> Result<(), &'static str> {
+    /// Validate the client options, returns all problems found
+    pub fn validate(&self) -> Result<(), Vec<ConfigError>> {
+        let mut errors = Vec::new();
         if self.client_id.is_empty() {
-            return Err("GitHub Client ID must be set in the configuration");
+            errors.push(ConfigError::MissingClientId);
+        }
+        if self.max_attempts == 0 || self.max_attempts > MAX_ATTEMPTS_LIMIT {
+            errors.push(ConfigError::InvalidMaxAttempts);
+        }
+        if self.max_concurrent_requests == 0 {
+            errors.push(ConfigError::InvalidMaxConcurrentRequests);
+        }
+        if self.jwt_clock_skew > MAX_JWT_CLOCK_SKEW {
+            errors.push(ConfigError::InvalidJwtClockSkew);
+        }
+        let key_sources = [
+            &self.private_key,
+            &self.private_key_data,
+            &self.private_key_base64,
+        ]
+        .iter()
+        .filter(|source| !source.is_empty())
+        .count();
+        match key_sources {
+            0 => errors.push(ConfigError::MissingPrivateKey),
+            1 => {}
+            _ => errors.push(ConfigError::ConflictingPrivateKeys),
+        }
+        if !self.private_key_base64.is_empty()
+            && self
+                .read_private_key()
+                .ok()
+                .and_then(|key| jsonwebtoken::EncodingKey::from_rsa_pem(key.as_bytes()).ok())
+                .is_none()
+        {
+            errors.push(ConfigError::InvalidPrivateKeyBase64);
+        }
+        if self.check_name.trim().is_empty() {
+            errors.push(ConfigError::EmptyCheckName);
+        } else if self.check_name.trim() != self.check_name {
+            errors.push(ConfigError::CheckNameWhitespace);
+        }
+        if self
+            .required_checks
+            .iter()
+            .any(|name| name.trim().is_empty())
+        {
+            errors.push(ConfigError::EmptyRequiredCheck);
+        }
+        if self
+            .ignored_checks
+            .iter()
+            .any(|pattern| pattern.trim().is_empty())
+        {
+            errors.push(ConfigError::EmptyIgnoredCheck);
+        }
+        if self
+            .rerun_flaky_checks
+            .iter()
+            .any(|pattern| pattern.trim().is_empty())
+        {
+            errors.push(ConfigError::EmptyFlakyCheck);
+        }
+        if self.max_flaky_reruns == 0 || self.max_flaky_reruns > MAX_ATTEMPTS_LIMIT {
+            errors.push(ConfigError::InvalidMaxFlakyReruns);
+        }
+        if self.passing_conclusions.is_empty() {
+            errors.push(ConfigError::EmptyPassingConclusions);
+        }
+        if self
+            .passing_conclusions
+            .iter()
+            .any(|conclusion| !CHECK_RUN_CONCLUSIONS.contains(&conclusion.as_str()))
+        {
+            errors.push(ConfigError::UnknownPassingConclusion);
+        }
+        if self
+            .conclusion_overrides
+            .iter()
+            .any(|o| o.check.trim().is_empty())
+        {
+            errors.push(ConfigError::EmptyConclusionOverrideCheck);
+        }
+        if self.conclusion_overrides.iter().any(|o| {
+            o.conclusions.is_empty()
+                || o.conclusions
+                    .iter()
+                    .any(|conclusion| !CHECK_RUN_CONCLUSIONS.contains(&conclusion.as_str()))
+        }) {
+            errors.push(ConfigError::InvalidConclusionOverrideConclusions);
+        }
+        if self
+            .required_labels
+            .iter()
+            .any(|name| name.trim().is_empty())
+        {
+            errors.push(ConfigError::EmptyRequiredLabel);
+        }
+        if self.required_checks.iter().any(|name| {
+            self.ignored_checks
+                .iter()
+                .any(|p| glob::glob_match(p, name))
+        }) {
+            errors.push(ConfigError::IgnoredRequiredCheck);
+        }
+        if !self.api.starts_with("http://") && !self.api.starts_with("https://") {
+            errors.push(ConfigError::InvalidApiUrl);
+        }
+        if !CHECK_RUN_PENDING_STATUSES.contains(&self.initial_status.as_str()) {
+            errors.push(ConfigError::InvalidInitialStatus);
+        }
+        if !self.details_url.is_empty()
+            && !self.details_url.starts_with("http://")
+            && !self.details_url.starts_with("https://")
+        {
+            errors.push(ConfigError::InvalidDetailsUrl);
+        }
+        if !self.summary_template.is_empty() && !self.summary_template_file.is_empty() {
+            errors.push(ConfigError::ConflictingSummaryTemplates);
+        } else if let Err(e) = self.read_summary_template() {
+            warn!("Invalid summary template: {e}");
+            errors.push(ConfigError::InvalidSummaryTemplate);
+        }
+        if reqwest::header::HeaderValue::from_str(&self.user_agent).is_err() {
+            errors.push(ConfigError::InvalidUserAgent);
+        }
+        if !self.proxy_url.is_empty()
+            && !reqwest::Url::parse(&self.proxy_url)
+                .is_ok_and(|url| PROXY_SCHEMES.contains(&url.scheme()) && url.has_host())
+        {
+            errors.push(ConfigError::InvalidProxyUrl);
+        }
+        if !errors.is_empty() {
+            return Err(errors);
         }
         Ok(())
     }
+
+    /// Return the PEM encoded private key, either inline, base64 encoded or read from the file system.
+    fn read_private_key(&self) -> Result<String, Error> {
+        if !self.private_key_data.is_empty() {
+            return Ok(self.private_key_data.clone());
+        }
+        if !self.private_key_base64.is_empty() {
+            let key =
+                base64::decode_base64(&self.private_key_base64).map_err(Error::DecodePrivateKey)?;
+            return String::from_utf8(key).map_err(|e| Error::DecodePrivateKey(e.to_string()));
+        }
+        std::fs::read_to_string(&self.private_key)
+            .map_err(|e| Error::ReadPrivateKey(self.private_key.clone(), e))
+    }
+
+    /// Return the parsed summary template, either inline or read from the file system.
+    /// Falls back to the built-in template, when none is configured.
+    fn read_summary_template(&self) -> Result<SummaryTemplate, String> {
+        let template = if !self.summary_template_file.is_empty() {
+            std::fs::read_to_string(&self.summary_template_file)
+                .map_err(|e| format!("failed to read '{}': {e}", self.summary_template_file))?
+        } else if !self.summary_template.is_empty() {
+            self.summary_template.clone()
+        } else {
+            return Ok(SummaryTemplate::default());
+        };
+        SummaryTemplate::parse(&template)
+    }
+
+    /// Read and parse the RSA private key used for signing JWTs.
+    fn read_encoding_key(&self) -> Result<jsonwebtoken::EncodingKey, Error> {
+        let key = self.read_private_key()?;
+        jsonwebtoken::EncodingKey::from_rsa_pem(key.as_bytes()).map_err(Error::EncodingKey)
+    }
+}
+
+/// Options deciding the state of the guard, which can be reloaded while the client is in use
+#[derive(Debug)]
+struct CheckOptions {
+    check_name: String,
+    initial_status: String,
+    details_url: String,
+    summary_template: SummaryTemplate,
+    required_checks: Vec<String>,
+    required_labels: Vec<String>,
+    ignored_checks: Vec<String>,
+    rerun_flaky_checks: Vec<String>,
+    max_flaky_reruns: u32,
+    passing_conclusions: Vec<String>,
+    conclusion_overrides: Vec<ConclusionOverride>,
+    require_at_least_one_check: bool,
+    comment_on_failure: bool,
+}
+
+impl From<&ClientOptions> for CheckOptions {
+    fn from(options: &ClientOptions) -> Self {
+        let mut passing_conclusions = options.passing_conclusions.clone();
+        if !options.action_required_blocks
+            && !passing_conclusions
+                .iter()
+                .any(|conclusion| conclusion == CHECK_RUN_ACTION_REQUIRED)
+        {
+            passing_conclusions.push(CHECK_RUN_ACTION_REQUIRED.to_string());
+        }
+        // The template is validated when loading the configuration, so this only fails when e.g. the file changed since
+        let summary_template = options.read_summary_template().unwrap_or_else(|e| {
+            error!("Invalid summary template, using the built-in one: {e}");
+            SummaryTemplate::default()
+        });
+        Self {
+            check_name: options.check_name.clone(),
+            initial_status: options.initial_status.clone(),
+            details_url: options.details_url.clone(),
+            summary_template,
+            required_checks: options.required_checks.clone(),
+            required_labels: options.required_labels.clone(),
+            ignored_checks: options.ignored_checks.clone(),
+            rerun_flaky_checks: options.rerun_flaky_checks.clone(),
+            max_flaky_reruns: options.max_flaky_reruns,
+            passing_conclusions,
+            conclusion_overrides: options.conclusion_overrides.clone(),
+            require_at_least_one_check: options.require_at_least_one_check,
+            comment_on_failure: options.comment_on_failure,
+        }
+    }
+}
+
+/// Locks of the commits by repository and commit, see Client::lock_commit
+type CommitLocks = std::sync::Mutex<HashMap<(String, String), Arc<Mutex<()>>>>;
+
+/// Lock on the guard of a commit, removes the lock of the commit once no other task is waiting for it
+struct CommitLock<'a> {
+    locks: &'a CommitLocks,
+    key: (String, String),
+    guard: Option<tokio::sync::OwnedMutexGuard<()>>,
+}
+
+impl Drop for CommitLock<'_> {
+    fn drop(&mut self) {
+        // Release the lock first, so only the map holds a reference when nobody else is waiting
+        self.guard.take();
+        let mut locks = self
+            .locks
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner);
+        if locks
+            .get(&self.key)
+            .is_some_and(|lock| Arc::strong_count(lock) == 1)
+        {
+            locks.remove(&self.key);
+        }
+    }
+}
+
+/// Last known state of a guard that has not concluded yet
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct PendingGuard {
+    /// Client ID of the GitHub App guarding the commit
+    pub client_id: String,
+    pub repo: String,
+    pub commit: String,
+    /// Status of the check run, e.g. "queued"
+    pub status: String,
+    /// Number of other checks that have not completed yet
+    pub pending: u32,
+    /// The checks considered for the last decision
+    pub checks: Vec<CheckResult>,
+    pub updated_at: DateTime<Utc>,
 }
 
 pub struct Client {
     client_id: String,
-    key: jsonwebtoken::EncodingKey,
-    api: String,
+    /// Swapped as a whole on reload, every evaluation takes it once, so it sees a consistent set of options
+    checks: std::sync::Mutex<Arc<CheckOptions>>,
+    /// Parsed private key, only read again when reloading it
+    key: std::sync::Mutex<jsonwebtoken::EncodingKey>,
+    /// Last signed JWT with the time it expires
+    jwt: std::sync::Mutex<Option<(DateTime<Utc>, String)>>,
+    api: api::Api,
     token_cache: Mutex<HashMap<u64, TokenResponse>>,
+    /// Pending guards by repository and commit, updated with every decision
+    guards: std::sync::Mutex<HashMap<(String, String), PendingGuard>>,
+    /// Locks by repository and commit, held while the guard of the commit is created or updated
+    commit_locks: CommitLocks,
+    /// Last fetched rate limit status with the time it was fetched
+    rate_limit: Mutex<Option<(DateTime<Utc>, RateLimitResponse)>>,
+    /// State shared between deliveries, e.g. the number of reruns of flaky checks
+    store: Arc<dyn StateStore>,
+    metrics: Arc<Metrics>,
+    clock: Arc<dyn Clock>,
+    /// Seconds the issued time of the JWT is set into the past
+    jwt_clock_skew: u64,
 }
 
 impl Client {
     /// Create a new GitHub client with the provided options.
-    /// Will read the private key from the file system.
+    /// Will read the private key from the file system, unless it is provided inline.
+    /// Uses a default http client with a timeout of 30s and the configured proxy.
     pub fn build(options: ClientOptions) -> Result<Self, Error> {
-        let key = std::fs::read_to_string(&options.private_key)
-            .map_err(|e| Error::ReadPrivateKey(options.private_key.clone(), e))?;
-        let key =
-            jsonwebtoken::EncodingKey::from_rsa_pem(key.as_bytes()).map_err(Error::EncodingKey)?;
+        let limiter = api::new_request_limiter(options.max_concurrent_requests);
+        let http = default_http_client(&options)?;
+        Self::new(options, http, Arc::new(Metrics::new()), limiter)
+    }
+
+    /// Create a new GitHub client, which shares the metrics registry and the limit of concurrent requests with the other client.
+    /// Used when serving multiple apps, so the limit applies to all requests of the server.
+    /// Uses a default http client with a timeout of 30s and the configured proxy.
+    pub fn build_sharing(options: ClientOptions, other: &Client) -> Result<Self, Error> {
+        let http = default_http_client(&options)?;
+        Self::new(options, http, other.metrics(), other.api.request_limiter())
+    }
+
+    /// Create a new GitHub client with the provided options and http client.
+    /// Allows using a custom client, e.g. for proxies, custom TLS or instrumentation.
+    /// Will read the private key from the file system, unless it is provided inline.
+    pub fn build_with_http_client(
+        options: ClientOptions,
+        http: reqwest::Client,
+    ) -> Result<Self, Error> {
+        let limiter = api::new_request_limiter(options.max_concurrent_requests);
+        Self::new(options, http, Arc::new(Metrics::new()), limiter)
+    }
+
+    fn new(
+        options: ClientOptions,
+        http: reqwest::Client,
+        metrics: Arc<Metrics>,
+        limiter: Arc<Semaphore>,
+    ) -> Result<Self, Error> {
+        let key = options.read_encoding_key()?;
+        if options.dry_run {
+            warn!("Dry-run is enabled, check-runs will not be created, updated or re-requested");
+        }
+        let clock: Arc<dyn Clock> = Arc::new(SystemClock);
         Ok(Client {
+            checks: std::sync::Mutex::new(Arc::new(CheckOptions::from(&options))),
             client_id: options.client_id,
-            key,
-            api: options.api,
+            key: std::sync::Mutex::new(key),
+            jwt: std::sync::Mutex::new(None),
+            api: api::Api::new(http, &options, metrics.clone(), limiter, clock.clone()),
             token_cache: Mutex::new(HashMap::new()),
+            guards: std::sync::Mutex::new(HashMap::new()),
+            commit_locks: std::sync::Mutex::new(HashMap::new()),
+            rate_limit: Mutex::new(None),
+            store: Arc::new(MemoryStore::default()),
+            metrics,
+            clock,
+            jwt_clock_skew: options.jwt_clock_skew,
         })
     }
 
@@ -68,16 +674,117 @@ impl Client {
         &self.client_id
     }
 
+    /// Return the name of the check run created by the bot.
+    pub fn check_name(&self) -> String {
+        self.checks().check_name.clone()
+    }
+
+    /// Return the labels that pull requests must have to pass the guard.
+    pub fn required_labels(&self) -> Vec<String> {
+        self.checks().required_labels.clone()
+    }
+
+    /// Apply the options deciding the state of the guard, e.g. after reloading the configuration.
+    /// All other options, like the credentials, are only read when building the client, see reload_private_key for the key.
+    pub fn reload(&self, options: &ClientOptions) {
+        let checks = Arc::new(CheckOptions::from(options));
+        debug!(
+            "Reloaded check options for app '{}': {checks:?}",
+            self.client_id
+        );
+        *self
+            .checks
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner) = checks;
+    }
+
+    /// Replace the private key with the one of the options, e.g. after the key has been rotated.
+    /// Keeps the current key if the new one can't be read or parsed, so authentication keeps working.
+    /// Returns true if the key has been replaced.
+    pub fn reload_private_key(&self, options: &ClientOptions) -> bool {
+        let key = match options.read_encoding_key() {
+            Ok(key) => key,
+            Err(e) => {
+                error!(
+                    "Failed to reload the private key of app '{}', keeping the current one: {e}",
+                    self.client_id
+                );
+                return false;
+            }
+        };
+        *self
+            .key
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner) = key;
+        // The cached JWT has been signed with the previous key
+        *self
+            .jwt
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner) = None;
+        info!("Reloaded the private key of app '{}'", self.client_id);
+        true
+    }
+
+    /// Return the current check options. Reloading does not affect the returned options.
+    fn checks(&self) -> Arc<CheckOptions> {
+        self.checks
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner)
+            .clone()
+    }
+
+    /// Return the metrics registry the client records its API requests in.
+    pub fn metrics(&self) -> Arc<Metrics> {
+        self.metrics.clone()
+    }
+
+    /// Return the store the client keeps state in, which needs to outlive a single delivery.
+    pub fn store(&self) -> Arc<dyn StateStore> {
+        self.store.clone()
+    }
+
+    /// Keep state in the given store instead of the default in-memory store, e.g. to share it with other apps.
+    pub fn use_store(&mut self, store: Arc<dyn StateStore>) {
+        self.store = store;
+    }
+
     /// Get an installations token for the GitHub App.
     async fn get_token(&self, app_installation_id: u64) -> Result<String, Error> {
         if let Some(token) = self.get_cached_token(app_installation_id).await {
             return Ok(token);
         }
+        self.fetch_token(app_installation_id).await
+    }
 
-        let claims = JWTClaims::new(&self.client_id);
-        let header = jsonwebtoken::Header::new(jsonwebtoken::Algorithm::RS256);
-        let jwt = jsonwebtoken::encode(&header, &claims, &self.key).map_err(Error::JWT)?;
-        let token = api::get_installation_token(&self.api, &jwt, app_installation_id).await?;
+    /// Send a request authenticated with the installation token.
+    /// If GitHub rejects the token with 401, e.g. because it has been revoked after the permissions of the
+    /// installation changed, the cached token is dropped and the request is retried once with a new token.
+    async fn with_token<T, F, Fut>(&self, app_installation_id: u64, request: F) -> Result<T, Error>
+    where
+        F: Fn(String) -> Fut,
+        Fut: Future<Output = Result<T, Error>>,
+    {
+        let token = self.get_token(app_installation_id).await?;
+        match request(token).await {
+            Err(e) if e.status() == Some(reqwest::StatusCode::UNAUTHORIZED) => {
+                warn!(
+                    "Installation token for '{app_installation_id}' has been rejected, retrying with a new token: {e}"
+                );
+                self.remove_cached_token(app_installation_id).await;
+                let token = self.fetch_token(app_installation_id).await?;
+                request(token).await
+            }
+            result => result,
+        }
+    }
+
+    /// Fetch a new installation token from GitHub and store it in the cache.
+    async fn fetch_token(&self, app_installation_id: u64) -> Result<String, Error> {
+        let jwt = self.new_jwt()?;
+        let token = self
+            .api
+            .get_installation_token(&jwt, app_installation_id)
+            .await?;
 
         let mut cache = self.token_cache.lock().await;
         let token_value = token.token.clone();
@@ -86,40 +793,268 @@ impl Client {
         Ok(token_value)
     }
 
+    /// Fetch tokens for all installations of the GitHub App, so the first webhook event does not have to wait for one.
+    /// Cached tokens that are still valid for the given duration are kept.
+    /// Returns the number of fetched tokens.
+    pub async fn prewarm_tokens(&self, valid_for: Duration) -> Result<usize, Error> {
+        let installations = self.list_installations().await?;
+        let valid_until = self.clock.now()
+            + chrono::Duration::from_std(valid_for).unwrap_or(chrono::Duration::MAX);
+        let mut fetched = 0;
+        for installation in installations {
+            let cached = self
+                .token_cache
+                .lock()
+                .await
+                .get(&installation.id)
+                .is_some_and(|token| token.expires_at >= valid_until);
+            if cached {
+                continue;
+            }
+            self.fetch_token(installation.id).await?;
+            fetched += 1;
+        }
+        debug!("Pre-warmed {fetched} tokens for app '{}'", self.client_id);
+        Ok(fetched)
+    }
+
+    /// Return a JWT signed with the private key of the GitHub App.
+    /// Signing is comparatively expensive, so the JWT is reused until shortly before it expires.
+    pub fn new_jwt(&self) -> Result<String, Error> {
+        let now = self.clock.now();
+        let mut cache = self
+            .jwt
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner);
+        if let Some((expires_at, jwt)) = cache.as_ref() {
+            if now + chrono::Duration::seconds(JWT_REFRESH_MARGIN) < *expires_at {
+                return Ok(jwt.clone());
+            }
+        }
+
+        let claims = JWTClaims::new(&self.client_id, now.timestamp() as u64, self.jwt_clock_skew);
+        let header = jsonwebtoken::Header::new(JWT_ALGORITHM);
+        let key = self
+            .key
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner);
+        let jwt = jsonwebtoken::encode(&header, &claims, &key).map_err(Error::JWT)?;
+        let expires_at = DateTime::from_timestamp(claims.exp as i64, 0).unwrap_or(now);
+        *cache = Some((expires_at, jwt.clone()));
+        Ok(jwt)
+    }
+
+    /// Verify that the client can authenticate as the GitHub App.
+    /// Uses the JWT to fetch the app from the API.
+    pub async fn verify_credentials(&self) -> Result<(), Error> {
+        let app = self.get_app().await?;
+        debug!("Authenticated as GitHub App '{}'", app.slug);
+        Ok(())
+    }
+
+    /// Fetch the GitHub App the client authenticates as.
+    /// Needs to use a JWT to authenticate.
+    pub async fn get_app(&self) -> Result<App, Error> {
+        let jwt = self.new_jwt()?;
+        self.api.get_app(&jwt).await
+    }
+
+    /// Get the rate limit status of the GitHub App.
+    /// The result is cached briefly, so frequent calls do not cause requests to GitHub.
+    /// Needs to use a JWT to authenticate.
+    pub async fn get_rate_limit(&self) -> Result<RateLimitResponse, Error> {
+        // Holding the lock ensures concurrent calls wait for a single request
+        let mut cache = self.rate_limit.lock().await;
+        let now = self.clock.now();
+        if let Some((fetched_at, rate_limit)) = cache.as_ref() {
+            if now < *fetched_at + chrono::Duration::seconds(RATE_LIMIT_CACHE_DURATION) {
+                debug!("Using cached rate limit for app '{}'", self.client_id);
+                return Ok(rate_limit.clone());
+            }
+        }
+
+        let jwt = self.new_jwt()?;
+        let rate_limit = self.api.get_rate_limit(&jwt).await?;
+        *cache = Some((now, rate_limit.clone()));
+        Ok(rate_limit)
+    }
+
+    /// List all installations of the GitHub App, e.g. to check where it can be used.
+    /// Needs to use a JWT to authenticate, as the installations are not known yet.
+    pub async fn list_installations(&self) -> Result<Vec<Installation>, Error> {
+        let jwt = self.new_jwt()?;
+        self.api.list_installations(&jwt).await
+    }
+
+    /// Get the ID of the installation of the GitHub App on a repository.
+    /// Needs to use a JWT to authenticate, as the installation is not known yet.
+    pub async fn get_repo_installation_id(&self, repo: &str) -> Result<u64, Error> {
+        let jwt = self.new_jwt()?;
+        let installation = self.api.get_repo_installation(&jwt, repo).await?;
+        Ok(installation.id)
+    }
+
     /// Create a new pending check run for a commit in a repository.
+    /// Returns the created check run, so it can be updated without fetching it again.
     /// Needs to use the GitHub App installation token to authenticate.
     pub async fn create_check_run(
         &self,
         app_installation_id: u64,
         repo: &str,
         commit: &str,
-    ) -> Result<(), Error> {
-        let token = self.get_token(app_installation_id).await?;
+    ) -> Result<CheckRun, Error> {
+        let run = &self.new_check_run(&self.checks(), repo, commit);
+        let check_run = self
+            .with_token(app_installation_id, |token| async move {
+                self.api.create_check_run(&token, repo, run).await
+            })
+            .await?;
+        self.remember_guard(repo, commit, &check_run).await?;
+        self.record_decision(repo, commit, &check_run, &CheckRunsStatus::default());
+        Ok(check_run)
+    }
+
+    /// Create the guard of a commit, unless it has already been created, e.g. for a duplicate delivery.
+    /// An existing guard is refreshed instead, so concurrent events for the same commit never create duplicates.
+    /// Returns the created check run, None if an existing guard has been refreshed.
+    pub async fn ensure_check_run(
+        &self,
+        app_installation_id: u64,
+        repo: &str,
+        commit: &str,
+    ) -> Result<Option<CheckRun>, Error> {
+        let _lock = self.lock_commit(repo, commit).await;
+        let key = store::commit_key("guard", &self.client_id, repo, commit);
+        if self.store.get(&key).await?.is_some() {
+            debug!("Guard of commit '{commit}' in '{repo}' already exists, refreshing it");
+            self.refresh_guard(app_installation_id, repo, commit)
+                .await?;
+            return Ok(None);
+        }
+        self.create_check_run(app_installation_id, repo, commit)
+            .await
+            .map(Some)
+    }
+
+    /// Remember that the guard of the commit has been created, see ensure_check_run.
+    async fn remember_guard(&self, repo: &str, commit: &str, run: &CheckRun) -> Result<(), Error> {
+        let key = store::commit_key("guard", &self.client_id, repo, commit);
+        self.store.set(&key, &run.id.to_string(), GUARD_TTL).await
+    }
 
-        api::create_check_run(&self.api, &token, repo, &CheckRun::new(commit)).await
+    /// Wait until no other task creates or updates the guard of the commit.
+    /// The lock only coordinates the tasks of this process, the guard is remembered in the store for others.
+    async fn lock_commit(&self, repo: &str, commit: &str) -> CommitLock<'_> {
+        let key = (repo.to_string(), commit.to_string());
+        let lock = self
+            .commit_locks
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner)
+            .entry(key.clone())
+            .or_default()
+            .clone();
+        let mut commit_lock = CommitLock {
+            locks: &self.commit_locks,
+            key,
+            guard: None,
+        };
+        commit_lock.guard = Some(lock.lock_owned().await);
+        commit_lock
     }
 
     /// Refresh the check_run status based on the current status.
     /// Will fetch the current check-runs first and then update the check-run status.
-    /// This means 2 API calls will be made.
+    /// This means 2 API calls will be made, plus one for every re-requested flaky check run.
     pub async fn refresh_check_run_status(
         &self,
         app_id: u64,
         repo: &str,
         commit: &str,
     ) -> Result<(), Error> {
-        let (uncompleted, own_run) = self.get_check_run_status(app_id, repo, commit).await?;
-        self.update_check_run(app_id, repo, commit, uncompleted, own_run)
-            .await
+        let _lock = self.lock_commit(repo, commit).await;
+        self.refresh_guard(app_id, repo, commit).await
     }
 
-    /// Get the combined status of all check-runs for a commit.
+    /// Same as refresh_check_run_status, but expects the caller to hold the lock of the commit.
+    async fn refresh_guard(&self, app_id: u64, repo: &str, commit: &str) -> Result<(), Error> {
+        let checks = self.checks();
+        let (mut status, own_run, check_runs) =
+            self.evaluate_checks(&checks, app_id, repo, commit).await?;
+        if status.failed > 0 {
+            self.rerun_flaky_checks(&checks, app_id, repo, commit, &check_runs, &mut status)
+                .await?;
+        }
+        self.update_guard(&checks, app_id, repo, commit, &status, own_run)
+            .await?;
+        if status.failed > 0 && checks.comment_on_failure {
+            self.comment_on_failure(&checks, app_id, repo, commit, &status)
+                .await?;
+        }
+        Ok(())
+    }
+
+    /// Comment on the open pull requests of the commit, summarizing the failed checks.
+    /// Only the first failure of a commit is commented, the comment is recorded before it is created,
+    /// so failed requests do not lead to duplicate comments either.
+    async fn comment_on_failure(
+        &self,
+        checks: &CheckOptions,
+        app_installation_id: u64,
+        repo: &str,
+        commit: &str,
+        status: &CheckRunsStatus,
+    ) -> Result<(), Error> {
+        let key = store::commit_key("failure-comment", &self.client_id, repo, commit);
+        if self.store.get(&key).await?.is_some() {
+            debug!("Already commented on the failure of commit '{commit}' in '{repo}'");
+            return Ok(());
+        }
+        self.store.set(&key, "1", FAILURE_COMMENT_TTL).await?;
+
+        let pull_requests = self
+            .with_token(app_installation_id, |token| async move {
+                self.api
+                    .get_commit_pull_requests(&token, repo, commit)
+                    .await
+            })
+            .await?;
+        let comment = &status.failure_comment(&checks.check_name);
+        for pr in pull_requests
+            .iter()
+            .filter(|pr| pr.state == PULL_REQUEST_OPEN)
+        {
+            self.with_token(app_installation_id, |token| async move {
+                self.api
+                    .create_issue_comment(&token, repo, pr.number, comment)
+                    .await
+            })
+            .await?;
+        }
+        Ok(())
+    }
+
+    /// Get the combined status of all check-runs and commit statuses for a commit.
     pub async fn get_check_run_status(
         &self,
         app_installation_id: u64,
         repo: &str,
         commit: &str,
-    ) -> Result<(u32, Option<CheckRun>), Error> {
+    ) -> Result<(CheckRunsStatus, Option<CheckRun>), Error> {
+        let (status, own_run, _) = self
+            .evaluate_checks(&self.checks(), app_installation_id, repo, commit)
+            .await?;
+        Ok((status, own_run))
+    }
+
+    /// Get the combined status of all check-runs and commit statuses for a commit.
+    /// Additionally returns the fetched check-runs, e.g. for re-requesting them.
+    async fn evaluate_checks(
+        &self,
+        checks: &CheckOptions,
+        app_installation_id: u64,
+        repo: &str,
+        commit: &str,
+    ) -> Result<(CheckRunsStatus, Option<CheckRun>, Vec<CheckRun>), Error> {
         let check_runs = self
             .get_check_runs(app_installation_id, repo, commit)
             .await?;
@@ -129,8 +1064,119 @@ impl Client {
             commit,
             repo
         );
+        let mut statuses = self
+            .with_token(app_installation_id, |token| async move {
+                self.api.get_commit_statuses(&token, repo, commit).await
+            })
+            .await?;
+        debug!(
+            "Found {} commit statuses for commit '{}' in repository '{}'",
+            statuses.len(),
+            commit,
+            repo
+        );
+
+        statuses.retain(|commit_status| {
+            let ignored = is_ignored_check(checks, &commit_status.context);
+            if ignored {
+                debug!("Ignoring commit status '{}'", commit_status.context);
+            }
+            !ignored
+        });
+
+        let (mut status, own_run) = self.overall_check_status(checks, &check_runs);
+        count_commit_statuses(&statuses, &mut status);
+        self.count_missing_required_checks(checks, &check_runs, &statuses, &mut status);
+        if checks.require_at_least_one_check && status.checks.is_empty() {
+            debug!("No check runs or commit statuses have been reported yet");
+            status.add_missing(NO_CHECKS_REPORTED, "not reported");
+        }
+        if !checks.required_labels.is_empty() {
+            let pull_requests = self
+                .with_token(app_installation_id, |token| async move {
+                    self.api
+                        .get_commit_pull_requests(&token, repo, commit)
+                        .await
+                })
+                .await?;
+            count_missing_required_labels(checks, &pull_requests, &mut status);
+        }
+        Ok((status, own_run, check_runs))
+    }
+
+    /// Re-request the failed check runs matching the flaky patterns and count them as pending.
+    /// Every check run is re-requested at most max_flaky_reruns times per commit, after that it counts as failed.
+    async fn rerun_flaky_checks(
+        &self,
+        checks: &CheckOptions,
+        app_installation_id: u64,
+        repo: &str,
+        commit: &str,
+        check_runs: &[CheckRun],
+        status: &mut CheckRunsStatus,
+    ) -> Result<(), Error> {
+        if checks.rerun_flaky_checks.is_empty() {
+            return Ok(());
+        }
+        for run in check_runs {
+            let failed = status
+                .checks
+                .iter()
+                .any(|check| check.failed && check.name == run.name);
+            if !failed
+                || !checks
+                    .rerun_flaky_checks
+                    .iter()
+                    .any(|pattern| glob::glob_match(pattern, &run.name))
+            {
+                continue;
+            }
+            if !self
+                .reserve_flaky_rerun(repo, commit, &run.name, checks.max_flaky_reruns)
+                .await?
+            {
+                info!(
+                    "Flaky check run '{}' of commit '{commit}' has been re-requested {} times already, counting it as failed",
+                    run.name, checks.max_flaky_reruns
+                );
+                continue;
+            }
+            self.with_token(app_installation_id, |token| async move {
+                self.api.rerequest_check_run(&token, repo, run.id).await
+            })
+            .await?;
+            status.retry(&run.name, "rerequested");
+        }
+        Ok(())
+    }
 
-        Ok(self.overall_check_status(&check_runs))
+    /// Count a rerun of the check for the commit, unless the maximum number of reruns has been reached.
+    /// Returns false if the check must not be re-requested again.
+    /// The rerun is counted before the request is made, so failed requests are not retried endlessly either.
+    async fn reserve_flaky_rerun(
+        &self,
+        repo: &str,
+        commit: &str,
+        name: &str,
+        max_reruns: u32,
+    ) -> Result<bool, Error> {
+        let key = format!(
+            "{}:{name}",
+            store::commit_key("flaky-reruns", &self.client_id, repo, commit)
+        );
+        let count = self
+            .store
+            .get(&key)
+            .await?
+            .and_then(|count| count.parse::<u32>().ok())
+            .unwrap_or(0);
+        if count >= max_reruns {
+            return Ok(false);
+        }
+        self.store
+            .set(&key, &(count + 1).to_string(), FLAKY_RERUNS_TTL)
+            .await?;
+        Ok(true)
     }
 
     /// Update the status of the check-run if necessary.
@@ -139,27 +1185,107 @@ impl Client {
         app_installation_id: u64,
         repo: &str,
         commit: &str,
-        count: u32,
+        status: &CheckRunsStatus,
         check_run: Option<CheckRun>,
     ) -> Result<(), Error> {
-        let token = self.get_token(app_installation_id).await?;
+        self.update_guard(
+            &self.checks(),
+            app_installation_id,
+            repo,
+            commit,
+            status,
+            check_run,
+        )
+        .await
+    }
 
+    /// Same as update_check_run, but uses the options the status has been evaluated with.
+    async fn update_guard(
+        &self,
+        checks: &CheckOptions,
+        app_installation_id: u64,
+        repo: &str,
+        commit: &str,
+        status: &CheckRunsStatus,
+        check_run: Option<CheckRun>,
+    ) -> Result<(), Error> {
         match check_run {
             Some(mut run) => {
-                if run.update_status(count) {
-                    api::update_check_run(&self.api, &token, repo, &run).await
+                if run.update_status_with(status, &checks.initial_status, &checks.summary_template)
+                {
+                    let run = &run;
+                    self.with_token(app_installation_id, |token| async move {
+                        self.api.update_check_run(&token, repo, run).await
+                    })
+                    .await?;
                 } else {
                     debug!("No changes to check run status, skipping update");
-                    Ok(())
                 }
+                self.record_decision(repo, commit, &run, status);
             }
             None => {
                 warn!("No check run found to update, creating a new one");
-                let mut run = CheckRun::new(commit);
-                run.update_status(count);
-                api::create_check_run(&self.api, &token, repo, &run).await
+                let mut run = self.new_check_run(checks, repo, commit);
+                run.update_status_with(status, &checks.initial_status, &checks.summary_template);
+                let run = &run;
+                let run = self
+                    .with_token(app_installation_id, |token| async move {
+                        self.api.create_check_run(&token, repo, run).await
+                    })
+                    .await?;
+                self.remember_guard(repo, commit, &run).await?;
+                self.record_decision(repo, commit, &run, status);
             }
         }
+        Ok(())
+    }
+
+    /// Fail the check-run of a commit if other checks are still queued or in progress after the timeout.
+    /// Checks that have not been reported at all, e.g. missing required labels, don't count as stalled.
+    /// Returns true if the check-run has been failed.
+    pub async fn fail_stalled_check_run(
+        &self,
+        app_installation_id: u64,
+        repo: &str,
+        commit: &str,
+        timeout: Duration,
+    ) -> Result<bool, Error> {
+        let _lock = self.lock_commit(repo, commit).await;
+        let checks = self.checks();
+        let (status, own_run, _) = self
+            .evaluate_checks(&checks, app_installation_id, repo, commit)
+            .await?;
+        let running = status.running();
+        if running == 0 {
+            return Ok(false);
+        }
+
+        let run = match own_run {
+            Some(mut run) => {
+                run.set_timed_out(running, timeout);
+                let run_ref = &run;
+                self.with_token(app_installation_id, |token| async move {
+                    self.api.update_check_run(&token, repo, run_ref).await
+                })
+                .await?;
+                run
+            }
+            None => {
+                warn!("No check run found to fail, creating a new one");
+                let mut run = self.new_check_run(&checks, repo, commit);
+                run.set_timed_out(running, timeout);
+                let run = &run;
+                let run = self
+                    .with_token(app_installation_id, |token| async move {
+                        self.api.create_check_run(&token, repo, run).await
+                    })
+                    .await?;
+                self.remember_guard(repo, commit, &run).await?;
+                run
+            }
+        };
+        self.record_decision(repo, commit, &run, &status);
+        Ok(true)
     }
 
     /// Get the current head commit for a pull request.
@@ -169,13 +1295,27 @@ impl Client {
         repo: &str,
         pull_number: u64,
     ) -> Result<String, Error> {
-        let token = self.get_token(app_installation_id).await?;
-
-        let pr = api::get_pull_request(&self.api, &token, repo, pull_number).await?;
+        let pr = self
+            .with_token(app_installation_id, |token| async move {
+                self.api.get_pull_request(&token, repo, pull_number).await
+            })
+            .await?;
 
         Ok(pr.head.sha)
     }
 
+    /// Create a new check-run for the commit with the configured name and details URL.
+    fn new_check_run(&self, checks: &CheckOptions, repo: &str, commit: &str) -> CheckRun {
+        let mut run = CheckRun::new(commit);
+        run.name = checks.check_name.clone();
+        run.status = checks.initial_status.clone();
+        if !checks.details_url.is_empty() {
+            run.details_url = Some(expand_details_url(&checks.details_url, repo, commit));
+        }
+        run.external_id = Some(commit.to_string());
+        run
+    }
+
     /// Return a list of current check runs for a commit in a repository.
     /// Needs to use the GitHub App installation token to authenticate.
     async fn get_check_runs(
@@ -184,19 +1324,25 @@ impl Client {
         repo: &str,
         commit: &str,
     ) -> Result<Vec<CheckRun>, Error> {
-        let token = self.get_token(app_installation_id).await?;
-
-        api::get_check_runs(&self.api, &token, repo, commit).await
+        self.with_token(app_installation_id, |token| async move {
+            self.api.get_check_runs(&token, repo, commit).await
+        })
+        .await
     }
 
-    /// Check a collection of check runs and returns the number of uncompleted check runs.
-    /// Additionally returns the check run created by this app. If there are multiple check-runs, the first will be returned.
-    fn overall_check_status(&self, check_runs: &[CheckRun]) -> (u32, Option<CheckRun>) {
+    /// Check a collection of check runs and returns the number of pending and failed check runs.
+    /// Additionally returns the check run created by this app. If there are multiple check-runs,
+    /// the first one with the configured check name will be returned, otherwise the first one.
+    fn overall_check_status(
+        &self,
+        checks: &CheckOptions,
+        check_runs: &[CheckRun],
+    ) -> (CheckRunsStatus, Option<CheckRun>) {
+        let mut status = CheckRunsStatus::default();
         if check_runs.is_empty() {
             warn!("Received empty check-runs list");
-            return (0, None);
+            return (status, None);
         }
-        let mut uncompleted = 0;
         let mut own_check_run: Option<CheckRun> = None;
 
         for run in check_runs {
@@ -215,26 +1361,52 @@ impl Client {
                             "Found multiple check runs created by this app: '{}' and '{}, commit: '{}'",
                             first.name, run.name, run.head_sha
                         );
+                        if first.name != checks.check_name && run.name == checks.check_name {
+                            own_check_run = Some(run.clone());
+                        }
                     }
                 };
                 debug!("Found own check run: {}", run.id);
                 continue;
             }
+            if is_ignored_check(checks, &run.name) {
+                debug!("Ignoring check run '{}'", run.name);
+                continue;
+            }
             match run.status.as_str() {
                 "completed" => {
-                    if run.conclusion.as_ref().is_some_and(|v| {
-                        v == CHECK_RUN_CONCLUSION
-                            || v == CHECK_RUN_SKIPPED
-                            || v == CHECK_RUN_NEUTRAL
-                    }) {
+                    let conclusion = run.conclusion.as_deref().unwrap_or("unknown");
+                    let treatment = checks
+                        .conclusion_overrides
+                        .iter()
+                        .find(|o| {
+                            o.conclusions.iter().any(|c| c == conclusion)
+                                && glob::glob_match(&o.check, &run.name)
+                        })
+                        .map(|o| o.treat_as);
+                    let passed = match treatment {
+                        Some(ConclusionTreatment::Ignore) => {
+                            debug!(
+                                "Ignoring check run '{}' with conclusion '{}'",
+                                run.name, conclusion
+                            );
+                            continue;
+                        }
+                        Some(treatment) => treatment == ConclusionTreatment::Pass,
+                        None => checks
+                            .passing_conclusions
+                            .iter()
+                            .any(|passing| passing == conclusion),
+                    };
+                    if passed {
                         debug!("Check run '{}' is completed successfully", run.name);
+                        status.add_passed(&run.name, conclusion);
                     } else {
                         debug!(
                             "Check run '{}' is completed not successfull: '{}'",
-                            run.name,
-                            run.conclusion.as_deref().unwrap_or("unknown")
+                            run.name, conclusion
                         );
-                        uncompleted += 1;
+                        status.add_failed(&run.name, conclusion);
                     }
                 }
                 _ => {
@@ -242,18 +1414,18 @@ impl Client {
                         "Check run '{}' is not completed, status: {}",
                         run.name, run.status
                     );
-                    uncompleted += 1;
+                    status.add_pending(&run.name, &run.status);
                 }
             }
         }
-        (uncompleted, own_check_run)
+        (status, own_check_run)
     }
 
     /// Check the cache for a token and return it if it exists.
     async fn get_cached_token(&self, app_installation_id: u64) -> Option<String> {
         let cache = self.token_cache.lock().await;
         if let Some(token) = cache.get(&app_installation_id) {
-            let now = chrono::Utc::now() + chrono::Duration::seconds(30);
+            let now = self.clock.now() + chrono::Duration::seconds(30);
             if token.expires_at.ge(&now) {
                 debug!(
                     "Using cached token for installation ID: {}",
@@ -269,19 +1441,230 @@ impl Client {
         None
     }
 
+    /// Remove the cached token for an installation, e.g. after the app has been uninstalled.
+    /// Returns true if a token was cached.
+    pub async fn remove_cached_token(&self, app_installation_id: u64) -> bool {
+        self.token_cache
+            .lock()
+            .await
+            .remove(&app_installation_id)
+            .is_some()
+    }
+
+    /// Record the decision in the audit log and update the tracked state of the guard.
+    fn record_decision(&self, repo: &str, commit: &str, run: &CheckRun, status: &CheckRunsStatus) {
+        audit_decision(repo, commit, run, status);
+        self.track_guard(repo, commit, run, status);
+    }
+
+    /// Track the guard of the commit while its check run is pending, stop tracking once it has concluded.
+    pub fn track_guard(&self, repo: &str, commit: &str, run: &CheckRun, status: &CheckRunsStatus) {
+        let key = (repo.to_string(), commit.to_string());
+        let mut guards = self
+            .guards
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner);
+        if run.status == CHECK_RUN_COMPLETED_STATUS {
+            guards.remove(&key);
+            return;
+        }
+
+        if !guards.contains_key(&key) && guards.len() >= MAX_TRACKED_GUARDS {
+            let oldest = guards
+                .iter()
+                .min_by_key(|(_, guard)| guard.updated_at)
+                .map(|(key, _)| key.clone());
+            if let Some(oldest) = oldest {
+                guards.remove(&oldest);
+            }
+        }
+        guards.insert(
+            key,
+            PendingGuard {
+                client_id: self.client_id.clone(),
+                repo: repo.to_string(),
+                commit: commit.to_string(),
+                status: run.status.clone(),
+                pending: status.pending,
+                checks: status.checks.clone(),
+                updated_at: self.clock.now(),
+            },
+        );
+    }
+
+    /// Return the guards that are currently pending, sorted by repository and commit.
+    /// Only uses the tracked state, no requests are made to GitHub.
+    pub fn pending_guards(&self) -> Vec<PendingGuard> {
+        let mut guards: Vec<PendingGuard> = self
+            .guards
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner)
+            .values()
+            .cloned()
+            .collect();
+        guards.sort_by(|a, b| (&a.repo, &a.commit).cmp(&(&b.repo, &b.commit)));
+        guards
+    }
+
+    /// Count the required checks that have not been reported as check run or commit status yet as pending.
+    /// Checks that have been reported are already counted based on their state.
+    fn count_missing_required_checks(
+        &self,
+        checks: &CheckOptions,
+        check_runs: &[CheckRun],
+        statuses: &[CommitStatus],
+        status: &mut CheckRunsStatus,
+    ) {
+        for name in &checks.required_checks {
+            let reported = check_runs.iter().any(|run| {
+                &run.name == name
+                    && !run
+                        .app
+                        .as_ref()
+                        .is_some_and(|app| app.client_id == self.client_id)
+            }) || statuses.iter().any(|status| &status.context == name);
+            if !reported {
+                debug!("Required check '{name}' has not been reported yet");
+                status.add_missing(name, "not reported");
+            }
+        }
+    }
+
     #[cfg(test)]
     pub fn new_for_testing(client_id: &str, secret: &str, api: &str) -> Self {
-        let key = jsonwebtoken::EncodingKey::from_secret(secret.as_bytes());
+        let key = std::sync::Mutex::new(jsonwebtoken::EncodingKey::from_secret(secret.as_bytes()));
+        let metrics = Arc::new(Metrics::new());
+        let clock: Arc<dyn Clock> = Arc::new(SystemClock);
 
         Client {
             client_id: client_id.to_string(),
+            checks: std::sync::Mutex::new(Arc::new(CheckOptions::from(&ClientOptions::default()))),
             key,
-            api: api.to_string(),
+            jwt: std::sync::Mutex::new(None),
+            api: api::Api::new(
+                reqwest::Client::new(),
+                &ClientOptions {
+                    api: api.to_string(),
+                    max_attempts: 1,
+                    ..Default::default()
+                },
+                metrics.clone(),
+                api::new_request_limiter(default_max_concurrent_requests()),
+                clock.clone(),
+            ),
             token_cache: Mutex::new(HashMap::new()),
+            guards: std::sync::Mutex::new(HashMap::new()),
+            commit_locks: std::sync::Mutex::new(HashMap::new()),
+            rate_limit: Mutex::new(None),
+            store: Arc::new(MemoryStore::default()),
+            metrics,
+            clock,
+            jwt_clock_skew: default_jwt_clock_skew(),
         }
     }
 }
 
+/// Add the commit statuses to the pending and failed counts.
+/// "pending" counts as pending, anything but "success" counts as failed.
+fn count_commit_statuses(statuses: &[CommitStatus], status: &mut CheckRunsStatus) {
+    for commit_status in statuses {
+        match commit_status.state.as_str() {
+            COMMIT_STATUS_SUCCESS => {
+                debug!("Commit status '{}' has passed", commit_status.context);
+                status.add_passed(&commit_status.context, &commit_status.state);
+            }
+            COMMIT_STATUS_PENDING => {
+                debug!("Commit status '{}' is pending", commit_status.context);
+                status.add_pending(&commit_status.context, &commit_status.state);
+            }
+            state => {
+                debug!(
+                    "Commit status '{}' has failed with state '{state}'",
+                    commit_status.context
+                );
+                status.add_failed(&commit_status.context, state);
+            }
+        }
+    }
+}
+
+/// Check if the check run or commit status context matches any of the ignored patterns.
+fn is_ignored_check(checks: &CheckOptions, name: &str) -> bool {
+    checks
+        .ignored_checks
+        .iter()
+        .any(|pattern| glob::glob_match(pattern, name))
+}
+
+/// Count the required labels as pending, unless all open pull requests of the commit have them.
+/// Without an open pull request, all required labels are missing.
+fn count_missing_required_labels(
+    checks: &CheckOptions,
+    pull_requests: &[PullRequestResponse],
+    status: &mut CheckRunsStatus,
+) {
+    let open: Vec<&PullRequestResponse> = pull_requests
+        .iter()
+        .filter(|pr| pr.state == PULL_REQUEST_OPEN)
+        .collect();
+    for label in &checks.required_labels {
+        let name = format!("label:{label}");
+        let present = !open.is_empty()
+            && open
+                .iter()
+                .all(|pr| pr.labels.iter().any(|l| &l.name == label));
+        if present {
+            status.add_passed(&name, "present");
+        } else {
+            debug!("Required label '{label}' is missing");
+            status.add_missing(&name, "missing");
+        }
+    }
+}
+
+/// Replace the placeholders of the details URL template with the owner, name and commit of the repository.
+fn expand_details_url(template: &str, repo: &str, commit: &str) -> String {
+    let (owner, name) = repo.split_once('/').unwrap_or(("", repo));
+    template
+        .replace("{owner}", owner)
+        .replace("{repo}", name)
+        .replace("{sha}", commit)
+}
+
+/// Create the default http client for requests to the GitHub API, using the proxy of the options if set.
+fn default_http_client(options: &ClientOptions) -> Result<reqwest::Client, Error> {
+    let mut builder = reqwest::Client::builder().timeout(DEFAULT_HTTP_TIMEOUT);
+    if !options.proxy_url.is_empty() {
+        // Setting a proxy disables the proxies from the environment
+        let proxy = reqwest::Proxy::all(&options.proxy_url).map_err(Error::CreateRequest)?;
+        builder = builder.proxy(proxy);
+    }
+    builder.build().map_err(Error::CreateRequest)
+}
+
+/// Record the state of the check run of a commit in the audit log, as machine-parseable fields.
+/// The webhook delivery and the pull request are added by the span of the webhook handler.
+fn audit_decision(repo: &str, commit: &str, run: &CheckRun, status: &CheckRunsStatus) {
+    let checks = status
+        .checks
+        .iter()
+        .map(|check| format!("{}={}", check.name, check.state))
+        .collect::<Vec<_>>()
+        .join(",");
+    info!(
+        target: "audit",
+        repo,
+        commit,
+        check_run = run.id,
+        status = run.status.as_str(),
+        conclusion = run.conclusion.as_deref().unwrap_or_default(),
+        pending = status.pending,
+        failed = status.failed,
+        checks = checks.as_str(),
+        "Guard decision"
+    );
+}
+
 #[derive(Debug, Serialize, Deserialize)]
 struct JWTClaims {
     /// Issued At
@@ -296,11 +1679,11 @@ struct JWTClaims {
 }
 
 impl JWTClaims {
-    /// Create a new JWT claims object with the issued time 30s in the past
-    pub fn new(client_id: &str) -> Self {
+    /// Create a new JWT claims object with the issued time clock_skew seconds in the past.
+    /// The current time is given as unix timestamp.
+    pub fn new(client_id: &str, now: u64, clock_skew: u64) -> Self {
         debug!("Creating JWT claims for client ID: {}", client_id);
-        let now = jsonwebtoken::get_current_timestamp();
-        let iat = now - 30;
+        let iat = now.saturating_sub(clock_skew);
         let exp = now + 2 * 60;
         JWTClaims {
             iat,
@@ -0,0 +1,117 @@
+const ALPHABET: &[u8; 64] = b"ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+
+/// Decode a standard base64 string into a vector of bytes.
+/// Whitespace is ignored and padding is optional.
+pub fn decode_base64(s: &str) -> Result<Vec<u8>, String> {
+    let mut output = Vec::with_capacity(s.len() * 3 / 4);
+    let mut buffer: u32 = 0;
+    let mut bits = 0;
+    let mut padding = 0;
+
+    for c in s.bytes().filter(|c| !c.is_ascii_whitespace()) {
+        if c == b'=' {
+            padding += 1;
+            continue;
+        }
+        if padding > 0 {
+            return Err("Base64 string has data after padding".to_string());
+        }
+        let value = ALPHABET
+            .iter()
+            .position(|a| *a == c)
+            .ok_or_else(|| format!("Invalid character '{}' in base64 string", c as char))?;
+        buffer = (buffer << 6) | value as u32;
+        bits += 6;
+        if bits >= 8 {
+            bits -= 8;
+            output.push((buffer >> bits) as u8);
+            buffer &= (1 << bits) - 1;
+        }
+    }
+
+    if bits >= 6 || padding > 2 {
+        return Err("Base64 string has an invalid length".to_string());
+    }
+    Ok(output)
+}
+
+/// Encode bytes as a standard base64 string with padding.
+#[cfg(test)]
+pub fn encode_base64(data: &[u8]) -> String {
+    let mut output = String::with_capacity(data.len().div_ceil(3) * 4);
+    for chunk in data.chunks(3) {
+        let buffer = chunk
+            .iter()
+            .enumerate()
+            .fold(0u32, |acc, (i, b)| acc | (u32::from(*b) << (16 - 8 * i)));
+        for i in 0..4 {
+            if i <= chunk.len() {
+                output.push(ALPHABET[((buffer >> (18 - 6 * i)) & 0x3f) as usize] as char);
+            } else {
+                output.push('=');
+            }
+        }
+    }
+    output
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_decode_base64() {
+        assert_eq!(decode_base64("SGVsbG8=").unwrap(), b"Hello");
+    }
+
+    #[test]
+    fn test_decode_base64_empty() {
+        assert_eq!(decode_base64("").unwrap(), Vec::<u8>::new());
+    }
+
+    #[test]
+    fn test_decode_base64_without_padding() {
+        assert_eq!(decode_base64("SGVsbG8").unwrap(), b"Hello");
+        assert_eq!(decode_base64("SGk").unwrap(), b"Hi");
+    }
+
+    #[test]
+    fn test_decode_base64_ignores_whitespace() {
+        assert_eq!(
+            decode_base64("SGVs\nbG8g\r\nV29y bGQ=\n").unwrap(),
+            b"Hello World"
+        );
+    }
+
+    #[test]
+    fn test_decode_base64_invalid_char() {
+        let result = decode_base64("SGVs*G8=");
+        assert!(result.is_err());
+        assert_eq!(
+            result.unwrap_err(),
+            "Invalid character '*' in base64 string"
+        );
+    }
+
+    #[test]
+    fn test_decode_base64_invalid_length() {
+        let result = decode_base64("SGVsb");
+        assert!(result.is_err());
+        assert_eq!(result.unwrap_err(), "Base64 string has an invalid length");
+    }
+
+    #[test]
+    fn test_decode_base64_data_after_padding() {
+        assert!(decode_base64("SG=VsbG8").is_err());
+    }
+
+    #[test]
+    fn test_encode_base64_round_trip() {
+        for data in [&b""[..], b"H", b"Hi", b"Hello", b"\x00\xff\x10\x80"] {
+            let encoded = encode_base64(data);
+            assert_eq!(encoded.len() % 4, 0, "Encoded string should be padded");
+            assert_eq!(decode_base64(&encoded).unwrap(), data);
+        }
+        assert_eq!(encode_base64(b"Hello"), "SGVsbG8=");
+    }
+}
@@ -0,0 +1,28 @@
+use chrono::{DateTime, Utc};
+
+/// Source of the current time.
+/// Allows replacing the system clock in tests of time based logic, e.g. token expiry.
+pub trait Clock: Send + Sync {
+    /// Return the current time
+    fn now(&self) -> DateTime<Utc>;
+}
+
+/// Clock using the system time
+pub struct SystemClock;
+
+impl Clock for SystemClock {
+    fn now(&self) -> DateTime<Utc> {
+        Utc::now()
+    }
+}
+
+/// Clock that always returns the same time
+#[cfg(test)]
+pub struct FixedClock(pub DateTime<Utc>);
+
+#[cfg(test)]
+impl Clock for FixedClock {
+    fn now(&self) -> DateTime<Utc> {
+        self.0
+    }
+}
@@ -0,0 +1,70 @@
+/// Check if the name matches the glob pattern.
+/// Supports "*" for any number of characters and "?" for a single character.
+pub fn glob_match(pattern: &str, name: &str) -> bool {
+    let pattern: Vec<char> = pattern.chars().collect();
+    let name: Vec<char> = name.chars().collect();
+
+    let (mut p, mut n) = (0, 0);
+    // Position of the last "*" in the pattern and the position in the name it was matched at
+    let mut backtrack: Option<(usize, usize)> = None;
+
+    while n < name.len() {
+        match pattern.get(p) {
+            Some('*') => {
+                backtrack = Some((p, n));
+                p += 1;
+            }
+            Some(c) if *c == '?' || *c == name[n] => {
+                p += 1;
+                n += 1;
+            }
+            _ => match backtrack {
+                // Let the last "*" consume one more character and try again
+                Some((star, matched)) => {
+                    backtrack = Some((star, matched + 1));
+                    p = star + 1;
+                    n = matched + 1;
+                }
+                None => return false,
+            },
+        }
+    }
+    pattern[p..].iter().all(|c| *c == '*')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_glob_match_exact() {
+        assert!(glob_match("build", "build"));
+        assert!(!glob_match("build", "build-linux"));
+        assert!(!glob_match("build-linux", "build"));
+    }
+
+    #[test]
+    fn test_glob_match_star() {
+        assert!(glob_match("*", ""));
+        assert!(glob_match("*", "anything"));
+        assert!(glob_match("coverage*", "coverage"));
+        assert!(glob_match("coverage*", "coverage-report"));
+        assert!(glob_match("*-optional", "e2e-optional"));
+        assert!(glob_match("ci/*/lint", "ci/linux/lint"));
+        assert!(!glob_match("ci/*/lint", "ci/linux/test"));
+        assert!(glob_match("a*b*c", "aXXbYYbZZc"));
+        assert!(!glob_match("a*b*c", "aXXbYY"));
+    }
+
+    #[test]
+    fn test_glob_match_question_mark() {
+        assert!(glob_match("test-?", "test-1"));
+        assert!(!glob_match("test-?", "test-10"));
+        assert!(!glob_match("test-?", "test-"));
+    }
+
+    #[test]
+    fn test_glob_match_unicode() {
+        assert!(glob_match("prüfung-?", "prüfung-ä"));
+    }
+}
@@ -0,0 +1,131 @@
+use crate::{
+    client::{Client, ClientOptions},
+    error::Error,
+};
+use std::io::Write;
+
+#[cfg(test)]
+mod test;
+
+/// Outcome of a single diagnostic check
+#[derive(Debug, PartialEq)]
+enum Outcome {
+    Pass(String),
+    Fail(String),
+    /// The check depends on a previous check that failed
+    Skip,
+}
+
+/// Run all diagnostic checks for the GitHub App and write a pass/fail summary to the writer.
+/// The checks build on each other, so checks after the first failure are skipped.
+/// Returns an error if any check failed.
+pub async fn run<W: Write>(options: ClientOptions, out: &mut W) -> Result<(), Error> {
+    let results = diagnose(options).await;
+
+    let mut passed = 0;
+    let mut failed = 0;
+    let mut skipped = 0;
+    for (name, outcome) in &results {
+        let _ = match outcome {
+            Outcome::Pass(msg) => {
+                passed += 1;
+                writeln!(out, "[PASS] {name}: {msg}")
+            }
+            Outcome::Fail(msg) => {
+                failed += 1;
+                writeln!(out, "[FAIL] {name}: {msg}")
+            }
+            Outcome::Skip => {
+                skipped += 1;
+                writeln!(out, "[SKIP] {name}: a previous check failed")
+            }
+        };
+    }
+    let _ = writeln!(out, "{passed} passed, {failed} failed, {skipped} skipped");
+
+    if failed > 0 {
+        return Err(Error::DoctorFailed(failed));
+    }
+    Ok(())
+}
+
+const CHECK_PRIVATE_KEY: &str = "Private key";
+const CHECK_JWT: &str = "JWT";
+const CHECK_APP: &str = "GitHub App";
+const CHECK_INSTALLATIONS: &str = "Installations";
+
+/// Names of the checks, in the order they are run
+const CHECKS: &[&str] = &[CHECK_PRIVATE_KEY, CHECK_JWT, CHECK_APP, CHECK_INSTALLATIONS];
+
+/// Run the checks in order and return the outcome of each one.
+async fn diagnose(options: ClientOptions) -> Vec<(&'static str, Outcome)> {
+    let mut results = Vec::new();
+    run_checks(options, &mut results).await;
+    for name in CHECKS.iter().skip(results.len()) {
+        results.push((*name, Outcome::Skip));
+    }
+    results
+}
+
+/// Run the checks until the first one fails, recording the outcomes.
+async fn run_checks(options: ClientOptions, results: &mut Vec<(&'static str, Outcome)>) {
+    let client_id = options.client_id.clone();
+    let client = match Client::build(options) {
+        Ok(client) => {
+            results.push((
+                CHECK_PRIVATE_KEY,
+                Outcome::Pass("parsed RSA key".to_string()),
+            ));
+            client
+        }
+        Err(e) => {
+            results.push((CHECK_PRIVATE_KEY, Outcome::Fail(e.to_string())));
+            return;
+        }
+    };
+
+    if let Err(e) = client.new_jwt() {
+        results.push((CHECK_JWT, Outcome::Fail(e.to_string())));
+        return;
+    }
+    results.push((
+        CHECK_JWT,
+        Outcome::Pass(format!("signed token for client ID '{client_id}'")),
+    ));
+
+    match client.get_app().await {
+        Ok(app) => results.push((
+            CHECK_APP,
+            Outcome::Pass(format!("authenticated as '{}' (id {})", app.slug, app.id)),
+        )),
+        Err(e) => {
+            results.push((CHECK_APP, Outcome::Fail(e.to_string())));
+            return;
+        }
+    }
+
+    match client.list_installations().await {
+        Ok(installations) if installations.is_empty() => results.push((
+            CHECK_INSTALLATIONS,
+            Outcome::Fail("the app is not installed on any account".to_string()),
+        )),
+        Ok(installations) => {
+            let installations: Vec<String> = installations
+                .iter()
+                .map(|installation| match &installation.account {
+                    Some(account) => format!("{} ({})", account.login, installation.id),
+                    None => installation.id.to_string(),
+                })
+                .collect();
+            results.push((
+                CHECK_INSTALLATIONS,
+                Outcome::Pass(format!(
+                    "found {}: {}",
+                    installations.len(),
+                    installations.join(", ")
+                )),
+            ));
+        }
+        Err(e) => results.push((CHECK_INSTALLATIONS, Outcome::Fail(e.to_string()))),
+    }
+}
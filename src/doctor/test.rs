@@ -0,0 +1,146 @@
+use super::*;
+use crate::testutils::*;
+use crate::types::{Account, App, Installation};
+use axum::http::{HeaderMap, StatusCode};
+use std::collections::VecDeque;
+
+fn test_app() -> App {
+    App {
+        id: 42,
+        client_id: "testid".to_string(),
+        slug: "cerberus-test".to_string(),
+        name: "Cerberus Test".to_string(),
+    }
+}
+
+#[tokio::test]
+async fn all_checks_pass() {
+    let api_server = MockGithubApiServer::new(VecDeque::from(vec![
+        ExpectedRequests::GetApp(StatusCode::OK, test_app()),
+        ExpectedRequests::ListInstallations(
+            StatusCode::OK,
+            vec![Installation {
+                id: 1234,
+                account: Some(Account {
+                    login: "heathcliff26".to_string(),
+                    account_type: "User".to_string(),
+                }),
+            }],
+        ),
+    ]));
+    let addr = api_server.start().await;
+    let certificate = TlsCertificate::create(None);
+    let options = ClientOptions {
+        client_id: "testid".to_string(),
+        private_key: certificate.key.clone(),
+        api: addr,
+        ..Default::default()
+    };
+
+    let mut out = Vec::new();
+    run(options, &mut out)
+        .await
+        .expect("All checks should pass");
+
+    let output = String::from_utf8(out).unwrap();
+    assert_eq!(
+        "[PASS] Private key: parsed RSA key\n\
+         [PASS] JWT: signed token for client ID 'testid'\n\
+         [PASS] GitHub App: authenticated as 'cerberus-test' (id 42)\n\
+         [PASS] Installations: found 1: heathcliff26 (1234)\n\
+         4 passed, 0 failed, 0 skipped\n",
+        output
+    );
+
+    let state = api_server.state.lock().await;
+    let uris: Vec<&str> = state.requests.iter().map(|r| r.uri.as_str()).collect();
+    assert_eq!(vec!["/app", "/app/installations?per_page=100"], uris);
+    for request in state.requests.iter() {
+        assert!(
+            request
+                .headers
+                .get("authorization")
+                .is_some_and(|v| v.to_str().unwrap().starts_with("Bearer ")),
+            "Should authenticate with the JWT"
+        );
+    }
+}
+
+#[tokio::test]
+async fn no_installations() {
+    let api_server = MockGithubApiServer::new(VecDeque::from(vec![
+        ExpectedRequests::GetApp(StatusCode::OK, test_app()),
+        ExpectedRequests::ListInstallations(StatusCode::OK, Vec::new()),
+    ]));
+    let addr = api_server.start().await;
+    let certificate = TlsCertificate::create(None);
+    let options = ClientOptions {
+        client_id: "testid".to_string(),
+        private_key: certificate.key.clone(),
+        api: addr,
+        ..Default::default()
+    };
+
+    let mut out = Vec::new();
+    let err = run(options, &mut out).await.expect_err("Should fail");
+    assert!(matches!(err, Error::DoctorFailed(1)), "Got: {err}");
+
+    let output = String::from_utf8(out).unwrap();
+    assert!(
+        output.contains("[FAIL] Installations: the app is not installed on any account\n"),
+        "Got:\n{output}"
+    );
+}
+
+#[tokio::test]
+async fn app_authentication_fails() {
+    let api_server = MockGithubApiServer::new(VecDeque::from(vec![ExpectedRequests::Raw(
+        StatusCode::UNAUTHORIZED,
+        HeaderMap::new(),
+        r#"{"message":"A JSON web token could not be decoded"}"#.to_string(),
+    )]));
+    let addr = api_server.start().await;
+    let certificate = TlsCertificate::create(None);
+    let options = ClientOptions {
+        client_id: "testid".to_string(),
+        private_key: certificate.key.clone(),
+        api: addr,
+        max_attempts: 1,
+        ..Default::default()
+    };
+
+    let mut out = Vec::new();
+    let err = run(options, &mut out).await.expect_err("Should fail");
+    assert!(matches!(err, Error::DoctorFailed(1)), "Got: {err}");
+
+    let output = String::from_utf8(out).unwrap();
+    assert!(output.contains("[PASS] JWT"), "Got:\n{output}");
+    assert!(
+        output.contains("[FAIL] GitHub App: ")
+            && output.contains("A JSON web token could not be decoded"),
+        "Should contain the API error message, got:\n{output}"
+    );
+    assert!(output.contains("[SKIP] Installations: a previous check failed\n"));
+    assert!(output.ends_with("2 passed, 1 failed, 1 skipped\n"));
+}
+
+#[tokio::test]
+async fn invalid_private_key_skips_remaining_checks() {
+    let options = ClientOptions {
+        client_id: "testid".to_string(),
+        private_key_data: "not a private key".to_string(),
+        api: "http://localhost:1".to_string(),
+        ..Default::default()
+    };
+
+    let mut out = Vec::new();
+    let err = run(options, &mut out).await.expect_err("Should fail");
+    assert!(matches!(err, Error::DoctorFailed(1)), "Got: {err}");
+
+    let output = String::from_utf8(out).unwrap();
+    assert!(output.starts_with("[FAIL] Private key: Failed to create encoding key"));
+    assert!(output.contains("[SKIP] JWT: a previous check failed\n"));
+    assert!(output.contains("[SKIP] GitHub App: a previous check failed\n"));
+    assert!(output.contains("[SKIP] Installations: a previous check failed\n"));
+    assert!(output.ends_with("0 passed, 1 failed, 3 skipped\n"));
+}
@@ -4,20 +4,27 @@ use std::fmt::Display;
 #[derive(Debug)]
 pub enum Error {
     ReadPrivateKey(String, std::io::Error),
+    DecodePrivateKey(String),
     EncodingKey(jsonwebtoken::errors::Error),
     #[allow(clippy::upper_case_acronyms)]
     JWT(jsonwebtoken::errors::Error),
     InvalidBearerToken(),
     CreateRequest(reqwest::Error),
     Send(reqwest::Error),
-    NonOkStatus(String, reqwest::StatusCode),
+    Api(ApiError),
+    RateLimited(String, Option<std::time::Duration>),
     Parse(&'static str, Box<dyn std::error::Error>),
     ReceiveBody(reqwest::Error),
     Serve(std::io::Error),
     BindPort(Box<dyn std::error::Error>),
     ReadConfigFile(String, std::io::Error),
     ParseConfigFile(String, serde_yaml::Error),
-    InvalidConfig(&'static str),
+    ExpandConfigFile(String, String),
+    SerializeConfig(serde_yaml::Error),
+    InvalidConfig(Vec<ConfigError>),
+    DoctorFailed(usize),
+    Redis(String, redis::RedisError),
+    Telemetry(String),
 }
 
 impl Display for Error {
@@ -26,6 +33,9 @@ impl Display for Error {
             Error::ReadPrivateKey(path, err) => {
                 write!(f, "Failed to read private key '{path}': {err}")
             }
+            Error::DecodePrivateKey(err) => {
+                write!(f, "Failed to decode base64 private key: {err}")
+            }
             Error::EncodingKey(err) => {
                 write!(f, "Failed to create encoding key: {err}")
             }
@@ -41,8 +51,18 @@ impl Display for Error {
             Error::Send(err) => {
                 write!(f, "Failed to send request: {}", full_error_stack(err))
             }
-            Error::NonOkStatus(url, status) => {
-                write!(f, "Request to '{url}' failed with status: {status}")
+            Error::Api(err) => {
+                write!(f, "{err}")
+            }
+            Error::RateLimited(url, Some(wait)) => {
+                write!(
+                    f,
+                    "Request to '{url}' exceeded the rate limit, resets in {}s",
+                    wait.as_secs()
+                )
+            }
+            Error::RateLimited(url, None) => {
+                write!(f, "Request to '{url}' exceeded the rate limit")
             }
             Error::Parse(url, err) => {
                 write!(f, "Failed to parse response from '{url}': {err}")
@@ -62,8 +82,27 @@ impl Display for Error {
             Error::ParseConfigFile(path, err) => {
                 write!(f, "Failed to parse config file '{path}': {err}")
             }
-            Error::InvalidConfig(msg) => {
-                write!(f, "Invalid configuration: {msg}")
+            Error::ExpandConfigFile(path, err) => {
+                write!(
+                    f,
+                    "Failed to expand environment variables in config file '{path}': {err}"
+                )
+            }
+            Error::SerializeConfig(err) => {
+                write!(f, "Failed to serialize configuration: {err}")
+            }
+            Error::InvalidConfig(errors) => {
+                let messages: Vec<&str> = errors.iter().map(ConfigError::message).collect();
+                write!(f, "Invalid configuration: {}", messages.join("; "))
+            }
+            Error::DoctorFailed(failed) => {
+                write!(f, "Doctor found {failed} failed checks")
+            }
+            Error::Redis(addr, err) => {
+                write!(f, "Failed to communicate with redis '{addr}': {err}")
+            }
+            Error::Telemetry(err) => {
+                write!(f, "Failed to create the OpenTelemetry exporter: {err}")
             }
         }
     }
@@ -71,6 +110,385 @@ impl Display for Error {
 
 impl std::error::Error for Error {}
 
+impl Error {
+    /// Returns true if the error is transient and a request with the given method can be retried.
+    /// A POST is only retried when it did not reach GitHub or was rejected by the rate limit,
+    /// as it might have been processed despite the error, e.g. after a timeout, and would create duplicates.
+    pub fn is_retryable(&self, method: &reqwest::Method) -> bool {
+        if method == reqwest::Method::POST {
+            return match self {
+                Error::Send(err) => err.is_connect(),
+                Error::RateLimited(_, _) => true,
+                _ => false,
+            };
+        }
+        match self {
+            Error::Send(err) => !err.is_builder(),
+            Error::Api(err) => err.status.is_server_error(),
+            Error::RateLimited(_, _) => true,
+            _ => false,
+        }
+    }
+
+    /// Returns the status code, if the error is caused by an unsuccessful response from the API.
+    /// Allows handling specific responses differently, e.g. 404.
+    pub fn status(&self) -> Option<reqwest::StatusCode> {
+        match self {
+            Error::Api(err) => Some(err.status),
+            _ => None,
+        }
+    }
+
+    /// Returns the problems found in the configuration, empty if the error is not caused by an invalid configuration.
+    pub fn config_errors(&self) -> &[ConfigError] {
+        match self {
+            Error::InvalidConfig(errors) => errors,
+            _ => &[],
+        }
+    }
+
+    /// Returns the time until the rate limit resets, if the error is caused by an exceeded rate limit.
+    pub fn rate_limit_reset(&self) -> Option<std::time::Duration> {
+        match self {
+            Error::RateLimited(_, wait) => *wait,
+            _ => None,
+        }
+    }
+}
+
+/// Problem found when validating the configuration.
+/// Every variant is a distinct failure, so callers can match on it instead of comparing messages.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ConfigError {
+    InvalidLogLevel,
+    InvalidOtlpEndpoint,
+    InvalidPort,
+    InvalidBindAddress,
+    InvalidWebhookPath,
+    InvalidWebhookPathCharacters,
+    ReservedWebhookPath,
+    MissingWebhookSecret,
+    ShortWebhookSecret,
+    InvalidPreviousWebhookSecrets,
+    ShortAdminToken,
+    EmptyRepoPattern,
+    UnknownRepoVisibility,
+    InvalidMaxBodySize,
+    InvalidHeaderReadTimeout,
+    InvalidIdleTimeout,
+    InvalidRedisUrl,
+    InvalidTokenPrewarmInterval,
+    InvalidWorkerQueueSize,
+    InvalidInitialEvaluationDelay,
+    SSLClientCaWithoutSSL,
+    IncompleteSSL,
+    InvalidSSLClientCa,
+    MissingClientId,
+    InvalidMaxAttempts,
+    InvalidMaxConcurrentRequests,
+    InvalidJwtClockSkew,
+    MissingPrivateKey,
+    ConflictingPrivateKeys,
+    InvalidPrivateKeyBase64,
+    EmptyCheckName,
+    CheckNameWhitespace,
+    EmptyRequiredCheck,
+    EmptyIgnoredCheck,
+    EmptyFlakyCheck,
+    InvalidMaxFlakyReruns,
+    EmptyPassingConclusions,
+    UnknownPassingConclusion,
+    EmptyConclusionOverrideCheck,
+    InvalidConclusionOverrideConclusions,
+    EmptyRequiredLabel,
+    IgnoredRequiredCheck,
+    InvalidApiUrl,
+    InvalidDetailsUrl,
+    ConflictingSummaryTemplates,
+    InvalidSummaryTemplate,
+    InvalidUserAgent,
+    InvalidProxyUrl,
+    InvalidInitialStatus,
+    MissingWebhookSecretForAdditionalApps,
+    MissingAdditionalAppWebhookSecret,
+    DuplicateWebhookSecret,
+    DuplicateClientId,
+}
+
+impl ConfigError {
+    /// Machine readable identifier of the problem, stable across changes of the message
+    pub fn code(&self) -> &'static str {
+        match self {
+            ConfigError::InvalidLogLevel => "invalid-log-level",
+            ConfigError::InvalidOtlpEndpoint => "invalid-otlp-endpoint",
+            ConfigError::InvalidPort => "invalid-port",
+            ConfigError::InvalidBindAddress => "invalid-bind-address",
+            ConfigError::InvalidWebhookPath => "invalid-webhook-path",
+            ConfigError::InvalidWebhookPathCharacters => "invalid-webhook-path-characters",
+            ConfigError::ReservedWebhookPath => "reserved-webhook-path",
+            ConfigError::MissingWebhookSecret => "missing-webhook-secret",
+            ConfigError::ShortWebhookSecret => "short-webhook-secret",
+            ConfigError::InvalidPreviousWebhookSecrets => "invalid-previous-webhook-secrets",
+            ConfigError::ShortAdminToken => "short-admin-token",
+            ConfigError::EmptyRepoPattern => "empty-repo-pattern",
+            ConfigError::UnknownRepoVisibility => "unknown-repo-visibility",
+            ConfigError::InvalidMaxBodySize => "invalid-max-body-size",
+            ConfigError::InvalidHeaderReadTimeout => "invalid-header-read-timeout",
+            ConfigError::InvalidIdleTimeout => "invalid-idle-timeout",
+            ConfigError::InvalidRedisUrl => "invalid-redis-url",
+            ConfigError::InvalidTokenPrewarmInterval => "invalid-token-prewarm-interval",
+            ConfigError::InvalidWorkerQueueSize => "invalid-worker-queue-size",
+            ConfigError::InvalidInitialEvaluationDelay => "invalid-initial-evaluation-delay",
+            ConfigError::SSLClientCaWithoutSSL => "ssl-client-ca-without-ssl",
+            ConfigError::IncompleteSSL => "incomplete-ssl",
+            ConfigError::InvalidSSLClientCa => "invalid-ssl-client-ca",
+            ConfigError::MissingClientId => "missing-client-id",
+            ConfigError::InvalidMaxAttempts => "invalid-max-attempts",
+            ConfigError::InvalidMaxConcurrentRequests => "invalid-max-concurrent-requests",
+            ConfigError::InvalidJwtClockSkew => "invalid-jwt-clock-skew",
+            ConfigError::MissingPrivateKey => "missing-private-key",
+            ConfigError::ConflictingPrivateKeys => "conflicting-private-keys",
+            ConfigError::InvalidPrivateKeyBase64 => "invalid-private-key-base64",
+            ConfigError::EmptyCheckName => "empty-check-name",
+            ConfigError::CheckNameWhitespace => "check-name-whitespace",
+            ConfigError::EmptyRequiredCheck => "empty-required-check",
+            ConfigError::EmptyIgnoredCheck => "empty-ignored-check",
+            ConfigError::EmptyFlakyCheck => "empty-flaky-check",
+            ConfigError::InvalidMaxFlakyReruns => "invalid-max-flaky-reruns",
+            ConfigError::EmptyPassingConclusions => "empty-passing-conclusions",
+            ConfigError::UnknownPassingConclusion => "unknown-passing-conclusion",
+            ConfigError::EmptyConclusionOverrideCheck => "empty-conclusion-override-check",
+            ConfigError::InvalidConclusionOverrideConclusions => {
+                "invalid-conclusion-override-conclusions"
+            }
+            ConfigError::EmptyRequiredLabel => "empty-required-label",
+            ConfigError::IgnoredRequiredCheck => "ignored-required-check",
+            ConfigError::InvalidApiUrl => "invalid-api-url",
+            ConfigError::InvalidDetailsUrl => "invalid-details-url",
+            ConfigError::ConflictingSummaryTemplates => "conflicting-summary-templates",
+            ConfigError::InvalidSummaryTemplate => "invalid-summary-template",
+            ConfigError::InvalidUserAgent => "invalid-user-agent",
+            ConfigError::InvalidProxyUrl => "invalid-proxy-url",
+            ConfigError::InvalidInitialStatus => "invalid-initial-status",
+            ConfigError::MissingWebhookSecretForAdditionalApps => {
+                "missing-webhook-secret-for-additional-apps"
+            }
+            ConfigError::MissingAdditionalAppWebhookSecret => {
+                "missing-additional-app-webhook-secret"
+            }
+            ConfigError::DuplicateWebhookSecret => "duplicate-webhook-secret",
+            ConfigError::DuplicateClientId => "duplicate-client-id",
+        }
+    }
+
+    /// Human readable description of the problem
+    pub fn message(&self) -> &'static str {
+        match self {
+            ConfigError::InvalidLogLevel => {
+                "Log level must be one of 'error', 'warn', 'info' or 'debug'"
+            }
+            ConfigError::InvalidOtlpEndpoint => "OTLP endpoint must be a http:// or https:// URL",
+            ConfigError::InvalidPort => "Port must be between 1 and 65535",
+            ConfigError::InvalidBindAddress => "Bind address must be an IPv4 or IPv6 address",
+            ConfigError::InvalidWebhookPath => "Webhook path must start with '/'",
+            ConfigError::InvalidWebhookPathCharacters => {
+                "Webhook path must not contain whitespace, '{' or '}'"
+            }
+            ConfigError::ReservedWebhookPath => {
+                "Webhook path must not be one of /healthz, /readyz, /version, /metrics, /debug/guards, /debug/ratelimit or /admin/reevaluate"
+            }
+            ConfigError::MissingWebhookSecret => {
+                "Webhook secret must be set when require-webhook-secret is enabled"
+            }
+            ConfigError::ShortWebhookSecret => "Webhook secret must be at least 16 bytes long",
+            ConfigError::InvalidPreviousWebhookSecrets => {
+                "Previous webhook secrets require a webhook secret and must not be empty"
+            }
+            ConfigError::ShortAdminToken => "Admin token must be at least 16 bytes long",
+            ConfigError::EmptyRepoPattern => {
+                "Repo allowlist and denylist must not contain empty patterns"
+            }
+            ConfigError::UnknownRepoVisibility => {
+                "Repo visibilities must only contain public, private or internal"
+            }
+            ConfigError::InvalidMaxBodySize => "Max body size must be greater than 0",
+            ConfigError::InvalidHeaderReadTimeout => "Header read timeout must be greater than 0",
+            ConfigError::InvalidIdleTimeout => {
+                "Idle timeout must be longer than the webhook timeout"
+            }
+            ConfigError::InvalidRedisUrl => {
+                "Redis URL must be of the form redis://[[username]:password@]host[:port][/db]"
+            }
+            ConfigError::InvalidTokenPrewarmInterval => {
+                "Token prewarm interval must not be longer than 1800 seconds"
+            }
+            ConfigError::InvalidWorkerQueueSize => {
+                "Worker queue size must be greater than 0 when workers are enabled"
+            }
+            ConfigError::InvalidInitialEvaluationDelay => {
+                "Initial evaluation delay must be shorter than the check timeout"
+            }
+            ConfigError::SSLClientCaWithoutSSL => "SSL client-ca requires SSL to be enabled",
+            ConfigError::IncompleteSSL => {
+                "Incomplete SSL configuration: cert and key must be set if SSL is enabled"
+            }
+            ConfigError::InvalidSSLClientCa => {
+                "SSL client-ca must be a readable file containing PEM encoded certificates"
+            }
+            ConfigError::MissingClientId => "GitHub Client ID must be set in the configuration",
+            ConfigError::InvalidMaxAttempts => "GitHub max-attempts must be between 1 and 5",
+            ConfigError::InvalidMaxConcurrentRequests => {
+                "GitHub max-concurrent-requests must be greater than 0"
+            }
+            ConfigError::InvalidJwtClockSkew => "GitHub jwt-clock-skew must be at most 120 seconds",
+            ConfigError::MissingPrivateKey => {
+                "GitHub private-key, private-key-data or private-key-base64 must be set"
+            }
+            ConfigError::ConflictingPrivateKeys => {
+                "GitHub private-key, private-key-data and private-key-base64 are mutually exclusive"
+            }
+            ConfigError::InvalidPrivateKeyBase64 => {
+                "GitHub private-key-base64 must be a base64 encoded RSA private key"
+            }
+            ConfigError::EmptyCheckName => "GitHub check-name must not be empty",
+            ConfigError::CheckNameWhitespace => {
+                "GitHub check-name must not have leading or trailing whitespace"
+            }
+            ConfigError::EmptyRequiredCheck => {
+                "GitHub required-checks must not contain empty names"
+            }
+            ConfigError::EmptyIgnoredCheck => {
+                "GitHub ignored-checks must not contain empty patterns"
+            }
+            ConfigError::EmptyFlakyCheck => {
+                "GitHub rerun-flaky-checks must not contain empty patterns"
+            }
+            ConfigError::InvalidMaxFlakyReruns => "GitHub max-flaky-reruns must be between 1 and 5",
+            ConfigError::EmptyPassingConclusions => "GitHub passing-conclusions must not be empty",
+            ConfigError::UnknownPassingConclusion => {
+                "GitHub passing-conclusions must only contain action_required, cancelled, failure, neutral, success, skipped, stale, startup_failure or timed_out"
+            }
+            ConfigError::EmptyConclusionOverrideCheck => {
+                "GitHub conclusion-overrides must not contain empty check patterns"
+            }
+            ConfigError::InvalidConclusionOverrideConclusions => {
+                "GitHub conclusion-overrides conclusions must not be empty and only contain action_required, cancelled, failure, neutral, success, skipped, stale, startup_failure or timed_out"
+            }
+            ConfigError::EmptyRequiredLabel => {
+                "GitHub required-labels must not contain empty names"
+            }
+            ConfigError::IgnoredRequiredCheck => {
+                "GitHub required-checks must not be matched by ignored-checks"
+            }
+            ConfigError::InvalidApiUrl => "GitHub api must be an http or https URL",
+            ConfigError::InvalidDetailsUrl => "GitHub details-url must be an http or https URL",
+            ConfigError::ConflictingSummaryTemplates => {
+                "GitHub summary-template and summary-template-file are mutually exclusive"
+            }
+            ConfigError::InvalidSummaryTemplate => {
+                "GitHub summary template must be a readable and valid template"
+            }
+            ConfigError::InvalidUserAgent => {
+                "GitHub user-agent must only contain visible ASCII characters"
+            }
+            ConfigError::InvalidProxyUrl => {
+                "GitHub proxy-url must be an http, https, socks5 or socks5h URL"
+            }
+            ConfigError::InvalidInitialStatus => {
+                "GitHub initial-status must be queued or in_progress"
+            }
+            ConfigError::MissingWebhookSecretForAdditionalApps => {
+                "Webhook secret must be set when serving additional apps"
+            }
+            ConfigError::MissingAdditionalAppWebhookSecret => {
+                "Additional apps must have a webhook-secret"
+            }
+            ConfigError::DuplicateWebhookSecret => "Webhook secrets of all apps must be different",
+            ConfigError::DuplicateClientId => "Client IDs of all apps must be different",
+        }
+    }
+}
+
+impl Display for ConfigError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}", self.message())
+    }
+}
+
+impl std::error::Error for ConfigError {}
+
+/// Maximum length of the response body kept in an API error, when it has no error message
+const API_ERROR_BODY_LIMIT: usize = 200;
+/// Message returned by GitHub when the installation of the app lacks the permission for the request
+const RESOURCE_NOT_ACCESSIBLE: &str = "Resource not accessible by integration";
+
+/// Unsuccessful response from the GitHub API.
+#[derive(Debug)]
+pub struct ApiError {
+    pub method: String,
+    pub url: String,
+    pub status: reqwest::StatusCode,
+    /// Error message returned by GitHub, or the start of the response body if there is none
+    pub message: String,
+}
+
+impl ApiError {
+    /// Create a new error from the response, using the message from the JSON body when possible.
+    pub fn new(method: &str, url: &str, status: reqwest::StatusCode, body: &str) -> Self {
+        let message = serde_json::from_str::<serde_json::Value>(body)
+            .ok()
+            .and_then(|body| body["message"].as_str().map(str::to_string))
+            .unwrap_or_else(|| body.trim().chars().take(API_ERROR_BODY_LIMIT).collect());
+        Self {
+            method: method.to_string(),
+            url: url.to_string(),
+            status,
+            message,
+        }
+    }
+
+    /// Returns true if the request failed because the installation of the app lacks a permission.
+    pub fn is_missing_permission(&self) -> bool {
+        self.status == reqwest::StatusCode::FORBIDDEN && self.message == RESOURCE_NOT_ACCESSIBLE
+    }
+
+    /// Name of the permission that is likely missing for the request, if it can be derived from the URL.
+    fn required_permission(&self) -> Option<&'static str> {
+        if self.url.contains("/check-runs") || self.url.contains("/check-suites") {
+            Some("Checks")
+        } else {
+            None
+        }
+    }
+}
+
+impl Display for ApiError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "Request {} '{}' failed with status: {}",
+            self.method, self.url, self.status
+        )?;
+        if !self.message.is_empty() {
+            write!(f, ": {}", self.message)?;
+        }
+        if self.is_missing_permission() {
+            match self.required_permission() {
+                Some(permission) => write!(
+                    f,
+                    ". The app is missing the '{permission}' (read and write) permission"
+                )?,
+                None => write!(f, ". The app is missing a required permission")?,
+            }
+            write!(
+                f,
+                ", grant it in the settings of the app and accept the updated permissions for the installation"
+            )?;
+        }
+        Ok(())
+    }
+}
+
 fn full_error_stack(mut e: &dyn std::error::Error) -> String {
     let mut s = format!("{e}");
     while let Some(src) = e.source() {
@@ -102,25 +520,127 @@ mod tests {
     }
 
     #[test]
-    fn test_error_display_non_ok_status() {
-        let error = Error::NonOkStatus(
-            "https://api.github.com".to_string(),
+    fn test_error_display_api_error() {
+        let error = Error::Api(ApiError::new(
+            "GET",
+            "https://api.github.com",
             reqwest::StatusCode::NOT_FOUND,
-        );
+            "",
+        ));
         let display_string = format!("{}", error);
         assert_eq!(
             display_string,
-            "Request to 'https://api.github.com' failed with status: 404 Not Found"
+            "Request GET 'https://api.github.com' failed with status: 404 Not Found"
+        );
+        assert_eq!(Some(reqwest::StatusCode::NOT_FOUND), error.status());
+    }
+
+    #[test]
+    fn test_api_error_message() {
+        let long_body = "x".repeat(500);
+        let tests = [
+            (
+                r#"{"message":"Resource not accessible by integration","documentation_url":"https://docs.github.com/rest"}"#,
+                "Resource not accessible by integration".to_string(),
+            ),
+            (
+                "  upstream connect error  ",
+                "upstream connect error".to_string(),
+            ),
+            (r#"{"errors":[]}"#, r#"{"errors":[]}"#.to_string()),
+            (long_body.as_str(), "x".repeat(200)),
+        ];
+        for (body, expected) in tests {
+            let error = ApiError::new(
+                "POST",
+                "https://api.github.com/repos/owner/repo/check-runs",
+                reqwest::StatusCode::FORBIDDEN,
+                body,
+            );
+            assert_eq!(expected, error.message, "Body: {body}");
+        }
+    }
+
+    #[test]
+    fn test_api_error_missing_permission() {
+        let body = r#"{"message":"Resource not accessible by integration"}"#;
+        let error = ApiError::new(
+            "POST",
+            "https://api.github.com/repos/owner/repo/check-runs",
+            reqwest::StatusCode::FORBIDDEN,
+            body,
+        );
+        assert!(error.is_missing_permission());
+        assert_eq!(
+            "Request POST 'https://api.github.com/repos/owner/repo/check-runs' failed with status: 403 Forbidden: Resource not accessible by integration. The app is missing the 'Checks' (read and write) permission, grant it in the settings of the app and accept the updated permissions for the installation",
+            error.to_string()
+        );
+
+        let error = ApiError::new(
+            "GET",
+            "https://api.github.com/repos/owner/repo/pulls/1",
+            reqwest::StatusCode::FORBIDDEN,
+            body,
+        );
+        assert!(error.is_missing_permission());
+        assert!(
+            error
+                .to_string()
+                .ends_with("The app is missing a required permission, grant it in the settings of the app and accept the updated permissions for the installation"),
+            "Should name no specific permission: {error}"
         );
+
+        for (status, body) in [
+            (
+                reqwest::StatusCode::FORBIDDEN,
+                r#"{"message":"API rate limit exceeded"}"#,
+            ),
+            (reqwest::StatusCode::NOT_FOUND, body),
+        ] {
+            let error = ApiError::new(
+                "POST",
+                "https://api.github.com/repos/owner/repo/check-runs",
+                status,
+                body,
+            );
+            assert!(!error.is_missing_permission(), "Body: {body}");
+            assert!(!error.to_string().contains("missing"), "Error: {error}");
+        }
     }
 
     #[test]
     fn test_error_display_invalid_config() {
-        let error = Error::InvalidConfig("missing required field");
+        let error = Error::InvalidConfig(vec![ConfigError::MissingClientId]);
         let display_string = format!("{}", error);
         assert_eq!(
             display_string,
-            "Invalid configuration: missing required field"
+            "Invalid configuration: GitHub Client ID must be set in the configuration"
+        );
+
+        let error = Error::InvalidConfig(vec![
+            ConfigError::InvalidLogLevel,
+            ConfigError::IncompleteSSL,
+        ]);
+        assert_eq!(
+            format!("{error}"),
+            "Invalid configuration: Log level must be one of 'error', 'warn', 'info' or 'debug'; Incomplete SSL configuration: cert and key must be set if SSL is enabled"
+        );
+    }
+
+    #[test]
+    fn test_config_errors() {
+        let error = Error::InvalidConfig(vec![ConfigError::InvalidPort]);
+        assert_eq!(&[ConfigError::InvalidPort], error.config_errors());
+        assert_eq!("invalid-port", error.config_errors()[0].code());
+        assert_eq!(
+            "Port must be between 1 and 65535",
+            error.config_errors()[0].to_string()
+        );
+
+        let error = Error::InvalidBearerToken();
+        assert!(
+            error.config_errors().is_empty(),
+            "Other errors should not have config errors"
         );
     }
 
@@ -142,6 +662,43 @@ mod tests {
         assert!(display_string.contains("address already in use"));
     }
 
+    #[test]
+    fn test_error_is_retryable() {
+        let url = "https://api.github.com".to_string();
+        for (status, retryable) in [
+            (reqwest::StatusCode::BAD_GATEWAY, true),
+            (reqwest::StatusCode::SERVICE_UNAVAILABLE, true),
+            (reqwest::StatusCode::INTERNAL_SERVER_ERROR, true),
+            (reqwest::StatusCode::NOT_FOUND, false),
+            (reqwest::StatusCode::UNPROCESSABLE_ENTITY, false),
+            (reqwest::StatusCode::FORBIDDEN, false),
+        ] {
+            let error = Error::Api(ApiError::new("GET", &url, status, ""));
+            assert_eq!(
+                retryable,
+                error.is_retryable(&reqwest::Method::GET),
+                "Status {status}"
+            );
+            assert_eq!(
+                retryable,
+                error.is_retryable(&reqwest::Method::PATCH),
+                "Status {status}"
+            );
+            assert!(
+                !error.is_retryable(&reqwest::Method::POST),
+                "Should not retry POST with status {status}"
+            );
+        }
+        for method in [
+            reqwest::Method::GET,
+            reqwest::Method::PATCH,
+            reqwest::Method::POST,
+        ] {
+            assert!(Error::RateLimited(url.clone(), None).is_retryable(&method));
+            assert!(!Error::InvalidBearerToken().is_retryable(&method));
+        }
+    }
+
     #[test]
     fn test_error_is_error_trait() {
         let error = Error::InvalidBearerToken();
@@ -1,12 +1,25 @@
 #![doc = include_str!(concat!(env!("CARGO_MANIFEST_DIR"), "/README.md"))]
-use clap::{Args, Parser, Subcommand};
-use tracing::Level;
+use clap::{Args, Parser, Subcommand, ValueEnum};
+use std::sync::atomic::{AtomicU64, Ordering};
+use tracing::{Event, Level, Metadata, info};
+use tracing_subscriber::{
+    Layer, Registry,
+    filter::LevelFilter,
+    fmt::MakeWriter,
+    layer::{Context, Filter, SubscriberExt},
+    reload,
+    util::SubscriberInitExt,
+};
 
 mod api;
 mod client;
 mod config;
+mod doctor;
 mod error;
+mod metrics;
 mod server;
+mod store;
+mod telemetry;
 #[cfg(test)]
 mod test;
 #[cfg(any(test, feature = "e2e"))]
@@ -30,37 +43,91 @@ pub struct App {
 impl App {
     /// Run the application based on the provided command and options.
     pub async fn run(self) -> Result<(), error::Error> {
-        if let Command::Version = self.command {
-            version::print_version_and_exit();
+        if let Command::Version { output } = self.command {
+            version::print_version_and_exit(output);
         }
 
-        let config = config::Configuration::load(&self.global_opts.config)?;
+        let mut config =
+            config::Configuration::load(&self.global_opts.config, self.global_opts.env)?;
 
-        let log_level = match self.global_opts.log {
-            Some(level) => level,
-            None => config.log_level,
+        if let Command::Config {
+            command: ConfigCommand::Validate,
+        } = self.command
+        {
+            println!("config OK");
+            return Ok(());
+        }
+
+        // A log level given on the command line is kept when reloading the configuration
+        let reload_log_level = self.global_opts.log.is_none();
+        if let Some(level) = self.global_opts.log {
+            config.log_level = level;
+        }
+
+        if let Command::Config {
+            command: ConfigCommand::Show,
+        } = self.command
+        {
+            print!("{}", config.to_redacted_yaml()?);
+            return Ok(());
+        }
+        let tracer_provider = match config.otlp_endpoint.as_str() {
+            "" => None,
+            endpoint => Some(telemetry::new_tracer_provider(endpoint)?),
         };
-        set_log_level(&log_level);
+        let log_level = init_logger(
+            &config.log_level,
+            config.log_format,
+            config.log_sampling,
+            tracer_provider.as_ref(),
+        );
+        let _tracer_provider = tracer_provider.map(telemetry::ShutdownOnDrop);
+        info!("Loaded configuration: {}", config.summary());
+
+        // The doctor reports problems with the private key itself, so it needs to build the client.
+        if let Command::Doctor = self.command {
+            return doctor::run(config.github, &mut std::io::stdout()).await;
+        }
 
         let client = client::Client::build(config.github)?;
 
         match self.command {
-            Command::Server => {
-                let server = server::Server::new(config.server);
+            Command::Server { listen } => {
+                if let Some(listen) = listen {
+                    config.server.bind_address = listen.to_string();
+                }
+                let mut server = server::Server::new(config.server);
+                for app in config.additional_apps {
+                    let github = client::Client::build_sharing(app.github, &client)?;
+                    info!("Serving additional app '{}'", github.client_id());
+                    server.add_app(app.webhook_secret, github);
+                }
+                let path = self.global_opts.config;
+                let expand_env = self.global_opts.env;
+                server.reload_on_sighup(move || {
+                    let config = config::Configuration::load(&path, expand_env)?;
+                    if reload_log_level {
+                        set_log_level(&log_level, &config.log_level);
+                    }
+                    Ok(config)
+                });
                 server.run(client).await?;
             }
             Command::Create { cli_opts } => {
-                return client
+                let check_run = client
                     .create_check_run(
                         cli_opts.app_installation_id,
                         &cli_opts.repo,
                         &cli_opts.commit,
                     )
-                    .await;
+                    .await?;
+                println!("Created check-run '{}'", check_run.id);
             }
             Command::Refresh { cli_opts } => {
-                let (uncompleted, own_run) = get_and_print_status(&cli_opts, &client).await?;
-                if uncompleted == 0 {
+                let (status, own_run) = get_and_print_status(&cli_opts, &client).await?;
+                if status.failed > 0 {
+                    println!("Some check runs have failed, setting check-run to 'failure'");
+                } else if status.pending == 0 {
                     println!("All check runs are completed, setting check-run to 'completed'");
                 }
                 if own_run.is_none() {
@@ -71,7 +138,7 @@ impl App {
                         cli_opts.app_installation_id,
                         &cli_opts.repo,
                         &cli_opts.commit,
-                        uncompleted,
+                        &status,
                         own_run,
                     )
                     .await?;
@@ -80,8 +147,14 @@ impl App {
             Command::Status { cli_opts } => {
                 get_and_print_status(&cli_opts, &client).await?;
             }
-            Command::Version => {
-                version::print_version_and_exit();
+            Command::Version { output } => {
+                version::print_version_and_exit(output);
+            }
+            Command::Config { .. } => {
+                println!("config OK");
+            }
+            Command::Doctor => {
+                unreachable!("Doctor is run before the client is built");
             }
         }
         Ok(())
@@ -92,7 +165,11 @@ impl App {
 #[derive(Debug, Subcommand)]
 pub enum Command {
     /// Run the bot and listen for webhook events on /webhook
-    Server,
+    Server {
+        /// IP address of the interface to listen on, overrides the bind-address given in the config file
+        #[clap(long)]
+        listen: Option<std::net::IpAddr>,
+    },
     /// Create a new pending status check for a commit
     Create {
         #[clap(flatten)]
@@ -108,8 +185,40 @@ pub enum Command {
         #[clap(flatten)]
         cli_opts: CLIOptions,
     },
+    /// Check the credentials and connectivity of the GitHub App.
+    /// Prints a pass/fail summary and exits with a non-zero code if any check failed.
+    Doctor,
     /// Print the version and exit
-    Version,
+    Version {
+        /// Output format, "json" prints the build information as a JSON object
+        #[clap(long, short, value_enum, default_value_t = VersionOutput::Text)]
+        output: VersionOutput,
+    },
+    /// Work with the config file
+    Config {
+        #[clap(subcommand)]
+        command: ConfigCommand,
+    },
+}
+
+/// Output formats of the `version` command.
+#[derive(Debug, Clone, Copy, ValueEnum)]
+pub enum VersionOutput {
+    /// Human readable text
+    Text,
+    /// JSON object with the name, version, commit and rust version
+    Json,
+}
+
+/// Subcommands for working with the config file.
+#[derive(Debug, Subcommand)]
+pub enum ConfigCommand {
+    /// Load and validate the config file without starting the server.
+    /// Prints all problems and exits with a non-zero code if the config is invalid.
+    Validate,
+    /// Print the effective configuration as YAML without starting the server.
+    /// Includes all defaults and overrides, secrets are redacted.
+    Show,
 }
 
 // TODO: Consider testing the env option of clap
@@ -120,9 +229,14 @@ pub struct GlobalOpts {
     #[clap(long, global = true)]
     pub log: Option<String>,
 
-    /// Path to the config file
+    /// Path to the config file or a directory of config fragments
     #[clap(long, short, global = true, default_value = "/config/config.yaml")]
     pub config: String,
+
+    /// Expand "${VAR}" placeholders in the config file with environment variables.
+    /// Use "$$" for a literal "$"
+    #[clap(long, global = true)]
+    pub env: bool,
 }
 
 /// Addtional cli options used by the local client commands like `create`, `refresh`, and `status`.
@@ -139,7 +253,104 @@ pub struct CLIOptions {
     pub commit: String,
 }
 
-fn set_log_level(level: &str) {
+/// Initialize the global logger with the given level and format, writing to stdout.
+/// With a tracer provider, the spans are exported to OpenTelemetry as well.
+fn init_logger(
+    level: &str,
+    format: config::LogFormat,
+    sampling: u64,
+    tracer_provider: Option<&opentelemetry_sdk::trace::SdkTracerProvider>,
+) -> LogLevelHandle {
+    let (logger, handle) = new_logger(level, format, sampling, tracer_provider, std::io::stdout);
+    #[cfg(not(test))]
+    logger.init();
+
+    // We can only init the logger once, but testing might call the parent function multiple times.
+    #[cfg(test)]
+    logger.try_init().unwrap_or_default();
+
+    handle
+}
+
+/// Handle for changing the level of a logger at runtime
+type LogLevelHandle = reload::Handle<LevelFilter, Registry>;
+
+/// Create a new logger with the given level and format, only writing 1 in sampling of the high-volume info logs.
+/// Spans are only exported when a tracer provider is given, otherwise there is no OpenTelemetry layer at all.
+/// Returns the logger together with a handle for changing its level.
+fn new_logger<W>(
+    level: &str,
+    format: config::LogFormat,
+    sampling: u64,
+    tracer_provider: Option<&opentelemetry_sdk::trace::SdkTracerProvider>,
+    writer: W,
+) -> (Box<dyn tracing::Subscriber + Send + Sync>, LogLevelHandle)
+where
+    W: for<'a> MakeWriter<'a> + Send + Sync + 'static,
+{
+    let (filter, handle) = reload::Layer::new(parse_log_level(level));
+    let registry = tracing_subscriber::registry()
+        .with(filter)
+        .with(tracer_provider.map(telemetry::layer));
+    let layer = tracing_subscriber::fmt::layer()
+        .with_ansi(false)
+        .with_writer(writer);
+    let sampling = SamplingFilter::new(sampling);
+    let logger: Box<dyn tracing::Subscriber + Send + Sync> = match format {
+        config::LogFormat::Text => Box::new(registry.with(layer.with_filter(sampling))),
+        config::LogFormat::Json => Box::new(registry.with(layer.json().with_filter(sampling))),
+    };
+    (logger, handle)
+}
+
+/// Targets of the high-volume info logs, e.g. the log of every request to the GitHub API or webhook delivery
+const SAMPLED_TARGETS: [&str; 2] = ["cerberus_mergeguard::api", server::EVENT_LOG_TARGET];
+
+/// Filter only passing 1 in rate of the info logs of the high-volume targets.
+/// Warnings, errors and the logs of all other targets, like the audit log, are never sampled.
+struct SamplingFilter {
+    rate: u64,
+    count: AtomicU64,
+}
+
+impl SamplingFilter {
+    /// Create a new filter, a rate of 0 or 1 passes all logs
+    fn new(rate: u64) -> Self {
+        Self {
+            rate,
+            count: AtomicU64::new(0),
+        }
+    }
+
+    fn is_sampled(metadata: &Metadata<'_>) -> bool {
+        *metadata.level() == Level::INFO
+            && SAMPLED_TARGETS
+                .iter()
+                .any(|target| metadata.target().starts_with(target))
+    }
+}
+
+impl<S> Filter<S> for SamplingFilter {
+    fn enabled(&self, _: &Metadata<'_>, _: &Context<'_, S>) -> bool {
+        true
+    }
+
+    fn event_enabled(&self, event: &Event<'_>, _: &Context<'_, S>) -> bool {
+        if self.rate <= 1 || !Self::is_sampled(event.metadata()) {
+            return true;
+        }
+        self.count.fetch_add(1, Ordering::Relaxed) % self.rate == 0
+    }
+}
+
+/// Change the level of the logger, e.g. after reloading the configuration.
+fn set_log_level(handle: &LogLevelHandle, level: &str) {
+    if let Err(e) = handle.reload(parse_log_level(level)) {
+        eprintln!("Failed to change the log level to '{level}': {e}");
+    }
+}
+
+fn parse_log_level(level: &str) -> LevelFilter {
     let level = match level.to_lowercase().as_str() {
         "error" => Level::ERROR,
         "warn" => Level::WARN,
@@ -150,41 +361,33 @@ fn set_log_level(level: &str) {
             Level::INFO
         }
     };
-    let logger = tracing_subscriber::fmt()
-        .with_max_level(level)
-        .with_ansi(false);
-    #[cfg(not(test))]
-    logger.init();
-
-    // We can only init the logger once, but testing might call the parent function multiple times.
-    #[cfg(test)]
-    logger.try_init().unwrap_or_default();
+    LevelFilter::from_level(level)
 }
 
 async fn get_and_print_status(
     cli_opts: &CLIOptions,
     client: &client::Client,
-) -> Result<(u32, Option<types::CheckRun>), error::Error> {
-    let (count, own_run) = client
+) -> Result<(types::CheckRunsStatus, Option<types::CheckRun>), error::Error> {
+    let (status, own_run) = client
         .get_check_run_status(
             cli_opts.app_installation_id,
             &cli_opts.repo,
             &cli_opts.commit,
         )
         .await?;
-    println!("Waiting on '{count}' check runs to complete");
+    println!("Waiting on '{}' check runs to complete", status.pending);
+    if status.failed > 0 {
+        println!("'{}' check runs have failed", status.failed);
+    }
     if let Some(own_run) = own_run.clone() {
         println!(
             "Found {} check-run, status: '{}', conclusion: '{}'",
-            types::CHECK_RUN_NAME,
+            client.check_name(),
             own_run.status,
             own_run.conclusion.unwrap_or("null".to_string())
         );
     } else {
-        println!(
-            "No {} check-run found for this commit",
-            types::CHECK_RUN_NAME
-        );
+        println!("No {} check-run found for this commit", client.check_name());
     };
-    Ok((count, own_run))
+    Ok((status, own_run))
 }
@@ -0,0 +1,237 @@
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::sync::Mutex;
+use std::time::Duration;
+
+#[cfg(test)]
+mod test;
+
+/// Content type of the prometheus text exposition format
+pub const CONTENT_TYPE: &str = "text/plain; version=0.0.4; charset=utf-8";
+
+/// Upper bounds of the buckets for the GitHub API latency histogram in seconds
+const API_LATENCY_BUCKETS: &[f64] = &[0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0];
+
+/// Registry for all metrics exported by the server.
+/// A new registry is created for every client, so there is no global state.
+pub struct Metrics {
+    webhook_events: CounterVec,
+    signature_failures: CounterVec,
+    check_runs: CounterVec,
+    api_requests: CounterVec,
+    api_request_duration: HistogramVec,
+}
+
+impl Metrics {
+    /// Create a new empty registry
+    pub fn new() -> Self {
+        Self {
+            webhook_events: CounterVec::new(
+                "cerberus_webhook_events_total",
+                "Number of webhook events received, by event type and response status",
+                &["event", "status"],
+            ),
+            signature_failures: CounterVec::new(
+                "cerberus_webhook_signature_failures_total",
+                "Number of webhook deliveries rejected because their signature was missing or invalid",
+                &["reason"],
+            ),
+            check_runs: CounterVec::new(
+                "cerberus_check_runs_total",
+                "Number of check runs created, updated or re-requested",
+                &["action"],
+            ),
+            api_requests: CounterVec::new(
+                "cerberus_github_api_requests_total",
+                "Number of requests to the GitHub API, by endpoint and response status",
+                &["endpoint", "status"],
+            ),
+            api_request_duration: HistogramVec::new(
+                "cerberus_github_api_request_duration_seconds",
+                "Latency of requests to the GitHub API, by endpoint",
+                &["endpoint"],
+                API_LATENCY_BUCKETS,
+            ),
+        }
+    }
+
+    /// Record a handled webhook event.
+    /// Unknown event types are grouped together to keep the number of series bounded.
+    pub fn observe_webhook_event(&self, event: &str, status: u16) {
+        let event = match event {
+            "check_run"
+            | "pull_request"
+            | "issue_comment"
+            | "check_suite"
+            | "ping"
+            | "installation"
+            | "installation_repositories" => event,
+            _ => "other",
+        };
+        self.webhook_events.inc(&[event, &status.to_string()]);
+    }
+
+    /// Record a webhook delivery with a missing or invalid signature
+    pub fn observe_signature_failure(&self, reason: &str) {
+        self.signature_failures.inc(&[reason]);
+    }
+
+    /// Record a created, updated or re-requested check run
+    pub fn observe_check_run(&self, action: &str) {
+        self.check_runs.inc(&[action]);
+    }
+
+    /// Record a request to the GitHub API.
+    /// The status is either the http status code or "error" if no response was received.
+    pub fn observe_api_request(&self, endpoint: &str, status: &str, duration: Duration) {
+        self.api_requests.inc(&[endpoint, status]);
+        self.api_request_duration
+            .observe(&[endpoint], duration.as_secs_f64());
+    }
+
+    /// Render all metrics in the prometheus text exposition format
+    pub fn render(&self) -> String {
+        let mut output = String::new();
+        self.webhook_events.render(&mut output);
+        self.signature_failures.render(&mut output);
+        self.check_runs.render(&mut output);
+        self.api_requests.render(&mut output);
+        self.api_request_duration.render(&mut output);
+        output
+    }
+}
+
+impl Default for Metrics {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+/// Counter partitioned by a set of labels
+struct CounterVec {
+    name: &'static str,
+    help: &'static str,
+    labels: &'static [&'static str],
+    values: Mutex<BTreeMap<Vec<String>, u64>>,
+}
+
+impl CounterVec {
+    fn new(name: &'static str, help: &'static str, labels: &'static [&'static str]) -> Self {
+        Self {
+            name,
+            help,
+            labels,
+            values: Mutex::new(BTreeMap::new()),
+        }
+    }
+
+    fn inc(&self, label_values: &[&str]) {
+        let key = label_values.iter().map(|v| v.to_string()).collect();
+        let mut values = self.values.lock().unwrap_or_else(|e| e.into_inner());
+        *values.entry(key).or_default() += 1;
+    }
+
+    fn render(&self, output: &mut String) {
+        write_header(output, self.name, self.help, "counter");
+        let values = self.values.lock().unwrap_or_else(|e| e.into_inner());
+        for (label_values, value) in values.iter() {
+            let labels = format_labels(self.labels, label_values, None);
+            let _ = writeln!(output, "{}{labels} {value}", self.name);
+        }
+    }
+}
+
+/// Histogram partitioned by a set of labels
+struct HistogramVec {
+    name: &'static str,
+    help: &'static str,
+    labels: &'static [&'static str],
+    buckets: &'static [f64],
+    values: Mutex<BTreeMap<Vec<String>, HistogramValue>>,
+}
+
+#[derive(Default)]
+struct HistogramValue {
+    /// Number of observations per bucket, not cumulative
+    buckets: Vec<u64>,
+    sum: f64,
+    count: u64,
+}
+
+impl HistogramVec {
+    fn new(
+        name: &'static str,
+        help: &'static str,
+        labels: &'static [&'static str],
+        buckets: &'static [f64],
+    ) -> Self {
+        Self {
+            name,
+            help,
+            labels,
+            buckets,
+            values: Mutex::new(BTreeMap::new()),
+        }
+    }
+
+    fn observe(&self, label_values: &[&str], value: f64) {
+        let key = label_values.iter().map(|v| v.to_string()).collect();
+        let mut values = self.values.lock().unwrap_or_else(|e| e.into_inner());
+        let histogram = values.entry(key).or_insert_with(|| HistogramValue {
+            buckets: vec![0; self.buckets.len()],
+            ..Default::default()
+        });
+        if let Some(i) = self.buckets.iter().position(|bound| value <= *bound) {
+            histogram.buckets[i] += 1;
+        }
+        histogram.sum += value;
+        histogram.count += 1;
+    }
+
+    fn render(&self, output: &mut String) {
+        write_header(output, self.name, self.help, "histogram");
+        let values = self.values.lock().unwrap_or_else(|e| e.into_inner());
+        for (label_values, histogram) in values.iter() {
+            let mut cumulative = 0;
+            for (bound, count) in self.buckets.iter().zip(&histogram.buckets) {
+                cumulative += count;
+                let labels = format_labels(self.labels, label_values, Some(&bound.to_string()));
+                let _ = writeln!(output, "{}_bucket{labels} {cumulative}", self.name);
+            }
+            let labels = format_labels(self.labels, label_values, Some("+Inf"));
+            let _ = writeln!(output, "{}_bucket{labels} {}", self.name, histogram.count);
+
+            let labels = format_labels(self.labels, label_values, None);
+            let _ = writeln!(output, "{}_sum{labels} {}", self.name, histogram.sum);
+            let _ = writeln!(output, "{}_count{labels} {}", self.name, histogram.count);
+        }
+    }
+}
+
+fn write_header(output: &mut String, name: &str, help: &str, metric_type: &str) {
+    let _ = writeln!(output, "# HELP {name} {help}");
+    let _ = writeln!(output, "# TYPE {name} {metric_type}");
+}
+
+/// Format the labels as '{name="value",...}', optionally with the "le" label of histogram buckets.
+fn format_labels(names: &[&str], values: &[String], le: Option<&str>) -> String {
+    let mut labels: Vec<String> = names
+        .iter()
+        .zip(values)
+        .map(|(name, value)| format!("{name}=\"{}\"", escape_label_value(value)))
+        .collect();
+    if let Some(le) = le {
+        labels.push(format!("le=\"{le}\""));
+    }
+    if labels.is_empty() {
+        return String::new();
+    }
+    format!("{{{}}}", labels.join(","))
+}
+
+fn escape_label_value(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
@@ -0,0 +1,83 @@
+use super::*;
+
+#[test]
+fn render_empty_registry() {
+    let metrics = Metrics::new();
+    let output = metrics.render();
+
+    assert!(output.contains("# TYPE cerberus_webhook_events_total counter"));
+    assert!(output.contains("# TYPE cerberus_webhook_signature_failures_total counter"));
+    assert!(output.contains("# TYPE cerberus_check_runs_total counter"));
+    assert!(output.contains("# TYPE cerberus_github_api_requests_total counter"));
+    assert!(output.contains("# TYPE cerberus_github_api_request_duration_seconds histogram"));
+    assert!(
+        !output.lines().any(|line| !line.starts_with('#')),
+        "Should not contain any samples, got:\n{output}"
+    );
+}
+
+#[test]
+fn webhook_events_by_type_and_status() {
+    let metrics = Metrics::new();
+    metrics.observe_webhook_event("pull_request", 200);
+    metrics.observe_webhook_event("pull_request", 200);
+    metrics.observe_webhook_event("check_run", 403);
+    metrics.observe_webhook_event("made-up-event", 501);
+    metrics.observe_webhook_event("another-made-up-event", 501);
+
+    let output = metrics.render();
+    assert!(
+        output.contains(r#"cerberus_webhook_events_total{event="pull_request",status="200"} 2"#)
+    );
+    assert!(output.contains(r#"cerberus_webhook_events_total{event="check_run",status="403"} 1"#));
+    assert!(
+        output.contains(r#"cerberus_webhook_events_total{event="other",status="501"} 2"#),
+        "Unknown events should be grouped, got:\n{output}"
+    );
+}
+
+#[test]
+fn api_requests_with_latency() {
+    let metrics = Metrics::new();
+    metrics.observe_api_request("get_check_runs", "200", Duration::from_millis(80));
+    metrics.observe_api_request("get_check_runs", "200", Duration::from_millis(700));
+    metrics.observe_api_request("get_check_runs", "error", Duration::from_secs(60));
+    metrics.observe_check_run("created");
+
+    let output = metrics.render();
+    assert!(output.contains(
+        r#"cerberus_github_api_requests_total{endpoint="get_check_runs",status="200"} 2"#
+    ));
+    assert!(output.contains(
+        r#"cerberus_github_api_requests_total{endpoint="get_check_runs",status="error"} 1"#
+    ));
+    assert!(output.contains(r#"cerberus_check_runs_total{action="created"} 1"#));
+
+    let histogram = "cerberus_github_api_request_duration_seconds";
+    assert!(output.contains(&format!(
+        r#"{histogram}_bucket{{endpoint="get_check_runs",le="0.05"}} 0"#
+    )));
+    assert!(output.contains(&format!(
+        r#"{histogram}_bucket{{endpoint="get_check_runs",le="0.1"}} 1"#
+    )));
+    assert!(
+        output.contains(&format!(
+            r#"{histogram}_bucket{{endpoint="get_check_runs",le="1"}} 2"#
+        )),
+        "Buckets should be cumulative, got:\n{output}"
+    );
+    assert!(output.contains(&format!(
+        r#"{histogram}_bucket{{endpoint="get_check_runs",le="30"}} 2"#
+    )));
+    assert!(output.contains(&format!(
+        r#"{histogram}_bucket{{endpoint="get_check_runs",le="+Inf"}} 3"#
+    )));
+    assert!(output.contains(&format!(
+        r#"{histogram}_count{{endpoint="get_check_runs"}} 3"#
+    )));
+}
+
+#[test]
+fn escape_label_values() {
+    assert_eq!(r#"a\"b\\c\nd"#, escape_label_value("a\"b\\c\nd"));
+}
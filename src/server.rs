@@ -1,22 +1,47 @@
 use crate::{
-    client::Client,
-    error::Error,
-    types::{CheckRunEvent, IssueCommentEvent, PullRequestEvent},
+    client::{Client, PendingGuard, glob::glob_match},
+    config::Configuration,
+    error::{ConfigError, Error},
+    metrics::{self, Metrics},
+    store::{self, MemoryStore, StateStore, redis::RedisStore},
+    types::{
+        CheckRunEvent, CheckSuiteEvent, InstallationEvent, InstallationRepositoriesEvent,
+        IssueCommentEvent, MergeGroupEvent, PingEvent, PullRequestEvent, REPO_VISIBILITIES,
+        RateLimit, Repo,
+    },
+    version,
 };
 use axum::{
     Json, Router,
-    extract::State,
-    http::{HeaderMap, HeaderValue, StatusCode},
+    extract::{DefaultBodyLimit, Request, State},
+    http::{HeaderMap, StatusCode, header},
+    middleware,
+    response::IntoResponse,
     routing::{get, post},
 };
 use hmac::{Hmac, KeyInit, Mac};
 use serde::{Deserialize, Serialize};
-use std::net::SocketAddr;
-use std::sync::Arc;
-use tokio::{net::TcpListener, signal, sync::Mutex, time::Duration};
-use tower_http::trace::TraceLayer;
-use tracing::{debug, error, info, warn};
+use std::any::Any;
+use std::collections::HashSet;
+use std::future::Future;
+use std::net::{IpAddr, Ipv6Addr, SocketAddr};
+use std::pin::Pin;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Once};
+use std::time::{SystemTime, UNIX_EPOCH};
+use tokio::{
+    net::TcpListener,
+    signal,
+    sync::{Mutex, mpsc, watch},
+    time::{Duration, Instant},
+};
+use tower_http::{
+    catch_panic::CatchPanicLayer, timeout::RequestBodyTimeoutLayer, trace::TraceLayer,
+};
+use tracing::{Instrument, Span, debug, debug_span, error, info, info_span, warn};
 
+mod conn;
+mod form;
 mod hex;
 #[cfg(test)]
 mod test;
@@ -26,39 +51,394 @@ pub const SERVER_STATUS_OK: &str = "ok";
 pub const SERVER_STATUS_ERROR: &str = "error";
 pub const SERVER_MESSAGE_OK: &str = "Server is running fine";
 
+/// Target of the info logs of every webhook delivery, sampled like the logs of the GitHub API requests
+pub const EVENT_LOG_TARGET: &str = "cerberus_mergeguard::server::events";
+/// Interval in which a blocked job is retried when the job queue is full
+const JOB_QUEUE_RETRY_INTERVAL: Duration = Duration::from_millis(100);
+/// Key of the jobs spilled to the store when the job queue is full
+const SPILLED_JOBS_KEY: &str = "spilled-jobs";
+/// Key of the webhook tasks spilled to the store when the worker queue is full
+const SPILLED_TASKS_KEY: &str = "spilled-tasks";
+/// Spilled jobs and tasks are dropped if they have not been picked up for this long, e.g. because all replicas are gone
+const SPILLED_TTL: Duration = Duration::from_secs(24 * 60 * 60);
+/// Interval in which spilled webhook tasks are moved back into the worker queue
+const SPILLED_TASKS_INTERVAL: Duration = Duration::from_secs(1);
+/// Duration for which a successful readiness check is cached
+const READINESS_CACHE_DURATION: Duration = Duration::from_secs(60);
+/// Duration for which a failed readiness check is cached, shorter to recover quickly
+const READINESS_FAILURE_CACHE_DURATION: Duration = Duration::from_secs(10);
+/// Time after a check_run event, in which a completed check suite of the same commit is not processed again
+const CHECK_SUITE_DUPLICATE_WINDOW: Duration = Duration::from_secs(10);
+/// Tokens expiring within this margin after the next pre-warm run are refreshed already.
+/// Larger than the margin in which the client stops using cached tokens.
+const TOKEN_PREWARM_MARGIN: Duration = Duration::from_secs(60);
+/// Initial delay before retrying a failed pre-warm run, doubled on every failure
+const TOKEN_PREWARM_MIN_BACKOFF: Duration = Duration::from_secs(5);
+/// Installation tokens expire after 1 hour, so they need to be refreshed at least every 30 minutes
+const MAX_TOKEN_PREWARM_INTERVAL: u64 = 30 * 60;
+
 /// Options for the http server
 #[derive(Serialize, Deserialize, Debug)]
 #[serde(default, rename_all = "kebab-case")]
 pub struct ServerOptions {
     /// Port to bind to, defaults to 8080
-    #[serde(default = "default_port")]
+    #[serde(default = "default_port", deserialize_with = "deserialize_port")]
     pub port: u16,
 
+    /// IP address of the interface to bind to, e.g. "127.0.0.1" when running behind a sidecar.
+    /// Empty to bind to all interfaces.
+    pub bind_address: String,
+
     /// Optional ssl configuration for the server
     pub ssl: SSLOptions,
 
     /// Shared webhook secret for verifying the webhook sender
     pub webhook_secret: Option<String>,
 
+    /// Secrets that are still accepted in addition to the webhook secret, allowing to rotate it without downtime.
+    /// Keep the old secret here until the webhook configuration on GitHub has been updated.
+    pub previous_webhook_secrets: Vec<String>,
+
+    /// Refuse to start without a webhook secret of at least 16 bytes.
+    /// Disabled by default, as webhooks without a secret are accepted unverified.
+    pub require_webhook_secret: bool,
+
+    /// Path on which the webhook events are received, defaults to "/webhook"
+    #[serde(default = "default_webhook_path")]
+    pub webhook_path: String,
+
     /// Refresh check runs periodically instead of on every webhook event
     /// This is useful for reducing the number of API calls to GitHub.
     /// When set to zero, periodic refresh is disabled.
     /// Unit is in seconds.
     #[serde(default = "Default::default")]
     pub periodic_refresh: u64,
+
+    /// Ignore events for repositories owned by a personal account instead of an organization.
+    /// Useful when the app is installed on both, but should only guard organization repositories.
+    pub ignore_user_repos: bool,
+
+    /// Glob patterns for the full names of the repositories the bot acts on, e.g. "my-org/*".
+    /// Events for other repositories are acknowledged but ignored.
+    /// Takes precedence over the denylist, which is not used when the allowlist is set.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub repo_allowlist: Vec<String>,
+
+    /// Glob patterns for the full names of the repositories the bot ignores, e.g. "my-org/sandbox-*".
+    /// Events for these repositories are acknowledged but ignored.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub repo_denylist: Vec<String>,
+
+    /// Visibilities of the repositories the bot acts on: public, private or internal.
+    /// Events for repositories with other visibilities are acknowledged but ignored.
+    /// When empty, repositories of all visibilities are guarded.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub repo_visibilities: Vec<String>,
+
+    /// Fail the check run when other checks are still pending this long after it has been created.
+    /// Prevents blocking the merge forever without any signal, e.g. when a CI runner died.
+    /// When set to zero, there is no timeout.
+    /// Unit is in seconds.
+    pub check_timeout: u64,
+
+    /// Refresh the check run this long after it has been created, in addition to the refreshes on check_run events.
+    /// Catches checks that have been registered shortly after the pull request was updated, which are missed otherwise
+    /// when their events arrived before the check run was created.
+    /// When set to zero, there is no delayed evaluation.
+    /// Unit is in seconds.
+    pub initial_evaluation_delay: u64,
+
+    /// Create check runs for draft pull requests as well.
+    /// By default, the check run is only created once the pull request is ready for review.
+    pub guard_drafts: bool,
+
+    /// Maximum number of jobs in the periodic refresh queue.
+    /// When set to zero, the queue is unbounded.
+    pub job_queue_size: usize,
+
+    /// What to do with new events when the job queue or the worker queue is full.
+    pub job_queue_full_strategy: QueueFullStrategy,
+
+    /// Time to wait for free space in the job queue or worker queue when using "block-with-timeout".
+    /// Unit is in seconds.
+    #[serde(default = "default_job_queue_block_timeout")]
+    pub job_queue_block_timeout: u64,
+
+    /// Maximum time for handling a webhook event, including all requests to GitHub.
+    /// Pending requests are cancelled when the timeout is reached.
+    /// When set to zero, there is no timeout.
+    /// Unit is in seconds.
+    #[serde(default = "default_webhook_timeout")]
+    pub webhook_timeout: u64,
+
+    /// Time to wait for in-flight requests to complete after receiving a shutdown signal.
+    /// When set to zero, the server waits until all requests are completed.
+    /// Unit is in seconds.
+    #[serde(default = "default_shutdown_grace_period")]
+    pub shutdown_grace_period: u64,
+
+    /// Maximum time to receive the headers of a request, protects against clients holding connections open by sending them slowly.
+    /// HTTP/1 keep-alive connections are closed as well, when they do not send a new request within this time.
+    /// Unit is in seconds.
+    #[serde(default = "default_header_read_timeout")]
+    pub header_read_timeout: u64,
+
+    /// Maximum time between two chunks of a webhook request body, slower requests are rejected.
+    /// When set to zero, there is no timeout.
+    /// Unit is in seconds.
+    #[serde(default = "default_read_timeout")]
+    pub read_timeout: u64,
+
+    /// Maximum time for writing a chunk of the response, e.g. when a load balancer stops reading it.
+    /// When set to zero, there is no timeout.
+    /// Unit is in seconds.
+    #[serde(default = "default_write_timeout")]
+    pub write_timeout: u64,
+
+    /// Close connections that have not received any data for this long.
+    /// Waiting for the response counts as idle as well, so it should be longer than the webhook timeout.
+    /// When set to zero, there is no timeout.
+    /// Unit is in seconds.
+    #[serde(default = "default_idle_timeout")]
+    pub idle_timeout: u64,
+
+    /// Maximum size of a webhook request body, larger requests are rejected with 413.
+    /// The limit is enforced while reading the body, before verifying the signature.
+    /// Unit is in bytes.
+    #[serde(default = "default_max_body_size")]
+    pub max_body_size: usize,
+
+    /// Number of workers processing webhook events in the background.
+    /// Events are acknowledged with 202 as soon as they are queued, instead of after processing.
+    /// When set to zero, events are processed before responding.
+    pub workers: usize,
+
+    /// Maximum number of webhook events waiting for a worker.
+    /// A full queue is handled according to the job_queue_full_strategy.
+    #[serde(default = "default_worker_queue_size")]
+    pub worker_queue_size: usize,
+
+    /// URL of a redis server to keep state in, which needs to outlive a single delivery, e.g. redis://redis:6379/0.
+    /// Required when running multiple replicas, so they share the state.
+    /// When empty, the state is kept in memory.
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub redis_url: String,
+
+    /// Fetch installation tokens for all installations at startup and refresh them in this interval, before they expire.
+    /// Saves fetching a token when handling the first webhook event of an installation.
+    /// When set to zero, tokens are only fetched when needed.
+    /// Unit is in seconds.
+    pub token_prewarm_interval: u64,
+
+    /// Expose GET /debug/guards, listing the pending guards with their last known state as JSON,
+    /// and GET /debug/ratelimit, returning the rate limit status of all apps as JSON.
+    /// Meant for debugging, the endpoints are not authenticated.
+    pub debug_endpoints: bool,
+
+    /// Bearer token for POST /admin/reevaluate, which re-evaluates the guard of a commit or pull request on demand.
+    /// Useful after changing the configuration, to update open pull requests without waiting for a new event.
+    /// When empty, the endpoint is disabled.
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub admin_token: String,
 }
 
 fn default_port() -> u16 {
     8080
 }
 
+/// Deserialize the port with a clear error message for values outside of the valid range
+fn deserialize_port<'de, D>(deserializer: D) -> Result<u16, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    let port = i64::deserialize(deserializer)?;
+    match u16::try_from(port) {
+        Ok(port) if port > 0 => Ok(port),
+        _ => Err(serde::de::Error::custom(format!(
+            "{}, got {port}",
+            ConfigError::InvalidPort
+        ))),
+    }
+}
+
+fn default_webhook_path() -> String {
+    "/webhook".to_string()
+}
+
+/// Minimum length of the webhook secret in bytes, when a secret is required
+const MIN_WEBHOOK_SECRET_LENGTH: usize = 16;
+
+/// Paths used by the server for other endpoints, which can't be used for the webhook
+const RESERVED_PATHS: [&str; 7] = [
+    "/healthz",
+    "/readyz",
+    "/version",
+    "/metrics",
+    "/debug/guards",
+    "/debug/ratelimit",
+    ADMIN_REEVALUATE_PATH,
+];
+
+/// Path of the endpoint for re-evaluating a guard on demand
+const ADMIN_REEVALUATE_PATH: &str = "/admin/reevaluate";
+
+fn default_job_queue_block_timeout() -> u64 {
+    5
+}
+
+fn default_webhook_timeout() -> u64 {
+    10
+}
+
+/// Stay below the default termination grace period of kubernetes (30s)
+fn default_shutdown_grace_period() -> u64 {
+    25
+}
+
+fn default_header_read_timeout() -> u64 {
+    10
+}
+
+fn default_read_timeout() -> u64 {
+    10
+}
+
+fn default_write_timeout() -> u64 {
+    30
+}
+
+fn default_idle_timeout() -> u64 {
+    120
+}
+
+/// GitHub caps payloads at 25 MiB, but real events are far smaller
+fn default_max_body_size() -> usize {
+    5 * 1024 * 1024
+}
+
+fn default_worker_queue_size() -> usize {
+    100
+}
+
+/// Strategy for handling new jobs when the job queue or the worker queue is full
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq, Default)]
+pub enum QueueFullStrategy {
+    /// Reject the event with 503, GitHub will mark the delivery as failed so it can be redelivered.
+    #[default]
+    #[serde(rename = "reject-503")]
+    Reject,
+    /// Wait for free space in the queue until the timeout is reached, then reject the event with 503.
+    #[serde(rename = "block-with-timeout")]
+    BlockWithTimeout,
+    /// Keep the job or task in the state store and move it back into the queue once it has free space.
+    /// The event is only rejected with 503 when the store fails.
+    #[serde(rename = "spill-to-store")]
+    SpillToStore,
+}
+
 impl ServerOptions {
     /// Validate the server options
-    pub fn validate(&self) -> Result<(), &'static str> {
+    pub fn validate(&self) -> Result<(), Vec<ConfigError>> {
+        let mut errors = Vec::new();
         if self.port == 0 {
-            return Err("Port can't be 0");
+            errors.push(ConfigError::InvalidPort);
+        }
+        if !self.bind_address.is_empty() && self.bind_address.parse::<IpAddr>().is_err() {
+            errors.push(ConfigError::InvalidBindAddress);
+        }
+        if !self.webhook_path.starts_with('/') {
+            errors.push(ConfigError::InvalidWebhookPath);
+        } else if self.webhook_path.contains(['{', '}'])
+            || self.webhook_path.contains(char::is_whitespace)
+        {
+            errors.push(ConfigError::InvalidWebhookPathCharacters);
+        } else if RESERVED_PATHS.contains(&self.webhook_path.as_str()) {
+            errors.push(ConfigError::ReservedWebhookPath);
+        }
+        if self.require_webhook_secret {
+            match self.webhook_secret.as_deref() {
+                None | Some("") => errors.push(ConfigError::MissingWebhookSecret),
+                Some(secret) if secret.len() < MIN_WEBHOOK_SECRET_LENGTH => {
+                    errors.push(ConfigError::ShortWebhookSecret)
+                }
+                Some(_) => {}
+            }
+        }
+        if !self.previous_webhook_secrets.is_empty()
+            && (self
+                .webhook_secret
+                .as_deref()
+                .unwrap_or_default()
+                .is_empty()
+                || self.previous_webhook_secrets.iter().any(String::is_empty))
+        {
+            errors.push(ConfigError::InvalidPreviousWebhookSecrets);
+        }
+        if !self.admin_token.is_empty() && self.admin_token.len() < MIN_WEBHOOK_SECRET_LENGTH {
+            errors.push(ConfigError::ShortAdminToken);
+        }
+        if self
+            .repo_allowlist
+            .iter()
+            .chain(&self.repo_denylist)
+            .any(|pattern| pattern.trim().is_empty())
+        {
+            errors.push(ConfigError::EmptyRepoPattern);
+        }
+        if self
+            .repo_visibilities
+            .iter()
+            .any(|visibility| !REPO_VISIBILITIES.contains(&visibility.as_str()))
+        {
+            errors.push(ConfigError::UnknownRepoVisibility);
+        }
+        if self.max_body_size == 0 {
+            errors.push(ConfigError::InvalidMaxBodySize);
+        }
+        if self.header_read_timeout == 0 {
+            errors.push(ConfigError::InvalidHeaderReadTimeout);
+        }
+        if self.idle_timeout > 0 && self.idle_timeout <= self.webhook_timeout {
+            errors.push(ConfigError::InvalidIdleTimeout);
+        }
+        if !self.redis_url.is_empty() && !store::redis::validate_url(&self.redis_url) {
+            errors.push(ConfigError::InvalidRedisUrl);
+        }
+        if self.token_prewarm_interval > MAX_TOKEN_PREWARM_INTERVAL {
+            errors.push(ConfigError::InvalidTokenPrewarmInterval);
+        }
+        if self.workers > 0 && self.worker_queue_size == 0 {
+            errors.push(ConfigError::InvalidWorkerQueueSize);
+        }
+        if self.check_timeout > 0 && self.initial_evaluation_delay >= self.check_timeout {
+            errors.push(ConfigError::InvalidInitialEvaluationDelay);
+        }
+        if let Err(e) = self.ssl.validate() {
+            errors.push(e);
+        }
+        if !errors.is_empty() {
+            return Err(errors);
+        }
+        Ok(())
+    }
+
+    /// Address the server listens on, all interfaces unless a bind address is configured
+    fn socket_addr(&self) -> SocketAddr {
+        let ip = self
+            .bind_address
+            .parse()
+            .unwrap_or(IpAddr::V6(Ipv6Addr::UNSPECIFIED));
+        SocketAddr::new(ip, self.port)
+    }
+
+    /// Timeouts applied to the connections of the server, a value of zero disables the timeout
+    fn timeouts(&self) -> conn::Timeouts {
+        let timeout = |secs: u64| (secs > 0).then(|| Duration::from_secs(secs));
+        conn::Timeouts {
+            header_read: timeout(self.header_read_timeout),
+            idle: timeout(self.idle_timeout),
+            write: timeout(self.write_timeout),
         }
-        self.ssl.validate()
     }
 }
 
@@ -66,9 +446,36 @@ impl Default for ServerOptions {
     fn default() -> Self {
         Self {
             port: default_port(),
+            bind_address: String::new(),
             webhook_secret: std::env::var("CERBERUS_WEBHOOK_SECRET").ok(),
+            previous_webhook_secrets: Vec::new(),
+            require_webhook_secret: false,
+            webhook_path: default_webhook_path(),
             ssl: SSLOptions::default(),
             periodic_refresh: 0,
+            ignore_user_repos: false,
+            repo_allowlist: Vec::new(),
+            repo_denylist: Vec::new(),
+            repo_visibilities: Vec::new(),
+            guard_drafts: false,
+            check_timeout: 0,
+            initial_evaluation_delay: 0,
+            job_queue_size: 0,
+            job_queue_full_strategy: QueueFullStrategy::default(),
+            job_queue_block_timeout: default_job_queue_block_timeout(),
+            webhook_timeout: default_webhook_timeout(),
+            shutdown_grace_period: default_shutdown_grace_period(),
+            header_read_timeout: default_header_read_timeout(),
+            read_timeout: default_read_timeout(),
+            write_timeout: default_write_timeout(),
+            idle_timeout: default_idle_timeout(),
+            max_body_size: default_max_body_size(),
+            workers: 0,
+            worker_queue_size: default_worker_queue_size(),
+            redis_url: String::new(),
+            token_prewarm_interval: 0,
+            debug_endpoints: false,
+            admin_token: String::new(),
         }
     }
 }
@@ -83,24 +490,126 @@ pub struct SSLOptions {
     pub key: String,
     /// Path to the SSL certificate file
     pub cert: String,
+    /// Minimum TLS version accepted by the server, defaults to 1.2
+    #[serde(rename = "min-tls-version")]
+    pub min_tls_version: tls::TlsVersion,
+    /// Optional path to a PEM bundle of CAs, clients must present a certificate signed by one of them (mTLS).
+    /// Connections without a valid client certificate are rejected during the TLS handshake.
+    #[serde(rename = "client-ca", skip_serializing_if = "String::is_empty")]
+    pub client_ca: String,
 }
 
 impl SSLOptions {
     /// Validate the SSL options
-    pub fn validate(&self) -> Result<(), &'static str> {
+    pub fn validate(&self) -> Result<(), ConfigError> {
         if !self.enabled {
+            if !self.client_ca.is_empty() {
+                return Err(ConfigError::SSLClientCaWithoutSSL);
+            }
             return Ok(());
         }
         if self.key.is_empty() || self.cert.is_empty() {
-            return Err("Incomplete SSL configuration: cert and key must be set if SSL is enabled");
+            return Err(ConfigError::IncompleteSSL);
+        }
+        if !self.client_ca.is_empty() && !tls::validate_ca_file(&self.client_ca) {
+            return Err(ConfigError::InvalidSSLClientCa);
+        }
+        Ok(())
+    }
+}
+
+/// Work resulting from a webhook event, which needs requests to GitHub
+#[derive(Debug, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+enum WebhookTask {
+    /// Create a new pending check run for a commit, or refresh it if it already exists
+    CreateCheckRun {
+        app_installation_id: u64,
+        repo: String,
+        commit: String,
+    },
+    /// Refresh the check run of a commit
+    RefreshCheckRun {
+        app_installation_id: u64,
+        repo: String,
+        commit: String,
+    },
+    /// Refresh the check run of the head commit of a pull request
+    RefreshPullRequest {
+        app_installation_id: u64,
+        repo: String,
+        pull_request: u64,
+    },
+}
+
+/// Webhook task spilled to the store because the worker queue was full
+#[derive(Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+struct SpilledTask {
+    /// Client id of the app the task belongs to
+    client_id: String,
+    task: WebhookTask,
+}
+
+impl WebhookTask {
+    /// Run the task. On failure, returns the message for the webhook response together with the error.
+    async fn run(&self, github: &Client) -> Result<(), (&'static str, Error)> {
+        match self {
+            WebhookTask::CreateCheckRun {
+                app_installation_id,
+                repo,
+                commit,
+            } => {
+                let check_run = github
+                    .ensure_check_run(*app_installation_id, repo, commit)
+                    .await
+                    .map_err(|e| ("Failed to create check-run", e))?;
+                match check_run {
+                    Some(check_run) => info!(
+                        target: EVENT_LOG_TARGET,
+                        "Created check run '{}' for commit '{commit}' in '{repo}'",
+                        check_run.id
+                    ),
+                    None => info!(
+                        target: EVENT_LOG_TARGET,
+                        "Check run for commit '{commit}' in '{repo}' already exists, refreshed it instead"
+                    ),
+                }
+            }
+            WebhookTask::RefreshCheckRun {
+                app_installation_id,
+                repo,
+                commit,
+            } => {
+                github
+                    .refresh_check_run_status(*app_installation_id, repo, commit)
+                    .await
+                    .map_err(|e| ("Failed to refresh check-run status", e))?;
+            }
+            WebhookTask::RefreshPullRequest {
+                app_installation_id,
+                repo,
+                pull_request,
+            } => {
+                let commit = github
+                    .get_pull_request_head_commit(*app_installation_id, repo, *pull_request)
+                    .await
+                    .map_err(|e| ("Failed to get pull request head commit", e))?;
+                github
+                    .refresh_check_run_status(*app_installation_id, repo, &commit)
+                    .await
+                    .map_err(|e| ("Failed to refresh check-run status", e))?;
+            }
         }
         Ok(())
     }
 }
 
 /// Job for refreshing check runs
-#[derive(Debug, Ord, PartialEq, PartialOrd, Eq)]
+#[derive(Debug, Clone, Hash, Ord, PartialEq, PartialOrd, Eq, Serialize, Deserialize)]
 struct Job {
+    /// Client ID of the GitHub App the installation belongs to
+    client_id: String,
     app_installation_id: u64,
     repo: String,
     commit: String,
@@ -109,43 +618,721 @@ struct Job {
 /// HTTP Server for receiving webhook events from GitHub
 pub struct Server {
     options: ServerOptions,
+    /// GitHub Apps served in addition to the one passed to run
+    apps: Vec<WebhookApp>,
+    /// Loads the configuration again when receiving SIGHUP
+    reload: Option<Arc<LoadConfig>>,
+    /// State shared by all apps, which needs to outlive a single delivery
+    store: Arc<dyn StateStore>,
 }
 
+/// Load the configuration for a reload, e.g. by reading the config file again
+type LoadConfig = dyn Fn() -> Result<Configuration, Error> + Send + Sync;
+
+/// Server options that can be changed by reloading the configuration.
+/// Listener-level options, like the port and SSL, require a restart.
+#[derive(Debug, Default)]
+struct ReloadableOptions {
+    repo_allowlist: Vec<String>,
+    repo_denylist: Vec<String>,
+    repo_visibilities: Vec<String>,
+}
+
+impl From<&ServerOptions> for ReloadableOptions {
+    fn from(options: &ServerOptions) -> Self {
+        Self {
+            repo_allowlist: options.repo_allowlist.clone(),
+            repo_denylist: options.repo_denylist.clone(),
+            repo_visibilities: options.repo_visibilities.clone(),
+        }
+    }
+}
+
+/// GitHub App served by the server, together with the secret of its webhook
 #[derive(Clone)]
-struct ServerState {
+struct WebhookApp {
     webhook_secret: Option<String>,
+    /// Secrets accepted in addition to the webhook secret while it is rotated
+    previous_webhook_secrets: Vec<String>,
+    github: Arc<Client>,
+}
+
+impl WebhookApp {
+    /// Verify the signature of the delivery with the webhook secret, falling back to the previous secrets.
+    fn verify(
+        &self,
+        headers: &HeaderMap,
+        payload: &str,
+    ) -> Result<(), (StatusCode, Json<Response>)> {
+        let result = verify_webhook(headers, self.webhook_secret.as_deref(), payload);
+        if self.previous_webhook_secrets.is_empty() {
+            return result;
+        }
+        if result.is_ok() {
+            debug!(
+                "Verified delivery for app '{}' with the current webhook secret",
+                self.github.client_id()
+            );
+            return result;
+        }
+        for (i, secret) in self.previous_webhook_secrets.iter().enumerate() {
+            if verify_webhook(headers, Some(secret.as_str()), payload).is_ok() {
+                debug!(
+                    "Verified delivery for app '{}' with previous webhook secret {}, the webhook on GitHub still uses it",
+                    self.github.client_id(),
+                    i + 1
+                );
+                return Ok(());
+            }
+        }
+        result
+    }
+}
+
+#[derive(Clone)]
+struct ServerState {
+    /// All apps served by the server, webhook deliveries are routed by their signature
+    apps: Vec<WebhookApp>,
+    /// Client of the app the current webhook delivery belongs to, the first app outside of deliveries
     github: Arc<Client>,
+    metrics: Arc<Metrics>,
     job_queue: Arc<Mutex<Vec<Job>>>,
     use_job_queue: bool,
+    job_queue_size: usize,
+    job_queue_full_strategy: QueueFullStrategy,
+    job_queue_block_timeout: Duration,
+    ignore_user_repos: bool,
+    /// Swapped as a whole on reload, so every event sees a consistent set of options
+    reloadable: Arc<std::sync::Mutex<Arc<ReloadableOptions>>>,
+    guard_drafts: bool,
+    check_timeout: Option<Duration>,
+    check_timeouts: Arc<Mutex<HashSet<Job>>>,
+    initial_evaluation_delay: Option<Duration>,
+    initial_evaluations: Arc<Mutex<HashSet<Job>>>,
+    /// State shared between deliveries, e.g. the commits recently refreshed due to a check_run event
+    store: Arc<dyn StateStore>,
+    webhook_timeout: Option<Duration>,
+    readiness: Arc<Mutex<Option<Readiness>>>,
+    /// Queue of the workers with the client of the app of the delivery.
+    /// The span keeps the delivery context for the logs of the task.
+    workers: Option<mpsc::Sender<(WebhookTask, Arc<Client>, Span)>>,
+    /// Bearer token required by the admin endpoints
+    admin_token: String,
+}
+
+/// Cached result of the last readiness check
+struct Readiness {
+    checked_at: Instant,
+    error: Option<String>,
+}
+
+impl Readiness {
+    /// Check if the result is recent enough to be reused
+    fn is_valid(&self) -> bool {
+        let max_age = match self.error {
+            None => READINESS_CACHE_DURATION,
+            Some(_) => READINESS_FAILURE_CACHE_DURATION,
+        };
+        self.checked_at.elapsed() < max_age
+    }
 }
 
 impl ServerState {
     /// Create a new server state with the given webhook secret and GitHub client
     fn new(webhook_secret: Option<String>, github: Client) -> Self {
+        let metrics = github.metrics();
+        let store = github.store();
         let github = Arc::new(github);
         Self {
-            webhook_secret,
+            apps: vec![WebhookApp {
+                webhook_secret,
+                previous_webhook_secrets: Vec::new(),
+                github: github.clone(),
+            }],
             github,
+            metrics,
             job_queue: Arc::new(Mutex::new(Vec::new())),
             use_job_queue: false,
+            job_queue_size: 0,
+            job_queue_full_strategy: QueueFullStrategy::default(),
+            job_queue_block_timeout: Duration::from_secs(default_job_queue_block_timeout()),
+            ignore_user_repos: false,
+            reloadable: Arc::new(std::sync::Mutex::new(Arc::default())),
+            guard_drafts: false,
+            check_timeout: None,
+            check_timeouts: Arc::new(Mutex::new(HashSet::new())),
+            initial_evaluation_delay: None,
+            initial_evaluations: Arc::new(Mutex::new(HashSet::new())),
+            store,
+            webhook_timeout: None,
+            readiness: Arc::new(Mutex::new(None)),
+            workers: None,
+            admin_token: String::new(),
+        }
+    }
+
+    /// Add another app, deliveries signed with its webhook secret are handled with its client.
+    fn add_app(&mut self, app: WebhookApp) {
+        self.apps.push(app);
+    }
+
+    /// Select the app a webhook delivery belongs to, by verifying the signature with the secret of each app.
+    /// Returns a copy of the state using the client of the selected app.
+    /// If no app matches, the error of the first app is returned.
+    fn route_delivery(
+        &self,
+        headers: &HeaderMap,
+        payload: &str,
+    ) -> Result<Self, (StatusCode, Json<Response>)> {
+        let mut error = None;
+        for app in &self.apps {
+            match app.verify(headers, payload) {
+                Ok(()) => {
+                    if self.apps.len() > 1 {
+                        debug!("Routing delivery to app '{}'", app.github.client_id());
+                    }
+                    let mut state = self.clone();
+                    state.github = app.github.clone();
+                    return Ok(state);
+                }
+                Err(e) => {
+                    error.get_or_insert(e);
+                }
+            }
+        }
+        Err(error.unwrap_or_else(|| {
+            (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                Json(Response::error("No GitHub App configured")),
+            )
+        }))
+    }
+
+    /// Check if the server is ready to handle webhook events.
+    /// The result is cached, so frequent probes do not cause requests to GitHub.
+    /// Returns the error message if the check failed.
+    async fn check_readiness(&self) -> Option<String> {
+        // Holding the lock ensures concurrent probes wait for a single check
+        let mut readiness = self.readiness.lock().await;
+        if let Some(readiness) = readiness.as_ref().filter(|r| r.is_valid()) {
+            return readiness.error.clone();
+        }
+
+        let error = self.readiness_error().await;
+        *readiness = Some(Readiness {
+            checked_at: Instant::now(),
+            error: error.clone(),
+        });
+        error
+    }
+
+    /// Check if the state store is available and the clients of all apps can authenticate against GitHub.
+    /// Returns the error message of the first failed check.
+    async fn readiness_error(&self) -> Option<String> {
+        if let Err(e) = self.store.ping().await {
+            warn!("Readiness check failed for the state store: {e}");
+            return Some(format!("State store is unavailable: {e}"));
+        }
+        for app in &self.apps {
+            if let Err(e) = app.github.verify_credentials().await {
+                warn!(
+                    "Readiness check failed for app '{}': {e}",
+                    app.github.client_id()
+                );
+                return Some(format!("Failed to authenticate with GitHub: {e}"));
+            }
+        }
+        None
+    }
+
+    /// Return the current reloadable options. Reloading does not affect the returned options.
+    fn reloadable(&self) -> Arc<ReloadableOptions> {
+        self.reloadable
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner)
+            .clone()
+    }
+
+    /// Apply the hot-reloadable options of the new configuration to the server and the clients of all apps.
+    /// Keeps the current options when the configuration could not be loaded or is invalid.
+    fn reload(&self, config: Result<Configuration, Error>) {
+        let config = match config {
+            Ok(config) => config,
+            Err(e) => {
+                error!("Failed to reload configuration, keeping the current one: {e}");
+                return;
+            }
+        };
+
+        let options = std::iter::once(&config.github)
+            .chain(config.additional_apps.iter().map(|app| &app.github));
+        for options in options {
+            match self
+                .apps
+                .iter()
+                .find(|app| app.github.client_id() == options.client_id)
+            {
+                Some(app) => {
+                    app.github.reload(options);
+                    app.github.reload_private_key(options);
+                }
+                None => warn!(
+                    "Not serving app '{}', adding apps requires a restart",
+                    options.client_id
+                ),
+            }
+        }
+        *self
+            .reloadable
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner) =
+            Arc::new(ReloadableOptions::from(&config.server));
+
+        info!("Reloaded configuration: {}", config.summary());
+    }
+
+    /// Start a background task that reloads the configuration on SIGHUP
+    fn reload_on_sighup(&self, load: Arc<LoadConfig>) {
+        #[cfg(unix)]
+        {
+            let mut hangup = match signal::unix::signal(signal::unix::SignalKind::hangup()) {
+                Ok(hangup) => hangup,
+                Err(e) => {
+                    error!("Failed to install SIGHUP handler, reloading is disabled: {e}");
+                    return;
+                }
+            };
+            let state = self.clone();
+            tokio::spawn(async move {
+                while hangup.recv().await.is_some() {
+                    info!("Received SIGHUP, reloading configuration");
+                    state.reload(load());
+                }
+            });
+        }
+
+        #[cfg(not(unix))]
+        {
+            let _ = load;
+            warn!("Reloading the configuration on SIGHUP is only supported on unix");
+        }
+    }
+
+    /// Check if events for the given repository should be ignored
+    fn is_ignored_repo(&self, repo: &Repo) -> bool {
+        if self.ignore_user_repos && repo.is_user_owned() {
+            debug!(
+                "Ignoring event for repository '{}' owned by a personal account",
+                repo.full_name
+            );
+            return true;
+        }
+        let options = self.reloadable();
+        if !is_repo_in_scope(
+            &options.repo_allowlist,
+            &options.repo_denylist,
+            &repo.full_name,
+        ) {
+            debug!(
+                "Ignoring event for repository '{}' excluded by the repo allowlist or denylist",
+                repo.full_name
+            );
+            return true;
+        }
+        if !options.repo_visibilities.is_empty()
+            && !options
+                .repo_visibilities
+                .iter()
+                .any(|visibility| visibility == repo.visibility())
+        {
+            debug!(
+                "Ignoring event for {} repository '{}'",
+                repo.visibility(),
+                repo.full_name
+            );
+            return true;
+        }
+        false
+    }
+
+    /// Create a new pending job and add it to the job queue.
+    /// Returns false if the job queue is full and the job has been rejected.
+    async fn new_job(&self, app_installation_id: u64, repo: &str, commit: &str) -> bool {
+        let job = self.job_for(app_installation_id, repo, commit);
+        let deadline = Instant::now() + self.job_queue_block_timeout;
+
+        loop {
+            let mut job_queue = self.job_queue.lock().await;
+            if job_queue.contains(&job) {
+                debug!("Job for '{}' - '{}' is already queued", repo, commit);
+                return true;
+            }
+            if self.job_queue_size == 0 || job_queue.len() < self.job_queue_size {
+                job_queue.push(job);
+                return true;
+            }
+            drop(job_queue);
+            if self.job_queue_full_strategy == QueueFullStrategy::SpillToStore {
+                return self.spill_job(job).await;
+            }
+
+            if self.job_queue_full_strategy == QueueFullStrategy::Reject
+                || Instant::now() >= deadline
+            {
+                warn!(
+                    "Job queue is full, rejecting job for '{}' - '{}'",
+                    repo, commit
+                );
+                return false;
+            }
+            tokio::time::sleep(JOB_QUEUE_RETRY_INTERVAL).await;
+        }
+    }
+
+    /// Append the job to the jobs spilled to the store, they are moved back into the queue once it has free space.
+    /// Duplicates are removed when the queue is run.
+    /// Returns false if the store failed and the job has been rejected.
+    async fn spill_job(&self, job: Job) -> bool {
+        let result = match serde_json::to_string(&job) {
+            Ok(value) => self.store.push(SPILLED_JOBS_KEY, &value, SPILLED_TTL).await,
+            Err(e) => Err(Error::Parse(SPILLED_JOBS_KEY, Box::new(e))),
+        };
+        if let Err(e) = result {
+            warn!(
+                "Job queue is full and spilling failed, rejecting job for '{}' - '{}': {}",
+                job.repo, job.commit, e
+            );
+            return false;
         }
+        info!(
+            "Job queue is full, spilled job for '{}' - '{}' to the store",
+            job.repo, job.commit
+        );
+        true
     }
 
-    /// Create a new pending job and add it to the job queue
-    async fn new_job(&self, app_installation_id: u64, repo: &str, commit: &str) {
-        let job = Job {
+    /// Create the job for a commit, using the app the current delivery belongs to.
+    fn job_for(&self, app_installation_id: u64, repo: &str, commit: &str) -> Job {
+        Job {
+            client_id: self.github.client_id().to_string(),
             app_installation_id,
             repo: repo.to_string(),
             commit: commit.to_string(),
+        }
+    }
+
+    /// Remember that the commit is refreshed due to a check_run event, for the duration of the duplicate window.
+    async fn record_check_run_refresh(&self, repo: &str, commit: &str) {
+        let key = self.check_run_refresh_key(repo, commit);
+        if let Err(e) = self
+            .store
+            .set(&key, "1", CHECK_SUITE_DUPLICATE_WINDOW)
+            .await
+        {
+            warn!("Failed to record check_run refresh of '{repo}' - '{commit}': {e}");
+        }
+    }
+
+    /// Check if the commit has recently been refreshed due to a check_run event.
+    /// The check_run events of the runs in a suite arrive together with the completed check suite,
+    /// so refreshing again for the suite would only repeat the same requests.
+    /// When the store fails, the commit is refreshed again to be on the safe side.
+    async fn is_recent_check_run_refresh(&self, repo: &str, commit: &str) -> bool {
+        let key = self.check_run_refresh_key(repo, commit);
+        match self.store.get(&key).await {
+            Ok(refresh) => refresh.is_some(),
+            Err(e) => {
+                warn!("Failed to look up check_run refresh of '{repo}' - '{commit}': {e}");
+                false
+            }
+        }
+    }
+
+    /// Key of the check_run refresh of a commit, using the app the current delivery belongs to.
+    fn check_run_refresh_key(&self, repo: &str, commit: &str) -> String {
+        store::commit_key("check-run-refresh", self.github.client_id(), repo, commit)
+    }
+
+    /// Run the task resulting from a webhook event.
+    /// When workers are enabled, the task is queued and the event is acknowledged with 202 right away.
+    /// A full worker queue is handled according to the job_queue_full_strategy.
+    async fn dispatch(&self, task: WebhookTask) -> (StatusCode, Json<Response>) {
+        if let Some(workers) = &self.workers {
+            let item = (task, self.github.clone(), Span::current());
+            let result = match self.job_queue_full_strategy {
+                QueueFullStrategy::BlockWithTimeout => workers
+                    .send_timeout(item, self.job_queue_block_timeout)
+                    .await
+                    .map_err(|e| match e {
+                        mpsc::error::SendTimeoutError::Timeout(item) => {
+                            mpsc::error::TrySendError::Full(item)
+                        }
+                        mpsc::error::SendTimeoutError::Closed(item) => {
+                            mpsc::error::TrySendError::Closed(item)
+                        }
+                    }),
+                _ => workers.try_send(item),
+            };
+            return match result {
+                Ok(()) => (StatusCode::ACCEPTED, Json(Response::new())),
+                Err(mpsc::error::TrySendError::Full((task, _, _)))
+                    if self.job_queue_full_strategy == QueueFullStrategy::SpillToStore =>
+                {
+                    self.spill_task(task).await
+                }
+                Err(mpsc::error::TrySendError::Full((task, _, _))) => {
+                    warn!("Worker queue is full, rejecting {task:?}");
+                    (
+                        StatusCode::SERVICE_UNAVAILABLE,
+                        Json(Response::error("Worker queue is full")),
+                    )
+                }
+                Err(mpsc::error::TrySendError::Closed((task, _, _))) => {
+                    error!("Workers have stopped, can't process {task:?}");
+                    (
+                        StatusCode::INTERNAL_SERVER_ERROR,
+                        Json(Response::error("Workers have stopped")),
+                    )
+                }
+            };
+        }
+
+        match task.run(&self.github).await {
+            Ok(()) => (StatusCode::OK, Json(Response::new())),
+            Err((message, e)) => {
+                error!("{message}: {e}");
+                (
+                    StatusCode::INTERNAL_SERVER_ERROR,
+                    Json(Response::error(message)),
+                )
+            }
+        }
+    }
+
+    /// Append the task to the webhook tasks spilled to the store, they are moved back into the worker queue once it has free space.
+    async fn spill_task(&self, task: WebhookTask) -> (StatusCode, Json<Response>) {
+        let spilled = SpilledTask {
+            client_id: self.github.client_id().to_string(),
+            task,
+        };
+        let result = match serde_json::to_string(&spilled) {
+            Ok(value) => {
+                self.store
+                    .push(SPILLED_TASKS_KEY, &value, SPILLED_TTL)
+                    .await
+            }
+            Err(e) => Err(Error::Parse(SPILLED_TASKS_KEY, Box::new(e))),
+        };
+        match result {
+            Ok(()) => {
+                info!(
+                    "Worker queue is full, spilled {:?} to the store",
+                    spilled.task
+                );
+                (StatusCode::ACCEPTED, Json(Response::new()))
+            }
+            Err(e) => {
+                warn!(
+                    "Worker queue is full and spilling failed, rejecting {:?}: {}",
+                    spilled.task, e
+                );
+                (
+                    StatusCode::SERVICE_UNAVAILABLE,
+                    Json(Response::error("Worker queue is full")),
+                )
+            }
+        }
+    }
+
+    /// Fail the check run of the commit, if other checks are still pending once the check timeout has passed.
+    /// Only one timeout is scheduled per commit at a time.
+    async fn schedule_check_timeout(&self, app_installation_id: u64, repo: &str, commit: &str) {
+        let Some(timeout) = self.check_timeout else {
+            return;
+        };
+        let job = self.job_for(app_installation_id, repo, commit);
+        if !self.check_timeouts.lock().await.insert(job.clone()) {
+            debug!(
+                "Check timeout for '{}' - '{}' is already scheduled",
+                repo, commit
+            );
+            return;
+        }
+
+        let github = self.github.clone();
+        let check_timeouts = self.check_timeouts.clone();
+        // Keep the context of the event that scheduled the timeout for the audit log
+        let span = Span::current();
+        tokio::spawn(
+            async move {
+                tokio::time::sleep(timeout).await;
+                check_timeouts.lock().await.remove(&job);
+
+                match github
+                    .fail_stalled_check_run(
+                        job.app_installation_id,
+                        &job.repo,
+                        &job.commit,
+                        timeout,
+                    )
+                    .await
+                {
+                    Ok(true) => warn!(
+                        "Checks for '{}' - '{}' did not complete within {:?}, failed the check run",
+                        job.repo, job.commit, timeout
+                    ),
+                    Ok(false) => debug!(
+                        "No checks for '{}' - '{}' are running after the timeout",
+                        job.repo, job.commit
+                    ),
+                    Err(e) => error!(
+                        "Failed to check for stalled checks of '{}' - '{}': {}",
+                        job.repo, job.commit, e
+                    ),
+                }
+            }
+            .instrument(span),
+        );
+    }
+
+    /// Refresh the check run of the commit once the initial evaluation delay has passed.
+    /// Only one evaluation is scheduled per commit at a time.
+    async fn schedule_initial_evaluation(
+        &self,
+        app_installation_id: u64,
+        repo: &str,
+        commit: &str,
+    ) {
+        let Some(delay) = self.initial_evaluation_delay else {
+            return;
         };
-        let mut job_queue = self.job_queue.lock().await;
-        job_queue.push(job);
+        let job = self.job_for(app_installation_id, repo, commit);
+        if !self.initial_evaluations.lock().await.insert(job.clone()) {
+            debug!(
+                "Initial evaluation for '{}' - '{}' is already scheduled",
+                repo, commit
+            );
+            return;
+        }
+
+        let github = self.github.clone();
+        let initial_evaluations = self.initial_evaluations.clone();
+        let span = Span::current();
+        tokio::spawn(
+            async move {
+                tokio::time::sleep(delay).await;
+                initial_evaluations.lock().await.remove(&job);
+
+                match github
+                    .refresh_check_run_status(job.app_installation_id, &job.repo, &job.commit)
+                    .await
+                {
+                    Ok(()) => debug!(
+                        "Evaluated checks for '{}' - '{}' after {:?}",
+                        job.repo, job.commit, delay
+                    ),
+                    Err(e) => error!(
+                        "Failed to evaluate checks of '{}' - '{}' after {:?}: {}",
+                        job.repo, job.commit, delay, e
+                    ),
+                }
+            }
+            .instrument(span),
+        );
+    }
+
+    /// Start background workers processing the tasks of webhook events
+    fn start_workers(&mut self, count: usize, queue_size: usize) {
+        let (workers, tasks) = mpsc::channel(queue_size);
+        let tasks = Arc::new(Mutex::new(tasks));
+
+        info!(
+            "Processing webhook events with {} workers and a queue size of {}",
+            count, queue_size,
+        );
+
+        for _ in 0..count {
+            let tasks = tasks.clone();
+            tokio::spawn(async move {
+                loop {
+                    let Some((task, github, span)) = tasks.lock().await.recv().await else {
+                        return;
+                    };
+                    if let Err((message, e)) = task.run(&github).instrument(span.clone()).await {
+                        span.in_scope(|| error!("{message} for {task:?}: {e}"));
+                    }
+                }
+            });
+        }
+
+        if self.job_queue_full_strategy == QueueFullStrategy::SpillToStore {
+            // Only hold a weak reference, so the workers still stop once the server state is dropped
+            let workers = workers.downgrade();
+            let store = self.store.clone();
+            let apps = self.apps.clone();
+            tokio::spawn(async move {
+                loop {
+                    tokio::time::sleep(SPILLED_TASKS_INTERVAL).await;
+                    let Some(workers) = workers.upgrade() else {
+                        return;
+                    };
+                    if let Err(e) = unspill_tasks(store.as_ref(), &workers, &apps).await {
+                        error!("Failed to move spilled tasks back into the worker queue: {e}");
+                    }
+                }
+            });
+        }
+        self.workers = Some(workers);
+    }
+
+    /// Start a background task that fetches the installation tokens of all apps and refreshes them before they expire.
+    /// Failed runs are retried with an exponential backoff, the task stops when shutdown is signaled.
+    fn prewarm_tokens(&self, interval: u64, mut shutdown: watch::Receiver<bool>) {
+        let apps = self.apps.clone();
+
+        info!("Pre-warming installation tokens every {} seconds", interval);
+
+        tokio::spawn(async move {
+            let interval = Duration::from_secs(interval);
+            let valid_for = interval + TOKEN_PREWARM_MARGIN;
+            let mut backoff = TOKEN_PREWARM_MIN_BACKOFF;
+            loop {
+                let mut failed = false;
+                for app in &apps {
+                    if let Err(e) = app.github.prewarm_tokens(valid_for).await {
+                        error!(
+                            "Failed to pre-warm tokens for app '{}': {}",
+                            app.github.client_id(),
+                            e
+                        );
+                        failed = true;
+                    }
+                }
+
+                let delay = if failed {
+                    let delay = backoff.min(interval);
+                    backoff = (backoff * 2).min(interval);
+                    debug!("Retrying to pre-warm tokens in {delay:?}");
+                    delay
+                } else {
+                    backoff = TOKEN_PREWARM_MIN_BACKOFF;
+                    interval
+                };
+                tokio::select! {
+                    _ = tokio::time::sleep(delay) => {},
+                    _ = shutdown.wait_for(|shutdown| *shutdown) => return,
+                }
+            }
+        });
     }
 
     /// Start a background task that periodically runs all jobs in the queue
     fn periodically_run_job_queue(&mut self, period: u64) {
         let job_queue = self.job_queue.clone();
-        let github = self.github.clone();
+        let job_queue_size = self.job_queue_size;
+        let spill_to_store = self.job_queue_full_strategy == QueueFullStrategy::SpillToStore;
+        let store = self.store.clone();
+        let apps = self.apps.clone();
 
         info!(
             "Periodic refresh of check runs enabled with a period of {} seconds",
@@ -158,6 +1345,12 @@ impl ServerState {
             loop {
                 tokio::time::sleep(period).await;
 
+                if spill_to_store {
+                    let result = unspill_jobs(store.as_ref(), &job_queue, job_queue_size).await;
+                    if let Err(e) = result {
+                        error!("Failed to move spilled jobs back into the job queue: {e}");
+                    }
+                }
                 let mut job_queue = job_queue.lock().await;
                 if job_queue.is_empty() {
                     continue;
@@ -168,7 +1361,18 @@ impl ServerState {
                 info!("Running {} jobs in the queue", job_queue.len());
 
                 for job in job_queue.drain(..) {
-                    if let Err(e) = github
+                    let Some(app) = apps
+                        .iter()
+                        .find(|app| app.github.client_id() == job.client_id)
+                    else {
+                        error!(
+                            "No app with client ID '{}' for job: '{}' - '{}'",
+                            job.client_id, job.repo, job.commit
+                        );
+                        continue;
+                    };
+                    if let Err(e) = app
+                        .github
                         .refresh_check_run_status(job.app_installation_id, &job.repo, &job.commit)
                         .await
                     {
@@ -184,109 +1388,649 @@ impl ServerState {
 }
 
 impl Server {
-    /// Create a new server with the given options and GitHub client
+    /// Create a new server with the given options
     pub fn new(options: ServerOptions) -> Self {
-        Self { options }
+        let store = new_store(&options.redis_url);
+        Self {
+            options,
+            apps: Vec::new(),
+            reload: None,
+            store,
+        }
+    }
+
+    /// Reload the configuration returned by load on SIGHUP, without restarting the server.
+    /// Applied are the options deciding the state of the guard of every app (check name, initial status, details url,
+    /// summary template, required, ignored and flaky checks, required labels, passing conclusions and their overrides,
+    /// require-at-least-one-check and comment-on-failure), the private key of every app and the repo allow-, denylist
+    /// and visibilities. The log level is reloaded by load itself, unless it has been set on the command line.
+    /// All other options require a restart. When load fails, e.g. due to an invalid configuration, nothing is applied.
+    pub fn reload_on_sighup<F>(&mut self, load: F)
+    where
+        F: Fn() -> Result<Configuration, Error> + Send + Sync + 'static,
+    {
+        self.reload = Some(Arc::new(load));
+    }
+
+    /// Serve another GitHub App from the same server.
+    /// Webhook deliveries are routed to the app whose secret verifies their signature.
+    pub fn add_app(&mut self, webhook_secret: String, mut github: Client) {
+        github.use_store(self.store.clone());
+        self.apps.push(WebhookApp {
+            webhook_secret: Some(webhook_secret),
+            previous_webhook_secrets: Vec::new(),
+            github: Arc::new(github),
+        });
     }
 
     /// Run the server
     /// Server will shutdown gracefully on Ctrl+C or SIGTERM
     pub async fn run(&self, github: Client) -> Result<(), Error> {
+        self.run_until(github, shutdown_signal()).await
+    }
+
+    /// Run the server until the shutdown future completes.
+    /// In-flight requests are given the configured grace period to complete before returning.
+    pub async fn run_until<F>(&self, mut github: Client, shutdown: F) -> Result<(), Error>
+    where
+        F: Future<Output = ()> + Send + 'static,
+    {
+        install_panic_hook();
+        github.use_store(self.store.clone());
         let mut state = ServerState::new(self.options.webhook_secret.clone(), github);
+        state.apps[0].previous_webhook_secrets = self.options.previous_webhook_secrets.clone();
+        for app in &self.apps {
+            state.add_app(app.clone());
+        }
+        state.ignore_user_repos = self.options.ignore_user_repos;
+        state.reloadable = Arc::new(std::sync::Mutex::new(Arc::new(ReloadableOptions::from(
+            &self.options,
+        ))));
+        state.guard_drafts = self.options.guard_drafts;
+        state.admin_token = self.options.admin_token.clone();
+        if self.options.check_timeout > 0 {
+            state.check_timeout = Some(Duration::from_secs(self.options.check_timeout));
+        }
+        if self.options.initial_evaluation_delay > 0 {
+            state.initial_evaluation_delay =
+                Some(Duration::from_secs(self.options.initial_evaluation_delay));
+        }
+        state.job_queue_size = self.options.job_queue_size;
+        state.job_queue_full_strategy = self.options.job_queue_full_strategy;
+        state.job_queue_block_timeout = Duration::from_secs(self.options.job_queue_block_timeout);
+        if self.options.webhook_timeout > 0 {
+            state.webhook_timeout = Some(Duration::from_secs(self.options.webhook_timeout));
+        }
         if self.options.periodic_refresh > 0 {
             state.periodically_run_job_queue(self.options.periodic_refresh);
         }
-        let router = new_router(state);
+        if self.options.workers > 0 {
+            state.start_workers(self.options.workers, self.options.worker_queue_size);
+        }
+        if let Some(load) = &self.reload {
+            state.reload_on_sighup(load.clone());
+        }
+        let (shutdown_tx, mut shutdown_rx) = watch::channel(false);
+        if self.options.token_prewarm_interval > 0 {
+            state.prewarm_tokens(self.options.token_prewarm_interval, shutdown_rx.clone());
+        }
+        let router = new_router(state, &self.options);
 
-        let addr = SocketAddr::from(([0, 0, 0, 0, 0, 0, 0, 0], self.options.port));
-        info!("Starting server on {}", addr);
+        let addr = self.options.socket_addr();
+        info!(
+            "Starting server on {}, receiving webhooks on {}",
+            addr, self.options.webhook_path
+        );
 
-        if self.options.ssl.enabled {
-            let listener =
-                tls::TlsListener::bind(addr, &self.options.ssl.key, &self.options.ssl.cert)
-                    .await
-                    .map_err(|e| Error::BindPort(Box::new(e)))?;
+        let shutdown = async move {
+            shutdown.await;
+            info!("Received shutdown signal, waiting for in-flight requests to complete");
+            let _ = shutdown_tx.send(true);
+        };
 
-            axum::serve(listener, router)
-                .with_graceful_shutdown(shutdown_signal())
-                .await
-                .map_err(Error::Serve)
-        } else {
-            let listener = TcpListener::bind(addr)
+        let timeouts = self.options.timeouts();
+        let mut server: Pin<Box<dyn Future<Output = std::io::Result<()>> + Send>> =
+            if self.options.ssl.enabled {
+                let listener = tls::TlsListener::bind(
+                    addr,
+                    &self.options.ssl.key,
+                    &self.options.ssl.cert,
+                    self.options.ssl.min_tls_version,
+                    Some(self.options.ssl.client_ca.as_str()).filter(|ca| !ca.is_empty()),
+                )
                 .await
                 .map_err(|e| Error::BindPort(Box::new(e)))?;
 
-            axum::serve(listener, router)
-                .with_graceful_shutdown(shutdown_signal())
-                .await
-                .map_err(Error::Serve)
+                Box::pin(conn::serve(listener, router, timeouts, shutdown))
+            } else {
+                let listener = TcpListener::bind(addr)
+                    .await
+                    .map_err(|e| Error::BindPort(Box::new(e)))?;
+
+                Box::pin(conn::serve(listener, router, timeouts, shutdown))
+            };
+
+        tokio::select! {
+            result = &mut server => return result.map_err(Error::Serve),
+            _ = shutdown_rx.wait_for(|shutdown| *shutdown) => {},
+        }
+
+        if self.options.shutdown_grace_period == 0 {
+            return server.await.map_err(Error::Serve);
+        }
+        let grace_period = Duration::from_secs(self.options.shutdown_grace_period);
+        match tokio::time::timeout(grace_period, server).await {
+            Ok(result) => result.map_err(Error::Serve),
+            Err(_) => {
+                warn!(
+                    "In-flight requests did not complete within the grace period of {grace_period:?}, shutting down anyway"
+                );
+                Ok(())
+            }
+        }
+    }
+}
+
+/// Create the store for the state of the server, using redis when configured.
+/// Falls back to keeping the state in memory, when the redis URL is invalid.
+fn new_store(redis_url: &str) -> Arc<dyn StateStore> {
+    if redis_url.is_empty() {
+        return Arc::new(MemoryStore::default());
+    }
+    match RedisStore::new(redis_url) {
+        Ok(store) => {
+            info!("Keeping state in redis '{}'", store.addr());
+            Arc::new(store)
+        }
+        Err(e) => {
+            error!("Failed to use redis, keeping state in memory instead: {e}");
+            Arc::new(MemoryStore::default())
         }
     }
 }
 
-fn new_router(state: ServerState) -> Router {
-    let webhook_router: Router = Router::new()
-        .route("/webhook", post(webhook_handler))
-        .with_state(state)
-        .layer(TraceLayer::new_for_http());
-
-    // Do not use tracing for the health check endpoint
-    let health_router: Router = Router::new().route("/healthz", get(healthz));
-
-    Router::new().merge(webhook_router).merge(health_router)
+fn new_router(state: ServerState, options: &ServerOptions) -> Router {
+    let metrics = state.metrics.clone();
+    let webhook_router: Router = Router::new()
+        .route(&options.webhook_path, post(webhook_handler))
+        .with_state(state.clone())
+        .layer(DefaultBodyLimit::max(options.max_body_size))
+        .layer(CatchPanicLayer::custom(handle_panic))
+        .layer(
+            TraceLayer::new_for_http().make_span_with(|request: &Request| {
+                let delivery = request
+                    .headers()
+                    .get(DELIVERY_HEADER)
+                    .and_then(|delivery| delivery.to_str().ok())
+                    .unwrap_or_default();
+                debug_span!(
+                    "request",
+                    method = %request.method(),
+                    uri = %request.uri(),
+                    delivery
+                )
+            }),
+        )
+        .layer(middleware::map_request(ensure_delivery_id));
+    let webhook_router = if options.read_timeout > 0 {
+        webhook_router.layer(RequestBodyTimeoutLayer::new(Duration::from_secs(
+            options.read_timeout,
+        )))
+    } else {
+        webhook_router
+    };
+
+    // Do not use tracing for the health check, version and metrics endpoints
+    let health_router: Router = Router::new()
+        .route("/healthz", get(healthz))
+        .route("/readyz", get(readyz))
+        .route("/version", get(version_handler))
+        .with_state(state.clone());
+    let metrics_router: Router = Router::new()
+        .route("/metrics", get(metrics_handler))
+        .with_state(metrics);
+
+    let mut router = Router::new()
+        .merge(webhook_router)
+        .merge(health_router)
+        .merge(metrics_router);
+    if !options.admin_token.is_empty() {
+        info!("Admin endpoint is enabled on {ADMIN_REEVALUATE_PATH}");
+        let admin_router: Router = Router::new()
+            .route(ADMIN_REEVALUATE_PATH, post(admin_reevaluate))
+            .with_state(state.clone())
+            .layer(DefaultBodyLimit::max(options.max_body_size))
+            .layer(CatchPanicLayer::custom(handle_panic));
+        router = router.merge(admin_router);
+    }
+    if !options.debug_endpoints {
+        return router;
+    }
+
+    info!("Debug endpoints are enabled on /debug/guards and /debug/ratelimit");
+    let debug_router: Router = Router::new()
+        .route("/debug/guards", get(debug_guards))
+        .route("/debug/ratelimit", get(debug_rate_limit))
+        .with_state(state);
+    router.merge(debug_router)
+}
+
+/// Respond with 500 when a handler panicked, so a single bad delivery does not affect others.
+/// The panic itself is logged by the panic hook, which has access to the backtrace.
+fn handle_panic(err: Box<dyn Any + Send + 'static>) -> axum::response::Response {
+    let message = err
+        .downcast_ref::<&str>()
+        .map(|s| s.to_string())
+        .or_else(|| err.downcast_ref::<String>().cloned())
+        .unwrap_or_else(|| "unknown panic".to_string());
+    error!("Recovered from panic while handling request: {message}");
+    (
+        StatusCode::INTERNAL_SERVER_ERROR,
+        Json(Response::error("Internal server error")),
+    )
+        .into_response()
+}
+
+/// Log panics together with their backtrace, instead of only printing them to stderr.
+fn install_panic_hook() {
+    static INSTALL: Once = Once::new();
+    INSTALL.call_once(|| {
+        std::panic::set_hook(Box::new(|info| {
+            let backtrace = std::backtrace::Backtrace::force_capture();
+            error!("{info}\n{backtrace}");
+        }));
+    });
+}
+
+/// Expose health check endpoint
+/// Can be used when running under kubernetes to check if the server is running
+/// GET /healthz
+async fn healthz() -> (StatusCode, Json<Response>) {
+    (StatusCode::OK, Json(Response::new()))
+}
+
+/// Expose readiness check endpoint
+/// Fails when the server can't authenticate as the GitHub App, e.g. due to a revoked key.
+/// GET /readyz
+async fn readyz(State(state): State<ServerState>) -> (StatusCode, Json<Response>) {
+    match state.check_readiness().await {
+        None => (StatusCode::OK, Json(Response::new())),
+        Some(message) => (
+            StatusCode::SERVICE_UNAVAILABLE,
+            Json(Response::error(&message)),
+        ),
+    }
+}
+
+/// Expose the build information of the running server, e.g. to verify a deployment
+/// GET /version
+async fn version_handler() -> Json<version::VersionInfo> {
+    Json(version::version_info())
+}
+
+/// Expose metrics in the prometheus text format
+/// GET /metrics
+async fn metrics_handler(State(metrics): State<Arc<Metrics>>) -> (HeaderMap, String) {
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        header::CONTENT_TYPE,
+        header::HeaderValue::from_static(metrics::CONTENT_TYPE),
+    );
+    (headers, metrics.render())
+}
+
+/// Expose the pending guards of all apps with their last known state.
+/// Only uses the state tracked by the clients, no requests are made to GitHub.
+/// GET /debug/guards, only when debug endpoints are enabled
+async fn debug_guards(State(state): State<ServerState>) -> Json<GuardsResponse> {
+    let guards = state
+        .apps
+        .iter()
+        .flat_map(|app| app.github.pending_guards())
+        .collect();
+    Json(GuardsResponse { guards })
+}
+
+/// Expose the rate limit status of all apps, to see how close they are to their limits.
+/// The status is cached briefly by the clients, so frequent requests do not count against the rate limit.
+/// GET /debug/ratelimit, only when debug endpoints are enabled
+async fn debug_rate_limit(State(state): State<ServerState>) -> axum::response::Response {
+    let mut apps = Vec::with_capacity(state.apps.len());
+    for app in &state.apps {
+        match app.github.get_rate_limit().await {
+            Ok(rate_limit) => apps.push(AppRateLimit {
+                client_id: app.github.client_id().to_string(),
+                core: rate_limit.resources.core,
+                graphql: rate_limit.resources.graphql,
+            }),
+            Err(e) => {
+                warn!(
+                    "Failed to fetch rate limit for app '{}': {e}",
+                    app.github.client_id()
+                );
+                return (
+                    StatusCode::BAD_GATEWAY,
+                    Json(Response::error(&format!(
+                        "Failed to fetch rate limit from GitHub: {e}"
+                    ))),
+                )
+                    .into_response();
+            }
+        }
+    }
+    Json(RateLimitsResponse { apps }).into_response()
+}
+
+/// Re-evaluate the guard of a commit or the head commit of a pull request, like after a check_run event.
+/// Requires the admin token as bearer token. The app is selected by looking up its installation on the repository.
+/// POST /admin/reevaluate, only when an admin token is configured
+async fn admin_reevaluate(
+    headers: HeaderMap,
+    State(state): State<ServerState>,
+    payload: String,
+) -> (StatusCode, Json<Response>) {
+    if !is_authorized(&headers, &state.admin_token) {
+        warn!("Rejected unauthorized request to {ADMIN_REEVALUATE_PATH}");
+        return (
+            StatusCode::UNAUTHORIZED,
+            Json(Response::error("Invalid or missing bearer token")),
+        );
+    }
+    let request: ReevaluateRequest = match serde_json::from_str(&payload) {
+        Ok(request) => request,
+        Err(e) => {
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(Response::error(&format!("Failed to parse request: {e}"))),
+            );
+        }
+    };
+    if request.commit.is_some() == request.pull_request.is_some() {
+        return (
+            StatusCode::BAD_REQUEST,
+            Json(Response::error(
+                "Exactly one of commit or pull_request must be set",
+            )),
+        );
+    }
+
+    let apps = state.apps.iter().filter(|app| {
+        request
+            .client_id
+            .as_deref()
+            .is_none_or(|client_id| app.github.client_id() == client_id)
+    });
+    for app in apps {
+        let app_installation_id = match app.github.get_repo_installation_id(&request.repo).await {
+            Ok(id) => id,
+            Err(e) if e.status() == Some(StatusCode::NOT_FOUND) => continue,
+            Err(e) => {
+                let message = format!(
+                    "Failed to look up installation of app '{}' on '{}'",
+                    app.github.client_id(),
+                    request.repo
+                );
+                error!("{message}: {e}");
+                return (StatusCode::BAD_GATEWAY, Json(Response::error(&message)));
+            }
+        };
+        info!(
+            "Re-evaluating guard of {request:?} with app '{}'",
+            app.github.client_id()
+        );
+        let mut state = state.clone();
+        state.github = app.github.clone();
+        let task = match request.commit {
+            Some(commit) => WebhookTask::RefreshCheckRun {
+                app_installation_id,
+                repo: request.repo,
+                commit,
+            },
+            None => WebhookTask::RefreshPullRequest {
+                app_installation_id,
+                repo: request.repo,
+                pull_request: request.pull_request.unwrap_or_default(),
+            },
+        };
+        return state.dispatch(task).await;
+    }
+
+    (
+        StatusCode::NOT_FOUND,
+        Json(Response::error(&format!(
+            "No app is installed on '{}'",
+            request.repo
+        ))),
+    )
+}
+
+/// Check if the request carries the expected bearer token.
+/// Compares digests of the tokens, so the comparison takes the same time regardless of where they differ.
+fn is_authorized(headers: &HeaderMap, token: &str) -> bool {
+    use sha2::Digest;
+
+    if token.is_empty() {
+        return false;
+    }
+    let Some(received) = headers
+        .get(header::AUTHORIZATION)
+        .and_then(|value| value.to_str().ok())
+        .and_then(|value| value.strip_prefix("Bearer "))
+    else {
+        return false;
+    };
+    let received = sha2::Sha256::digest(received.as_bytes());
+    let expected = sha2::Sha256::digest(token.as_bytes());
+    received
+        .iter()
+        .zip(expected.iter())
+        .fold(0, |diff, (a, b)| diff | (a ^ b))
+        == 0
+}
+
+/// Handle the webhook events send from GitHub
+/// POST /webhook, the path is configurable
+async fn webhook_handler(
+    headers: HeaderMap,
+    state: State<ServerState>,
+    payload: String,
+) -> (StatusCode, Json<Response>) {
+    let event = match headers.get("X-GitHub-Event") {
+        Some(event) => event
+            .to_str()
+            .unwrap_or("could not read X-GitHub-Event header"),
+        None => {
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(Response::error("Missing X-GitHub-Event header")),
+            );
+        }
+    };
+    // Set by the middleware, only missing when the handler is called directly
+    let delivery = match headers
+        .get(DELIVERY_HEADER)
+        .and_then(|delivery| delivery.to_str().ok())
+    {
+        Some(delivery) => delivery.to_string(),
+        None => new_delivery_id(),
+    };
+    // Correlates all logs of the event, including the requests to GitHub and the audit log, with the delivery.
+    // The repository and pull request are recorded by the handlers, once the payload has been parsed.
+    let span = info_span!(
+        "webhook",
+        event,
+        delivery = delivery.as_str(),
+        repo = tracing::field::Empty,
+        pull_request = tracing::field::Empty,
+        status = tracing::field::Empty
+    );
+    span.in_scope(|| debug!("Received webhook event: {}", event));
+    let metrics = state.metrics.clone();
+    let format = match payload_format(&headers) {
+        Ok(format) => format,
+        Err(e) => {
+            span.in_scope(|| warn!("Rejected webhook delivery: {}", e.1.message));
+            span.record("status", e.0.as_u16());
+            metrics.observe_webhook_event(event, e.0.as_u16());
+            return e;
+        }
+    };
+    let state = match state.route_delivery(&headers, &payload) {
+        Ok(state) => State(state),
+        Err(e) => {
+            span.in_scope(|| warn!("Failed to verify webhook signature: {}", e.1.message));
+            if e.0 == StatusCode::FORBIDDEN {
+                metrics.observe_signature_failure(signature_failure_reason(&headers));
+            }
+            span.record("status", e.0.as_u16());
+            metrics.observe_webhook_event(event, e.0.as_u16());
+            return e;
+        }
+    };
+    // The signature covers the raw body, so the payload is only extracted from the form after verifying it
+    let payload = match format {
+        PayloadFormat::Json => payload,
+        PayloadFormat::Form => match form::form_payload(&payload) {
+            Ok(payload) => payload,
+            Err(message) => {
+                span.in_scope(|| warn!("Failed to read form encoded webhook delivery: {message}"));
+                span.record("status", StatusCode::BAD_REQUEST.as_u16());
+                metrics.observe_webhook_event(event, StatusCode::BAD_REQUEST.as_u16());
+                return (StatusCode::BAD_REQUEST, Json(Response::error(&message)));
+            }
+        },
+    };
+
+    let timeout = state.webhook_timeout;
+    let handle_event = async move {
+        match event {
+            "check_run" => handle_check_run_event(state.0, &payload).await,
+            "pull_request" => handle_pull_request_event(&state, &payload).await,
+            "issue_comment" => handle_issue_comment_event(&state, &payload).await,
+            "check_suite" => handle_check_suite_event(&state, &payload).await,
+            "merge_group" => handle_merge_group_event(&state, &payload).await,
+            "ping" => handle_ping_event(&payload),
+            "installation" => handle_installation_event(&state, &payload).await,
+            "installation_repositories" => handle_installation_repositories_event(&payload),
+            event => {
+                let message = format!("Received unsupported event: {event}");
+                info!(target: EVENT_LOG_TARGET, "{message}");
+                (StatusCode::NOT_IMPLEMENTED, Json(Response::error(&message)))
+            }
+        }
+    }
+    .instrument(span.clone());
+
+    // Dropping the future on timeout cancels all pending requests to GitHub
+    let mut response = match timeout {
+        Some(timeout) => tokio::time::timeout(timeout, handle_event)
+            .await
+            .unwrap_or_else(|_| {
+                error!("Timed out handling {event} event after {timeout:?}");
+                (
+                    StatusCode::GATEWAY_TIMEOUT,
+                    Json(Response::error("Timed out handling event")),
+                )
+            }),
+        None => handle_event.await,
+    };
+    // Acknowledge successful deliveries explicitly, so it is clear from the response if they were acted upon
+    if response.0.is_success() {
+        response.1.handled.get_or_insert(true);
+        response.1.event = Some(event.to_string());
+    }
+    span.record("status", response.0.as_u16());
+    metrics.observe_webhook_event(event, response.0.as_u16());
+    response
+}
+
+/// Content types GitHub can use for webhook deliveries
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum PayloadFormat {
+    /// The body is the JSON payload, "application/json"
+    Json,
+    /// The JSON payload is in the "payload" field of the form, "application/x-www-form-urlencoded"
+    Form,
 }
 
-/// Expose health check endpoint
-/// Can be used when running under kubernetes to check if the server is running
-/// GET /healthz
-async fn healthz() -> (StatusCode, Json<Response>) {
-    (StatusCode::OK, Json(Response::new()))
+/// Determine the format of the payload from the Content-Type header, rejecting unsupported content types with 415.
+/// A missing header is treated as JSON, as GitHub always sends it and JSON is the default format.
+fn payload_format(headers: &HeaderMap) -> Result<PayloadFormat, (StatusCode, Json<Response>)> {
+    let Some(content_type) = headers.get(header::CONTENT_TYPE) else {
+        return Ok(PayloadFormat::Json);
+    };
+    let media_type = content_type
+        .to_str()
+        .unwrap_or_default()
+        .split(';')
+        .next()
+        .unwrap_or_default()
+        .trim();
+    if media_type.eq_ignore_ascii_case("application/json") {
+        Ok(PayloadFormat::Json)
+    } else if media_type.eq_ignore_ascii_case("application/x-www-form-urlencoded") {
+        Ok(PayloadFormat::Form)
+    } else {
+        Err((
+            StatusCode::UNSUPPORTED_MEDIA_TYPE,
+            Json(Response::error(&format!(
+                "Unsupported Content-Type '{media_type}', expected application/json or application/x-www-form-urlencoded"
+            ))),
+        ))
+    }
 }
 
-/// Handle the webhook events send from GitHub
-/// POST /webhook
-async fn webhook_handler(
-    headers: HeaderMap,
-    state: State<ServerState>,
-    payload: String,
-) -> (StatusCode, Json<Response>) {
-    let event = match headers.get("X-GitHub-Event") {
-        Some(event) => event
-            .to_str()
-            .unwrap_or("could not read X-GitHub-Event header"),
-        None => {
-            return (
-                StatusCode::BAD_REQUEST,
-                Json(Response::error("Missing X-GitHub-Event header")),
-            );
+/// Header with the unique ID of a webhook delivery, used to correlate all logs of the delivery
+const DELIVERY_HEADER: &str = "X-GitHub-Delivery";
+
+/// Make sure every webhook request has a delivery ID, generating one if GitHub did not send it.
+/// Allows correlating the request log of the middleware with the logs of the handler.
+async fn ensure_delivery_id(mut request: Request) -> Request {
+    if !request.headers().contains_key(DELIVERY_HEADER) {
+        let delivery = new_delivery_id();
+        debug!("Missing {DELIVERY_HEADER} header, generated delivery ID '{delivery}'");
+        if let Ok(value) = header::HeaderValue::from_str(&delivery) {
+            request.headers_mut().insert(DELIVERY_HEADER, value);
         }
-    };
-    debug!("Received webhook event: {}", event);
-    if let Err(e) = verify_webhook(
-        headers.get("X-Hub-Signature-256"),
-        state.webhook_secret.as_deref(),
-        &payload,
-    ) {
-        warn!("Failed to verify webhook signature: {}", e.1.message);
-        return e;
     }
+    request
+}
 
-    match event {
-        "check_run" => handle_check_run_event(state.0, &payload).await,
-        "pull_request" => handle_pull_request_event(&state.github, &payload).await,
-        "issue_comment" => handle_issue_comment_event(&state.github, &payload).await,
-        "check_suite" => (StatusCode::OK, Json(Response::new())), // Ignore check_suite events
-        event => {
-            let message = format!("Received unsupported event: {event}");
-            info!("{message}");
-            (StatusCode::NOT_IMPLEMENTED, Json(Response::error(&message)))
-        }
+/// Generate a new unique delivery ID, for requests that were not sent by GitHub.
+/// Prefixed with "generated-", so it can't be mistaken for an ID assigned by GitHub.
+fn new_delivery_id() -> String {
+    static COUNTER: AtomicU64 = AtomicU64::new(0);
+    let nanos = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .unwrap_or_default()
+        .as_nanos();
+    let count = COUNTER.fetch_add(1, Ordering::Relaxed);
+    format!("generated-{nanos:x}-{count}")
+}
+
+/// Signature headers sent by GitHub with their value prefix, in order of preference.
+/// The SHA1 signature is only sent by older GitHub Enterprise versions and some proxies.
+const SIGNATURE_HEADERS: [(&str, &str); 2] = [
+    ("X-Hub-Signature-256", "sha256="),
+    ("X-Hub-Signature", "sha1="),
+];
+
+/// Reason label for the signature failure metric, distinguishes missing from invalid signatures.
+fn signature_failure_reason(headers: &HeaderMap) -> &'static str {
+    if SIGNATURE_HEADERS
+        .iter()
+        .any(|(header, _)| headers.contains_key(*header))
+    {
+        "invalid"
+    } else {
+        "missing"
     }
 }
 
-/// Verify the webhook request against the shared secret
+/// Verify the webhook request against the shared secret.
+/// Uses X-Hub-Signature-256 when present, otherwise falls back to X-Hub-Signature.
 fn verify_webhook(
-    signature: Option<&HeaderValue>,
+    headers: &HeaderMap,
     secret: Option<&str>,
     payload: &str,
 ) -> Result<(), (StatusCode, Json<Response>)> {
@@ -297,14 +2041,11 @@ fn verify_webhook(
         }
     };
 
-    let signature = match signature {
-        Some(s) => s.to_str().map_err(|e| {
-            info!("Failed to read X-Hub-Signature-256 header: {e}");
-            (
-                StatusCode::FORBIDDEN,
-                Json(Response::error("Invalid X-Hub-Signature-256 header")),
-            )
-        })?,
+    let (header, prefix, signature) = match SIGNATURE_HEADERS
+        .iter()
+        .find_map(|(header, prefix)| Some((*header, *prefix, headers.get(*header)?)))
+    {
+        Some(signature) => signature,
         None => {
             return Err((
                 StatusCode::FORBIDDEN,
@@ -312,15 +2053,37 @@ fn verify_webhook(
             ));
         }
     };
-    let signature = signature.strip_prefix("sha256=").unwrap_or(signature);
-    let signature = hex::decode_hex(signature).map_err(|_| {
+    let invalid_header = || {
         (
             StatusCode::FORBIDDEN,
-            Json(Response::error("Invalid X-Hub-Signature-256 header")),
+            Json(Response::error(&format!("Invalid {header} header"))),
         )
+    };
+
+    let signature = signature.to_str().map_err(|e| {
+        info!("Failed to read {header} header: {e}");
+        invalid_header()
     })?;
+    let signature = signature.strip_prefix(prefix).unwrap_or(signature);
+    let signature = hex::decode_hex(signature).map_err(|_| invalid_header())?;
+
+    if prefix == "sha1=" {
+        debug!("Verifying webhook with legacy {header} header");
+        verify_hmac::<Hmac<sha1::Sha1>>(secret, payload, &signature)
+    } else {
+        verify_hmac::<Hmac<sha2::Sha256>>(secret, payload, &signature)
+    }
+}
 
-    let mut mac = Hmac::<sha2::Sha256>::new_from_slice(secret.as_bytes()).map_err(|e| {
+/// Verify the HMAC of the payload against the given signature.
+/// The comparison is constant-time for all digests, and neither the received nor the computed
+/// signature are part of the error, so they can't end up in the logs.
+fn verify_hmac<M: Mac + KeyInit>(
+    secret: &str,
+    payload: &str,
+    signature: &[u8],
+) -> Result<(), (StatusCode, Json<Response>)> {
+    let mut mac = M::new_from_slice(secret.as_bytes()).map_err(|e| {
         error!("Failed to create HMAC from secret: {e}");
         (
             StatusCode::INTERNAL_SERVER_ERROR,
@@ -329,7 +2092,7 @@ fn verify_webhook(
     })?;
     mac.update(payload.as_bytes());
 
-    mac.verify_slice(signature.as_slice()).map_err(|_| {
+    mac.verify_slice(signature).map_err(|_| {
         (
             StatusCode::FORBIDDEN,
             Json(Response::error("Invalid webhook signature")),
@@ -340,7 +2103,10 @@ fn verify_webhook(
 }
 
 /// Handle webhook pull_request events
-async fn handle_pull_request_event(client: &Client, payload: &str) -> (StatusCode, Json<Response>) {
+async fn handle_pull_request_event(
+    state: &ServerState,
+    payload: &str,
+) -> (StatusCode, Json<Response>) {
     let payload: PullRequestEvent = match serde_json::from_str(payload) {
         Ok(event) => event,
         Err(e) => {
@@ -352,13 +2118,36 @@ async fn handle_pull_request_event(client: &Client, payload: &str) -> (StatusCod
         }
     };
 
-    match payload.action.as_str() {
-        "opened" | "synchronize" => {}
+    Span::current().record("pull_request", payload.number);
+    Span::current().record("repo", payload.repository.full_name.as_str());
+    if state.is_ignored_repo(&payload.repository) {
+        return (StatusCode::OK, Json(Response::ignored()));
+    }
+
+    // Changed labels or base branches only need a refresh of the existing check run
+    let refresh = match payload.action.as_str() {
+        "opened" | "reopened" | "synchronize" | "labeled" | "unlabeled" | "edited"
+            if payload.pull_request.draft && !state.guard_drafts =>
+        {
+            debug!(
+                "Ignoring draft pull request {} - {}",
+                payload.repository.full_name, payload.pull_request.number
+            );
+            return (StatusCode::OK, Json(Response::ignored()));
+        }
+        "opened" | "reopened" | "synchronize" => None,
+        // Drafts already have a check run when they are guarded
+        "ready_for_review" if !state.guard_drafts => None,
+        "labeled" | "unlabeled" if !state.github.required_labels().is_empty() => {
+            Some("labels changed")
+        }
+        // Edits of only the title or body do not affect the checks
+        "edited" if payload.changes.base.is_some() => Some("base branch changed"),
         action => {
             debug!("Ignoring pull_request event with action: {action}");
-            return (StatusCode::OK, Json(Response::new()));
+            return (StatusCode::OK, Json(Response::ignored()));
         }
-    }
+    };
 
     let app_id = match payload.installation {
         Some(installation) => installation.id,
@@ -371,25 +2160,40 @@ async fn handle_pull_request_event(client: &Client, payload: &str) -> (StatusCod
         }
     };
 
-    if let Err(e) = client
-        .create_check_run(
-            app_id,
-            &payload.repository.full_name,
-            &payload.pull_request.head.sha,
-        )
-        .await
-    {
-        error!("Failed to create check run: {e}");
-        return (
-            StatusCode::INTERNAL_SERVER_ERROR,
-            Json(Response::error("Failed to create check-run")),
+    let repo = payload.repository.full_name;
+    let commit = payload.pull_request.head.sha;
+    if let Some(reason) = refresh {
+        debug!(
+            "Refreshing check run for pull request {} - {} after {}",
+            repo, payload.pull_request.number, reason
         );
-    };
-    info!(
-        "Created check run for pull request {} - {}",
-        payload.repository.full_name, payload.pull_request.number
+        return state
+            .dispatch(WebhookTask::RefreshCheckRun {
+                app_installation_id: app_id,
+                repo,
+                commit,
+            })
+            .await;
+    }
+
+    debug!(
+        "Creating check run for pull request {} - {}",
+        repo, payload.pull_request.number
     );
-    (StatusCode::OK, Json(Response::new()))
+    let response = state
+        .dispatch(WebhookTask::CreateCheckRun {
+            app_installation_id: app_id,
+            repo: repo.clone(),
+            commit: commit.clone(),
+        })
+        .await;
+    if response.0.is_success() {
+        state.schedule_check_timeout(app_id, &repo, &commit).await;
+        state
+            .schedule_initial_evaluation(app_id, &repo, &commit)
+            .await;
+    }
+    response
 }
 
 /// Handle webhook check_run events
@@ -405,13 +2209,18 @@ async fn handle_check_run_event(state: ServerState, payload: &str) -> (StatusCod
         }
     };
 
+    Span::current().record("repo", payload.repository.full_name.as_str());
+    if state.is_ignored_repo(&payload.repository) {
+        return (StatusCode::OK, Json(Response::ignored()));
+    }
+
     if payload
         .check_run
         .app
         .is_some_and(|app| app.client_id == state.github.client_id())
     {
         debug!("Ignoring check_run event from our own app");
-        return (StatusCode::OK, Json(Response::new()));
+        return (StatusCode::OK, Json(Response::ignored()));
     }
 
     let app_id = match payload.installation {
@@ -425,40 +2234,273 @@ async fn handle_check_run_event(state: ServerState, payload: &str) -> (StatusCod
         }
     };
 
-    if state.use_job_queue {
+    state
+        .record_check_run_refresh(&payload.repository.full_name, &payload.check_run.head_sha)
+        .await;
+
+    refresh_commit(
+        &state,
+        app_id,
+        payload.repository.full_name,
+        payload.check_run.head_sha,
+    )
+    .await
+}
+
+/// Handle check_suite events by refreshing the check run of the head commit once the suite has completed.
+/// Allows reacting to integrations that report their results on the suite level.
+/// Skipped when a check_run event has just refreshed the same commit, to avoid processing it twice.
+async fn handle_check_suite_event(
+    state: &ServerState,
+    payload: &str,
+) -> (StatusCode, Json<Response>) {
+    let payload: CheckSuiteEvent = match serde_json::from_str(payload) {
+        Ok(event) => event,
+        Err(e) => {
+            warn!("Failed to parse check_suite event payload: {e}");
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(Response::error("Invalid check_suite event payload")),
+            );
+        }
+    };
+
+    if payload.action != "completed" {
+        debug!(
+            "Ignoring check_suite event with action '{}'",
+            payload.action
+        );
+        return (StatusCode::OK, Json(Response::ignored()));
+    }
+
+    Span::current().record("repo", payload.repository.full_name.as_str());
+    if state.is_ignored_repo(&payload.repository) {
+        return (StatusCode::OK, Json(Response::ignored()));
+    }
+
+    if payload
+        .check_suite
+        .app
+        .is_some_and(|app| app.client_id == state.github.client_id())
+    {
+        debug!("Ignoring check_suite event from our own app");
+        return (StatusCode::OK, Json(Response::ignored()));
+    }
+
+    let app_id = match payload.installation {
+        Some(installation) => installation.id,
+        None => {
+            warn!("Missing app installation id in check_suite event");
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(Response::error("Missing app installation id")),
+            );
+        }
+    };
+
+    let repo = payload.repository.full_name;
+    let commit = payload.check_suite.head_sha;
+    if state.is_recent_check_run_refresh(&repo, &commit).await {
+        debug!(
+            "Ignoring check_suite event for '{}' - '{}', already refreshed by a check_run event",
+            repo, commit
+        );
+        return (StatusCode::OK, Json(Response::ignored()));
+    }
+
+    refresh_commit(state, app_id, repo, commit).await
+}
+
+/// Handle webhook merge_group events.
+/// Guards the temporary commit of the merge queue, otherwise the queue would wait for our check forever.
+async fn handle_merge_group_event(
+    state: &ServerState,
+    payload: &str,
+) -> (StatusCode, Json<Response>) {
+    let payload: MergeGroupEvent = match serde_json::from_str(payload) {
+        Ok(event) => event,
+        Err(e) => {
+            warn!("Failed to parse merge_group event payload: {e}");
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(Response::error("Invalid merge_group event payload")),
+            );
+        }
+    };
+
+    if payload.action != "checks_requested" {
+        debug!(
+            "Ignoring merge_group event with action '{}'",
+            payload.action
+        );
+        return (StatusCode::OK, Json(Response::ignored()));
+    }
+
+    Span::current().record("repo", payload.repository.full_name.as_str());
+    if state.is_ignored_repo(&payload.repository) {
+        return (StatusCode::OK, Json(Response::ignored()));
+    }
+
+    let app_id = match payload.installation {
+        Some(installation) => installation.id,
+        None => {
+            warn!("Missing app installation id in merge_group event");
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(Response::error("Missing app installation id")),
+            );
+        }
+    };
+
+    let repo = payload.repository.full_name;
+    let commit = payload.merge_group.head_sha;
+    debug!(
+        "Creating check run for merge group '{}' in {}",
+        payload.merge_group.head_ref, repo
+    );
+    let response = state
+        .dispatch(WebhookTask::CreateCheckRun {
+            app_installation_id: app_id,
+            repo: repo.clone(),
+            commit: commit.clone(),
+        })
+        .await;
+    if response.0.is_success() {
+        state.schedule_check_timeout(app_id, &repo, &commit).await;
         state
-            .new_job(
-                app_id,
-                &payload.repository.full_name,
-                &payload.check_run.head_sha,
-            )
+            .schedule_initial_evaluation(app_id, &repo, &commit)
             .await;
+    }
+    response
+}
+
+/// Refresh the check run of the commit, either by queueing a job or right away.
+async fn refresh_commit(
+    state: &ServerState,
+    app_installation_id: u64,
+    repo: String,
+    commit: String,
+) -> (StatusCode, Json<Response>) {
+    if state.use_job_queue {
+        if !state.new_job(app_installation_id, &repo, &commit).await {
+            return (
+                StatusCode::SERVICE_UNAVAILABLE,
+                Json(Response::error("Job queue is full")),
+            );
+        }
         return (StatusCode::OK, Json(Response::new()));
     }
 
-    match state
-        .github
-        .refresh_check_run_status(
-            app_id,
-            &payload.repository.full_name,
-            &payload.check_run.head_sha,
-        )
+    state
+        .dispatch(WebhookTask::RefreshCheckRun {
+            app_installation_id,
+            repo,
+            commit,
+        })
         .await
-    {
-        Ok(_) => (StatusCode::OK, Json(Response::new())),
+}
+
+/// Answer the ping event sent by GitHub when the webhook is created.
+/// Reaching this means the signature of the webhook was verified successfully.
+fn handle_ping_event(payload: &str) -> (StatusCode, Json<Response>) {
+    let payload: PingEvent = match serde_json::from_str(payload) {
+        Ok(event) => event,
         Err(e) => {
-            error!("Failed to refresh check-run status: {e}");
-            (
-                StatusCode::INTERNAL_SERVER_ERROR,
-                Json(Response::error("Failed to refresh check-run status")),
-            )
+            warn!("Failed to parse ping event payload: {e}");
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(Response::error("Invalid ping event payload")),
+            );
+        }
+    };
+
+    info!(
+        "Received ping from GitHub for webhook {}",
+        payload
+            .hook_id
+            .map_or_else(|| "unknown".to_string(), |id| id.to_string())
+    );
+
+    let mut response = Response::new();
+    if let Some(zen) = payload.zen {
+        response.message = zen;
+    }
+    (StatusCode::OK, Json(response))
+}
+
+/// Handle webhook installation events.
+/// Cached tokens are removed when the app is uninstalled, as they have been revoked.
+async fn handle_installation_event(
+    state: &ServerState,
+    payload: &str,
+) -> (StatusCode, Json<Response>) {
+    let payload: InstallationEvent = match serde_json::from_str(payload) {
+        Ok(event) => event,
+        Err(e) => {
+            warn!("Failed to parse installation event payload: {e}");
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(Response::error("Invalid installation event payload")),
+            );
         }
+    };
+
+    let installation = &payload.installation;
+    info!(
+        target: EVENT_LOG_TARGET,
+        "App installation {} for '{}' has been {}",
+        installation.id,
+        installation
+            .account
+            .as_ref()
+            .map_or("unknown account", |account| account.login.as_str()),
+        payload.action
+    );
+
+    if payload.action == "deleted" && state.github.remove_cached_token(installation.id).await {
+        debug!(
+            "Removed cached token for deleted installation {}",
+            installation.id
+        );
     }
+    (StatusCode::OK, Json(Response::new()))
+}
+
+/// Handle webhook installation_repositories events
+fn handle_installation_repositories_event(payload: &str) -> (StatusCode, Json<Response>) {
+    let payload: InstallationRepositoriesEvent = match serde_json::from_str(payload) {
+        Ok(event) => event,
+        Err(e) => {
+            warn!("Failed to parse installation_repositories event payload: {e}");
+            return (
+                StatusCode::BAD_REQUEST,
+                Json(Response::error(
+                    "Invalid installation_repositories event payload",
+                )),
+            );
+        }
+    };
+
+    let names = |repos: &[Repo]| {
+        repos
+            .iter()
+            .map(|repo| repo.full_name.as_str())
+            .collect::<Vec<_>>()
+            .join(", ")
+    };
+    info!(
+        target: EVENT_LOG_TARGET,
+        "Repositories of app installation {} have changed, added: [{}], removed: [{}]",
+        payload.installation.id,
+        names(&payload.repositories_added),
+        names(&payload.repositories_removed)
+    );
+    (StatusCode::OK, Json(Response::new()))
 }
 
 /// Handle webhook issue_comment events
 async fn handle_issue_comment_event(
-    client: &Client,
+    state: &ServerState,
     payload: &str,
 ) -> (StatusCode, Json<Response>) {
     let payload: IssueCommentEvent = match serde_json::from_str(payload) {
@@ -472,6 +2514,11 @@ async fn handle_issue_comment_event(
         }
     };
 
+    Span::current().record("repo", payload.repository.full_name.as_str());
+    if state.is_ignored_repo(&payload.repository) {
+        return (StatusCode::OK, Json(Response::ignored()));
+    }
+
     let app_id = match payload.installation {
         Some(installation) => installation.id,
         None => {
@@ -488,44 +2535,64 @@ async fn handle_issue_comment_event(
             "Ignoring issue_comment event with action: {}",
             payload.action
         );
-        return (StatusCode::OK, Json(Response::new()));
+        return (StatusCode::OK, Json(Response::ignored()));
     }
 
     if !payload.comment.body.contains("/cerberus refresh") {
         debug!("Ignoring issue comment without '/cerberus' command");
-        return (StatusCode::OK, Json(Response::new()));
+        return (StatusCode::OK, Json(Response::ignored()));
     }
     info!(
+        target: EVENT_LOG_TARGET,
         "Received issue_comment event for issue {}: {}",
         payload.issue.number, payload.comment.body
     );
-
-    let commit = match client
-        .get_pull_request_head_commit(app_id, &payload.repository.full_name, payload.issue.number)
+    Span::current().record("pull_request", payload.issue.number);
+
+    state
+        .dispatch(WebhookTask::RefreshPullRequest {
+            app_installation_id: app_id,
+            repo: payload.repository.full_name,
+            pull_request: payload.issue.number,
+        })
         .await
-    {
-        Ok(commit) => commit,
-        Err(e) => {
-            error!("Failed to get pull request head commit: {e}");
-            return (
-                StatusCode::INTERNAL_SERVER_ERROR,
-                Json(Response::error("Failed to get pull request head commit")),
-            );
-        }
-    };
+}
 
-    if let Err(e) = client
-        .refresh_check_run_status(app_id, &payload.repository.full_name, &commit)
-        .await
-    {
-        error!("Failed to refresh check-run status: {e}");
-        return (
-            StatusCode::INTERNAL_SERVER_ERROR,
-            Json(Response::error("Failed to refresh check-run status")),
-        );
-    }
+/// Request body of the admin endpoint for re-evaluating a guard
+#[derive(Debug, Serialize, Deserialize)]
+pub struct ReevaluateRequest {
+    /// Full name of the repository, e.g. "owner/repo"
+    pub repo: String,
+    /// Commit to re-evaluate, mutually exclusive with pull_request
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub commit: Option<String>,
+    /// Pull request to re-evaluate the head commit of, mutually exclusive with commit
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub pull_request: Option<u64>,
+    /// Only use the app with this client ID, when multiple apps are installed on the repository
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub client_id: Option<String>,
+}
 
-    (StatusCode::OK, Json(Response::new()))
+/// Pending guards returned by the debug endpoint
+#[derive(Debug, Serialize)]
+pub struct GuardsResponse {
+    pub guards: Vec<PendingGuard>,
+}
+
+/// Rate limit status of all apps returned by the debug endpoint
+#[derive(Debug, Serialize)]
+pub struct RateLimitsResponse {
+    pub apps: Vec<AppRateLimit>,
+}
+
+/// Rate limit status of a single app
+#[derive(Debug, Serialize)]
+pub struct AppRateLimit {
+    pub client_id: String,
+    pub core: RateLimit,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub graphql: Option<RateLimit>,
 }
 
 /// Detailed status of the Webserver
@@ -536,6 +2603,12 @@ pub struct Response {
     pub status: String,
     /// Optional message providing more details about the status.
     pub message: String,
+    /// Set for webhook deliveries, false if the event was accepted but ignored.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub handled: Option<bool>,
+    /// Set for webhook deliveries, the event that was received.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub event: Option<String>,
 }
 
 impl Response {
@@ -544,6 +2617,16 @@ impl Response {
         Self {
             status: SERVER_STATUS_OK.to_string(),
             message: SERVER_MESSAGE_OK.to_string(),
+            handled: None,
+            event: None,
+        }
+    }
+
+    /// Create a new response with ok status for a webhook event that was accepted, but not acted upon.
+    pub fn ignored() -> Self {
+        Self {
+            handled: Some(false),
+            ..Self::new()
         }
     }
 
@@ -552,6 +2635,8 @@ impl Response {
         Self {
             status: SERVER_STATUS_ERROR.to_string(),
             message: message.to_string(),
+            handled: None,
+            event: None,
         }
     }
 }
@@ -581,6 +2666,105 @@ async fn shutdown_signal() {
     }
 }
 
+/// Check if the bot should act on the repository with the given full name ("owner/repo").
+/// When the allowlist is set, the repository must match it, otherwise it must not match the denylist.
+/// Matching is case-insensitive, like the repository names on GitHub.
+fn is_repo_in_scope(allowlist: &[String], denylist: &[String], full_name: &str) -> bool {
+    let full_name = full_name.to_lowercase();
+    let matches = |patterns: &[String]| {
+        patterns
+            .iter()
+            .any(|pattern| glob_match(&pattern.to_lowercase(), &full_name))
+    };
+    if !allowlist.is_empty() {
+        return matches(allowlist);
+    }
+    !matches(denylist)
+}
+
+/// Move spilled jobs back into the job queue, as many as fit into it.
+/// The remaining jobs are kept in the store for the next run.
+/// The queue is only locked to check its size and to add the jobs, not while waiting for the store.
+async fn unspill_jobs(
+    store: &dyn StateStore,
+    job_queue: &Mutex<Vec<Job>>,
+    job_queue_size: usize,
+) -> Result<(), Error> {
+    let free = match job_queue_size {
+        0 => usize::MAX,
+        size => size.saturating_sub(job_queue.lock().await.len()),
+    };
+
+    let mut jobs = Vec::new();
+    let mut result = Ok(());
+    while jobs.len() < free {
+        let value = match store.pop(SPILLED_JOBS_KEY).await {
+            Ok(Some(value)) => value,
+            Ok(None) => break,
+            Err(e) => {
+                // Keep the jobs that have already been taken from the store
+                result = Err(e);
+                break;
+            }
+        };
+        match serde_json::from_str::<Job>(&value) {
+            Ok(job) => jobs.push(job),
+            Err(e) => warn!("Dropping invalid spilled job '{value}': {e}"),
+        }
+    }
+
+    if !jobs.is_empty() {
+        info!("Moved {} spilled jobs back into the job queue", jobs.len());
+        job_queue.lock().await.extend(jobs);
+    }
+    result
+}
+
+/// Move spilled webhook tasks back into the worker queue, as many as fit into it.
+/// The remaining tasks are kept in the store for the next run.
+async fn unspill_tasks(
+    store: &dyn StateStore,
+    workers: &mpsc::Sender<(WebhookTask, Arc<Client>, Span)>,
+    apps: &[WebhookApp],
+) -> Result<(), Error> {
+    let mut moved = 0;
+    while workers.capacity() > 0 {
+        let Some(value) = store.pop(SPILLED_TASKS_KEY).await? else {
+            break;
+        };
+        let spilled = match serde_json::from_str::<SpilledTask>(&value) {
+            Ok(spilled) => spilled,
+            Err(e) => {
+                warn!("Dropping invalid spilled task '{value}': {e}");
+                continue;
+            }
+        };
+        let Some(app) = apps
+            .iter()
+            .find(|app| app.github.client_id() == spilled.client_id)
+        else {
+            warn!(
+                "Dropping spilled {:?}, the app '{}' is not configured",
+                spilled.task, spilled.client_id
+            );
+            continue;
+        };
+        if workers
+            .try_send((spilled.task, app.github.clone(), Span::none()))
+            .is_err()
+        {
+            // A webhook event took the free slot in the meantime, keep the task for the next run
+            store.push(SPILLED_TASKS_KEY, &value, SPILLED_TTL).await?;
+            break;
+        }
+        moved += 1;
+    }
+    if moved > 0 {
+        info!("Moved {moved} spilled tasks back into the worker queue");
+    }
+    Ok(())
+}
+
 /// Remove duplicates from job queue
 fn deduplicate_jobs(job_queue: &mut Vec<Job>) {
     job_queue.sort();
@@ -0,0 +1,260 @@
+use axum::{Router, serve::Listener};
+use hyper_util::{
+    rt::{TokioExecutor, TokioIo, TokioTimer},
+    server::{conn::auto::Builder, graceful::GracefulShutdown},
+    service::TowerToHyperService,
+};
+use std::future::Future;
+use std::io;
+use std::pin::Pin;
+use std::task::{Context, Poll};
+use tokio::io::{AsyncRead, AsyncWrite, ReadBuf};
+use tokio::time::{Duration, Sleep};
+use tracing::debug;
+
+/// Timeouts applied to every connection of the server, None disables the timeout
+#[derive(Debug, Clone, Copy, PartialEq, Default)]
+pub struct Timeouts {
+    /// Time to receive the headers of a HTTP/1 request
+    pub header_read: Option<Duration>,
+    /// Time a connection may wait for data from the client
+    pub idle: Option<Duration>,
+    /// Time a write to the client may take to make progress
+    pub write: Option<Duration>,
+}
+
+/// Serve the router on all connections accepted by the listener, applying the timeouts to each of them.
+/// Stops accepting new connections when the shutdown future completes and waits for the open ones to finish.
+pub async fn serve<L, F>(
+    mut listener: L,
+    router: Router,
+    timeouts: Timeouts,
+    shutdown: F,
+) -> io::Result<()>
+where
+    L: Listener,
+    F: Future<Output = ()> + Send + 'static,
+{
+    let mut builder = Builder::new(TokioExecutor::new());
+    builder
+        .http1()
+        .timer(TokioTimer::new())
+        .header_read_timeout(timeouts.header_read);
+    builder.http2().timer(TokioTimer::new());
+
+    let graceful = GracefulShutdown::new();
+    let mut shutdown = std::pin::pin!(shutdown);
+    loop {
+        let (io, _) = tokio::select! {
+            conn = listener.accept() => conn,
+            _ = &mut shutdown => break,
+        };
+        let io = TokioIo::new(TimeoutStream::new(io, timeouts));
+        let conn = builder
+            .serve_connection_with_upgrades(io, TowerToHyperService::new(router.clone()))
+            .into_owned();
+        let conn = graceful.watch(conn);
+        tokio::spawn(async move {
+            if let Err(e) = conn.await {
+                debug!("Connection closed with error: {e}");
+            }
+        });
+    }
+
+    graceful.shutdown().await;
+    Ok(())
+}
+
+/// Wrapper around a connection, failing reads and writes that are pending for longer than the timeouts.
+pub struct TimeoutStream<S> {
+    inner: S,
+    timeouts: Timeouts,
+    /// Running while a read is pending
+    read_sleep: Option<Pin<Box<Sleep>>>,
+    /// Running while a write is pending
+    write_sleep: Option<Pin<Box<Sleep>>>,
+}
+
+impl<S> TimeoutStream<S> {
+    pub fn new(inner: S, timeouts: Timeouts) -> Self {
+        Self {
+            inner,
+            timeouts,
+            read_sleep: None,
+            write_sleep: None,
+        }
+    }
+}
+
+/// Start the timer if it is not running yet and fail once the timeout is reached.
+fn poll_timeout<T>(
+    sleep: &mut Option<Pin<Box<Sleep>>>,
+    timeout: Option<Duration>,
+    cx: &mut Context<'_>,
+    message: &'static str,
+) -> Poll<io::Result<T>> {
+    let Some(timeout) = timeout else {
+        return Poll::Pending;
+    };
+    let timer = sleep.get_or_insert_with(|| Box::pin(tokio::time::sleep(timeout)));
+    match timer.as_mut().poll(cx) {
+        Poll::Ready(()) => {
+            *sleep = None;
+            Poll::Ready(Err(io::Error::new(io::ErrorKind::TimedOut, message)))
+        }
+        Poll::Pending => Poll::Pending,
+    }
+}
+
+impl<S: AsyncRead + Unpin> AsyncRead for TimeoutStream<S> {
+    fn poll_read(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &mut ReadBuf<'_>,
+    ) -> Poll<io::Result<()>> {
+        let this = self.get_mut();
+        match Pin::new(&mut this.inner).poll_read(cx, buf) {
+            Poll::Ready(result) => {
+                this.read_sleep = None;
+                Poll::Ready(result)
+            }
+            Poll::Pending => poll_timeout(
+                &mut this.read_sleep,
+                this.timeouts.idle,
+                cx,
+                "connection has been idle for too long",
+            ),
+        }
+    }
+}
+
+impl<S: AsyncWrite + Unpin> AsyncWrite for TimeoutStream<S> {
+    fn poll_write(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        let this = self.get_mut();
+        match Pin::new(&mut this.inner).poll_write(cx, buf) {
+            Poll::Ready(result) => {
+                this.write_sleep = None;
+                Poll::Ready(result)
+            }
+            Poll::Pending => poll_timeout(
+                &mut this.write_sleep,
+                this.timeouts.write,
+                cx,
+                "write to the client timed out",
+            ),
+        }
+    }
+
+    fn poll_flush(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        let this = self.get_mut();
+        match Pin::new(&mut this.inner).poll_flush(cx) {
+            Poll::Ready(result) => {
+                this.write_sleep = None;
+                Poll::Ready(result)
+            }
+            Poll::Pending => poll_timeout(
+                &mut this.write_sleep,
+                this.timeouts.write,
+                cx,
+                "write to the client timed out",
+            ),
+        }
+    }
+
+    fn poll_shutdown(self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.get_mut().inner).poll_shutdown(cx)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::routing::get;
+    use std::net::SocketAddr;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::{TcpListener, TcpStream};
+
+    /// Serve a router with the timeouts on a random port and return its address.
+    async fn start(timeouts: Timeouts) -> (SocketAddr, tokio::sync::oneshot::Sender<()>) {
+        let listener = TcpListener::bind("127.0.0.1:0")
+            .await
+            .expect("Failed to bind listener");
+        let addr = listener.local_addr().expect("Listener should have addr");
+        let router = Router::new().route("/", get(|| async { "ok" }));
+        let (shutdown_tx, shutdown_rx) = tokio::sync::oneshot::channel::<()>();
+        tokio::spawn(serve(listener, router, timeouts, async move {
+            let _ = shutdown_rx.await;
+        }));
+        (addr, shutdown_tx)
+    }
+
+    /// Read from the stream until it is closed by the server, returns false if it is still open after the limit.
+    async fn closed_within(stream: &mut TcpStream, limit: Duration) -> bool {
+        let mut buf = Vec::new();
+        tokio::time::timeout(limit, stream.read_to_end(&mut buf))
+            .await
+            .is_ok()
+    }
+
+    #[tokio::test]
+    async fn header_read_timeout_closes_slow_connections() {
+        let (addr, _shutdown) = start(Timeouts {
+            header_read: Some(Duration::from_millis(500)),
+            ..Default::default()
+        })
+        .await;
+
+        let mut stream = TcpStream::connect(addr).await.expect("Failed to connect");
+        stream
+            .write_all(b"GET / HTTP/1.1\r\nHost: localhost\r\n")
+            .await
+            .expect("Failed to send partial headers");
+        assert!(
+            closed_within(&mut stream, Duration::from_secs(5)).await,
+            "Should close the connection when the headers are incomplete"
+        );
+    }
+
+    #[tokio::test]
+    async fn idle_timeout_closes_idle_connections() {
+        let (addr, _shutdown) = start(Timeouts {
+            idle: Some(Duration::from_millis(500)),
+            ..Default::default()
+        })
+        .await;
+
+        let mut stream = TcpStream::connect(addr).await.expect("Failed to connect");
+        stream
+            .write_all(b"GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+            .await
+            .expect("Failed to send request");
+        let mut buf = [0; 1024];
+        let n = stream
+            .read(&mut buf)
+            .await
+            .expect("Should receive response");
+        assert!(
+            String::from_utf8_lossy(&buf[..n]).starts_with("HTTP/1.1 200"),
+            "Should serve requests"
+        );
+        assert!(
+            closed_within(&mut stream, Duration::from_secs(5)).await,
+            "Should close the idle keep-alive connection"
+        );
+    }
+
+    #[tokio::test]
+    async fn connections_stay_open_without_timeouts() {
+        let (addr, _shutdown) = start(Timeouts::default()).await;
+
+        let mut stream = TcpStream::connect(addr).await.expect("Failed to connect");
+        assert!(
+            !closed_within(&mut stream, Duration::from_secs(1)).await,
+            "Should keep the connection open"
+        );
+    }
+}
@@ -0,0 +1,81 @@
+use super::hex::decode_hex;
+
+/// Name of the field GitHub puts the JSON payload in, when the webhook uses application/x-www-form-urlencoded
+const PAYLOAD_FIELD: &str = "payload";
+
+/// Extract the JSON payload from the body of a form encoded webhook delivery.
+pub fn form_payload(body: &str) -> Result<String, String> {
+    for pair in body.split('&') {
+        let (key, value) = pair.split_once('=').unwrap_or((pair, ""));
+        if decode_form_value(key)? == PAYLOAD_FIELD {
+            return decode_form_value(value);
+        }
+    }
+    Err(format!("Missing '{PAYLOAD_FIELD}' field in form body"))
+}
+
+/// Decode a single key or value of a form, "+" is a space and "%XX" a percent encoded byte.
+fn decode_form_value(s: &str) -> Result<String, String> {
+    let bytes = s.as_bytes();
+    let mut decoded = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+    while i < bytes.len() {
+        match bytes[i] {
+            b'+' => decoded.push(b' '),
+            b'%' => {
+                let encoded = s
+                    .get(i + 1..i + 3)
+                    .ok_or_else(|| "Incomplete percent encoding in form body".to_string())?;
+                decoded.extend(decode_hex(encoded)?);
+                i += 2;
+            }
+            byte => decoded.push(byte),
+        }
+        i += 1;
+    }
+    String::from_utf8(decoded).map_err(|e| format!("Form body is not valid UTF-8: {e}"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_form_payload() {
+        assert_eq!(
+            Ok(r#"{"zen":"Keep it simple & stupid."}"#.to_string()),
+            form_payload("payload=%7B%22zen%22%3A%22Keep+it+simple+%26+stupid.%22%7D")
+        );
+    }
+
+    #[test]
+    fn test_form_payload_with_other_fields() {
+        assert_eq!(
+            Ok("{}".to_string()),
+            form_payload("other=value&payload=%7b%7d&last")
+        );
+    }
+
+    #[test]
+    fn test_form_payload_missing() {
+        assert_eq!(
+            Err("Missing 'payload' field in form body".to_string()),
+            form_payload("other=%7B%7D")
+        );
+        assert!(form_payload("").is_err());
+    }
+
+    #[test]
+    fn test_form_payload_invalid_encoding() {
+        assert_eq!(
+            Err("Incomplete percent encoding in form body".to_string()),
+            form_payload("payload=%7")
+        );
+        assert!(form_payload("payload=%zz").is_err());
+        assert!(
+            form_payload("payload=%ff")
+                .unwrap_err()
+                .starts_with("Form body is not valid UTF-8")
+        );
+    }
+}
@@ -1,6 +1,10 @@
-use crate::testutils::{ExpectedRequests, MockGithubApiServer, TlsCertificate};
+use crate::testutils::{
+    BufferWriter, ExpectedRequests, MockGithubApiServer, SpanRecorder, TlsCertificate,
+};
 use crate::{client::Client, client::ClientOptions, types::*};
+use axum::http::HeaderValue;
 use std::collections::VecDeque;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
 use tokio::time::Duration;
 
 use super::*;
@@ -27,14 +31,14 @@ macro_rules! verify_webhook_test {
     $(
         #[test]
         fn $name() {
-            let (signature, secret, payload, res) = $value;
+            let (signatures, secret, payload, res): (Vec<(&str, &str)>, _, _, _) = $value;
 
-            let signature: Option<HeaderValue> = match signature {
-                Some(sig) => Some(HeaderValue::from_str(sig).unwrap()),
-                None => None,
-            };
+            let mut headers = HeaderMap::new();
+            for (header, signature) in signatures {
+                headers.insert(header, HeaderValue::from_str(signature).unwrap());
+            }
 
-            let output = verify_webhook(signature.as_ref(), secret, payload);
+            let output = verify_webhook(&headers, secret, payload);
 
             match res {
                 Ok(()) => assert!(output.is_ok(), "Expected Ok, got: {:?}", output),
@@ -53,44 +57,113 @@ macro_rules! verify_webhook_test {
     }
 }
 
+const VALID_SHA256_SIGNATURE: (&str, &str) = (
+    "X-Hub-Signature-256",
+    "sha256=2f94a757d2246073e26781d117ce0183ebd87b4d66c460494376d5c37d71985b",
+);
+const VALID_SHA1_SIGNATURE: (&str, &str) = (
+    "X-Hub-Signature",
+    "sha1=036390762c04ea4aaad6eb98131200edfe902fd9",
+);
+
 verify_webhook_test! {
     verify_webhook_valid_signature: (
-        Some("sha256=2f94a757d2246073e26781d117ce0183ebd87b4d66c460494376d5c37d71985b"),
+        vec![VALID_SHA256_SIGNATURE],
         Some("test-secret"),
         "test payload",
         verify_webhook_ok_result(),
     ),
     verify_webhook_invalid_signature: (
-        Some("sha256=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"),
+        vec![("X-Hub-Signature-256", "sha256=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")],
         Some("test-secret"),
         "test payload",
         verify_webhook_error_result("Invalid webhook signature"),
     ),
     verify_webhook_malformed_signature: (
-        Some("sha256=invalid-signature"),
+        vec![("X-Hub-Signature-256", "sha256=invalid-signature")],
         Some("test-secret"),
         "test payload",
         verify_webhook_error_result("Invalid X-Hub-Signature-256 header"),
     ),
     verify_webhook_missing_signature: (
-        None,
+        vec![],
         Some("test-secret"),
         "test payload",
         verify_webhook_error_result("Missing X-Hub-Signature-256 header"),
     ),
     verify_webhook_no_secret: (
-        Some("sha256=invalid-signature"),
+        vec![("X-Hub-Signature-256", "sha256=invalid-signature")],
         None,
         "test payload",
         verify_webhook_ok_result(),
     ),
     verify_webhook_no_secret_or_signature: (
+        vec![],
         None,
-        None,
         "test payload",
         verify_webhook_ok_result(),
     ),
+    verify_webhook_valid_sha1_signature: (
+        vec![VALID_SHA1_SIGNATURE],
+        Some("test-secret"),
+        "test payload",
+        verify_webhook_ok_result(),
+    ),
+    verify_webhook_invalid_sha1_signature: (
+        vec![("X-Hub-Signature", "sha1=0123456789abcdef0123456789abcdef01234567")],
+        Some("test-secret"),
+        "test payload",
+        verify_webhook_error_result("Invalid webhook signature"),
+    ),
+    verify_webhook_malformed_sha1_signature: (
+        vec![("X-Hub-Signature", "sha1=invalid-signature")],
+        Some("test-secret"),
+        "test payload",
+        verify_webhook_error_result("Invalid X-Hub-Signature header"),
+    ),
+    verify_webhook_prefers_sha256_signature: (
+        vec![
+            ("X-Hub-Signature-256", "sha256=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"),
+            VALID_SHA1_SIGNATURE,
+        ],
+        Some("test-secret"),
+        "test payload",
+        verify_webhook_error_result("Invalid webhook signature"),
+    ),
+    verify_webhook_both_signatures_valid: (
+        vec![VALID_SHA256_SIGNATURE, VALID_SHA1_SIGNATURE],
+        Some("test-secret"),
+        "test payload",
+        verify_webhook_ok_result(),
+    ),
+}
 
+#[test]
+fn verify_webhook_error_does_not_leak_signatures() {
+    for ((header, expected), received) in [
+        (
+            VALID_SHA256_SIGNATURE,
+            "sha256=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+        ),
+        (
+            VALID_SHA1_SIGNATURE,
+            "sha1=0123456789abcdef0123456789abcdef01234567",
+        ),
+    ] {
+        let mut headers = HeaderMap::new();
+        headers.insert(header, HeaderValue::from_static(received));
+
+        let (_, response) = verify_webhook(&headers, Some("test-secret"), "test payload")
+            .expect_err("Signature should not match");
+        for signature in [expected, received] {
+            let (_, hex) = signature.split_once('=').unwrap();
+            assert!(
+                !response.message.contains(hex),
+                "{header}: error should not contain the signature, got: {}",
+                response.message
+            );
+        }
+    }
 }
 
 #[tokio::test]
@@ -127,7 +200,7 @@ async fn handle_webhook_comment_refresh_command() {
     let mut own_run = CheckRun::new(commit);
     own_run.id = 123456;
     // Status should be success, so the server does not attempt to update it.
-    own_run.update_status(0);
+    own_run.update_status(&CheckRunsStatus::default());
     own_run.app = Some(App {
         id: 123456,
         client_id: client_id.to_string(),
@@ -147,6 +220,7 @@ async fn handle_webhook_comment_refresh_command() {
             PullRequestResponse {
                 id: 123456,
                 number: 42,
+                state: "open".to_string(),
                 head: BranchRef {
                     label: "feature-branch".to_string(),
                     ref_field: "feature-branch".to_string(),
@@ -155,8 +229,12 @@ async fn handle_webhook_comment_refresh_command() {
                         id: 7890,
                         name: "test-repo".to_string(),
                         full_name: "test-org/test-repo".to_string(),
+                        owner: None,
+                        private: false,
+                        visibility: String::new(),
                     },
                 },
+                labels: Vec::new(),
             },
         ),
         ExpectedRequests::GetCheckRuns(
@@ -166,6 +244,7 @@ async fn handle_webhook_comment_refresh_command() {
                 check_runs: vec![own_run],
             },
         ),
+        ExpectedRequests::GetCommitStatuses(StatusCode::OK, CombinedStatusResponse::default()),
     ]);
 
     // Start the mock server
@@ -178,6 +257,7 @@ async fn handle_webhook_comment_refresh_command() {
         client_id: client_id.to_string(),
         private_key: certificate.key.to_string(),
         api: api_addr.to_string(),
+        ..Default::default()
     };
     let github = Client::build(client_options).expect("Failed to build GitHub client");
     let state = ServerState::new(None, github);
@@ -220,6 +300,7 @@ async fn webhook_check_run_job_queue() {
         client_id: "test-client-id".to_string(),
         private_key: certificate.key.to_string(),
         api: api_addr.to_string(),
+        ..Default::default()
     };
     let github = Client::build(client_options).expect("Failed to build GitHub client");
     let mut state = ServerState::new(None, github);
@@ -249,41 +330,49 @@ fn duplicate_jobs() {
     let mut job_queue = Vec::new();
 
     job_queue.push(Job {
+        client_id: "test-client".to_string(),
         app_installation_id: 1,
         repo: "test-org/test-repo".to_string(),
         commit: "abc123".to_string(),
     });
     job_queue.push(Job {
+        client_id: "test-client".to_string(),
         app_installation_id: 1,
         repo: "test-org/new-test-repo".to_string(),
         commit: "abc123".to_string(),
     });
     job_queue.push(Job {
+        client_id: "test-client".to_string(),
         app_installation_id: 1,
         repo: "test-org/new-test-repo".to_string(),
         commit: "123456".to_string(),
     });
     job_queue.push(Job {
+        client_id: "test-client".to_string(),
         app_installation_id: 3,
         repo: "test-org/test-repo".to_string(),
         commit: "abc123".to_string(),
     });
     job_queue.push(Job {
+        client_id: "test-client".to_string(),
         app_installation_id: 2,
         repo: "test-org/test-repo".to_string(),
         commit: "abc123".to_string(),
     });
     job_queue.push(Job {
+        client_id: "test-client".to_string(),
         app_installation_id: 3,
         repo: "test-org/test-repo".to_string(),
         commit: "abc123".to_string(),
     });
     job_queue.push(Job {
+        client_id: "test-client".to_string(),
         app_installation_id: 1,
         repo: "test-org/new-test-repo".to_string(),
         commit: "abc123".to_string(),
     });
     job_queue.push(Job {
+        client_id: "test-client".to_string(),
         app_installation_id: 1,
         repo: "test-org/new-test-repo".to_string(),
         commit: "123456".to_string(),
@@ -319,6 +408,7 @@ async fn run_periodic_job_queue() {
             },
         ),
         ExpectedRequests::GetCheckRuns(StatusCode::OK, check_runs_response),
+        ExpectedRequests::GetCommitStatuses(StatusCode::OK, CombinedStatusResponse::default()),
         ExpectedRequests::UpdateCheckRun(StatusCode::OK, check_run.clone()),
     ]);
 
@@ -330,11 +420,15 @@ async fn run_periodic_job_queue() {
         client_id: "test-client".to_string(),
         private_key: certificate.key.to_string(),
         api: api_addr.to_string(),
+        ..Default::default()
     };
     let github = Client::build(client_options).expect("Failed to build GitHub client");
 
     let mut state = ServerState::new(None, github);
-    state.new_job(12345, "testorg/testrepo", commit).await;
+    assert!(
+        state.new_job(12345, "testorg/testrepo", commit).await,
+        "Should have queued job"
+    );
     state.periodically_run_job_queue(1);
 
     for i in 0..10 {
@@ -349,7 +443,75 @@ async fn run_periodic_job_queue() {
     }
 
     let requests = &server.state.lock().await.requests;
-    assert_eq!(3, requests.len(), "Should have made 3 requests");
+    assert_eq!(4, requests.len(), "Should have made 4 requests");
+}
+
+#[tokio::test]
+async fn webhook_check_suite_completed_event() {
+    let payload = include_str!("testdata/check-suite-event-completed.json");
+
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    state.use_job_queue = true;
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("check_suite"));
+    let (status, response) =
+        webhook_handler(headers, State(state.clone()), payload.to_string()).await;
+
+    assert_eq!(StatusCode::OK, status, "Response: {response:?}");
+    assert_eq!(
+        serde_json::json!({
+            "status": SERVER_STATUS_OK,
+            "message": SERVER_MESSAGE_OK,
+            "handled": true,
+            "event": "check_suite",
+        }),
+        serde_json::to_value(&response.0).expect("Should serialize response"),
+        "Should acknowledge the handled event"
+    );
+    assert_eq!(
+        vec![Job {
+            client_id: "testid".to_string(),
+            app_installation_id: 68583790,
+            repo: "heathcliff26/cerberus-mergeguard".to_string(),
+            commit: "253f31d91db3a05dcf75c0e8135309491fed8669".to_string(),
+        }],
+        *state.job_queue.lock().await,
+        "Should refresh the head commit of the suite"
+    );
+}
+
+#[tokio::test]
+async fn webhook_check_suite_after_check_run_event() {
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    state.use_job_queue = true;
+
+    for (event, payload) in [
+        ("check_run", include_str!("testdata/check-run-event.json")),
+        (
+            "check_suite",
+            include_str!("testdata/check-suite-event-completed.json"),
+        ),
+    ] {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-GitHub-Event", HeaderValue::from_str(event).unwrap());
+        let (status, response) =
+            webhook_handler(headers, State(state.clone()), payload.to_string()).await;
+        assert_eq!(StatusCode::OK, status, "{event} response: {response:?}");
+
+        // Processing the job in between must not cause the suite to refresh the commit again
+        let jobs = state.job_queue.lock().await.drain(..).count();
+        match event {
+            "check_run" => assert_eq!(1, jobs, "Should refresh the commit for the check_run"),
+            _ => assert_eq!(0, jobs, "Should not refresh the commit again for the suite"),
+        }
+    }
 }
 
 #[tokio::test]
@@ -365,7 +527,3345 @@ async fn ignore_webhook_check_suite_event() {
     );
     let state = State(state);
 
-    let (status, _) = webhook_handler(headers, state, payload.to_string()).await;
+    let (status, response) = webhook_handler(headers, state, payload.to_string()).await;
 
     assert_eq!(StatusCode::OK, status, "Should return OK for ignored event");
+    assert_eq!(
+        Some(false),
+        response.handled,
+        "Should mark the event as ignored"
+    );
+    assert_eq!(Some("check_suite"), response.event.as_deref());
+}
+
+#[tokio::test]
+async fn webhook_error_response_has_no_acknowledgement() {
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("check_suite"));
+
+    let state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    let (status, response) = webhook_handler(headers, State(state), "{}".to_string()).await;
+
+    assert_eq!(StatusCode::BAD_REQUEST, status);
+    assert_eq!(
+        serde_json::json!({
+            "status": SERVER_STATUS_ERROR,
+            "message": "Invalid check_suite event payload",
+        }),
+        serde_json::to_value(&response.0).expect("Should serialize response"),
+        "Should keep the error response"
+    );
+}
+
+#[tokio::test]
+async fn ignore_user_owned_repo() {
+    let payload = include_str!("../types/testdata/pr-synchronize.json");
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    state.ignore_user_repos = true;
+    let state = State(state);
+
+    let (status, _) = webhook_handler(headers, state, payload.to_string()).await;
+
+    assert_eq!(
+        StatusCode::OK,
+        status,
+        "Should return OK for ignored user owned repo"
+    );
+}
+
+#[test]
+fn is_ignored_repo_user_vs_org() {
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    let mut repo = Repo {
+        id: 1,
+        name: "test-repo".to_string(),
+        full_name: "test-user/test-repo".to_string(),
+        owner: Some(Account {
+            login: "test-user".to_string(),
+            account_type: ACCOUNT_TYPE_USER.to_string(),
+        }),
+        private: false,
+        visibility: String::new(),
+    };
+
+    assert!(
+        !state.is_ignored_repo(&repo),
+        "Should not ignore user repos by default"
+    );
+
+    state.ignore_user_repos = true;
+    assert!(state.is_ignored_repo(&repo), "Should ignore user repos");
+
+    repo.owner = Some(Account {
+        login: "test-org".to_string(),
+        account_type: "Organization".to_string(),
+    });
+    assert!(!state.is_ignored_repo(&repo), "Should not ignore org repos");
+}
+
+macro_rules! repo_in_scope_test {
+    ($($name:ident: $value:expr,)*) => {
+    $(
+        #[test]
+        fn $name() {
+            let (allowlist, denylist, full_name, expected): (Vec<&str>, Vec<&str>, &str, bool) = $value;
+            let allowlist: Vec<String> = allowlist.into_iter().map(String::from).collect();
+            let denylist: Vec<String> = denylist.into_iter().map(String::from).collect();
+            assert_eq!(expected, is_repo_in_scope(&allowlist, &denylist, full_name));
+        }
+    )*
+    }
+}
+
+repo_in_scope_test! {
+    repo_in_scope_without_lists: (vec![], vec![], "my-org/app", true),
+    repo_in_scope_allowlist_include: (vec!["my-org/app"], vec![], "my-org/app", true),
+    repo_in_scope_allowlist_exclude: (vec!["my-org/app"], vec![], "my-org/other", false),
+    repo_in_scope_allowlist_glob: (vec!["my-org/*"], vec![], "my-org/other", true),
+    repo_in_scope_allowlist_glob_other_owner: (vec!["my-org/*"], vec![], "other-org/app", false),
+    repo_in_scope_denylist_exclude: (vec![], vec!["my-org/sandbox"], "my-org/sandbox", false),
+    repo_in_scope_denylist_include: (vec![], vec!["my-org/sandbox"], "my-org/app", true),
+    repo_in_scope_denylist_glob: (vec![], vec!["*/sandbox-?"], "my-org/sandbox-1", false),
+    repo_in_scope_allowlist_precedence: (vec!["my-org/*"], vec!["my-org/*"], "my-org/app", true),
+    repo_in_scope_ignore_case: (vec!["My-Org/*"], vec![], "my-org/App", true),
+}
+
+#[tokio::test]
+async fn ignore_out_of_scope_repo() {
+    for (event, payload) in [
+        (
+            "pull_request",
+            include_str!("../types/testdata/pr-synchronize.json"),
+        ),
+        ("check_run", include_str!("testdata/check-run-event.json")),
+    ] {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-GitHub-Event", HeaderValue::from_str(event).unwrap());
+
+        // Any request to the API would fail, so the event must be ignored to succeed
+        let mut state = ServerState::new(
+            None,
+            Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+        );
+        state.reloadable = Arc::new(std::sync::Mutex::new(Arc::new(ReloadableOptions {
+            repo_denylist: vec!["heathcliff26/*".to_string()],
+            ..Default::default()
+        })));
+
+        let (status, response) = webhook_handler(headers, State(state), payload.to_string()).await;
+
+        assert_eq!(
+            StatusCode::OK,
+            status,
+            "Should acknowledge {event} event for out of scope repo, response: {response:?}"
+        );
+    }
+}
+
+#[test]
+fn is_ignored_repo_visibility() {
+    let state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    let repo = |private: bool, visibility: &str| Repo {
+        id: 1,
+        name: "test-repo".to_string(),
+        full_name: "test-org/test-repo".to_string(),
+        owner: None,
+        private,
+        visibility: visibility.to_string(),
+    };
+    assert!(
+        !state.is_ignored_repo(&repo(false, "public")),
+        "Should guard all visibilities by default"
+    );
+
+    *state.reloadable.lock().unwrap() = Arc::new(ReloadableOptions {
+        repo_visibilities: vec!["private".to_string(), "internal".to_string()],
+        ..Default::default()
+    });
+    assert!(state.is_ignored_repo(&repo(false, "public")));
+    assert!(
+        state.is_ignored_repo(&repo(false, "")),
+        "Should treat repositories without visibility as public"
+    );
+    assert!(!state.is_ignored_repo(&repo(true, "private")));
+    assert!(!state.is_ignored_repo(&repo(true, "internal")));
+    assert!(
+        !state.is_ignored_repo(&repo(true, "")),
+        "Should fall back to the private flag"
+    );
+}
+
+#[tokio::test]
+async fn ignore_repo_with_excluded_visibility() {
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+    // Any request to the API would fail, so the event must be ignored to succeed
+    let state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    *state.reloadable.lock().unwrap() = Arc::new(ReloadableOptions {
+        repo_visibilities: vec!["private".to_string()],
+        ..Default::default()
+    });
+
+    let payload = include_str!("../types/testdata/pr-synchronize.json");
+    let (status, response) = webhook_handler(headers, State(state), payload.to_string()).await;
+    assert_eq!(
+        StatusCode::OK,
+        status,
+        "Should acknowledge event for public repo, response: {response:?}"
+    );
+}
+
+#[test]
+fn validate_repo_visibilities() {
+    let mut options = ServerOptions {
+        repo_visibilities: vec!["public".to_string(), "internal".to_string()],
+        ..Default::default()
+    };
+    assert!(options.validate().is_ok());
+
+    options.repo_visibilities.push("secret".to_string());
+    assert_eq!(
+        Err(vec![ConfigError::UnknownRepoVisibility]),
+        options.validate()
+    );
+}
+
+#[test]
+fn validate_repo_lists() {
+    let mut options = ServerOptions {
+        repo_allowlist: vec!["my-org/*".to_string()],
+        repo_denylist: vec!["my-org/sandbox".to_string()],
+        ..Default::default()
+    };
+    assert!(options.validate().is_ok(), "Should accept repo lists");
+
+    options.repo_denylist.push(" ".to_string());
+    assert_eq!(Err(vec![ConfigError::EmptyRepoPattern]), options.validate());
+}
+
+#[test]
+fn validate_ssl_client_ca() {
+    let certificate = TlsCertificate::create(None);
+    let mut options = SSLOptions {
+        enabled: true,
+        key: certificate.key.clone(),
+        cert: certificate.crt.clone(),
+        client_ca: certificate.crt.clone(),
+        ..Default::default()
+    };
+    assert_eq!(Ok(()), options.validate(), "Should accept a CA bundle");
+
+    options.client_ca = certificate.key.clone();
+    assert_eq!(Err(ConfigError::InvalidSSLClientCa), options.validate());
+
+    options.client_ca = "/does/not/exist.crt".to_string();
+    assert!(options.validate().is_err(), "Should reject missing files");
+
+    options.enabled = false;
+    options.client_ca = certificate.crt.clone();
+    assert_eq!(Err(ConfigError::SSLClientCaWithoutSSL), options.validate());
+}
+
+#[test]
+fn validate_timeouts() {
+    let mut options = ServerOptions::default();
+    assert!(
+        options.validate().is_ok(),
+        "Should accept the default timeouts"
+    );
+
+    options.header_read_timeout = 0;
+    assert_eq!(
+        Err(vec![ConfigError::InvalidHeaderReadTimeout]),
+        options.validate()
+    );
+
+    options.header_read_timeout = 5;
+    options.idle_timeout = options.webhook_timeout;
+    assert_eq!(
+        Err(vec![ConfigError::InvalidIdleTimeout]),
+        options.validate()
+    );
+
+    options.idle_timeout = 0;
+    assert!(
+        options.validate().is_ok(),
+        "Should allow disabling the idle timeout"
+    );
+
+    let negative: Result<ServerOptions, _> = serde_yaml::from_str("write-timeout: -1");
+    assert!(negative.is_err(), "Should reject negative timeouts");
+}
+
+#[test]
+fn validate_token_prewarm_interval() {
+    let mut options = ServerOptions {
+        token_prewarm_interval: 1800,
+        ..Default::default()
+    };
+    assert!(
+        options.validate().is_ok(),
+        "Should accept refreshing tokens every 30 minutes"
+    );
+
+    options.token_prewarm_interval = 1801;
+    assert_eq!(
+        Err(vec![ConfigError::InvalidTokenPrewarmInterval]),
+        options.validate()
+    );
+}
+
+#[test]
+fn validate_redis_url() {
+    for url in ["", "redis://localhost", "redis://:secret@redis:6380/1"] {
+        let options = ServerOptions {
+            redis_url: url.to_string(),
+            ..Default::default()
+        };
+        assert!(options.validate().is_ok(), "Should accept '{url}'");
+    }
+    for url in ["localhost:6379", "rediss://redis", "redis://redis:port"] {
+        let options = ServerOptions {
+            redis_url: url.to_string(),
+            ..Default::default()
+        };
+        assert_eq!(
+            Err(vec![ConfigError::InvalidRedisUrl]),
+            options.validate(),
+            "Should reject '{url}'"
+        );
+    }
+}
+
+#[tokio::test]
+async fn prewarm_tokens_before_first_webhook() {
+    let payload = include_str!("testdata/pull-request-event-reopened.json");
+    let commit = "7f3a1c9e2b4d6f8a0c1e3b5d7f9a2c4e6b8d0f1a";
+
+    let expected_requests = VecDeque::from(vec![
+        ExpectedRequests::ListInstallations(
+            StatusCode::OK,
+            vec![Installation {
+                id: 68583790,
+                account: None,
+            }],
+        ),
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::CreateCheckRun(StatusCode::OK, CheckRun::new(commit)),
+    ]);
+    let server = MockGithubApiServer::new(expected_requests);
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let github = Client::build(ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    })
+    .expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+
+    let (shutdown_tx, shutdown_rx) = watch::channel(false);
+    state.prewarm_tokens(600, shutdown_rx);
+    tokio::time::sleep(Duration::from_millis(200)).await;
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+    let (status, response) = webhook_handler(headers, State(state), payload.to_string()).await;
+    assert_eq!(
+        StatusCode::OK,
+        status,
+        "Should create check-run, response: {response:?}"
+    );
+    let _ = shutdown_tx.send(true);
+
+    let requests = &server.state.lock().await.requests;
+    let uris: Vec<&str> = requests.iter().map(|r| r.uri.as_str()).collect();
+    assert_eq!(
+        vec![
+            "/app/installations?per_page=100",
+            "/app/installations/68583790/access_tokens",
+            "/repos/heathcliff26/cerberus-mergeguard/check-runs",
+        ],
+        uris,
+        "Should use the pre-warmed token for the webhook event"
+    );
+}
+
+#[test]
+fn timeouts_from_options() {
+    let options: ServerOptions = serde_yaml::from_str(
+        "header-read-timeout: 3\nread-timeout: 4\nwrite-timeout: 0\nidle-timeout: 60",
+    )
+    .expect("Should parse options");
+    assert_eq!(4, options.read_timeout);
+    assert_eq!(
+        conn::Timeouts {
+            header_read: Some(Duration::from_secs(3)),
+            idle: Some(Duration::from_secs(60)),
+            write: None,
+        },
+        options.timeouts()
+    );
+
+    let defaults = ServerOptions::default().timeouts();
+    assert_eq!(
+        conn::Timeouts {
+            header_read: Some(Duration::from_secs(10)),
+            idle: Some(Duration::from_secs(120)),
+            write: Some(Duration::from_secs(30)),
+        },
+        defaults
+    );
+}
+
+#[tokio::test]
+async fn read_timeout_rejects_slow_request_bodies() {
+    let options = ServerOptions {
+        read_timeout: 1,
+        ..Default::default()
+    };
+    let state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    let router = new_router(state, &options);
+    let listener = TcpListener::bind("127.0.0.1:0")
+        .await
+        .expect("Failed to bind listener");
+    let addr = listener.local_addr().expect("Listener should have addr");
+    let (shutdown_tx, shutdown_rx) = tokio::sync::oneshot::channel::<()>();
+    tokio::spawn(conn::serve(
+        listener,
+        router,
+        options.timeouts(),
+        async move {
+            let _ = shutdown_rx.await;
+        },
+    ));
+
+    let mut stream = tokio::net::TcpStream::connect(addr)
+        .await
+        .expect("Failed to connect");
+    stream
+        .write_all(
+            b"POST /webhook HTTP/1.1\r\nHost: localhost\r\nX-GitHub-Event: ping\r\nContent-Length: 100\r\n\r\n{",
+        )
+        .await
+        .expect("Failed to send request");
+    let mut buf = [0; 1024];
+    let n = tokio::time::timeout(Duration::from_secs(5), stream.read(&mut buf))
+        .await
+        .expect("Should respond before the client gives up")
+        .expect("Should receive response");
+    let response = String::from_utf8_lossy(&buf[..n]);
+    assert!(
+        response.starts_with("HTTP/1.1 400"),
+        "Should reject the incomplete body: {response}"
+    );
+
+    shutdown_tx
+        .send(())
+        .expect("Failed to send shutdown signal");
+}
+
+#[tokio::test]
+async fn version_endpoint_returns_build_information() {
+    let options = ServerOptions {
+        webhook_secret: Some("0123456789abcdef".to_string()),
+        admin_token: "some-admin-token".to_string(),
+        ..Default::default()
+    };
+    let state = ServerState::new(
+        options.webhook_secret.clone(),
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    let router = new_router(state, &options);
+    let listener = TcpListener::bind("127.0.0.1:0")
+        .await
+        .expect("Failed to bind listener");
+    let addr = listener.local_addr().expect("Listener should have addr");
+    let (shutdown_tx, shutdown_rx) = tokio::sync::oneshot::channel::<()>();
+    tokio::spawn(conn::serve(
+        listener,
+        router,
+        options.timeouts(),
+        async move {
+            let _ = shutdown_rx.await;
+        },
+    ));
+
+    let response = reqwest::get(format!("http://{addr}/version"))
+        .await
+        .expect("Failed to send request");
+    assert_eq!(
+        StatusCode::OK,
+        response.status(),
+        "Should not require authentication"
+    );
+    let info: serde_json::Value = response.json().await.expect("Should return JSON");
+    let info = info.as_object().expect("Should be a JSON object");
+    let mut keys: Vec<&str> = info.keys().map(String::as_str).collect();
+    keys.sort();
+    assert_eq!(vec!["commit", "name", "rust_version", "version"], keys);
+    assert_eq!(version::NAME, info["name"]);
+    assert_eq!(version::VERSION, info["version"]);
+    assert_eq!(version::COMMIT.unwrap_or("unknown"), info["commit"]);
+
+    shutdown_tx
+        .send(())
+        .expect("Failed to send shutdown signal");
+}
+
+#[tokio::test]
+async fn job_queue_full_reject() {
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    state.job_queue_size = 1;
+    state.job_queue_full_strategy = QueueFullStrategy::Reject;
+
+    assert!(state.new_job(1, "test-org/test-repo", "commit1").await);
+    assert!(
+        state.new_job(1, "test-org/test-repo", "commit1").await,
+        "Should accept duplicate of queued job"
+    );
+    assert!(
+        !state.new_job(1, "test-org/test-repo", "commit2").await,
+        "Should reject job when queue is full"
+    );
+    assert_eq!(1, state.job_queue.lock().await.len());
+}
+
+#[tokio::test]
+async fn job_queue_full_block_with_timeout() {
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    state.job_queue_size = 1;
+    state.job_queue_full_strategy = QueueFullStrategy::BlockWithTimeout;
+    state.job_queue_block_timeout = Duration::from_millis(300);
+
+    assert!(state.new_job(1, "test-org/test-repo", "commit1").await);
+
+    let start = tokio::time::Instant::now();
+    assert!(
+        !state.new_job(1, "test-org/test-repo", "commit2").await,
+        "Should reject job after timeout"
+    );
+    assert!(
+        start.elapsed() >= Duration::from_millis(300),
+        "Should have waited for the timeout"
+    );
+
+    let job_queue = state.job_queue.clone();
+    tokio::spawn(async move {
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        job_queue.lock().await.clear();
+    });
+    assert!(
+        state.new_job(1, "test-org/test-repo", "commit2").await,
+        "Should accept job once the queue has been drained"
+    );
+}
+
+#[tokio::test]
+async fn job_queue_full_spill_to_store() {
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    state.job_queue_size = 1;
+    state.job_queue_full_strategy = QueueFullStrategy::SpillToStore;
+
+    assert!(state.new_job(1, "test-org/test-repo", "commit1").await);
+    for commit in ["commit2", "commit3"] {
+        assert!(
+            state.new_job(1, "test-org/test-repo", commit).await,
+            "Should spill job for {commit} instead of rejecting it"
+        );
+    }
+    assert_eq!(1, state.job_queue.lock().await.len());
+
+    // Running the queue drains it, afterwards the spilled jobs are moved back as far as they fit
+    state.job_queue.lock().await.clear();
+    unspill_jobs(state.store.as_ref(), &state.job_queue, state.job_queue_size)
+        .await
+        .unwrap();
+    assert_eq!(
+        vec![state.job_for(1, "test-org/test-repo", "commit2")],
+        *state.job_queue.lock().await
+    );
+
+    state.job_queue.lock().await.clear();
+    unspill_jobs(state.store.as_ref(), &state.job_queue, state.job_queue_size)
+        .await
+        .unwrap();
+    assert_eq!(
+        vec![state.job_for(1, "test-org/test-repo", "commit3")],
+        *state.job_queue.lock().await
+    );
+    assert!(
+        state.store.pop(SPILLED_JOBS_KEY).await.unwrap().is_none(),
+        "Should have taken all jobs from the store"
+    );
+}
+
+#[tokio::test]
+async fn webhook_check_run_job_queue_full() {
+    let payload = include_str!("testdata/check-run-event.json");
+
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    state.use_job_queue = true;
+    state.job_queue_size = 1;
+    assert!(state.new_job(1, "test-org/test-repo", "other-commit").await);
+    let state = State(state);
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("check_run"));
+
+    let (status, _) = webhook_handler(headers, state, payload.to_string()).await;
+
+    assert_eq!(
+        StatusCode::SERVICE_UNAVAILABLE,
+        status,
+        "Should reject event when the job queue is full"
+    );
+}
+
+#[tokio::test]
+async fn webhook_pull_request_reopened_creates_check_run() {
+    let payload = include_str!("testdata/pull-request-event-reopened.json");
+    let commit = "7f3a1c9e2b4d6f8a0c1e3b5d7f9a2c4e6b8d0f1a";
+
+    let mut created_run = CheckRun::new(commit);
+    created_run.id = 12345;
+    let expected_requests = VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::CreateCheckRun(StatusCode::OK, created_run),
+    ]);
+
+    let server = MockGithubApiServer::new(expected_requests);
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+    let metrics = state.metrics.clone();
+    let state = State(state);
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+    let (status, response) = webhook_handler(headers, state, payload.to_string()).await;
+    assert_eq!(
+        StatusCode::OK,
+        status,
+        "Should create check-run for reopened pull request, response: {response:?}"
+    );
+
+    let output = metrics.render();
+    for sample in [
+        r#"cerberus_webhook_events_total{event="pull_request",status="200"} 1"#,
+        r#"cerberus_check_runs_total{action="created"} 1"#,
+        r#"cerberus_github_api_requests_total{endpoint="get_installation_token",status="200"} 1"#,
+        r#"cerberus_github_api_requests_total{endpoint="create_check_run",status="200"} 1"#,
+        r#"cerberus_github_api_request_duration_seconds_count{endpoint="create_check_run"} 1"#,
+    ] {
+        assert!(
+            output.contains(sample),
+            "Metrics should contain '{sample}', got:\n{output}"
+        );
+    }
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!(2, requests.len(), "Should have made 2 requests");
+    let request = &requests[1];
+    assert_eq!("POST", request.method, "Should create a check-run");
+    assert_eq!(
+        "/repos/heathcliff26/cerberus-mergeguard/check-runs",
+        request.uri
+    );
+    let check_run: CheckRun =
+        serde_json::from_str(&request.body).expect("Should send check-run payload");
+    assert_eq!(commit, check_run.head_sha, "Should use the head commit");
+    assert_eq!(CHECK_RUN_NAME, check_run.name);
+}
+
+#[tokio::test]
+async fn webhook_merge_group_creates_check_run() {
+    let payload = include_str!("testdata/merge-group-event.json");
+    let commit = "9c2e4a6b8d0f1a3c5e7b9d1f3a5c7e9b2d4f6a8c";
+
+    let mut created_run = CheckRun::new(commit);
+    created_run.id = 12345;
+    let expected_requests = VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::CreateCheckRun(StatusCode::OK, created_run),
+    ]);
+
+    let server = MockGithubApiServer::new(expected_requests);
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let github = Client::build(ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    })
+    .expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("merge_group"));
+    let (status, response) =
+        webhook_handler(headers, State(state.clone()), payload.to_string()).await;
+    assert_eq!(
+        StatusCode::OK,
+        status,
+        "Should create check-run for merge group, response: {response:?}"
+    );
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!(2, requests.len(), "Should have made 2 requests");
+    let request = &requests[1];
+    assert_eq!("POST", request.method, "Should create a check-run");
+    assert_eq!(
+        "/repos/heathcliff26/cerberus-mergeguard/check-runs",
+        request.uri
+    );
+    let check_run: CheckRun =
+        serde_json::from_str(&request.body).expect("Should send check-run payload");
+    assert_eq!(
+        commit, check_run.head_sha,
+        "Should use the head commit of the merge group"
+    );
+
+    let destroyed = payload.replace("checks_requested", "destroyed");
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("merge_group"));
+    let (status, _) = webhook_handler(headers, State(state), destroyed).await;
+    assert_eq!(
+        StatusCode::OK,
+        status,
+        "Should ignore destroyed merge groups"
+    );
+}
+
+#[tokio::test]
+async fn webhook_handler_timeout_cancels_requests() {
+    let payload = include_str!("../types/testdata/pr-synchronize.json");
+
+    // Accepts connections, but never responds
+    let unresponsive_api = tokio::net::TcpListener::bind("127.0.0.1:0")
+        .await
+        .expect("Failed to bind listener");
+    let api_addr = format!(
+        "http://{}",
+        unresponsive_api
+            .local_addr()
+            .expect("Listener should have addr")
+    );
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr,
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let mut state = ServerState::new(None, github);
+    state.webhook_timeout = Some(Duration::from_millis(500));
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+    let start = tokio::time::Instant::now();
+    let (status, _) = webhook_handler(headers, State(state), payload.to_string()).await;
+
+    assert_eq!(
+        StatusCode::GATEWAY_TIMEOUT,
+        status,
+        "Should time out when GitHub does not respond"
+    );
+    assert!(
+        start.elapsed() < Duration::from_secs(5),
+        "Should not wait for the http client timeout"
+    );
+}
+
+#[tokio::test]
+async fn run_until_shutdown() {
+    let github = Client::new_for_testing("test-client-id", "test-secret", "http://localhost");
+    let server = Server::new(ServerOptions {
+        port: 8903,
+        webhook_secret: None,
+        ..Default::default()
+    });
+    let (shutdown_tx, shutdown_rx) = tokio::sync::oneshot::channel::<()>();
+
+    let handle = tokio::spawn(async move {
+        server
+            .run_until(github, async move {
+                let _ = shutdown_rx.await;
+            })
+            .await
+    });
+
+    tokio::time::sleep(Duration::from_millis(200)).await;
+    let response = reqwest::get("http://localhost:8903/healthz")
+        .await
+        .expect("Server should be running");
+    assert_eq!(StatusCode::OK, response.status());
+
+    shutdown_tx
+        .send(())
+        .expect("Failed to send shutdown signal");
+    let result = tokio::time::timeout(Duration::from_secs(5), handle)
+        .await
+        .expect("Server should shutdown promptly")
+        .expect("Server task should not panic");
+    assert!(result.is_ok(), "Server should shutdown cleanly: {result:?}");
+}
+
+#[tokio::test]
+async fn run_until_binds_configured_address() {
+    let github = Client::new_for_testing("test-client-id", "test-secret", "http://localhost");
+    let server = Server::new(ServerOptions {
+        port: 8907,
+        bind_address: "127.0.0.1".to_string(),
+        webhook_secret: None,
+        ..Default::default()
+    });
+    let (shutdown_tx, shutdown_rx) = tokio::sync::oneshot::channel::<()>();
+
+    let handle = tokio::spawn(async move {
+        server
+            .run_until(github, async move {
+                let _ = shutdown_rx.await;
+            })
+            .await
+    });
+
+    tokio::time::sleep(Duration::from_millis(200)).await;
+    let response = reqwest::get("http://127.0.0.1:8907/healthz")
+        .await
+        .expect("Server should listen on the bind address");
+    assert_eq!(StatusCode::OK, response.status());
+    assert!(
+        tokio::net::TcpStream::connect("[::1]:8907").await.is_err(),
+        "Server should not listen on other interfaces"
+    );
+
+    shutdown_tx
+        .send(())
+        .expect("Failed to send shutdown signal");
+    let result = tokio::time::timeout(Duration::from_secs(5), handle)
+        .await
+        .expect("Server should shutdown promptly")
+        .expect("Server task should not panic");
+    assert!(result.is_ok(), "Server should shutdown cleanly: {result:?}");
+}
+
+#[test]
+fn validate_bind_address() {
+    let tests = [
+        ("", None),
+        ("127.0.0.1", None),
+        ("::1", None),
+        ("0.0.0.0", None),
+        ("localhost", Some(ConfigError::InvalidBindAddress)),
+        ("127.0.0.1:8080", Some(ConfigError::InvalidBindAddress)),
+    ];
+    for (address, expected) in tests {
+        let options = ServerOptions {
+            bind_address: address.to_string(),
+            ..Default::default()
+        };
+        assert_eq!(
+            expected.map(|e| vec![e]),
+            options.validate().err(),
+            "Address '{address}'"
+        );
+        if expected.is_none() && !address.is_empty() {
+            assert_eq!(
+                address,
+                options.socket_addr().ip().to_string(),
+                "Should bind to '{address}'"
+            );
+        }
+    }
+    assert_eq!(
+        "[::]:8080",
+        ServerOptions::default().socket_addr().to_string(),
+        "Should bind to all interfaces by default"
+    );
+}
+
+#[tokio::test]
+async fn run_until_shutdown_grace_period_exceeded() {
+    let payload = include_str!("../types/testdata/pr-synchronize.json");
+
+    // Accepts connections, but never responds
+    let unresponsive_api = tokio::net::TcpListener::bind("127.0.0.1:0")
+        .await
+        .expect("Failed to bind listener");
+    let api_addr = format!(
+        "http://{}",
+        unresponsive_api
+            .local_addr()
+            .expect("Listener should have addr")
+    );
+    let certificate = TlsCertificate::create(None);
+    let github = Client::build(ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr,
+        ..Default::default()
+    })
+    .expect("Failed to build GitHub client");
+
+    let server = Server::new(ServerOptions {
+        port: 8904,
+        webhook_secret: None,
+        webhook_timeout: 0,
+        shutdown_grace_period: 1,
+        ..Default::default()
+    });
+    let (shutdown_tx, shutdown_rx) = tokio::sync::oneshot::channel::<()>();
+    let handle = tokio::spawn(async move {
+        server
+            .run_until(github, async move {
+                let _ = shutdown_rx.await;
+            })
+            .await
+    });
+    tokio::time::sleep(Duration::from_millis(200)).await;
+
+    // Request hangs, as GitHub never responds
+    tokio::spawn(async move {
+        let _ = reqwest::Client::new()
+            .post("http://localhost:8904/webhook")
+            .header("X-GitHub-Event", "pull_request")
+            .body(payload)
+            .send()
+            .await;
+    });
+    tokio::time::sleep(Duration::from_millis(200)).await;
+
+    let start = Instant::now();
+    shutdown_tx
+        .send(())
+        .expect("Failed to send shutdown signal");
+    let result = tokio::time::timeout(Duration::from_secs(5), handle)
+        .await
+        .expect("Server should shutdown after the grace period")
+        .expect("Server task should not panic");
+    assert!(result.is_ok(), "Server should shutdown cleanly: {result:?}");
+    assert!(
+        start.elapsed() >= Duration::from_secs(1),
+        "Server should have waited for the in-flight request"
+    );
+}
+
+#[tokio::test]
+async fn metrics_endpoint() {
+    let state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    let metrics = state.metrics.clone();
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("unknown_event"));
+    let (status, _) = webhook_handler(headers, State(state), "{}".to_string()).await;
+    assert_eq!(StatusCode::NOT_IMPLEMENTED, status);
+
+    let (headers, body) = metrics_handler(State(metrics)).await;
+    let content_type = headers
+        .get(header::CONTENT_TYPE)
+        .expect("Should set content type");
+    assert_eq!(metrics::CONTENT_TYPE, content_type.to_str().unwrap());
+    assert!(
+        body.contains(r#"cerberus_webhook_events_total{event="other",status="501"} 1"#),
+        "Should count the unsupported event, got:\n{body}"
+    );
+}
+
+#[tokio::test]
+async fn signature_failures_are_counted() {
+    let state = ServerState::new(
+        Some("test-secret".to_string()),
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    let metrics = state.metrics.clone();
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("ping"));
+    headers.insert(
+        "X-Hub-Signature-256",
+        HeaderValue::from_static(
+            "sha256=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+        ),
+    );
+    let (status, _) =
+        webhook_handler(headers.clone(), State(state.clone()), "{}".to_string()).await;
+    assert_eq!(StatusCode::FORBIDDEN, status);
+
+    headers.remove("X-Hub-Signature-256");
+    let (status, _) = webhook_handler(headers, State(state), "{}".to_string()).await;
+    assert_eq!(StatusCode::FORBIDDEN, status);
+
+    let (_, body) = metrics_handler(State(metrics)).await;
+    for sample in [
+        r#"cerberus_webhook_signature_failures_total{reason="invalid"} 1"#,
+        r#"cerberus_webhook_signature_failures_total{reason="missing"} 1"#,
+        r#"cerberus_webhook_events_total{event="ping",status="403"} 2"#,
+    ] {
+        assert!(
+            body.contains(sample),
+            "Metrics should contain '{sample}', got:\n{body}"
+        );
+    }
+}
+
+#[tokio::test]
+async fn webhook_ping_event() {
+    let payload = include_str!("testdata/ping-event.json");
+    let secret = "test-secret";
+
+    let mut mac = Hmac::<sha2::Sha256>::new_from_slice(secret.as_bytes()).unwrap();
+    mac.update(payload.as_bytes());
+    let signature: String = mac
+        .finalize()
+        .into_bytes()
+        .iter()
+        .map(|b| format!("{b:02x}"))
+        .collect();
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("ping"));
+    headers.insert(
+        "X-Hub-Signature-256",
+        HeaderValue::from_str(&format!("sha256={signature}")).unwrap(),
+    );
+
+    let state = ServerState::new(
+        Some(secret.to_string()),
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+
+    let (status, response) = webhook_handler(headers, State(state), payload.to_string()).await;
+
+    assert_eq!(StatusCode::OK, status, "Should answer ping with OK");
+    assert_eq!(SERVER_STATUS_OK, response.status);
+    assert_eq!(
+        "Keep it logically awesome.", response.message,
+        "Should echo the zen"
+    );
+}
+
+#[tokio::test]
+async fn webhook_content_types() {
+    let payload = include_str!("testdata/ping-event.json");
+    let form: String = payload
+        .bytes()
+        .map(|b| match b {
+            b'a'..=b'z' | b'A'..=b'Z' | b'0'..=b'9' => (b as char).to_string(),
+            b' ' => "+".to_string(),
+            b => format!("%{b:02X}"),
+        })
+        .collect();
+    let form = format!("payload={form}");
+    let secret = "test-secret";
+    let state = ServerState::new(
+        Some(secret.to_string()),
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+
+    let tests = [
+        ("application/json", payload, StatusCode::OK),
+        ("application/json; charset=utf-8", payload, StatusCode::OK),
+        (
+            "application/x-www-form-urlencoded",
+            form.as_str(),
+            StatusCode::OK,
+        ),
+        (
+            "application/x-www-form-urlencoded",
+            "other=value",
+            StatusCode::BAD_REQUEST,
+        ),
+        ("text/plain", payload, StatusCode::UNSUPPORTED_MEDIA_TYPE),
+        (
+            "multipart/form-data; boundary=abc",
+            payload,
+            StatusCode::UNSUPPORTED_MEDIA_TYPE,
+        ),
+    ];
+    for (content_type, body, expected) in tests {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-GitHub-Event", HeaderValue::from_static("ping"));
+        headers.insert(header::CONTENT_TYPE, HeaderValue::from_static(content_type));
+        headers.insert("X-Hub-Signature-256", sign_payload(secret, body));
+
+        let (status, response) =
+            webhook_handler(headers, State(state.clone()), body.to_string()).await;
+        assert_eq!(expected, status, "Content-Type '{content_type}'");
+        if status == StatusCode::OK {
+            assert_eq!(
+                "Keep it logically awesome.", response.message,
+                "Should read the payload with Content-Type '{content_type}'"
+            );
+        }
+    }
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("ping"));
+    headers.insert(header::CONTENT_TYPE, HeaderValue::from_static("text/plain"));
+    let (status, response) =
+        webhook_handler(headers, State(state.clone()), payload.to_string()).await;
+    assert_eq!(
+        StatusCode::UNSUPPORTED_MEDIA_TYPE,
+        status,
+        "Should reject the content type before verifying the signature"
+    );
+    assert_eq!(
+        "Unsupported Content-Type 'text/plain', expected application/json or application/x-www-form-urlencoded",
+        response.message
+    );
+}
+
+#[tokio::test]
+async fn readyz_ready_is_cached() {
+    let app = App {
+        id: 1,
+        client_id: "test-client-id".to_string(),
+        slug: "cerberus-mergeguard".to_string(),
+        name: "Cerberus Mergeguard".to_string(),
+    };
+    let server = MockGithubApiServer::new(VecDeque::from(vec![ExpectedRequests::GetApp(
+        StatusCode::OK,
+        app,
+    )]));
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr,
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+
+    for _ in 0..3 {
+        let (status, response) = readyz(State(state.clone())).await;
+        assert_eq!(StatusCode::OK, status, "Should be ready");
+        assert_eq!(SERVER_STATUS_OK, response.status);
+    }
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!(1, requests.len(), "Should cache the readiness check");
+    assert_eq!("/app", requests[0].uri);
+    let auth = requests[0]
+        .headers
+        .get("authorization")
+        .expect("Should authenticate");
+    assert!(
+        auth.to_str().unwrap().starts_with("Bearer "),
+        "Should use the JWT as bearer token"
+    );
+}
+
+#[tokio::test]
+async fn readyz_not_ready() {
+    let server = MockGithubApiServer::new(VecDeque::from(vec![ExpectedRequests::Raw(
+        StatusCode::UNAUTHORIZED,
+        HeaderMap::new(),
+        r#"{"message":"A JSON web token could not be decoded"}"#.to_string(),
+    )]));
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr,
+        max_attempts: 1,
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+
+    let (status, response) = readyz(State(state.clone())).await;
+    assert_eq!(
+        StatusCode::SERVICE_UNAVAILABLE,
+        status,
+        "Should not be ready when authentication fails"
+    );
+    assert_eq!(SERVER_STATUS_ERROR, response.status);
+
+    // The failure is cached as well, the mock server panics on unexpected requests
+    let (status, _) = readyz(State(state)).await;
+    assert_eq!(StatusCode::SERVICE_UNAVAILABLE, status);
+}
+
+/// State store with a health that can be changed by the test, e.g. to simulate an unavailable redis
+#[derive(Default)]
+struct ToggleStore {
+    store: MemoryStore,
+    unavailable: std::sync::atomic::AtomicBool,
+}
+
+impl StateStore for ToggleStore {
+    fn get<'a>(&'a self, key: &'a str) -> store::StoreFuture<'a, Option<String>> {
+        self.store.get(key)
+    }
+
+    fn set<'a>(
+        &'a self,
+        key: &'a str,
+        value: &'a str,
+        ttl: Duration,
+    ) -> store::StoreFuture<'a, ()> {
+        self.store.set(key, value, ttl)
+    }
+
+    fn delete<'a>(&'a self, key: &'a str) -> store::StoreFuture<'a, bool> {
+        self.store.delete(key)
+    }
+
+    fn push<'a>(
+        &'a self,
+        key: &'a str,
+        value: &'a str,
+        ttl: Duration,
+    ) -> store::StoreFuture<'a, ()> {
+        self.store.push(key, value, ttl)
+    }
+
+    fn pop<'a>(&'a self, key: &'a str) -> store::StoreFuture<'a, Option<String>> {
+        self.store.pop(key)
+    }
+
+    fn ping(&self) -> store::StoreFuture<'_, ()> {
+        let unavailable = self.unavailable.load(Ordering::Relaxed);
+        Box::pin(async move {
+            if unavailable {
+                return Err(Error::Redis(
+                    "redis:6379".to_string(),
+                    std::io::Error::from(std::io::ErrorKind::ConnectionRefused).into(),
+                ));
+            }
+            Ok(())
+        })
+    }
+}
+
+#[tokio::test]
+async fn readyz_follows_state_store_health() {
+    let app = App {
+        id: 1,
+        client_id: "test-client-id".to_string(),
+        slug: "cerberus-mergeguard".to_string(),
+        name: "Cerberus Mergeguard".to_string(),
+    };
+    let server = MockGithubApiServer::new(VecDeque::from(vec![ExpectedRequests::GetApp(
+        StatusCode::OK,
+        app,
+    )]));
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let mut github = Client::build(ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr,
+        ..Default::default()
+    })
+    .expect("Failed to build GitHub client");
+    let store = Arc::new(ToggleStore::default());
+    github.use_store(store.clone());
+    let state = ServerState::new(None, github);
+
+    store.unavailable.store(true, Ordering::Relaxed);
+    let (status, response) = readyz(State(state.clone())).await;
+    assert_eq!(
+        StatusCode::SERVICE_UNAVAILABLE,
+        status,
+        "Should not be ready while the store is unavailable"
+    );
+    assert!(
+        response.message.contains("State store is unavailable"),
+        "Should report the store, got: {}",
+        response.message
+    );
+    assert!(
+        server.state.lock().await.requests.is_empty(),
+        "Should not check GitHub while the store is unavailable"
+    );
+
+    // Expire the cached result, so the next probe checks again
+    *state.readiness.lock().await = None;
+    store.unavailable.store(false, Ordering::Relaxed);
+    let (status, response) = readyz(State(state.clone())).await;
+    assert_eq!(
+        StatusCode::OK,
+        status,
+        "Should be ready once the store is available again, response: {response:?}"
+    );
+
+    *state.readiness.lock().await = None;
+    store.unavailable.store(true, Ordering::Relaxed);
+    let (status, _) = readyz(State(state)).await;
+    assert_eq!(
+        StatusCode::SERVICE_UNAVAILABLE,
+        status,
+        "Should not be ready when the store becomes unavailable"
+    );
+}
+
+#[tokio::test]
+async fn custom_webhook_path() {
+    let payload = include_str!("testdata/check-suite-event.json");
+    let github = Client::new_for_testing("test-client-id", "test-secret", "http://localhost");
+    let server = Server::new(ServerOptions {
+        port: 8905,
+        webhook_secret: None,
+        webhook_path: "/github/webhook".to_string(),
+        ..Default::default()
+    });
+    let (shutdown_tx, shutdown_rx) = tokio::sync::oneshot::channel::<()>();
+
+    let handle = tokio::spawn(async move {
+        server
+            .run_until(github, async move {
+                let _ = shutdown_rx.await;
+            })
+            .await
+    });
+    tokio::time::sleep(Duration::from_millis(200)).await;
+
+    let http = reqwest::Client::new();
+    for (path, expected_status) in [
+        ("/github/webhook", StatusCode::OK),
+        ("/webhook", StatusCode::NOT_FOUND),
+    ] {
+        let response = http
+            .post(format!("http://localhost:8905{path}"))
+            .header("X-GitHub-Event", "check_suite")
+            .body(payload)
+            .send()
+            .await
+            .expect("Server should be running");
+        assert_eq!(
+            expected_status,
+            response.status(),
+            "Wrong status for {path}"
+        );
+    }
+
+    shutdown_tx
+        .send(())
+        .expect("Failed to send shutdown signal");
+    let _ = tokio::time::timeout(Duration::from_secs(5), handle).await;
+}
+
+#[test]
+fn validate_webhook_path() {
+    let tests = [
+        ("/webhook", None),
+        ("/github/webhook", None),
+        ("webhook", Some(ConfigError::InvalidWebhookPath)),
+        ("", Some(ConfigError::InvalidWebhookPath)),
+        (
+            "/webhook/{id}",
+            Some(ConfigError::InvalidWebhookPathCharacters),
+        ),
+        ("/web hook", Some(ConfigError::InvalidWebhookPathCharacters)),
+        ("/healthz", Some(ConfigError::ReservedWebhookPath)),
+        ("/version", Some(ConfigError::ReservedWebhookPath)),
+        ("/debug/guards", Some(ConfigError::ReservedWebhookPath)),
+        ("/debug/ratelimit", Some(ConfigError::ReservedWebhookPath)),
+        ("/admin/reevaluate", Some(ConfigError::ReservedWebhookPath)),
+    ];
+
+    for (path, expected) in tests {
+        let options = ServerOptions {
+            webhook_path: path.to_string(),
+            ..Default::default()
+        };
+        match (options.validate(), expected) {
+            (Ok(()), None) => {}
+            (Err(errors), Some(expected)) => assert_eq!(vec![expected], errors, "Path '{path}'"),
+            (result, expected) => panic!("Path '{path}': expected {expected:?}, got {result:?}"),
+        }
+    }
+}
+
+#[test]
+fn validate_require_webhook_secret() {
+    let tests = [
+        (false, None, None),
+        (false, Some("abc"), None),
+        (true, Some("0123456789abcdef"), None),
+        (true, None, Some(ConfigError::MissingWebhookSecret)),
+        (true, Some(""), Some(ConfigError::MissingWebhookSecret)),
+        (
+            true,
+            Some("0123456789abcde"),
+            Some(ConfigError::ShortWebhookSecret),
+        ),
+    ];
+
+    for (require, secret, expected) in tests {
+        let options = ServerOptions {
+            webhook_secret: secret.map(str::to_string),
+            require_webhook_secret: require,
+            ..Default::default()
+        };
+        match (options.validate(), expected) {
+            (Ok(()), None) => {}
+            (Err(errors), Some(expected)) => {
+                assert_eq!(vec![expected], errors, "Secret {secret:?}")
+            }
+            (result, expected) => {
+                panic!("Secret {secret:?}: expected {expected:?}, got {result:?}")
+            }
+        }
+    }
+}
+
+#[tokio::test]
+async fn webhook_body_too_large() {
+    let github = Client::new_for_testing("test-client-id", "test-secret", "http://localhost");
+    let server = Server::new(ServerOptions {
+        port: 8906,
+        webhook_secret: Some("test-secret".to_string()),
+        max_body_size: 1024,
+        ..Default::default()
+    });
+    let (shutdown_tx, shutdown_rx) = tokio::sync::oneshot::channel::<()>();
+
+    let handle = tokio::spawn(async move {
+        server
+            .run_until(github, async move {
+                let _ = shutdown_rx.await;
+            })
+            .await
+    });
+    tokio::time::sleep(Duration::from_millis(200)).await;
+
+    let response = reqwest::Client::new()
+        .post("http://localhost:8906/webhook")
+        .header("X-GitHub-Event", "pull_request")
+        .body("a".repeat(2048))
+        .send()
+        .await
+        .expect("Server should be running");
+    assert_eq!(
+        StatusCode::PAYLOAD_TOO_LARGE,
+        response.status(),
+        "Should reject oversized body before verifying the signature"
+    );
+
+    shutdown_tx
+        .send(())
+        .expect("Failed to send shutdown signal");
+    let _ = tokio::time::timeout(Duration::from_secs(5), handle).await;
+}
+
+async fn panicking_handler() -> StatusCode {
+    panic!("test panic");
+}
+
+#[tokio::test]
+async fn recover_from_panic_in_handler() {
+    install_panic_hook();
+    let router: Router = Router::new()
+        .route("/panic", post(panicking_handler))
+        .route("/healthz", get(healthz))
+        .layer(CatchPanicLayer::custom(handle_panic));
+
+    let listener = TcpListener::bind("127.0.0.1:0")
+        .await
+        .expect("Failed to bind listener");
+    let addr = listener.local_addr().expect("Listener should have addr");
+    tokio::spawn(async move { axum::serve(listener, router).await });
+
+    let http = reqwest::Client::new();
+    for _ in 0..2 {
+        let response = http
+            .post(format!("http://{addr}/panic"))
+            .send()
+            .await
+            .expect("Should receive a response despite the panic");
+        assert_eq!(StatusCode::INTERNAL_SERVER_ERROR, response.status());
+        let body: Response = response.json().await.expect("Should return json body");
+        assert_eq!(SERVER_STATUS_ERROR, body.status);
+    }
+
+    let response = http
+        .get(format!("http://{addr}/healthz"))
+        .send()
+        .await
+        .expect("Server should survive the panic");
+    assert_eq!(StatusCode::OK, response.status());
+}
+
+#[tokio::test]
+async fn webhook_workers_process_in_background() {
+    let payload = include_str!("testdata/pull-request-event-reopened.json");
+    let commit = "7f3a1c9e2b4d6f8a0c1e3b5d7f9a2c4e6b8d0f1a";
+
+    let mut created_run = CheckRun::new(commit);
+    created_run.id = 12345;
+    let expected_requests = VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::CreateCheckRun(StatusCode::OK, created_run),
+    ]);
+
+    let server = MockGithubApiServer::new(expected_requests);
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let mut state = ServerState::new(None, github);
+    state.start_workers(2, 10);
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+    let (status, response) = webhook_handler(headers, State(state), payload.to_string()).await;
+    assert_eq!(
+        StatusCode::ACCEPTED,
+        status,
+        "Should acknowledge the event once queued, response: {response:?}"
+    );
+
+    let deadline = tokio::time::Instant::now() + Duration::from_secs(5);
+    while server.state.lock().await.requests.len() < 2 {
+        assert!(
+            tokio::time::Instant::now() < deadline,
+            "Workers should process the queued event"
+        );
+        tokio::time::sleep(Duration::from_millis(50)).await;
+    }
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!("POST", requests[1].method, "Should create a check-run");
+    assert_eq!(
+        "/repos/heathcliff26/cerberus-mergeguard/check-runs",
+        requests[1].uri
+    );
+}
+
+#[tokio::test]
+async fn webhook_workers_queue_full() {
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    // Without workers receiving the tasks, the queue fills up
+    let (workers, _tasks) = mpsc::channel(1);
+    state.workers = Some(workers);
+
+    let task = || WebhookTask::RefreshCheckRun {
+        app_installation_id: 1,
+        repo: "owner/repo".to_string(),
+        commit: "abc123".to_string(),
+    };
+
+    let (status, _) = state.dispatch(task()).await;
+    assert_eq!(StatusCode::ACCEPTED, status, "Should queue the first task");
+
+    let (status, response) = state.dispatch(task()).await;
+    assert_eq!(
+        StatusCode::SERVICE_UNAVAILABLE,
+        status,
+        "Should reject tasks when the queue is full"
+    );
+    assert_eq!("Worker queue is full", response.message);
+}
+
+#[tokio::test]
+async fn webhook_workers_queue_full_block_with_timeout() {
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    state.job_queue_full_strategy = QueueFullStrategy::BlockWithTimeout;
+    state.job_queue_block_timeout = Duration::from_millis(300);
+    let (workers, mut tasks) = mpsc::channel(1);
+    state.workers = Some(workers);
+
+    let task = || WebhookTask::RefreshCheckRun {
+        app_installation_id: 1,
+        repo: "owner/repo".to_string(),
+        commit: "abc123".to_string(),
+    };
+
+    let (status, _) = state.dispatch(task()).await;
+    assert_eq!(StatusCode::ACCEPTED, status, "Should queue the first task");
+
+    let start = tokio::time::Instant::now();
+    let (status, response) = state.dispatch(task()).await;
+    assert_eq!(
+        StatusCode::SERVICE_UNAVAILABLE,
+        status,
+        "Should reject the task after the timeout"
+    );
+    assert_eq!("Worker queue is full", response.message);
+    assert!(
+        start.elapsed() >= Duration::from_millis(300),
+        "Should have waited for the timeout"
+    );
+
+    tokio::spawn(async move {
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        tasks.recv().await;
+        // Keep the channel open until the blocked task has been queued
+        tokio::time::sleep(Duration::from_secs(1)).await;
+    });
+    let (status, _) = state.dispatch(task()).await;
+    assert_eq!(
+        StatusCode::ACCEPTED,
+        status,
+        "Should queue the task once a worker took the previous one"
+    );
+}
+
+#[tokio::test]
+async fn webhook_workers_queue_full_spill_to_store() {
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    state.job_queue_full_strategy = QueueFullStrategy::SpillToStore;
+    let (workers, mut tasks) = mpsc::channel(1);
+    state.workers = Some(workers.clone());
+
+    let task = |commit: &str| WebhookTask::RefreshCheckRun {
+        app_installation_id: 1,
+        repo: "owner/repo".to_string(),
+        commit: commit.to_string(),
+    };
+
+    let (status, _) = state.dispatch(task("commit1")).await;
+    assert_eq!(StatusCode::ACCEPTED, status, "Should queue the first task");
+    let (status, response) = state.dispatch(task("commit2")).await;
+    assert_eq!(
+        StatusCode::ACCEPTED,
+        status,
+        "Should spill the task instead of rejecting it, response: {response:?}"
+    );
+
+    unspill_tasks(state.store.as_ref(), &workers, &state.apps)
+        .await
+        .unwrap();
+    let (queued, _, _) = tasks.recv().await.unwrap();
+    assert!(
+        matches!(queued, WebhookTask::RefreshCheckRun { ref commit, .. } if commit == "commit1"),
+        "Should not move spilled tasks into a full queue, got {queued:?}"
+    );
+
+    unspill_tasks(state.store.as_ref(), &workers, &state.apps)
+        .await
+        .unwrap();
+    let (queued, github, _) = tasks.recv().await.unwrap();
+    assert!(
+        matches!(queued, WebhookTask::RefreshCheckRun { ref commit, .. } if commit == "commit2"),
+        "Should move the spilled task back into the queue, got {queued:?}"
+    );
+    assert_eq!("testid", github.client_id());
+    assert!(
+        state.store.pop(SPILLED_TASKS_KEY).await.unwrap().is_none(),
+        "Should have taken the task from the store"
+    );
+}
+
+/// Returns the expected requests for fetching the head commit of a pull request with a new token
+fn get_pull_request_requests(commit: &str) -> Vec<ExpectedRequests> {
+    vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::GetPullRequest(
+            StatusCode::OK,
+            PullRequestResponse {
+                id: 123456,
+                number: 42,
+                state: "open".to_string(),
+                head: BranchRef {
+                    label: "feature-branch".to_string(),
+                    ref_field: "feature-branch".to_string(),
+                    sha: commit.to_string(),
+                    repo: Repo {
+                        id: 7890,
+                        name: "test-repo".to_string(),
+                        full_name: "test-org/test-repo".to_string(),
+                        owner: None,
+                        private: false,
+                        visibility: String::new(),
+                    },
+                },
+                labels: Vec::new(),
+            },
+        ),
+    ]
+}
+
+macro_rules! installation_event_test {
+    ($($name:ident: $value:expr,)*) => {
+    $(
+        #[tokio::test]
+        async fn $name() {
+            let (payload, token_requests): (&str, usize) = $value;
+            let commit = "test-commit";
+            let repo = "heathcliff26/cerberus-mergeguard";
+
+            let mut expected_requests = get_pull_request_requests(commit);
+            // The cached token is used again, unless it has been removed
+            expected_requests.extend(get_pull_request_requests(commit).into_iter().skip(1 - token_requests));
+            let server = MockGithubApiServer::new(VecDeque::from(expected_requests));
+            let api_addr = server.start().await;
+
+            let certificate = TlsCertificate::create(None);
+            let client_options = ClientOptions {
+                client_id: "test-client-id".to_string(),
+                private_key: certificate.key.to_string(),
+                api: api_addr.to_string(),
+                ..Default::default()
+            };
+            let github = Client::build(client_options).expect("Failed to build GitHub client");
+            let state = ServerState::new(None, github);
+
+            state
+                .github
+                .get_pull_request_head_commit(123456, repo, 42)
+                .await
+                .expect("Should get head commit");
+
+            let mut headers = HeaderMap::new();
+            headers.insert("X-GitHub-Event", HeaderValue::from_static("installation"));
+            let (status, _) = webhook_handler(headers, State(state.clone()), payload.to_string()).await;
+            assert_eq!(StatusCode::OK, status, "Should handle installation event");
+
+            state
+                .github
+                .get_pull_request_head_commit(123456, repo, 42)
+                .await
+                .expect("Should get head commit");
+
+            let requests = &server.state.lock().await.requests;
+            let token_requests_made = requests
+                .iter()
+                .filter(|r| r.uri.ends_with("/access_tokens"))
+                .count();
+            assert_eq!(1 + token_requests, token_requests_made, "Wrong number of token requests");
+        }
+    )*
+    }
+}
+
+installation_event_test! {
+    installation_created_keeps_token: (include_str!("testdata/installation-event-created.json"), 0),
+    installation_deleted_removes_token: (include_str!("testdata/installation-event-deleted.json"), 1),
+}
+
+/// Returns the reopened pull request event with the given action and draft flag
+fn pull_request_event_payload(action: &str, draft: bool) -> String {
+    let mut payload: serde_json::Value =
+        serde_json::from_str(include_str!("testdata/pull-request-event-reopened.json"))
+            .expect("Should parse pull request event");
+    payload["action"] = serde_json::Value::from(action);
+    payload["pull_request"]["draft"] = serde_json::Value::from(draft);
+    payload.to_string()
+}
+
+#[tokio::test]
+async fn webhook_pull_request_draft_skipped() {
+    // Any request to the API would fail, as the address is invalid
+    let state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+
+    for action in ["opened", "reopened", "synchronize"] {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+        let payload = pull_request_event_payload(action, true);
+        let (status, response) = webhook_handler(headers, State(state.clone()), payload).await;
+        assert_eq!(
+            StatusCode::OK,
+            status,
+            "Should skip draft for action '{action}', response: {response:?}"
+        );
+    }
+}
+
+#[tokio::test]
+async fn webhook_pull_request_ready_for_review_creates_check_run() {
+    let commit = "7f3a1c9e2b4d6f8a0c1e3b5d7f9a2c4e6b8d0f1a";
+    let expected_requests = VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::CreateCheckRun(StatusCode::OK, CheckRun::new(commit)),
+    ]);
+    let server = MockGithubApiServer::new(expected_requests);
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+    let payload = pull_request_event_payload("ready_for_review", false);
+    let (status, response) = webhook_handler(headers, State(state), payload).await;
+    assert_eq!(
+        StatusCode::OK,
+        status,
+        "Should create check-run when ready for review, response: {response:?}"
+    );
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!(2, requests.len(), "Should have made 2 requests");
+    let check_run: CheckRun =
+        serde_json::from_str(&requests[1].body).expect("Should send check-run payload");
+    assert_eq!(commit, check_run.head_sha, "Should use the head commit");
+}
+
+#[tokio::test]
+async fn webhook_pull_request_synchronize_creates_check_run_per_commit() {
+    let commits = [
+        "1d2c3b4a5f6e7d8c9b0a1f2e3d4c5b6a7f8e9d0c",
+        "9e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2f1e0d",
+    ];
+    let expected_requests = VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::CreateCheckRun(StatusCode::OK, CheckRun::new(commits[0])),
+        ExpectedRequests::CreateCheckRun(StatusCode::OK, CheckRun::new(commits[1])),
+    ]);
+    let server = MockGithubApiServer::new(expected_requests);
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+
+    for commit in commits {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+        let mut payload: serde_json::Value =
+            serde_json::from_str(&pull_request_event_payload("synchronize", false))
+                .expect("Should parse pull request event");
+        payload["pull_request"]["head"]["sha"] = serde_json::Value::from(commit);
+
+        let (status, response) =
+            webhook_handler(headers, State(state.clone()), payload.to_string()).await;
+        assert_eq!(
+            StatusCode::OK,
+            status,
+            "Should create check-run for '{commit}', response: {response:?}"
+        );
+    }
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!(
+        3,
+        requests.len(),
+        "Should reuse the token for the second commit"
+    );
+    for (request, commit) in requests[1..].iter().zip(commits) {
+        assert_eq!("POST", request.method);
+        let check_run: CheckRun =
+            serde_json::from_str(&request.body).expect("Should send check-run payload");
+        assert_eq!(
+            commit, check_run.head_sha,
+            "Should guard the new head commit"
+        );
+        assert_eq!(CHECK_RUN_INITIAL_STATUS, check_run.status);
+    }
+}
+
+#[tokio::test]
+async fn webhook_pull_request_guard_drafts() {
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    state.guard_drafts = true;
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+    // The check-run already exists, when drafts are guarded
+    let payload = pull_request_event_payload("ready_for_review", false);
+    let (status, _) = webhook_handler(headers.clone(), State(state.clone()), payload).await;
+    assert_eq!(StatusCode::OK, status, "Should ignore ready_for_review");
+
+    // Fails to reach the API, which shows the draft is not skipped
+    let payload = pull_request_event_payload("opened", true);
+    let (status, _) = webhook_handler(headers, State(state), payload).await;
+    assert_eq!(
+        StatusCode::INTERNAL_SERVER_ERROR,
+        status,
+        "Should try to create check-run for draft"
+    );
+}
+
+#[tokio::test]
+async fn webhook_pull_request_labeled_refreshes_check_run() {
+    let mut own_run = CheckRun::new("test-commit");
+    own_run.id = 12345;
+    own_run.app = Some(App {
+        id: 1,
+        client_id: "test-client-id".to_string(),
+        slug: "cerberus-mergeguard".to_string(),
+        name: "Cerberus Mergeguard".to_string(),
+    });
+    let expected_requests = VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::GetCheckRuns(
+            StatusCode::OK,
+            CheckRunsResponse {
+                total_count: 1,
+                check_runs: vec![own_run.clone()],
+            },
+        ),
+        ExpectedRequests::GetCommitStatuses(StatusCode::OK, CombinedStatusResponse::default()),
+        ExpectedRequests::GetCommitPullRequests(StatusCode::OK, Vec::new()),
+        ExpectedRequests::UpdateCheckRun(StatusCode::OK, own_run),
+    ]);
+    let server = MockGithubApiServer::new(expected_requests);
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        required_labels: vec!["qa-approved".to_string()],
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+    let payload = pull_request_event_payload("labeled", false);
+    let (status, response) = webhook_handler(headers, State(state), payload).await;
+    assert_eq!(
+        StatusCode::OK,
+        status,
+        "Should refresh check-run when labels change, response: {response:?}"
+    );
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!(5, requests.len(), "Should have made 5 requests");
+    assert_eq!("PATCH", requests[4].method, "Should update the check-run");
+}
+
+#[tokio::test]
+async fn webhook_pull_request_labeled_ignored_without_required_labels() {
+    // Any request to the API would fail, as the address is invalid
+    let state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+
+    for action in ["labeled", "unlabeled"] {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+        let payload = pull_request_event_payload(action, false);
+        let (status, response) = webhook_handler(headers, State(state.clone()), payload).await;
+        assert_eq!(
+            StatusCode::OK,
+            status,
+            "Should ignore action '{action}', response: {response:?}"
+        );
+    }
+}
+
+/// Returns the payload of an edited pull request event with the given changes
+fn pull_request_edited_payload(changes: serde_json::Value) -> String {
+    let mut payload: serde_json::Value =
+        serde_json::from_str(&pull_request_event_payload("edited", false))
+            .expect("Should parse pull request event");
+    payload["changes"] = changes;
+    payload.to_string()
+}
+
+#[tokio::test]
+async fn webhook_pull_request_base_changed_refreshes_check_run() {
+    let commit = "7f3a1c9e2b4d6f8a0c1e3b5d7f9a2c4e6b8d0f1a";
+    let mut own_run = CheckRun::new(commit);
+    own_run.id = 12345;
+    own_run.app = Some(App {
+        id: 1,
+        client_id: "test-client-id".to_string(),
+        slug: "cerberus-mergeguard".to_string(),
+        name: "Cerberus Mergeguard".to_string(),
+    });
+    let expected_requests = VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::GetCheckRuns(
+            StatusCode::OK,
+            CheckRunsResponse {
+                total_count: 1,
+                check_runs: vec![own_run.clone()],
+            },
+        ),
+        ExpectedRequests::GetCommitStatuses(StatusCode::OK, CombinedStatusResponse::default()),
+        ExpectedRequests::UpdateCheckRun(StatusCode::OK, own_run),
+    ]);
+    let server = MockGithubApiServer::new(expected_requests);
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+    let payload = pull_request_edited_payload(serde_json::json!({
+        "base": {
+            "ref": { "from": "release-1.0" },
+            "sha": { "from": "253f31d91db3a05dcf75c0e8135309491fed8669" }
+        }
+    }));
+    let (status, response) = webhook_handler(headers, State(state), payload).await;
+    assert_eq!(
+        StatusCode::OK,
+        status,
+        "Should refresh check-run when the base branch changes, response: {response:?}"
+    );
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!(4, requests.len(), "Should have made 4 requests");
+    assert!(
+        requests[1]
+            .uri
+            .contains(&format!("/commits/{commit}/check-runs")),
+        "Should evaluate the checks of the head commit, got: {}",
+        requests[1].uri
+    );
+    assert_eq!("PATCH", requests[3].method, "Should update the check-run");
+}
+
+#[tokio::test]
+async fn webhook_pull_request_title_edit_ignored() {
+    // Any request to the API would fail, as the address is invalid
+    let state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+
+    for changes in [
+        serde_json::json!({ "title": { "from": "Old title" } }),
+        serde_json::json!({ "body": { "from": "Old description" } }),
+        serde_json::json!({}),
+    ] {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+        let payload = pull_request_edited_payload(changes.clone());
+        let (status, response) = webhook_handler(headers, State(state.clone()), payload).await;
+        assert_eq!(
+            StatusCode::OK,
+            status,
+            "Should ignore edit with changes {changes}, response: {response:?}"
+        );
+    }
+}
+
+/// Returns the requests for getting the status of the checks, with one check still pending
+fn stalled_check_runs_requests(commit: &str) -> Vec<ExpectedRequests> {
+    let mut own_run = CheckRun::new(commit);
+    own_run.id = 12345;
+    own_run.app = Some(App {
+        id: 1,
+        client_id: "test-client-id".to_string(),
+        slug: "cerberus-mergeguard".to_string(),
+        name: "Cerberus Mergeguard".to_string(),
+    });
+    let mut stalled_run = CheckRun::new(commit);
+    stalled_run.id = 67890;
+    stalled_run.name = "ci".to_string();
+    stalled_run.status = "in_progress".to_string();
+
+    vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::GetCheckRuns(
+            StatusCode::OK,
+            CheckRunsResponse {
+                total_count: 2,
+                check_runs: vec![own_run.clone(), stalled_run],
+            },
+        ),
+        ExpectedRequests::GetCommitStatuses(StatusCode::OK, CombinedStatusResponse::default()),
+        ExpectedRequests::UpdateCheckRun(StatusCode::OK, own_run),
+    ]
+}
+
+#[tokio::test]
+async fn check_timeout_fails_stalled_check_run() {
+    let commit = "test-commit";
+    let server = MockGithubApiServer::new(VecDeque::from(stalled_check_runs_requests(commit)));
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let mut state = ServerState::new(None, github);
+    state.check_timeout = Some(Duration::from_millis(200));
+
+    state
+        .schedule_check_timeout(123456, "owner/repo", commit)
+        .await;
+    // Scheduling the same commit again is a no-op, the mock server panics on a second evaluation
+    state
+        .schedule_check_timeout(123456, "owner/repo", commit)
+        .await;
+    assert_eq!(1, state.check_timeouts.lock().await.len());
+
+    tokio::time::sleep(Duration::from_millis(100)).await;
+    assert!(
+        server.state.lock().await.requests.is_empty(),
+        "Should not evaluate before the timeout"
+    );
+
+    let deadline = tokio::time::Instant::now() + Duration::from_secs(5);
+    while server.state.lock().await.requests.len() < 4 {
+        assert!(
+            tokio::time::Instant::now() < deadline,
+            "Should evaluate the checks after the timeout"
+        );
+        tokio::time::sleep(Duration::from_millis(50)).await;
+    }
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!("PATCH", requests[3].method, "Should update the check run");
+    let check_run: CheckRun =
+        serde_json::from_str(&requests[3].body).expect("Should send check-run payload");
+    assert_eq!(Some(CHECK_RUN_FAILURE.to_string()), check_run.conclusion);
+    assert_eq!(
+        Some("Timed out waiting for 1 other checks to complete".to_string()),
+        check_run.output.and_then(|output| output.title)
+    );
+    assert!(
+        state.check_timeouts.lock().await.is_empty(),
+        "Should remove the commit once evaluated"
+    );
+}
+
+#[tokio::test]
+async fn check_timeout_ignores_missing_required_labels() {
+    let commit = "test-commit";
+    let mut own_run = CheckRun::new(commit);
+    own_run.id = 12345;
+    own_run.app = Some(App {
+        id: 1,
+        client_id: "test-client-id".to_string(),
+        slug: "cerberus-mergeguard".to_string(),
+        name: "Cerberus Mergeguard".to_string(),
+    });
+    // Neither the missing label nor the missing checks are running, the guard must not be failed
+    let expected_requests = VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::GetCheckRuns(
+            StatusCode::OK,
+            CheckRunsResponse {
+                total_count: 1,
+                check_runs: vec![own_run],
+            },
+        ),
+        ExpectedRequests::GetCommitStatuses(StatusCode::OK, CombinedStatusResponse::default()),
+        ExpectedRequests::GetCommitPullRequests(StatusCode::OK, Vec::new()),
+    ]);
+    let server = MockGithubApiServer::new(expected_requests);
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        required_labels: vec!["qa-approved".to_string()],
+        require_at_least_one_check: true,
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let mut state = ServerState::new(None, github);
+    state.check_timeout = Some(Duration::from_millis(100));
+
+    state
+        .schedule_check_timeout(123456, "owner/repo", commit)
+        .await;
+
+    let deadline = tokio::time::Instant::now() + Duration::from_secs(5);
+    while server.state.lock().await.requests.len() < 4 {
+        assert!(
+            tokio::time::Instant::now() < deadline,
+            "Should evaluate the checks after the timeout"
+        );
+        tokio::time::sleep(Duration::from_millis(50)).await;
+    }
+    // Give a wrongly failed check run the time to be sent
+    tokio::time::sleep(Duration::from_millis(200)).await;
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!(
+        4,
+        requests.len(),
+        "Should only get the status of the checks and labels"
+    );
+    assert!(
+        requests.iter().all(|request| request.method == "GET"),
+        "Should not fail the check run for a missing label"
+    );
+}
+
+#[tokio::test]
+async fn check_timeout_disabled() {
+    let state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+
+    state
+        .schedule_check_timeout(123456, "owner/repo", "commit")
+        .await;
+    assert!(
+        state.check_timeouts.lock().await.is_empty(),
+        "Should not schedule anything without a timeout"
+    );
+}
+
+#[tokio::test]
+async fn initial_evaluation_refreshes_check_run_after_delay() {
+    let commit = "test-commit";
+    let server = MockGithubApiServer::new(VecDeque::from(stalled_check_runs_requests(commit)));
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let mut state = ServerState::new(None, github);
+    state.initial_evaluation_delay = Some(Duration::from_millis(200));
+
+    state
+        .schedule_initial_evaluation(123456, "owner/repo", commit)
+        .await;
+    // Scheduling the same commit again is a no-op, the mock server panics on a second evaluation
+    state
+        .schedule_initial_evaluation(123456, "owner/repo", commit)
+        .await;
+    assert_eq!(1, state.initial_evaluations.lock().await.len());
+
+    tokio::time::sleep(Duration::from_millis(100)).await;
+    assert!(
+        server.state.lock().await.requests.is_empty(),
+        "Should not evaluate before the delay"
+    );
+
+    let deadline = tokio::time::Instant::now() + Duration::from_secs(5);
+    while server.state.lock().await.requests.len() < 4 {
+        assert!(
+            tokio::time::Instant::now() < deadline,
+            "Should evaluate the checks after the delay"
+        );
+        tokio::time::sleep(Duration::from_millis(50)).await;
+    }
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!("PATCH", requests[3].method, "Should update the check run");
+    let check_run: CheckRun =
+        serde_json::from_str(&requests[3].body).expect("Should send check-run payload");
+    assert_eq!(None, check_run.conclusion, "Should still be pending");
+    assert_eq!(
+        Some("Waiting for 1 other checks to complete".to_string()),
+        check_run.output.and_then(|output| output.title)
+    );
+    assert!(
+        state.initial_evaluations.lock().await.is_empty(),
+        "Should remove the commit once evaluated"
+    );
+}
+
+#[tokio::test]
+async fn initial_evaluation_disabled() {
+    let state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+
+    state
+        .schedule_initial_evaluation(123456, "owner/repo", "commit")
+        .await;
+    assert!(
+        state.initial_evaluations.lock().await.is_empty(),
+        "Should not schedule anything without a delay"
+    );
+}
+
+#[test]
+fn validate_initial_evaluation_delay() {
+    let mut options = ServerOptions {
+        initial_evaluation_delay: 30,
+        ..Default::default()
+    };
+    assert!(
+        options.validate().is_ok(),
+        "Should accept a delay without check timeout"
+    );
+
+    options.check_timeout = 3600;
+    assert!(
+        options.validate().is_ok(),
+        "Should accept a delay shorter than the check timeout"
+    );
+
+    options.check_timeout = 30;
+    assert_eq!(
+        Err(vec![ConfigError::InvalidInitialEvaluationDelay]),
+        options.validate()
+    );
+}
+
+/// Sign the payload like GitHub does with the webhook secret
+fn sign_payload(secret: &str, payload: &str) -> HeaderValue {
+    let mut mac = Hmac::<sha2::Sha256>::new_from_slice(secret.as_bytes()).unwrap();
+    mac.update(payload.as_bytes());
+    let signature: String = mac
+        .finalize()
+        .into_bytes()
+        .iter()
+        .map(|b| format!("{b:02x}"))
+        .collect();
+    HeaderValue::from_str(&format!("sha256={signature}")).unwrap()
+}
+
+#[test]
+fn route_delivery_by_webhook_secret() {
+    let payload = include_str!("testdata/check-suite-event.json");
+    let mut state = ServerState::new(
+        Some("first-app-secret".to_string()),
+        Client::new_for_testing("first-app", "testsecret", "https://noops.example.com"),
+    );
+    state.add_app(WebhookApp {
+        webhook_secret: Some("second-app-secret".to_string()),
+        previous_webhook_secrets: Vec::new(),
+        github: Arc::new(Client::new_for_testing(
+            "second-app",
+            "testsecret",
+            "https://noops.example.com",
+        )),
+    });
+
+    for (secret, expected) in [
+        ("first-app-secret", Some("first-app")),
+        ("second-app-secret", Some("second-app")),
+        ("unknown-secret", None),
+    ] {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-Hub-Signature-256", sign_payload(secret, payload));
+
+        match (state.route_delivery(&headers, payload), expected) {
+            (Ok(routed), Some(expected)) => {
+                assert_eq!(expected, routed.github.client_id(), "Secret '{secret}'")
+            }
+            (Err((status, response)), None) => {
+                assert_eq!(StatusCode::FORBIDDEN, status);
+                assert_eq!("Invalid webhook signature", response.message);
+            }
+            (Ok(routed), None) => panic!(
+                "Secret '{secret}' should be rejected, got app '{}'",
+                routed.github.client_id()
+            ),
+            (Err((status, _)), Some(expected)) => {
+                panic!("Secret '{secret}' should be routed to '{expected}', got {status}")
+            }
+        }
+    }
+}
+
+#[test]
+fn route_delivery_with_previous_webhook_secret() {
+    let payload = include_str!("testdata/check-suite-event.json");
+    let mut state = ServerState::new(
+        Some("current-secret".to_string()),
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    state.apps[0].previous_webhook_secrets =
+        vec!["old-secret".to_string(), "older-secret".to_string()];
+
+    for (secret, accepted) in [
+        ("current-secret", true),
+        ("old-secret", true),
+        ("older-secret", true),
+        ("unknown-secret", false),
+    ] {
+        let mut headers = HeaderMap::new();
+        headers.insert("X-Hub-Signature-256", sign_payload(secret, payload));
+
+        match state.route_delivery(&headers, payload) {
+            Ok(routed) => {
+                assert!(accepted, "Secret '{secret}' should be rejected");
+                assert_eq!("testid", routed.github.client_id());
+            }
+            Err((status, response)) => {
+                assert!(
+                    !accepted,
+                    "Secret '{secret}' should be accepted, got {status}"
+                );
+                assert_eq!(StatusCode::FORBIDDEN, status);
+                assert_eq!("Invalid webhook signature", response.message);
+            }
+        }
+    }
+}
+
+#[tokio::test]
+async fn webhook_routed_to_second_app() {
+    let payload = include_str!("testdata/pull-request-event-reopened.json");
+    let commit = "7f3a1c9e2b4d6f8a0c1e3b5d7f9a2c4e6b8d0f1a";
+
+    let mut created_run = CheckRun::new(commit);
+    created_run.id = 12345;
+    let first_server = MockGithubApiServer::new(VecDeque::new());
+    let first_addr = first_server.start().await;
+    let second_server = MockGithubApiServer::new(VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::CreateCheckRun(StatusCode::OK, created_run),
+    ]));
+    let second_addr = second_server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client = |client_id: &str, api: &str| {
+        Client::build(ClientOptions {
+            client_id: client_id.to_string(),
+            private_key: certificate.key.to_string(),
+            api: api.to_string(),
+            ..Default::default()
+        })
+        .expect("Failed to build GitHub client")
+    };
+    let mut state = ServerState::new(
+        Some("first-app-secret".to_string()),
+        client("first-app", &first_addr),
+    );
+    state.add_app(WebhookApp {
+        webhook_secret: Some("second-app-secret".to_string()),
+        previous_webhook_secrets: Vec::new(),
+        github: Arc::new(client("second-app", &second_addr)),
+    });
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+    headers.insert(
+        "X-Hub-Signature-256",
+        sign_payload("second-app-secret", payload),
+    );
+
+    let (status, response) = webhook_handler(headers, State(state), payload.to_string()).await;
+    assert_eq!(
+        StatusCode::OK,
+        status,
+        "Should create check-run with the second app, response: {response:?}"
+    );
+
+    assert!(
+        first_server.state.lock().await.requests.is_empty(),
+        "Should not use the first app"
+    );
+    let requests = &second_server.state.lock().await.requests;
+    let uris: Vec<&str> = requests.iter().map(|r| r.uri.as_str()).collect();
+    assert_eq!(
+        vec![
+            "/app/installations/68583790/access_tokens",
+            "/repos/heathcliff26/cerberus-mergeguard/check-runs",
+        ],
+        uris
+    );
+}
+
+#[tokio::test]
+async fn delivery_id_in_handler_and_client_logs() {
+    let payload = include_str!("testdata/pull-request-event-reopened.json");
+    let commit = "7f3a1c9e2b4d6f8a0c1e3b5d7f9a2c4e6b8d0f1a";
+    let delivery = "72d3162e-cc78-11e3-81ab-4c9367dc0958";
+
+    let mut created_run = CheckRun::new(commit);
+    created_run.id = 12345;
+    let server = MockGithubApiServer::new(VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::CreateCheckRun(StatusCode::OK, created_run),
+    ]));
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let client_options = ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    };
+    let github = Client::build(client_options).expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+    headers.insert("X-GitHub-Delivery", HeaderValue::from_static(delivery));
+
+    let buffer = BufferWriter::default();
+    let writer = buffer.clone();
+    let (logger, _) = crate::new_logger(
+        "debug",
+        crate::config::LogFormat::Json,
+        0,
+        None,
+        move || writer.clone(),
+    );
+    let guard = tracing::subscriber::set_default(logger);
+    let (status, response) = webhook_handler(headers, State(state), payload.to_string()).await;
+    drop(guard);
+    assert_eq!(StatusCode::OK, status, "Response: {response:?}");
+
+    let output = buffer.output();
+    let lines: Vec<serde_json::Value> = output
+        .lines()
+        .map(|line| serde_json::from_str(line).expect("Each line should be valid JSON"))
+        .collect();
+    for target in ["cerberus_mergeguard::server", "cerberus_mergeguard::api"] {
+        let logs: Vec<&serde_json::Value> = lines
+            .iter()
+            .filter(|line| line["target"] == target)
+            .collect();
+        assert!(!logs.is_empty(), "Should have logs from {target}: {output}");
+        for log in logs {
+            assert_eq!(
+                delivery, log["span"]["delivery"],
+                "Log from {target} should contain the delivery ID: {log}"
+            );
+        }
+    }
+}
+
+#[tokio::test]
+async fn spans_for_webhook_and_github_requests() {
+    use tracing_subscriber::layer::SubscriberExt;
+
+    let payload = include_str!("testdata/pull-request-event-reopened.json");
+    let commit = "7f3a1c9e2b4d6f8a0c1e3b5d7f9a2c4e6b8d0f1a";
+
+    let mut created_run = CheckRun::new(commit);
+    created_run.id = 12345;
+    let server = MockGithubApiServer::new(VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::CreateCheckRun(StatusCode::CREATED, created_run),
+    ]));
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let github = Client::build(ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    })
+    .expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+    let recorder = SpanRecorder::default();
+    let subscriber = tracing_subscriber::registry()
+        .with(tracing_subscriber::filter::LevelFilter::DEBUG)
+        .with(recorder.clone());
+    let guard = tracing::subscriber::set_default(subscriber);
+    let (status, response) = webhook_handler(headers, State(state), payload.to_string()).await;
+    drop(guard);
+    assert_eq!(StatusCode::OK, status, "Response: {response:?}");
+
+    let spans = recorder.spans();
+    let webhook = spans
+        .iter()
+        .find(|span| span.name == "webhook")
+        .expect("Should have a span for the webhook");
+    for (field, value) in [
+        ("event", "pull_request"),
+        ("repo", "heathcliff26/cerberus-mergeguard"),
+        ("status", "200"),
+    ] {
+        assert_eq!(
+            Some(value),
+            webhook.fields.get(field).map(String::as_str),
+            "Webhook span should have field '{field}': {webhook:?}"
+        );
+    }
+
+    let requests: Vec<_> = spans
+        .iter()
+        .filter(|span| span.name == "github_request")
+        .collect();
+    assert_eq!(
+        2,
+        requests.len(),
+        "Should have a span per request: {spans:?}"
+    );
+    for (span, endpoint, method, status) in [
+        (requests[0], "get_installation_token", "POST", "200"),
+        (requests[1], "create_check_run", "POST", "201"),
+    ] {
+        assert_eq!(
+            Some(endpoint),
+            span.fields.get("endpoint").map(String::as_str)
+        );
+        assert_eq!(Some(method), span.fields.get("method").map(String::as_str));
+        assert_eq!(Some(status), span.fields.get("status").map(String::as_str));
+        assert_eq!(
+            Some("webhook"),
+            span.parent.as_deref(),
+            "Request span should be a child of the webhook span"
+        );
+    }
+}
+
+#[tokio::test]
+async fn spans_exported_to_opentelemetry() {
+    use opentelemetry_sdk::trace::{InMemorySpanExporter, SdkTracerProvider};
+    use tracing_subscriber::layer::SubscriberExt;
+
+    let payload = include_str!("testdata/pull-request-event-reopened.json");
+    let commit = "7f3a1c9e2b4d6f8a0c1e3b5d7f9a2c4e6b8d0f1a";
+
+    let mut created_run = CheckRun::new(commit);
+    created_run.id = 12345;
+    let server = MockGithubApiServer::new(VecDeque::from(vec![
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::CreateCheckRun(StatusCode::CREATED, created_run),
+    ]));
+    let api_addr = server.start().await;
+
+    let certificate = TlsCertificate::create(None);
+    let github = Client::build(ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api_addr.to_string(),
+        ..Default::default()
+    })
+    .expect("Failed to build GitHub client");
+    let state = ServerState::new(None, github);
+
+    let mut headers = HeaderMap::new();
+    headers.insert("X-GitHub-Event", HeaderValue::from_static("pull_request"));
+
+    let exporter = InMemorySpanExporter::default();
+    let provider = SdkTracerProvider::builder()
+        .with_simple_exporter(exporter.clone())
+        .build();
+    let subscriber = tracing_subscriber::registry()
+        .with(tracing_subscriber::filter::LevelFilter::INFO)
+        .with(crate::telemetry::layer(&provider));
+    let guard = tracing::subscriber::set_default(subscriber);
+    let (status, response) = webhook_handler(headers, State(state), payload.to_string()).await;
+    drop(guard);
+    assert_eq!(StatusCode::OK, status, "Response: {response:?}");
+    provider.force_flush().expect("Should flush the spans");
+
+    let spans = exporter
+        .get_finished_spans()
+        .expect("Should have exported spans");
+    let attribute = |span: &opentelemetry_sdk::trace::SpanData, key: &str| {
+        span.attributes
+            .iter()
+            .find(|attribute| attribute.key.as_str() == key)
+            .map(|attribute| attribute.value.to_string())
+    };
+
+    let webhook = spans
+        .iter()
+        .find(|span| span.name == "webhook")
+        .expect("Should export the span of the webhook");
+    for (key, value) in [
+        ("event", "pull_request"),
+        ("repo", "heathcliff26/cerberus-mergeguard"),
+        ("status", "200"),
+    ] {
+        assert_eq!(
+            Some(value.to_string()),
+            attribute(webhook, key),
+            "Webhook span should have attribute '{key}': {webhook:?}"
+        );
+    }
+
+    let requests: Vec<_> = spans
+        .iter()
+        .filter(|span| span.name == "github_request")
+        .collect();
+    assert_eq!(
+        2,
+        requests.len(),
+        "Should export a span per request: {spans:?}"
+    );
+    for (span, endpoint, status) in [
+        (requests[0], "get_installation_token", "200"),
+        (requests[1], "create_check_run", "201"),
+    ] {
+        assert_eq!(Some(endpoint.to_string()), attribute(span, "endpoint"));
+        assert_eq!(Some(status.to_string()), attribute(span, "status"));
+        assert_eq!(
+            webhook.span_context.span_id(),
+            span.parent_span_id,
+            "Request span should be a child of the webhook span"
+        );
+        assert_eq!(
+            webhook.span_context.trace_id(),
+            span.span_context.trace_id(),
+            "Request span should belong to the trace of the webhook"
+        );
+    }
+}
+
+#[tokio::test]
+async fn generate_missing_delivery_id() {
+    let request = || {
+        Request::builder()
+            .uri("/webhook")
+            .body(axum::body::Body::empty())
+            .unwrap()
+    };
+
+    let first = ensure_delivery_id(request()).await;
+    let second = ensure_delivery_id(request()).await;
+    let first = first.headers().get(DELIVERY_HEADER).expect("Should set ID");
+    let second = second
+        .headers()
+        .get(DELIVERY_HEADER)
+        .expect("Should set ID");
+    assert!(first.to_str().unwrap().starts_with("generated-"));
+    assert_ne!(first, second, "Generated IDs should be unique");
+
+    let mut existing = request();
+    existing
+        .headers_mut()
+        .insert(DELIVERY_HEADER, HeaderValue::from_static("from-github"));
+    let existing = ensure_delivery_id(existing).await;
+    assert_eq!("from-github", existing.headers()[DELIVERY_HEADER]);
+}
+
+#[test]
+fn reload_applies_changed_options() {
+    let state = ServerState::new(
+        None,
+        Client::new_for_testing("testid", "testsecret", "https://noops.example.com"),
+    );
+    let repo = |full_name: &str| Repo {
+        id: 1,
+        name: full_name
+            .split('/')
+            .next_back()
+            .unwrap_or_default()
+            .to_string(),
+        full_name: full_name.to_string(),
+        owner: None,
+        private: false,
+        visibility: String::new(),
+    };
+    assert_eq!("cerberus-mergeguard", state.github.check_name());
+    assert!(!state.is_ignored_repo(&repo("my-org/sandbox")));
+
+    state.reload(Ok(Configuration {
+        log_level: "debug".to_string(),
+        log_format: Default::default(),
+        log_sampling: 0,
+        otlp_endpoint: String::new(),
+        github: ClientOptions {
+            client_id: "testid".to_string(),
+            check_name: "cerberus-mergeguard-staging".to_string(),
+            required_labels: vec!["qa-approved".to_string()],
+            ..Default::default()
+        },
+        server: ServerOptions {
+            repo_denylist: vec!["my-org/sandbox".to_string()],
+            ..Default::default()
+        },
+        additional_apps: Vec::new(),
+    }));
+
+    assert_eq!(
+        "cerberus-mergeguard-staging",
+        state.github.check_name(),
+        "Should apply the check name"
+    );
+    assert_eq!(
+        vec!["qa-approved".to_string()],
+        state.github.required_labels(),
+        "Should apply the required labels"
+    );
+    assert!(
+        state.is_ignored_repo(&repo("my-org/sandbox")),
+        "Should apply the repo denylist"
+    );
+    assert!(!state.is_ignored_repo(&repo("my-org/app")));
+
+    state.reload(Err(Error::InvalidConfig(vec![ConfigError::EmptyCheckName])));
+
+    assert_eq!(
+        "cerberus-mergeguard-staging",
+        state.github.check_name(),
+        "Should keep the current options when the reload failed"
+    );
+    assert!(state.is_ignored_repo(&repo("my-org/sandbox")));
+}
+
+#[tokio::test]
+async fn debug_guards_lists_pending_guards() {
+    let mut state = ServerState::new(
+        None,
+        Client::new_for_testing("first-app", "testsecret", "https://noops.example.com"),
+    );
+    let second = Arc::new(Client::new_for_testing(
+        "second-app",
+        "testsecret",
+        "https://noops.example.com",
+    ));
+    state.add_app(WebhookApp {
+        webhook_secret: Some("second-secret".to_string()),
+        previous_webhook_secrets: Vec::new(),
+        github: second.clone(),
+    });
+
+    let mut status = CheckRunsStatus::default();
+    status.add_passed("lint", "success");
+    status.add_pending("build", "in_progress");
+    let pending_run = CheckRun::new("commit-b");
+    state
+        .github
+        .track_guard("owner/repo", "commit-b", &pending_run, &status);
+    state.github.track_guard(
+        "owner/repo",
+        "commit-a",
+        &CheckRun::new("commit-a"),
+        &CheckRunsStatus::default(),
+    );
+    second.track_guard("other/repo", "commit-c", &pending_run, &status);
+
+    // Concluded guards are no longer tracked
+    let mut completed_run = CheckRun::new("commit-a");
+    completed_run.update_status(&CheckRunsStatus::default());
+    state.github.track_guard(
+        "owner/repo",
+        "commit-a",
+        &completed_run,
+        &CheckRunsStatus::default(),
+    );
+
+    let Json(response) = debug_guards(State(state)).await;
+    let output = serde_json::to_value(&response).expect("Should serialize response");
+    let guards = output["guards"].as_array().expect("Should list guards");
+
+    assert_eq!(2, guards.len(), "Should only list pending guards: {output}");
+    assert_eq!("first-app", guards[0]["client_id"]);
+    assert_eq!("owner/repo", guards[0]["repo"]);
+    assert_eq!("commit-b", guards[0]["commit"]);
+    assert_eq!("queued", guards[0]["status"]);
+    assert_eq!(1, guards[0]["pending"]);
+    assert_eq!(
+        serde_json::json!([
+            {"name": "lint", "state": "success", "failed": false},
+            {"name": "build", "state": "in_progress", "failed": false},
+        ]),
+        guards[0]["checks"]
+    );
+    assert!(guards[0]["updated_at"].is_string());
+    assert_eq!("second-app", guards[1]["client_id"]);
+    assert_eq!("other/repo", guards[1]["repo"]);
+}
+
+#[tokio::test]
+async fn debug_endpoints_disabled_by_default() {
+    for (port, debug_endpoints, expected) in [
+        (8907, false, reqwest::StatusCode::NOT_FOUND),
+        (8908, true, reqwest::StatusCode::OK),
+    ] {
+        let server = Server::new(ServerOptions {
+            port,
+            debug_endpoints,
+            shutdown_grace_period: 0,
+            ..Default::default()
+        });
+        let github = Client::new_for_testing("testid", "testsecret", "https://noops.example.com");
+        let (shutdown_tx, shutdown_rx) = tokio::sync::oneshot::channel::<()>();
+        let handle = tokio::spawn(async move {
+            server
+                .run_until(github, async move {
+                    let _ = shutdown_rx.await;
+                })
+                .await
+        });
+        tokio::time::sleep(Duration::from_millis(200)).await;
+
+        let response = reqwest::get(format!("http://localhost:{port}/debug/guards"))
+            .await
+            .expect("Should reach the server");
+        assert_eq!(
+            expected,
+            response.status(),
+            "debug-endpoints: {debug_endpoints}"
+        );
+        if debug_endpoints {
+            let body: serde_json::Value = response.json().await.expect("Should return JSON");
+            assert_eq!(serde_json::json!({"guards": []}), body);
+        }
+
+        shutdown_tx
+            .send(())
+            .expect("Failed to send shutdown signal");
+        let _ = tokio::time::timeout(Duration::from_secs(5), handle).await;
+    }
+}
+
+#[tokio::test]
+async fn debug_rate_limit_returns_cached_status() {
+    let rate_limit = RateLimitResponse {
+        resources: RateLimitResources {
+            core: RateLimit {
+                limit: 5000,
+                used: 1200,
+                remaining: 3800,
+                reset: 1_700_000_000,
+            },
+            graphql: Some(RateLimit {
+                limit: 5000,
+                used: 0,
+                remaining: 5000,
+                reset: 1_700_000_100,
+            }),
+        },
+    };
+    let api_server =
+        MockGithubApiServer::new(VecDeque::from(vec![ExpectedRequests::GetRateLimit(
+            StatusCode::OK,
+            rate_limit,
+        )]));
+    let addr = api_server.start().await;
+    let state = ServerState::new(None, Client::new_for_testing("testid", "testsecret", &addr));
+
+    for _ in 0..2 {
+        let response = debug_rate_limit(State(state.clone())).await;
+        assert_eq!(StatusCode::OK, response.status());
+        let body = axum::body::to_bytes(response.into_body(), usize::MAX)
+            .await
+            .expect("Should read body");
+        let body: serde_json::Value = serde_json::from_slice(&body).expect("Should return JSON");
+        assert_eq!(
+            serde_json::json!({"apps": [{
+                "client_id": "testid",
+                "core": {"limit": 5000, "used": 1200, "remaining": 3800, "reset": 1_700_000_000},
+                "graphql": {"limit": 5000, "used": 0, "remaining": 5000, "reset": 1_700_000_100},
+            }]}),
+            body
+        );
+    }
+
+    let state = api_server.state.lock().await;
+    assert_eq!(1, state.requests.len(), "Should cache the rate limit");
+    assert_eq!("/rate_limit", state.requests[0].uri);
+    let auth = state.requests[0]
+        .headers
+        .get("authorization")
+        .and_then(|value| value.to_str().ok())
+        .unwrap_or_default();
+    assert!(auth.starts_with("Bearer "), "Should use a JWT: {auth}");
+}
+
+#[tokio::test]
+async fn debug_rate_limit_fails_when_github_is_unavailable() {
+    let api_server = MockGithubApiServer::new(VecDeque::from(vec![ExpectedRequests::Raw(
+        StatusCode::INTERNAL_SERVER_ERROR,
+        HeaderMap::new(),
+        String::new(),
+    )]));
+    let addr = api_server.start().await;
+    let state = ServerState::new(None, Client::new_for_testing("testid", "testsecret", &addr));
+
+    let response = debug_rate_limit(State(state)).await;
+    assert_eq!(StatusCode::BAD_GATEWAY, response.status());
+}
+
+/// Returns the state of a server with the admin endpoint enabled, using a client for the mock API.
+fn admin_state(api: &str) -> ServerState {
+    let certificate = TlsCertificate::create(None);
+    let github = Client::build(ClientOptions {
+        client_id: "test-client-id".to_string(),
+        private_key: certificate.key.to_string(),
+        api: api.to_string(),
+        ..Default::default()
+    })
+    .expect("Failed to build GitHub client");
+    let mut state = ServerState::new(None, github);
+    state.admin_token = "0123456789abcdef".to_string();
+    state
+}
+
+fn admin_headers(token: &str) -> HeaderMap {
+    let mut headers = HeaderMap::new();
+    headers.insert(
+        header::AUTHORIZATION,
+        HeaderValue::from_str(&format!("Bearer {token}")).unwrap(),
+    );
+    headers
+}
+
+#[tokio::test]
+async fn admin_reevaluate_updates_guard() {
+    let commit = "test-commit";
+    let mut own_run = CheckRun::new(commit);
+    own_run.id = 12345;
+    own_run.app = Some(App {
+        id: 1,
+        client_id: "test-client-id".to_string(),
+        slug: "cerberus-mergeguard".to_string(),
+        name: "Cerberus Mergeguard".to_string(),
+    });
+    let mut ci_run = CheckRun::new(commit);
+    ci_run.id = 67890;
+    ci_run.name = "ci".to_string();
+    ci_run.status = "completed".to_string();
+    ci_run.conclusion = Some("success".to_string());
+    let server = MockGithubApiServer::new(VecDeque::from(vec![
+        ExpectedRequests::GetRepoInstallation(
+            StatusCode::OK,
+            Installation {
+                id: 42,
+                account: None,
+            },
+        ),
+        ExpectedRequests::GetInstallationToken(
+            StatusCode::OK,
+            TokenResponse {
+                token: "test_token".to_string(),
+                expires_at: chrono::Utc::now() + chrono::Duration::seconds(3600),
+            },
+        ),
+        ExpectedRequests::GetCheckRuns(
+            StatusCode::OK,
+            CheckRunsResponse {
+                total_count: 2,
+                check_runs: vec![own_run.clone(), ci_run],
+            },
+        ),
+        ExpectedRequests::GetCommitStatuses(StatusCode::OK, CombinedStatusResponse::default()),
+        ExpectedRequests::UpdateCheckRun(StatusCode::OK, own_run),
+    ]));
+    let api_addr = server.start().await;
+    let state = admin_state(&api_addr);
+
+    let payload = serde_json::json!({"repo": "owner/repo", "commit": commit}).to_string();
+    let (status, response) =
+        admin_reevaluate(admin_headers("0123456789abcdef"), State(state), payload).await;
+    assert_eq!(StatusCode::OK, status, "Response: {response:?}");
+
+    let requests = &server.state.lock().await.requests;
+    assert_eq!(5, requests.len(), "Should have made 5 requests");
+    assert_eq!("/repos/owner/repo/installation", requests[0].uri);
+    assert_eq!(
+        "/app/installations/42/access_tokens", requests[1].uri,
+        "Should use the installation of the repository"
+    );
+    assert_eq!("PATCH", requests[4].method, "Should update the check run");
+    assert_eq!("/repos/owner/repo/check-runs/12345", requests[4].uri);
+    let check_run: CheckRun =
+        serde_json::from_str(&requests[4].body).expect("Should send check-run payload");
+    assert_eq!(Some(CHECK_RUN_CONCLUSION.to_string()), check_run.conclusion);
+}
+
+#[tokio::test]
+async fn admin_reevaluate_requires_token() {
+    // The mock server panics on any request
+    let server = MockGithubApiServer::new(VecDeque::new());
+    let api_addr = server.start().await;
+    let state = admin_state(&api_addr);
+    let payload = serde_json::json!({"repo": "owner/repo", "commit": "abc"}).to_string();
+
+    let tests = [
+        ("missing", HeaderMap::new()),
+        ("wrong", admin_headers("fedcba9876543210")),
+        ("prefix", admin_headers("0123456789abcde")),
+    ];
+    for (name, headers) in tests {
+        let (status, _) = admin_reevaluate(headers, State(state.clone()), payload.clone()).await;
+        assert_eq!(StatusCode::UNAUTHORIZED, status, "Token: {name}");
+    }
+
+    let mut state = state;
+    state.admin_token = String::new();
+    let (status, _) = admin_reevaluate(admin_headers(""), State(state), payload).await;
+    assert_eq!(
+        StatusCode::UNAUTHORIZED,
+        status,
+        "Should never accept an empty token"
+    );
+    assert!(server.state.lock().await.requests.is_empty());
+}
+
+#[tokio::test]
+async fn admin_reevaluate_rejects_invalid_requests() {
+    let server = MockGithubApiServer::new(VecDeque::new());
+    let api_addr = server.start().await;
+    let state = admin_state(&api_addr);
+
+    for payload in [
+        serde_json::json!({"repo": "owner/repo"}).to_string(),
+        serde_json::json!({"repo": "owner/repo", "commit": "abc", "pull_request": 1}).to_string(),
+        serde_json::json!({"commit": "abc"}).to_string(),
+        "not json".to_string(),
+    ] {
+        let (status, _) = admin_reevaluate(
+            admin_headers("0123456789abcdef"),
+            State(state.clone()),
+            payload.clone(),
+        )
+        .await;
+        assert_eq!(StatusCode::BAD_REQUEST, status, "Payload: {payload}");
+    }
+    assert!(server.state.lock().await.requests.is_empty());
+}
+
+#[tokio::test]
+async fn admin_reevaluate_app_not_installed() {
+    let server = MockGithubApiServer::new(VecDeque::from(vec![ExpectedRequests::Raw(
+        StatusCode::NOT_FOUND,
+        HeaderMap::new(),
+        r#"{"message":"Not Found"}"#.to_string(),
+    )]));
+    let api_addr = server.start().await;
+    let state = admin_state(&api_addr);
+
+    let payload = serde_json::json!({"repo": "owner/repo", "pull_request": 1}).to_string();
+    let (status, _) =
+        admin_reevaluate(admin_headers("0123456789abcdef"), State(state), payload).await;
+    assert_eq!(StatusCode::NOT_FOUND, status);
+}
+
+#[test]
+fn validate_previous_webhook_secrets() {
+    let tests = [
+        (Some("current-secret"), vec![], None),
+        (Some("current-secret"), vec!["old-secret"], None),
+        (
+            None,
+            vec!["old-secret"],
+            Some(ConfigError::InvalidPreviousWebhookSecrets),
+        ),
+        (
+            Some(""),
+            vec!["old-secret"],
+            Some(ConfigError::InvalidPreviousWebhookSecrets),
+        ),
+        (
+            Some("current-secret"),
+            vec!["old-secret", ""],
+            Some(ConfigError::InvalidPreviousWebhookSecrets),
+        ),
+    ];
+    for (secret, previous, expected) in tests {
+        let options = ServerOptions {
+            webhook_secret: secret.map(str::to_string),
+            previous_webhook_secrets: previous.iter().map(|s| s.to_string()).collect(),
+            ..Default::default()
+        };
+        assert_eq!(
+            expected.map(|e| vec![e]),
+            options.validate().err(),
+            "Secret {secret:?}, previous {previous:?}"
+        );
+    }
+}
+
+#[test]
+fn validate_admin_token() {
+    let tests = [
+        ("", None),
+        ("0123456789abcdef", None),
+        ("short", Some(ConfigError::ShortAdminToken)),
+    ];
+    for (token, expected) in tests {
+        let options = ServerOptions {
+            admin_token: token.to_string(),
+            ..Default::default()
+        };
+        assert_eq!(
+            expected.map(|e| vec![e]),
+            options.validate().err(),
+            "Token '{token}'"
+        );
+    }
 }
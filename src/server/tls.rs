@@ -1,15 +1,39 @@
 use axum::serve::Listener;
+use openssl::{
+    error::ErrorStack,
+    pkey::PKey,
+    ssl::{Ssl, SslAcceptor, SslMethod, SslVerifyMode, SslVersion},
+    x509::{X509, X509Name},
+};
+use serde::{Deserialize, Serialize};
 use std::fs;
 use std::net::SocketAddr;
+use std::pin::Pin;
 use tokio::net::{TcpListener, TcpStream};
 use tokio::sync::mpsc;
-use tokio_native_tls::{
-    TlsAcceptor,
-    native_tls::{Identity, Protocol, TlsAcceptor as NativeTlsAcceptor},
-};
+use tokio_openssl::SslStream;
 use tracing::{error, warn};
 
-type TlsStream = (tokio_native_tls::TlsStream<TcpStream>, SocketAddr);
+type TlsStream = (SslStream<TcpStream>, SocketAddr);
+
+/// Minimum TLS version accepted by the server
+#[derive(Serialize, Deserialize, Debug, Clone, Copy, PartialEq, Default)]
+pub enum TlsVersion {
+    #[default]
+    #[serde(rename = "1.2")]
+    V1_2,
+    #[serde(rename = "1.3")]
+    V1_3,
+}
+
+impl TlsVersion {
+    fn protocol(self) -> SslVersion {
+        match self {
+            TlsVersion::V1_2 => SslVersion::TLS1_2,
+            TlsVersion::V1_3 => SslVersion::TLS1_3,
+        }
+    }
+}
 
 /// Wrapper around a TcpListener that handles TLS encryption/decryption for incoming connections.
 pub struct TlsListener {
@@ -19,18 +43,34 @@ pub struct TlsListener {
 
 impl TlsListener {
     /// Read the key and cert files, bind to the given socket and handle decryption/encryption for incoming traffic.
-    pub async fn bind(addr: SocketAddr, key: &str, cert: &str) -> Result<Self, TlsError> {
+    /// Connections using a TLS version older than min_version are rejected during the handshake.
+    /// When a client CA file is given, clients must present a certificate signed by one of its CAs.
+    pub async fn bind(
+        addr: SocketAddr,
+        key: &str,
+        cert: &str,
+        min_version: TlsVersion,
+        client_ca: Option<&str>,
+    ) -> Result<Self, TlsError> {
         let key = fs::read(key).map_err(TlsError::ReadKeyError)?;
         let cert = fs::read(cert).map_err(TlsError::ReadCertError)?;
 
-        let id = Identity::from_pkcs8(&cert, &key).map_err(TlsError::CreateIdentityError)?;
-
-        let tls_acceptor = NativeTlsAcceptor::builder(id)
-            .min_protocol_version(Some(Protocol::Tlsv12))
-            .build()
+        let mut builder = SslAcceptor::mozilla_intermediate_v5(SslMethod::tls_server())
             .map_err(TlsError::CreateAcceptorError)?;
-
-        let tls_acceptor = TlsAcceptor::from(tls_acceptor);
+        set_identity(&mut builder, &key, &cert).map_err(TlsError::CreateIdentityError)?;
+        builder
+            .set_min_proto_version(Some(min_version.protocol()))
+            .map_err(TlsError::CreateAcceptorError)?;
+        if let Some(client_ca) = client_ca {
+            builder
+                .set_ca_file(client_ca)
+                .map_err(TlsError::LoadClientCaError)?;
+            builder.set_client_ca_list(
+                X509Name::load_client_ca_file(client_ca).map_err(TlsError::LoadClientCaError)?,
+            );
+            builder.set_verify(SslVerifyMode::PEER | SslVerifyMode::FAIL_IF_NO_PEER_CERT);
+        }
+        let tls_acceptor = builder.build();
 
         let mut listener = TcpListener::bind(addr)
             .await
@@ -44,11 +84,10 @@ impl TlsListener {
 
         tokio::spawn(async move {
             loop {
-                let tls_acceptor = tls_acceptor.clone();
                 let stream_tx = stream_tx.clone();
 
                 let (stream, addr) = Listener::accept(&mut listener).await;
-                match tls_acceptor.accept(stream).await {
+                match accept(&tls_acceptor, stream).await {
                     Ok(stream) => stream_tx.send((stream, addr)).await.unwrap_or_else(|e| {
                         error!("Failed to send stream to listener: {e}");
                     }),
@@ -63,8 +102,45 @@ impl TlsListener {
     }
 }
 
+/// Use the PEM encoded key and certificate chain for the server.
+/// The first certificate is the one of the server, the others are sent as intermediates.
+fn set_identity(
+    builder: &mut openssl::ssl::SslAcceptorBuilder,
+    key: &[u8],
+    cert: &[u8],
+) -> Result<(), ErrorStack> {
+    builder.set_private_key(&PKey::private_key_from_pem(key)?)?;
+    let mut chain = X509::stack_from_pem(cert)?.into_iter();
+    if let Some(leaf) = chain.next() {
+        builder.set_certificate(&leaf)?;
+    }
+    for intermediate in chain {
+        builder.add_extra_chain_cert(intermediate)?;
+    }
+    builder.check_private_key()
+}
+
+/// Perform the TLS handshake for an incoming connection.
+async fn accept(
+    acceptor: &SslAcceptor,
+    stream: TcpStream,
+) -> Result<SslStream<TcpStream>, Box<dyn std::error::Error + Send + Sync>> {
+    let ssl = Ssl::new(acceptor.context())?;
+    let mut stream = SslStream::new(ssl, stream)?;
+    Pin::new(&mut stream).accept().await?;
+    Ok(stream)
+}
+
+/// Check that the file contains at least one PEM encoded certificate.
+pub fn validate_ca_file(path: &str) -> bool {
+    fs::read(path)
+        .ok()
+        .and_then(|pem| X509::stack_from_pem(&pem).ok())
+        .is_some_and(|certs| !certs.is_empty())
+}
+
 impl Listener for TlsListener {
-    type Io = tokio_native_tls::TlsStream<TcpStream>;
+    type Io = SslStream<TcpStream>;
     type Addr = SocketAddr;
 
     async fn accept(&mut self) -> TlsStream {
@@ -83,8 +159,9 @@ impl Listener for TlsListener {
 pub enum TlsError {
     ReadKeyError(std::io::Error),
     ReadCertError(std::io::Error),
-    CreateIdentityError(tokio_native_tls::native_tls::Error),
-    CreateAcceptorError(tokio_native_tls::native_tls::Error),
+    CreateIdentityError(ErrorStack),
+    CreateAcceptorError(ErrorStack),
+    LoadClientCaError(ErrorStack),
     FailedToBindListener(std::io::Error),
 }
 
@@ -95,6 +172,7 @@ impl std::fmt::Display for TlsError {
             TlsError::ReadCertError(e) => write!(f, "Failed to read SSL cert file: {e}"),
             TlsError::CreateIdentityError(e) => write!(f, "Failed to create SSL identity: {e}"),
             TlsError::CreateAcceptorError(e) => write!(f, "Failed to create SSL acceptor: {e}"),
+            TlsError::LoadClientCaError(e) => write!(f, "Failed to load SSL client CA file: {e}"),
             TlsError::FailedToBindListener(e) => write!(f, "Failed to bind listener: {e}"),
         }
     }
@@ -105,7 +183,136 @@ impl std::error::Error for TlsError {}
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::testutils::TlsCertificate;
     use std::io;
+    use tokio_native_tls::{
+        TlsConnector,
+        native_tls::{Identity, Protocol, TlsConnector as NativeTlsConnector},
+    };
+
+    /// Try a TLS handshake with a client limited to the given maximum version.
+    async fn handshake(addr: SocketAddr, max_version: Protocol) -> bool {
+        handshake_with_identity(addr, max_version, None).await
+    }
+
+    /// Try a TLS handshake with a client presenting the certificate, if one is given.
+    async fn handshake_with_identity(
+        addr: SocketAddr,
+        max_version: Protocol,
+        identity: Option<&TlsCertificate>,
+    ) -> bool {
+        let mut builder = NativeTlsConnector::builder();
+        builder
+            .danger_accept_invalid_certs(true)
+            .min_protocol_version(Some(Protocol::Tlsv10))
+            .max_protocol_version(Some(max_version));
+        if let Some(identity) = identity {
+            let cert = fs::read(&identity.crt).expect("Failed to read client cert");
+            let key = fs::read(&identity.key).expect("Failed to read client key");
+            builder.identity(
+                Identity::from_pkcs8(&cert, &key).expect("Failed to create client identity"),
+            );
+        }
+        let connector = builder.build().expect("Failed to create TLS connector");
+        let connector = TlsConnector::from(connector);
+        let stream = TcpStream::connect(addr)
+            .await
+            .expect("Failed to connect to listener");
+        connector.connect("localhost", stream).await.is_ok()
+    }
+
+    #[tokio::test]
+    async fn test_min_tls_version() {
+        let certificate = TlsCertificate::create(None);
+        let addr: SocketAddr = "127.0.0.1:0".parse().unwrap();
+
+        let tls12 = TlsListener::bind(
+            addr,
+            &certificate.key,
+            &certificate.crt,
+            TlsVersion::V1_2,
+            None,
+        )
+        .await
+        .expect("Failed to bind listener");
+        assert!(
+            !handshake(tls12.addr, Protocol::Tlsv11).await,
+            "TLS 1.1 should be rejected"
+        );
+        assert!(
+            handshake(tls12.addr, Protocol::Tlsv12).await,
+            "TLS 1.2 should be accepted"
+        );
+
+        let tls13 = TlsListener::bind(
+            addr,
+            &certificate.key,
+            &certificate.crt,
+            TlsVersion::V1_3,
+            None,
+        )
+        .await
+        .expect("Failed to bind listener");
+        assert!(
+            !handshake(tls13.addr, Protocol::Tlsv12).await,
+            "TLS 1.2 should be rejected when 1.3 is required"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_client_certificate_verification() {
+        let certificate = TlsCertificate::create(None);
+        let client = TlsCertificate::create(None);
+        let other_client = TlsCertificate::create(None);
+        let addr: SocketAddr = "127.0.0.1:0".parse().unwrap();
+
+        let listener = TlsListener::bind(
+            addr,
+            &certificate.key,
+            &certificate.crt,
+            TlsVersion::V1_2,
+            Some(&client.crt),
+        )
+        .await
+        .expect("Failed to bind listener");
+
+        // With TLS 1.3 the client only notices a rejected certificate after the handshake
+        assert!(
+            handshake_with_identity(listener.addr, Protocol::Tlsv12, Some(&client)).await,
+            "Client with a trusted certificate should be accepted"
+        );
+        assert!(
+            !handshake_with_identity(listener.addr, Protocol::Tlsv12, None).await,
+            "Client without a certificate should be rejected"
+        );
+        assert!(
+            !handshake_with_identity(listener.addr, Protocol::Tlsv12, Some(&other_client)).await,
+            "Client with an untrusted certificate should be rejected"
+        );
+    }
+
+    #[test]
+    fn test_validate_ca_file() {
+        let certificate = TlsCertificate::create(None);
+        assert!(
+            validate_ca_file(&certificate.crt),
+            "Should accept PEM certificates"
+        );
+        assert!(!validate_ca_file(&certificate.key), "Should reject a key");
+        assert!(
+            !validate_ca_file("/does/not/exist.crt"),
+            "Should reject missing files"
+        );
+    }
+
+    #[test]
+    fn test_tls_version_deserialize() {
+        assert_eq!(
+            TlsVersion::V1_3,
+            serde_yaml::from_str::<TlsVersion>("\"1.3\"").unwrap()
+        );
+        assert!(serde_yaml::from_str::<TlsVersion>("\"1.1\"").is_err());
+    }
 
     #[test]
     fn test_tls_error_display_read_key_error() {
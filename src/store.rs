@@ -0,0 +1,191 @@
+use crate::error::Error;
+use std::collections::{HashMap, VecDeque};
+use std::future::Future;
+use std::pin::Pin;
+use std::sync::Mutex;
+use tokio::time::{Duration, Instant};
+
+pub mod redis;
+#[cfg(test)]
+mod test;
+
+/// Maximum number of entries kept by the in-memory store, the entries expiring first are evicted when it is full
+const MAX_MEMORY_STORE_ENTRIES: usize = 10_000;
+
+/// Future returned by the operations of a state store
+pub type StoreFuture<'a, T> = Pin<Box<dyn Future<Output = Result<T, Error>> + Send + 'a>>;
+
+/// Key-value store for state that needs to outlive a single webhook delivery, e.g. counters per commit.
+/// Every value expires after its TTL, so the state does not grow without bounds.
+/// Implementations need to be safe for concurrent use.
+pub trait StateStore: Send + Sync {
+    /// Return the value of the key, None if it does not exist or has expired
+    fn get<'a>(&'a self, key: &'a str) -> StoreFuture<'a, Option<String>>;
+
+    /// Set the value of the key, replacing the previous value and its TTL
+    fn set<'a>(&'a self, key: &'a str, value: &'a str, ttl: Duration) -> StoreFuture<'a, ()>;
+
+    /// Delete the key, returns true if it existed
+    fn delete<'a>(&'a self, key: &'a str) -> StoreFuture<'a, bool>;
+
+    /// Append the value to the list of the key in a single atomic operation, creating the list if needed.
+    /// The TTL of the whole list is reset to the given one.
+    fn push<'a>(&'a self, key: &'a str, value: &'a str, ttl: Duration) -> StoreFuture<'a, ()>;
+
+    /// Remove and return the first value of the list of the key in a single atomic operation.
+    /// Returns None if the list is empty or does not exist.
+    fn pop<'a>(&'a self, key: &'a str) -> StoreFuture<'a, Option<String>>;
+
+    /// Check if the store can be used, e.g. for the readiness probe
+    fn ping(&self) -> StoreFuture<'_, ()>;
+}
+
+/// Key for state belonging to a commit.
+/// The client ID separates the state of multiple apps sharing the same store.
+pub fn commit_key(kind: &str, client_id: &str, repo: &str, commit: &str) -> String {
+    format!("{kind}:{client_id}:{repo}:{commit}")
+}
+
+/// Value stored in memory, either set as a whole or built by pushing to a list
+enum Value {
+    String(String),
+    List(VecDeque<String>),
+}
+
+/// Value stored in memory with the time it expires
+struct Entry {
+    value: Value,
+    expires_at: Instant,
+}
+
+/// State store keeping all values in memory, used when no external store is configured.
+/// The state is lost on restart and not shared between replicas.
+pub struct MemoryStore {
+    entries: Mutex<HashMap<String, Entry>>,
+    max_entries: usize,
+}
+
+impl MemoryStore {
+    /// Create a new empty store, holding at most max_entries values
+    pub fn new(max_entries: usize) -> Self {
+        Self {
+            entries: Mutex::new(HashMap::new()),
+            max_entries,
+        }
+    }
+
+    fn lock(&self) -> std::sync::MutexGuard<'_, HashMap<String, Entry>> {
+        self.entries
+            .lock()
+            .unwrap_or_else(std::sync::PoisonError::into_inner)
+    }
+
+    /// Make room for a new key, evicting the expired entries first and the entry expiring first if still full.
+    fn evict(&self, entries: &mut HashMap<String, Entry>, key: &str, now: Instant) {
+        if entries.contains_key(key) || entries.len() < self.max_entries {
+            return;
+        }
+        entries.retain(|_, entry| entry.expires_at > now);
+        if entries.len() >= self.max_entries {
+            let first = entries
+                .iter()
+                .min_by_key(|(_, entry)| entry.expires_at)
+                .map(|(key, _)| key.clone());
+            if let Some(first) = first {
+                entries.remove(&first);
+            }
+        }
+    }
+}
+
+impl Default for MemoryStore {
+    fn default() -> Self {
+        Self::new(MAX_MEMORY_STORE_ENTRIES)
+    }
+}
+
+impl StateStore for MemoryStore {
+    fn get<'a>(&'a self, key: &'a str) -> StoreFuture<'a, Option<String>> {
+        let now = Instant::now();
+        let mut entries = self.lock();
+        let value = match entries.get(key) {
+            Some(entry) if entry.expires_at > now => match &entry.value {
+                Value::String(value) => Some(value.clone()),
+                Value::List(_) => None,
+            },
+            Some(_) => {
+                entries.remove(key);
+                None
+            }
+            None => None,
+        };
+        Box::pin(async move { Ok(value) })
+    }
+
+    fn set<'a>(&'a self, key: &'a str, value: &'a str, ttl: Duration) -> StoreFuture<'a, ()> {
+        let now = Instant::now();
+        let mut entries = self.lock();
+        self.evict(&mut entries, key, now);
+        entries.insert(
+            key.to_string(),
+            Entry {
+                value: Value::String(value.to_string()),
+                expires_at: now + ttl,
+            },
+        );
+        Box::pin(async move { Ok(()) })
+    }
+
+    fn delete<'a>(&'a self, key: &'a str) -> StoreFuture<'a, bool> {
+        let now = Instant::now();
+        let existed = self
+            .lock()
+            .remove(key)
+            .is_some_and(|entry| entry.expires_at > now);
+        Box::pin(async move { Ok(existed) })
+    }
+
+    fn push<'a>(&'a self, key: &'a str, value: &'a str, ttl: Duration) -> StoreFuture<'a, ()> {
+        let now = Instant::now();
+        let mut entries = self.lock();
+        self.evict(&mut entries, key, now);
+        let entry = entries.entry(key.to_string()).or_insert_with(|| Entry {
+            value: Value::List(VecDeque::new()),
+            expires_at: now,
+        });
+        // An expired list or a single value is replaced by a new list
+        if entry.expires_at <= now || !matches!(entry.value, Value::List(_)) {
+            entry.value = Value::List(VecDeque::new());
+        }
+        if let Value::List(list) = &mut entry.value {
+            list.push_back(value.to_string());
+        }
+        entry.expires_at = now + ttl;
+        Box::pin(async move { Ok(()) })
+    }
+
+    fn pop<'a>(&'a self, key: &'a str) -> StoreFuture<'a, Option<String>> {
+        let now = Instant::now();
+        let mut entries = self.lock();
+        let (value, empty) = match entries.get_mut(key) {
+            Some(Entry {
+                value: Value::List(list),
+                expires_at,
+            }) if *expires_at > now => {
+                let value = list.pop_front();
+                (value, list.is_empty())
+            }
+            Some(Entry { expires_at, .. }) => (None, *expires_at <= now),
+            None => (None, false),
+        };
+        if empty {
+            entries.remove(key);
+        }
+        Box::pin(async move { Ok(value) })
+    }
+
+    /// The in-memory store is always available
+    fn ping(&self) -> StoreFuture<'_, ()> {
+        Box::pin(async { Ok(()) })
+    }
+}
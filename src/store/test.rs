@@ -0,0 +1,215 @@
+use super::*;
+use std::sync::Arc;
+
+#[tokio::test]
+async fn memory_store_get_set_delete() {
+    let store = MemoryStore::default();
+
+    assert_eq!(None, store.get("key").await.unwrap());
+
+    store
+        .set("key", "value", Duration::from_secs(60))
+        .await
+        .unwrap();
+    assert_eq!(Some("value".to_string()), store.get("key").await.unwrap());
+
+    store
+        .set("key", "other", Duration::from_secs(60))
+        .await
+        .unwrap();
+    assert_eq!(
+        Some("other".to_string()),
+        store.get("key").await.unwrap(),
+        "Should replace the value"
+    );
+
+    assert!(store.delete("key").await.unwrap(), "Should delete the key");
+    assert_eq!(None, store.get("key").await.unwrap());
+    assert!(
+        !store.delete("key").await.unwrap(),
+        "Should report that the key did not exist"
+    );
+}
+
+#[tokio::test]
+async fn memory_store_values_expire() {
+    let store = MemoryStore::default();
+    store
+        .set("short", "value", Duration::from_millis(100))
+        .await
+        .unwrap();
+    store
+        .set("long", "value", Duration::from_secs(60))
+        .await
+        .unwrap();
+    assert_eq!(Some("value".to_string()), store.get("short").await.unwrap());
+
+    tokio::time::sleep(Duration::from_millis(200)).await;
+
+    assert_eq!(
+        None,
+        store.get("short").await.unwrap(),
+        "Should not return expired values"
+    );
+    assert!(
+        !store.delete("short").await.unwrap(),
+        "Expired values should not count as existing"
+    );
+    assert_eq!(Some("value".to_string()), store.get("long").await.unwrap());
+}
+
+#[tokio::test]
+async fn memory_store_push_pop() {
+    let store = MemoryStore::default();
+
+    assert_eq!(None, store.pop("list").await.unwrap());
+    for value in ["first", "second"] {
+        store
+            .push("list", value, Duration::from_secs(60))
+            .await
+            .unwrap();
+    }
+    assert_eq!(
+        None,
+        store.get("list").await.unwrap(),
+        "Lists are not single values"
+    );
+    assert_eq!(Some("first".to_string()), store.pop("list").await.unwrap());
+    assert_eq!(Some("second".to_string()), store.pop("list").await.unwrap());
+    assert_eq!(None, store.pop("list").await.unwrap());
+    assert!(
+        !store.delete("list").await.unwrap(),
+        "Should remove the list once it is empty"
+    );
+
+    store
+        .push("short", "value", Duration::from_millis(100))
+        .await
+        .unwrap();
+    tokio::time::sleep(Duration::from_millis(200)).await;
+    assert_eq!(
+        None,
+        store.pop("short").await.unwrap(),
+        "Should not return values of expired lists"
+    );
+    store
+        .push("short", "new", Duration::from_secs(60))
+        .await
+        .unwrap();
+    assert_eq!(
+        Some("new".to_string()),
+        store.pop("short").await.unwrap(),
+        "Should start a new list after the old one expired"
+    );
+}
+
+#[tokio::test]
+async fn memory_store_set_renews_ttl() {
+    let store = MemoryStore::default();
+    store
+        .set("key", "value", Duration::from_millis(100))
+        .await
+        .unwrap();
+    store
+        .set("key", "value", Duration::from_secs(60))
+        .await
+        .unwrap();
+
+    tokio::time::sleep(Duration::from_millis(200)).await;
+
+    assert_eq!(
+        Some("value".to_string()),
+        store.get("key").await.unwrap(),
+        "Should use the TTL of the last set"
+    );
+}
+
+#[tokio::test]
+async fn memory_store_evicts_when_full() {
+    let store = MemoryStore::new(2);
+    store
+        .set("first", "value", Duration::from_secs(10))
+        .await
+        .unwrap();
+    store
+        .set("second", "value", Duration::from_secs(60))
+        .await
+        .unwrap();
+    store
+        .set("third", "value", Duration::from_secs(60))
+        .await
+        .unwrap();
+
+    assert_eq!(
+        None,
+        store.get("first").await.unwrap(),
+        "Should evict the entry expiring first"
+    );
+    assert!(store.get("second").await.unwrap().is_some());
+    assert!(store.get("third").await.unwrap().is_some());
+
+    store
+        .set("second", "updated", Duration::from_secs(60))
+        .await
+        .unwrap();
+    assert!(
+        store.get("third").await.unwrap().is_some(),
+        "Should not evict when replacing a value"
+    );
+}
+
+#[tokio::test]
+async fn memory_store_concurrent_access() {
+    let store: Arc<dyn StateStore> = Arc::new(MemoryStore::default());
+
+    let mut handles = Vec::new();
+    for task in 0..16 {
+        let store = store.clone();
+        handles.push(tokio::spawn(async move {
+            for i in 0..100 {
+                let key = format!("key-{task}-{i}");
+                store
+                    .set(&key, &i.to_string(), Duration::from_secs(60))
+                    .await
+                    .unwrap();
+                store
+                    .set("shared", &task.to_string(), Duration::from_secs(60))
+                    .await
+                    .unwrap();
+                assert_eq!(Some(i.to_string()), store.get(&key).await.unwrap());
+            }
+        }));
+    }
+    for handle in handles {
+        handle.await.expect("Task should not panic");
+    }
+
+    for task in 0..16 {
+        for i in 0..100 {
+            assert_eq!(
+                Some(i.to_string()),
+                store.get(&format!("key-{task}-{i}")).await.unwrap(),
+                "Should keep the values of all tasks"
+            );
+        }
+    }
+    let shared = store.get("shared").await.unwrap().expect("Should be set");
+    assert!(
+        shared.parse::<u32>().is_ok_and(|task| task < 16),
+        "Should contain the value of one of the tasks, got: {shared}"
+    );
+}
+
+#[tokio::test]
+async fn memory_store_is_always_healthy() {
+    let store = MemoryStore::new(0);
+    assert!(store.ping().await.is_ok());
+}
+
+#[test]
+fn commit_key_includes_all_parts() {
+    assert_eq!(
+        "flaky-reruns:client-id:owner/repo:abc123",
+        commit_key("flaky-reruns", "client-id", "owner/repo", "abc123")
+    );
+}
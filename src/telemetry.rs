@@ -0,0 +1,42 @@
+use crate::{error::Error, version};
+use opentelemetry::trace::TracerProvider;
+use opentelemetry_otlp::WithExportConfig;
+use opentelemetry_sdk::{
+    Resource,
+    trace::{SdkTracer, SdkTracerProvider},
+};
+use tracing::Subscriber;
+use tracing_opentelemetry::OpenTelemetryLayer;
+use tracing_subscriber::registry::LookupSpan;
+
+/// Create a tracer provider exporting the spans in batches to the OTLP/HTTP endpoint.
+pub fn new_tracer_provider(endpoint: &str) -> Result<SdkTracerProvider, Error> {
+    let exporter = opentelemetry_otlp::SpanExporter::builder()
+        .with_http()
+        .with_endpoint(endpoint)
+        .build()
+        .map_err(|e| Error::Telemetry(e.to_string()))?;
+    Ok(SdkTracerProvider::builder()
+        .with_batch_exporter(exporter)
+        .with_resource(Resource::builder().with_service_name(version::NAME).build())
+        .build())
+}
+
+/// Layer passing the spans, e.g. of the webhook deliveries and the requests to GitHub, to the tracer provider.
+pub fn layer<S>(provider: &SdkTracerProvider) -> OpenTelemetryLayer<S, SdkTracer>
+where
+    S: Subscriber + for<'a> LookupSpan<'a>,
+{
+    tracing_opentelemetry::layer().with_tracer(provider.tracer(version::NAME))
+}
+
+/// Shuts the tracer provider down when dropped, so the spans of the last batch are exported before exiting.
+pub struct ShutdownOnDrop(pub SdkTracerProvider);
+
+impl Drop for ShutdownOnDrop {
+    fn drop(&mut self) {
+        if let Err(e) = self.0.shutdown() {
+            eprintln!("Failed to export the remaining spans: {e}");
+        }
+    }
+}
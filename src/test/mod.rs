@@ -1,9 +1,9 @@
 use crate::client::ClientOptions;
-use crate::config::Configuration;
+use crate::config::{Configuration, LogFormat};
 use crate::server::ServerOptions;
 use crate::testutils::*;
 use crate::types::*;
-use crate::{Command, GlobalOpts};
+use crate::{Command, ConfigCommand, GlobalOpts};
 use axum::http::{HeaderMap, StatusCode};
 use reqwest::header;
 use std::collections::VecDeque;
@@ -35,12 +35,17 @@ async fn pull_request_event() {
     server_options.port = 8900;
     let config = Configuration {
         log_level: "debug".to_string(),
+        log_format: Default::default(),
+        log_sampling: 0,
+        otlp_endpoint: String::new(),
         github: ClientOptions {
             api: api_addr.clone(),
             client_id: client_id.to_string(),
             private_key: certificate.key.clone(),
+            ..Default::default()
         },
         server: server_options,
+        additional_apps: Vec::new(),
     };
     let config = TmpTestConfigFile::new(config);
 
@@ -48,8 +53,9 @@ async fn pull_request_event() {
         global_opts: GlobalOpts {
             log: None,
             config: config.file.clone(),
+            env: false,
         },
-        command: Command::Server,
+        command: Command::Server { listen: None },
     };
 
     tokio::spawn(async move {
@@ -58,9 +64,12 @@ async fn pull_request_event() {
 
     let pull_request_event = PullRequestEvent {
         action: "opened".to_string(),
+        changes: PullRequestChanges::default(),
         number: 1,
         pull_request: PullRequest {
             title: "Test Pull Request".to_string(),
+            state: "open".to_string(),
+            draft: false,
             head: BranchRef {
                 label: "base_label".to_string(),
                 sha: "base_sha".to_string(),
@@ -69,15 +78,25 @@ async fn pull_request_event() {
                     id: 12345678,
                     name: "test_repo".to_string(),
                     full_name: "test_user/test_repo".to_string(),
+                    owner: None,
+                    private: false,
+                    visibility: String::new(),
                 },
             },
             number: 1,
+            labels: Vec::new(),
         },
-        installation: Some(Installation { id: 123456 }),
+        installation: Some(Installation {
+            id: 123456,
+            account: None,
+        }),
         repository: Repo {
             id: 12345678,
             name: "test_repo".to_string(),
             full_name: "test_user/test_repo".to_string(),
+            owner: None,
+            private: false,
+            visibility: String::new(),
         },
     };
     let response = reqwest::Client::new()
@@ -145,6 +164,7 @@ async fn check_run_event_incomplete() {
             },
         ),
         ExpectedRequests::GetCheckRuns(StatusCode::OK, check_runs_response),
+        ExpectedRequests::GetCommitStatuses(StatusCode::OK, CombinedStatusResponse::default()),
         ExpectedRequests::UpdateCheckRun(StatusCode::OK, check_run.clone()),
     ]);
 
@@ -157,12 +177,17 @@ async fn check_run_event_incomplete() {
     server_options.port = 8901;
     let config = Configuration {
         log_level: "debug".to_string(),
+        log_format: Default::default(),
+        log_sampling: 0,
+        otlp_endpoint: String::new(),
         github: ClientOptions {
             api: api_addr.clone(),
             client_id: client_id.to_string(),
             private_key: certificate.key.clone(),
+            ..Default::default()
         },
         server: server_options,
+        additional_apps: Vec::new(),
     };
     let config = TmpTestConfigFile::new(config);
 
@@ -170,8 +195,9 @@ async fn check_run_event_incomplete() {
         global_opts: GlobalOpts {
             log: None,
             config: config.file.clone(),
+            env: false,
         },
-        command: Command::Server,
+        command: Command::Server { listen: None },
     };
 
     tokio::spawn(async move {
@@ -181,11 +207,17 @@ async fn check_run_event_incomplete() {
     let check_run_event = CheckRunEvent {
         action: "created".to_string(),
         check_run,
-        installation: Some(Installation { id: 123456 }),
+        installation: Some(Installation {
+            id: 123456,
+            account: None,
+        }),
         repository: Repo {
             id: 12345678,
             name: "test_repo".to_string(),
             full_name: "test_user/test_repo".to_string(),
+            owner: None,
+            private: false,
+            visibility: String::new(),
         },
     };
 
@@ -221,7 +253,7 @@ async fn check_run_event_incomplete() {
         .expect("Should have get check-runs request");
     assert_eq!("GET", request.method.as_str(), "Method should be GET");
     assert_eq!(
-        "/repos/test_user/test_repo/commits/test_commit/check-runs",
+        "/repos/test_user/test_repo/commits/test_commit/check-runs?per_page=100",
         request.uri.as_str(),
         "URI should match"
     );
@@ -241,12 +273,17 @@ async fn check_run_event_ignore_own() {
     server_options.port = 8902;
     let config = Configuration {
         log_level: "debug".to_string(),
+        log_format: Default::default(),
+        log_sampling: 0,
+        otlp_endpoint: String::new(),
         github: ClientOptions {
             api: api_addr.clone(),
             client_id: client_id.to_string(),
             private_key: certificate.key.clone(),
+            ..Default::default()
         },
         server: server_options,
+        additional_apps: Vec::new(),
     };
     let config = TmpTestConfigFile::new(config);
 
@@ -254,8 +291,9 @@ async fn check_run_event_ignore_own() {
         global_opts: GlobalOpts {
             log: None,
             config: config.file.clone(),
+            env: false,
         },
-        command: Command::Server,
+        command: Command::Server { listen: None },
     };
 
     tokio::spawn(async move {
@@ -275,11 +313,17 @@ async fn check_run_event_ignore_own() {
     let check_run_event = CheckRunEvent {
         action: "created".to_string(),
         check_run,
-        installation: Some(Installation { id: 123456 }),
+        installation: Some(Installation {
+            id: 123456,
+            account: None,
+        }),
         repository: Repo {
             id: 12345678,
             name: "test_repo".to_string(),
             full_name: "test_user/test_repo".to_string(),
+            owner: None,
+            private: false,
+            visibility: String::new(),
         },
     };
 
@@ -300,6 +344,58 @@ async fn check_run_event_ignore_own() {
     // No requests should be made and the server panics anyway on unexpected requests
 }
 
+#[tokio::test]
+async fn config_validate_valid() {
+    let config = Configuration {
+        log_level: "info".to_string(),
+        log_format: Default::default(),
+        log_sampling: 0,
+        otlp_endpoint: String::new(),
+        github: ClientOptions {
+            client_id: "test_client_id".to_string(),
+            private_key: "/does/not/need/to/exist.pem".to_string(),
+            ..Default::default()
+        },
+        server: ServerOptions::default(),
+        additional_apps: Vec::new(),
+    };
+    let config = TmpTestConfigFile::new(config);
+
+    let app = crate::App {
+        global_opts: GlobalOpts {
+            log: None,
+            config: config.file.clone(),
+            env: false,
+        },
+        command: Command::Config {
+            command: ConfigCommand::Validate,
+        },
+    };
+
+    let result = app.run().await;
+    assert!(result.is_ok(), "Valid config should pass: {result:?}");
+}
+
+#[tokio::test]
+async fn config_validate_invalid() {
+    let app = crate::App {
+        global_opts: GlobalOpts {
+            log: None,
+            config: "src/config/testdata/invalid.yaml".to_string(),
+            env: false,
+        },
+        command: Command::Config {
+            command: ConfigCommand::Validate,
+        },
+    };
+
+    let result = app.run().await;
+    assert!(
+        matches!(result, Err(crate::error::Error::InvalidConfig(_))),
+        "Invalid config should fail validation: {result:?}"
+    );
+}
+
 /// Asserts that the common headers, including the token, are set.
 fn should_have_common_headers(headers: HeaderMap) {
     assert!(
@@ -310,12 +406,129 @@ fn should_have_common_headers(headers: HeaderMap) {
         headers.contains_key("x-github-api-version"),
         "Missing x-github-api-version header"
     );
-    assert!(
-        headers.contains_key(header::USER_AGENT),
-        "Missing User-Agent header"
+    assert_eq!(
+        Some(crate::version::user_agent().as_str()),
+        headers
+            .get(header::USER_AGENT)
+            .and_then(|v| v.to_str().ok()),
+        "Missing or wrong User-Agent header"
     );
     assert!(
         headers.contains_key(header::AUTHORIZATION),
         "Missing Authorization header"
     );
 }
+
+#[test]
+fn json_log_format() {
+    let buffer = BufferWriter::default();
+    let writer = buffer.clone();
+    let (logger, _) = crate::new_logger("info", LogFormat::Json, 0, None, move || writer.clone());
+
+    tracing::subscriber::with_default(logger, || {
+        tracing::info!("first message");
+        tracing::debug!("filtered by level");
+        tracing::warn!(repo = "owner/repo", "second message");
+    });
+
+    let output = buffer.output();
+    let lines: Vec<serde_json::Value> = output
+        .lines()
+        .map(|line| serde_json::from_str(line).expect("Each line should be valid JSON"))
+        .collect();
+
+    assert_eq!(2, lines.len(), "Should respect the log level: {output}");
+    assert_eq!("INFO", lines[0]["level"]);
+    assert_eq!("first message", lines[0]["fields"]["message"]);
+    assert_eq!("WARN", lines[1]["level"]);
+    assert_eq!("owner/repo", lines[1]["fields"]["repo"]);
+}
+
+#[test]
+fn log_sampling() {
+    let buffer = BufferWriter::default();
+    let writer = buffer.clone();
+    let (logger, _) = crate::new_logger("info", LogFormat::Json, 3, None, move || writer.clone());
+
+    tracing::subscriber::with_default(logger, || {
+        for i in 0..6 {
+            tracing::info!(target: "cerberus_mergeguard::api", "request {i}");
+            tracing::info!(target: "audit", "decision {i}");
+        }
+        for i in 0..6 {
+            tracing::info!(target: crate::server::EVENT_LOG_TARGET, "event {i}");
+        }
+        tracing::info!(target: "cerberus_mergeguard::server", "Starting server");
+        tracing::warn!(target: "cerberus_mergeguard::api", "API request failed");
+    });
+
+    let output = buffer.output();
+    let messages: Vec<String> = output
+        .lines()
+        .map(|line| {
+            let line: serde_json::Value =
+                serde_json::from_str(line).expect("Each line should be valid JSON");
+            line["fields"]["message"]
+                .as_str()
+                .unwrap_or_default()
+                .to_string()
+        })
+        .collect();
+
+    let requests: Vec<&str> = messages
+        .iter()
+        .map(String::as_str)
+        .filter(|message| message.starts_with("request "))
+        .collect();
+    assert_eq!(
+        vec!["request 0", "request 3"],
+        requests,
+        "Should only log 1 in 3 of the high-volume logs: {output}"
+    );
+    let events = messages
+        .iter()
+        .filter(|message| message.starts_with("event "))
+        .count();
+    assert_eq!(
+        2, events,
+        "Should only log 1 in 3 of the webhook event logs: {output}"
+    );
+    assert!(
+        messages.contains(&"Starting server".to_string()),
+        "Should never sample the other server logs: {output}"
+    );
+    let decisions = messages
+        .iter()
+        .filter(|message| message.starts_with("decision"))
+        .count();
+    assert_eq!(6, decisions, "Should never sample the audit log: {output}");
+    assert!(
+        messages.contains(&"API request failed".to_string()),
+        "Should never sample warnings: {output}"
+    );
+}
+
+#[test]
+fn change_log_level() {
+    let buffer = BufferWriter::default();
+    let writer = buffer.clone();
+    let (logger, handle) =
+        crate::new_logger("info", LogFormat::Json, 0, None, move || writer.clone());
+
+    tracing::subscriber::with_default(logger, || {
+        tracing::debug!("filtered by level");
+        crate::set_log_level(&handle, "debug");
+        tracing::debug!("after reload");
+        crate::set_log_level(&handle, "warn");
+        tracing::info!("filtered by reloaded level");
+    });
+
+    let output = buffer.output();
+    let lines: Vec<serde_json::Value> = output
+        .lines()
+        .map(|line| serde_json::from_str(line).expect("Each line should be valid JSON"))
+        .collect();
+
+    assert_eq!(1, lines.len(), "Should respect the changed level: {output}");
+    assert_eq!("after reload", lines[0]["fields"]["message"]);
+}
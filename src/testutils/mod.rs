@@ -106,13 +106,23 @@ pub enum ExpectedRequests {
     GetCheckRuns(StatusCode, CheckRunsResponse),
     CreateCheckRun(StatusCode, CheckRun),
     UpdateCheckRun(StatusCode, CheckRun),
+    RerequestCheckRun(StatusCode),
+    CreateIssueComment(StatusCode, IssueComment),
     GetPullRequest(StatusCode, PullRequestResponse),
+    GetCommitPullRequests(StatusCode, Vec<PullRequestResponse>),
+    GetCommitStatuses(StatusCode, CombinedStatusResponse),
+    GetApp(StatusCode, App),
+    ListInstallations(StatusCode, Vec<Installation>),
+    GetRepoInstallation(StatusCode, Installation),
+    GetRateLimit(StatusCode, RateLimitResponse),
+    /// Respond with the given status code, headers and raw body, e.g. for simulating errors.
+    Raw(StatusCode, HeaderMap, String),
 }
 
 impl ExpectedRequests {
-    /// Returns the provided status code and the response body as a tuple.
-    pub fn response(&self) -> (StatusCode, String) {
-        match self {
+    /// Returns the provided status code, the response headers and the response body as a tuple.
+    pub fn response(&self) -> (StatusCode, HeaderMap, String) {
+        let (status, body) = match self {
             ExpectedRequests::GetInstallationToken(status, token_response) => (
                 *status,
                 serde_json::to_string(&token_response).expect("Failed to serialize token response"),
@@ -130,12 +140,47 @@ impl ExpectedRequests {
                 *status,
                 serde_json::to_string(&check_run).expect("Failed to serialize token response"),
             ),
+            ExpectedRequests::RerequestCheckRun(status) => (*status, "{}".to_string()),
+            ExpectedRequests::CreateIssueComment(status, comment) => (
+                *status,
+                serde_json::to_string(&comment).expect("Failed to serialize issue comment"),
+            ),
             ExpectedRequests::GetPullRequest(status, pull_request_response) => (
                 *status,
                 serde_json::to_string(&pull_request_response)
                     .expect("Failed to serialize pull request response"),
             ),
-        }
+            ExpectedRequests::GetCommitPullRequests(status, pull_requests) => (
+                *status,
+                serde_json::to_string(&pull_requests)
+                    .expect("Failed to serialize pull requests response"),
+            ),
+            ExpectedRequests::GetCommitStatuses(status, combined_status_response) => (
+                *status,
+                serde_json::to_string(&combined_status_response)
+                    .expect("Failed to serialize combined status response"),
+            ),
+            ExpectedRequests::GetApp(status, app) => (
+                *status,
+                serde_json::to_string(&app).expect("Failed to serialize app"),
+            ),
+            ExpectedRequests::ListInstallations(status, installations) => (
+                *status,
+                serde_json::to_string(&installations).expect("Failed to serialize installations"),
+            ),
+            ExpectedRequests::GetRepoInstallation(status, installation) => (
+                *status,
+                serde_json::to_string(&installation).expect("Failed to serialize installation"),
+            ),
+            ExpectedRequests::GetRateLimit(status, rate_limit) => (
+                *status,
+                serde_json::to_string(&rate_limit).expect("Failed to serialize rate limit"),
+            ),
+            ExpectedRequests::Raw(status, headers, body) => {
+                return (*status, headers.clone(), body.clone());
+            }
+        };
+        (status, HeaderMap::new(), body)
     }
 }
 
@@ -145,7 +190,7 @@ async fn handle_request(
     uri: Uri,
     State(state): State<SharedState>,
     payload: String,
-) -> (StatusCode, String) {
+) -> (StatusCode, HeaderMap, String) {
     let mut state = state.lock().await;
 
     let record = RecordedRequests {
@@ -195,6 +240,104 @@ impl Drop for TmpTestConfigFile {
     }
 }
 
+/// Writer collecting the log output in memory.
+#[derive(Clone, Default)]
+pub struct BufferWriter(Arc<std::sync::Mutex<Vec<u8>>>);
+
+impl BufferWriter {
+    /// Returns the log output written so far.
+    pub fn output(&self) -> String {
+        String::from_utf8(self.0.lock().unwrap().clone()).expect("Log output should be UTF-8")
+    }
+}
+
+impl std::io::Write for BufferWriter {
+    fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+        self.0.lock().unwrap().extend_from_slice(buf);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> std::io::Result<()> {
+        Ok(())
+    }
+}
+
+/// Span with its fields, recorded by the SpanRecorder once it has been closed.
+#[derive(Debug, Clone, Default)]
+pub struct RecordedSpan {
+    pub name: String,
+    pub fields: std::collections::HashMap<String, String>,
+    /// Name of the parent span, if any
+    pub parent: Option<String>,
+}
+
+impl tracing::field::Visit for RecordedSpan {
+    fn record_str(&mut self, field: &tracing::field::Field, value: &str) {
+        self.fields
+            .insert(field.name().to_string(), value.to_string());
+    }
+
+    fn record_debug(&mut self, field: &tracing::field::Field, value: &dyn std::fmt::Debug) {
+        self.fields
+            .insert(field.name().to_string(), format!("{value:?}"));
+    }
+}
+
+/// Layer keeping all closed spans in memory, for asserting on the instrumentation.
+#[derive(Clone, Default)]
+pub struct SpanRecorder(Arc<std::sync::Mutex<Vec<RecordedSpan>>>);
+
+impl SpanRecorder {
+    /// Returns the spans closed so far, in the order they have been closed.
+    pub fn spans(&self) -> Vec<RecordedSpan> {
+        self.0.lock().unwrap().clone()
+    }
+}
+
+impl<S> tracing_subscriber::Layer<S> for SpanRecorder
+where
+    S: tracing::Subscriber + for<'a> tracing_subscriber::registry::LookupSpan<'a>,
+{
+    fn on_new_span(
+        &self,
+        attrs: &tracing::span::Attributes<'_>,
+        id: &tracing::span::Id,
+        ctx: tracing_subscriber::layer::Context<'_, S>,
+    ) {
+        let Some(span) = ctx.span(id) else {
+            return;
+        };
+        let mut recorded = RecordedSpan {
+            name: span.name().to_string(),
+            parent: span.parent().map(|parent| parent.name().to_string()),
+            ..Default::default()
+        };
+        attrs.record(&mut recorded);
+        span.extensions_mut().insert(recorded);
+    }
+
+    fn on_record(
+        &self,
+        id: &tracing::span::Id,
+        values: &tracing::span::Record<'_>,
+        ctx: tracing_subscriber::layer::Context<'_, S>,
+    ) {
+        if let Some(span) = ctx.span(id) {
+            if let Some(recorded) = span.extensions_mut().get_mut::<RecordedSpan>() {
+                values.record(recorded);
+            }
+        }
+    }
+
+    fn on_close(&self, id: tracing::span::Id, ctx: tracing_subscriber::layer::Context<'_, S>) {
+        if let Some(span) = ctx.span(&id) {
+            if let Some(recorded) = span.extensions_mut().remove::<RecordedSpan>() {
+                self.0.lock().unwrap().push(recorded);
+            }
+        }
+    }
+}
+
 /// Randomly generated self-signed TLS certificate and key pair.
 /// Will be cleaned up when it goes out of scope.
 pub struct TlsCertificate {
@@ -1,6 +1,8 @@
 use chrono::{DateTime, Utc};
 use serde::{Deserialize, Serialize};
+use template::SummaryTemplate;
 
+pub mod template;
 #[cfg(test)]
 mod test;
 
@@ -9,6 +11,11 @@ pub const CHECK_RUN_NAME: &str = "cerberus-mergeguard";
 /// Status for unfinished check-runs from the bot
 /// Using 'queued', because while 'pending' is valid according to docs, the actual API does not allow it.
 pub const CHECK_RUN_INITIAL_STATUS: &str = "queued";
+/// Status of check-runs that are actively running
+pub const CHECK_RUN_IN_PROGRESS_STATUS: &str = "in_progress";
+/// Statuses the check-run from the bot can have while other checks are pending
+pub const CHECK_RUN_PENDING_STATUSES: [&str; 2] =
+    [CHECK_RUN_INITIAL_STATUS, CHECK_RUN_IN_PROGRESS_STATUS];
 /// Status for completed check-runs from the bot
 pub const CHECK_RUN_COMPLETED_STATUS: &str = "completed";
 /// Conclusion for completed check-runs from the bot
@@ -17,23 +24,82 @@ pub const CHECK_RUN_CONCLUSION: &str = "success";
 pub const CHECK_RUN_SKIPPED: &str = "skipped";
 /// Conclusion for neutral check-runs from the bot
 pub const CHECK_RUN_NEUTRAL: &str = "neutral";
+/// Conclusion for check-runs from the bot when other checks have failed
+pub const CHECK_RUN_FAILURE: &str = "failure";
+/// Conclusion of check-runs that have been cancelled, counts as failed unless configured as passing
+pub const CHECK_RUN_CANCELLED: &str = "cancelled";
+/// Conclusion of check-runs that did not complete in time, counts as failed unless configured as passing
+pub const CHECK_RUN_TIMED_OUT: &str = "timed_out";
+/// Conclusion of check-runs waiting for a manual action, e.g. a deployment approval
+pub const CHECK_RUN_ACTION_REQUIRED: &str = "action_required";
+/// All conclusions GitHub reports for completed check-runs
+pub const CHECK_RUN_CONCLUSIONS: [&str; 9] = [
+    CHECK_RUN_ACTION_REQUIRED,
+    CHECK_RUN_CANCELLED,
+    "failure",
+    "neutral",
+    "success",
+    "skipped",
+    "stale",
+    "startup_failure",
+    CHECK_RUN_TIMED_OUT,
+];
 /// Title for unfinished check-runs from the bot
 pub const CHECK_RUN_INITIAL_TITLE: &str = "Waiting for other checks to complete";
 /// Title for completed check-runs from the bot
 pub const CHECK_RUN_COMPLETED_TITLE: &str = "All status checks have passed";
 /// Summary for check-runs from the bot
 pub const CHECK_RUN_SUMMARY: &str = "Will block merging until all other checks have completed";
+/// Account type of repositories owned by a personal account
+pub const ACCOUNT_TYPE_USER: &str = "User";
+/// Visibility of repositories everyone can see
+pub const REPO_VISIBILITY_PUBLIC: &str = "public";
+/// Visibility of repositories only members can see
+pub const REPO_VISIBILITY_PRIVATE: &str = "private";
+/// All visibilities a repository can have, internal repositories are visible to all members of an enterprise
+pub const REPO_VISIBILITIES: [&str; 3] =
+    [REPO_VISIBILITY_PUBLIC, REPO_VISIBILITY_PRIVATE, "internal"];
+/// State of commit statuses that have passed
+pub const COMMIT_STATUS_SUCCESS: &str = "success";
+/// State of commit statuses that are still running
+pub const COMMIT_STATUS_PENDING: &str = "pending";
+/// State of pull requests that have not been merged or closed
+pub const PULL_REQUEST_OPEN: &str = "open";
 
 /// Partial fields of a pull_request event webhook payload.
 #[derive(Debug, Serialize, Deserialize)]
 pub struct PullRequestEvent {
     pub action: String,
+    /// Previous values of the changed fields, only sent with the "edited" action
+    #[serde(default)]
+    pub changes: PullRequestChanges,
     pub installation: Option<Installation>,
     pub number: u64,
     pub pull_request: PullRequest,
     pub repository: Repo,
 }
 
+/// Partial fields of the changes of an edited pull request.
+/// Edits of the title or body are not needed, so only the base branch is parsed.
+#[derive(Debug, Serialize, Deserialize, Default)]
+pub struct PullRequestChanges {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub base: Option<BaseChange>,
+}
+
+/// Previous base branch of an edited pull request.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct BaseChange {
+    #[serde(rename = "ref")]
+    pub ref_field: ChangedValue,
+}
+
+/// Previous value of a changed field.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct ChangedValue {
+    pub from: String,
+}
+
 /// Partial fields of a check_run event webhook payload.
 #[derive(Debug, Serialize, Deserialize)]
 pub struct CheckRunEvent {
@@ -43,6 +109,45 @@ pub struct CheckRunEvent {
     pub repository: Repo,
 }
 
+/// Partial fields of a check_suite event webhook payload.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct CheckSuiteEvent {
+    pub action: String,
+    pub check_suite: CheckSuite,
+    pub installation: Option<Installation>,
+    pub repository: Repo,
+}
+
+/// Partial fields of a check suite object.
+/// A check suite groups the check runs created by one app for a commit.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct CheckSuite {
+    pub id: u64,
+    pub head_sha: String,
+    pub status: Option<String>,
+    pub conclusion: Option<String>,
+    pub app: Option<App>,
+}
+
+/// Partial fields of a merge_group event webhook payload.
+/// GitHub sends it when a pull request is added to or removed from a merge queue.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct MergeGroupEvent {
+    pub action: String,
+    pub merge_group: MergeGroup,
+    pub installation: Option<Installation>,
+    pub repository: Repo,
+}
+
+/// Partial fields of a merge group object.
+/// The head commit is the temporary commit the checks of the merge queue run against.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct MergeGroup {
+    pub head_sha: String,
+    pub head_ref: String,
+    pub base_ref: String,
+}
+
 /// Partial fields of an issue_comment event webhook payload.
 #[derive(Debug, Serialize, Deserialize)]
 pub struct IssueCommentEvent {
@@ -53,12 +158,53 @@ pub struct IssueCommentEvent {
     pub repository: Repo,
 }
 
+/// Partial fields of a ping event webhook payload.
+/// GitHub sends it once when a webhook is created.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct PingEvent {
+    pub zen: Option<String>,
+    pub hook_id: Option<u64>,
+}
+
+/// Partial fields of an installation event webhook payload.
+/// Sent when the app is installed, uninstalled, suspended or unsuspended.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct InstallationEvent {
+    pub action: String,
+    pub installation: Installation,
+}
+
+/// Partial fields of an installation_repositories event webhook payload.
+/// Sent when repositories are added to or removed from an installation.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct InstallationRepositoriesEvent {
+    pub action: String,
+    pub installation: Installation,
+    #[serde(default)]
+    pub repositories_added: Vec<Repo>,
+    #[serde(default)]
+    pub repositories_removed: Vec<Repo>,
+}
+
 /// Partial fields of a pull_request object.
 #[derive(Debug, Serialize, Deserialize)]
 pub struct PullRequest {
     pub number: u64,
     pub title: String,
+    /// Either "open" or "closed"
+    #[serde(default)]
+    pub state: String,
+    #[serde(default)]
+    pub draft: bool,
     pub head: BranchRef,
+    #[serde(default)]
+    pub labels: Vec<Label>,
+}
+
+/// Partial fields of a label object.
+#[derive(Debug, Serialize, Deserialize, Clone)]
+pub struct Label {
+    pub name: String,
 }
 
 /// Partial fields of a branch reference object.
@@ -77,6 +223,42 @@ pub struct Repo {
     pub id: u64,
     pub name: String,
     pub full_name: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub owner: Option<Account>,
+    #[serde(default)]
+    pub private: bool,
+    /// Not sent by older GitHub Enterprise versions
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub visibility: String,
+}
+
+impl Repo {
+    /// Returns true if the repository is owned by a personal account instead of an organization.
+    pub fn is_user_owned(&self) -> bool {
+        self.owner
+            .as_ref()
+            .is_some_and(|owner| owner.account_type == ACCOUNT_TYPE_USER)
+    }
+
+    /// Returns the visibility of the repository: public, private or internal.
+    /// Falls back to the private flag, when the visibility is not part of the payload.
+    pub fn visibility(&self) -> &str {
+        if !self.visibility.is_empty() {
+            &self.visibility
+        } else if self.private {
+            REPO_VISIBILITY_PRIVATE
+        } else {
+            REPO_VISIBILITY_PUBLIC
+        }
+    }
+}
+
+/// Partial fields of a user or organization account object.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct Account {
+    pub login: String,
+    #[serde(rename = "type", default)]
+    pub account_type: String,
 }
 
 /// Partial fields of a check_run object.
@@ -95,6 +277,12 @@ pub struct CheckRun {
     pub completed_at: Option<String>,
     #[serde(skip_serializing_if = "Option::is_none")]
     pub output: Option<CheckRunOutput>,
+    /// URL of the page with the details of the check, linked from the check in the GitHub UI
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub details_url: Option<String>,
+    /// Reference to the check run in external systems, set to the commit
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub external_id: Option<String>,
     #[serde(skip_serializing_if = "Option::is_none")]
     pub app: Option<App>,
 }
@@ -117,22 +305,60 @@ impl CheckRun {
             ..Default::default()
         }
     }
-    /// Update the status based on the count of uncompleted check-runs.
+    /// Update the status based on the combined status of the other check-runs.
+    /// Fails if any other check-run failed, otherwise waits for all pending check-runs.
     /// Returns if the content of the check-run has changed.
-    pub fn update_status(&mut self, count: u32) -> bool {
+    pub fn update_status(&mut self, checks: &CheckRunsStatus) -> bool {
+        self.update_status_pending_as(checks, CHECK_RUN_INITIAL_STATUS)
+    }
+
+    /// Same as update_status, but uses the given status while other checks are pending, e.g. "in_progress".
+    pub fn update_status_pending_as(
+        &mut self,
+        checks: &CheckRunsStatus,
+        pending_status: &str,
+    ) -> bool {
+        self.update_status_with(checks, pending_status, &SummaryTemplate::default())
+    }
+
+    /// Same as update_status_pending_as, but renders the summary of the output with the given template.
+    pub fn update_status_with(
+        &mut self,
+        checks: &CheckRunsStatus,
+        pending_status: &str,
+        template: &SummaryTemplate,
+    ) -> bool {
         let status: String;
         let conclusion: Option<String>;
         let output_title: Option<String>;
 
-        if count == 0 {
+        if checks.failed > 0 {
+            status = CHECK_RUN_COMPLETED_STATUS.to_string();
+            conclusion = Some(CHECK_RUN_FAILURE.to_string());
+            let failed_checks = checks.failed_checks();
+            output_title = if failed_checks.is_empty() {
+                Some(format!("{} other checks have failed", checks.failed))
+            } else {
+                Some(format!(
+                    "{} other checks have failed: {}",
+                    checks.failed,
+                    failed_checks.join(", ")
+                ))
+            };
+        } else if checks.pending > 0 {
+            status = pending_status.to_string();
+            conclusion = None;
+            output_title = Some(format!(
+                "Waiting for {} other checks to complete",
+                checks.pending
+            ));
+        } else {
             status = CHECK_RUN_COMPLETED_STATUS.to_string();
             conclusion = Some(CHECK_RUN_CONCLUSION.to_string());
             output_title = Some(CHECK_RUN_COMPLETED_TITLE.to_string());
-        } else {
-            status = CHECK_RUN_INITIAL_STATUS.to_string();
-            conclusion = None;
-            output_title = Some(format!("Waiting for {count} other checks to complete"));
         }
+        let output_summary =
+            Some(template.render(checks, &status, conclusion.as_deref().unwrap_or_default()));
 
         let mut changed = false;
 
@@ -150,18 +376,132 @@ impl CheckRun {
                     changed = true;
                     output.title = output_title;
                 }
+                if output.summary != output_summary {
+                    changed = true;
+                    output.summary = output_summary;
+                }
             }
             None => {
                 changed = true;
                 self.output = Some(CheckRunOutput {
                     title: output_title,
-                    summary: Some(CHECK_RUN_SUMMARY.to_string()),
+                    summary: output_summary,
                 });
             }
         }
 
         changed
     }
+
+    /// Fail the check-run, because other checks did not complete within the timeout.
+    /// The check-run is reset by the next refresh, e.g. when the stalled checks complete after all.
+    pub fn set_timed_out(&mut self, pending: u32, timeout: std::time::Duration) {
+        self.status = CHECK_RUN_COMPLETED_STATUS.to_string();
+        self.conclusion = Some(CHECK_RUN_FAILURE.to_string());
+        self.output = Some(CheckRunOutput {
+            title: Some(format!(
+                "Timed out waiting for {pending} other checks to complete"
+            )),
+            summary: Some(format!(
+                "Other checks did not complete within {}s after the pull request was updated. The runner might have died, re-run the stalled checks to continue.",
+                timeout.as_secs()
+            )),
+        });
+    }
+}
+
+/// Combined status of all check-runs of a commit, excluding the ones created by the bot.
+#[derive(Debug, Default, Clone, PartialEq)]
+pub struct CheckRunsStatus {
+    /// Number of check-runs that have not completed yet
+    pub pending: u32,
+    /// Number of check-runs that completed without a passing conclusion
+    pub failed: u32,
+    /// Number of the pending checks that have not been reported at all, e.g. missing required checks or labels
+    pub missing: u32,
+    /// The checks that have been considered, in the order they have been added
+    pub checks: Vec<CheckResult>,
+}
+
+/// Result of a single check-run or commit status that has been considered for the combined status.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct CheckResult {
+    pub name: String,
+    /// Conclusion of completed checks, otherwise the current status, e.g. "in_progress"
+    pub state: String,
+    pub failed: bool,
+}
+
+impl CheckRunsStatus {
+    /// Add a check that has passed.
+    pub fn add_passed(&mut self, name: &str, state: &str) {
+        self.add(name, state, false);
+    }
+
+    /// Add a check that has not completed yet.
+    pub fn add_pending(&mut self, name: &str, state: &str) {
+        self.pending += 1;
+        self.add(name, state, false);
+    }
+
+    /// Add a check that has not been reported, it counts as pending without anything running for it.
+    pub fn add_missing(&mut self, name: &str, state: &str) {
+        self.missing += 1;
+        self.add_pending(name, state);
+    }
+
+    /// Number of check-runs and commit statuses that are queued or in progress.
+    pub fn running(&self) -> u32 {
+        self.pending - self.missing
+    }
+
+    /// Add a check that completed without a passing conclusion.
+    pub fn add_failed(&mut self, name: &str, state: &str) {
+        self.failed += 1;
+        self.add(name, state, true);
+    }
+
+    fn add(&mut self, name: &str, state: &str, failed: bool) {
+        self.checks.push(CheckResult {
+            name: name.to_string(),
+            state: state.to_string(),
+            failed,
+        });
+    }
+
+    /// Count the failed checks with the given name as pending again, e.g. after they have been re-requested.
+    pub fn retry(&mut self, name: &str, state: &str) {
+        for check in self.checks.iter_mut() {
+            if check.failed && check.name == name {
+                check.failed = false;
+                check.state = state.to_string();
+                self.failed -= 1;
+                self.pending += 1;
+            }
+        }
+    }
+
+    /// Names of the checks that have failed.
+    pub fn failed_checks(&self) -> Vec<&str> {
+        self.checks
+            .iter()
+            .filter(|check| check.failed)
+            .map(|check| check.name.as_str())
+            .collect()
+    }
+
+    /// Markdown comment for pull requests of a commit the guard has failed for, listing the failed checks.
+    pub fn failure_comment(&self, check_name: &str) -> String {
+        let mut comment = format!(
+            "**{check_name}** is blocking this pull request, {} other checks have failed:\n\n",
+            self.failed
+        );
+        for check in self.checks.iter().filter(|check| check.failed) {
+            comment.push_str(&format!("- `{}`: {}\n", check.name, check.state));
+        }
+        comment.push_str("\nMerging is possible again once all failed checks pass.\n");
+        comment
+    }
 }
 
 /// Partial fields of a check_run output object.
@@ -186,6 +526,32 @@ pub struct App {
 #[derive(Debug, Serialize, Deserialize)]
 pub struct Installation {
     pub id: u64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub account: Option<Account>,
+}
+
+/// Partial fields of a rate limit response.
+#[derive(Debug, Serialize, Deserialize, Clone)]
+pub struct RateLimitResponse {
+    pub resources: RateLimitResources,
+}
+
+/// Rate limits of the resources relevant for the bot.
+#[derive(Debug, Serialize, Deserialize, Clone)]
+pub struct RateLimitResources {
+    pub core: RateLimit,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub graphql: Option<RateLimit>,
+}
+
+/// Status of a single rate limit.
+#[derive(Debug, Serialize, Deserialize, Clone, PartialEq)]
+pub struct RateLimit {
+    pub limit: u64,
+    pub used: u64,
+    pub remaining: u64,
+    /// Time when the rate limit resets, in UTC epoch seconds
+    pub reset: i64,
 }
 
 /// Partial fields of a comment object.
@@ -209,6 +575,22 @@ pub struct CheckRunsResponse {
     pub check_runs: Vec<CheckRun>,
 }
 
+/// Response to combined commit status requests from the GitHub API.
+#[derive(Debug, Serialize, Deserialize, Clone, Default)]
+pub struct CombinedStatusResponse {
+    pub state: String,
+    pub total_count: u64,
+    pub statuses: Vec<CommitStatus>,
+}
+
+/// Status of a commit reported via the legacy Statuses API.
+#[derive(Debug, Serialize, Deserialize, Clone, Default)]
+pub struct CommitStatus {
+    pub context: String,
+    /// One of "success", "pending", "failure" or "error"
+    pub state: String,
+}
+
 /// Response to installation token requests from the GitHub API.
 #[derive(Debug, Serialize, Deserialize, Clone)]
 pub struct TokenResponse {
@@ -221,5 +603,16 @@ pub struct TokenResponse {
 pub struct PullRequestResponse {
     pub id: u64,
     pub number: u64,
+    /// Either "open" or "closed"
+    #[serde(default)]
+    pub state: String,
     pub head: BranchRef,
+    #[serde(default)]
+    pub labels: Vec<Label>,
+}
+
+/// Partial fields of an issue comment object, also used for comments on pull requests.
+#[derive(Debug, Serialize, Deserialize, Default, Clone)]
+pub struct IssueComment {
+    pub body: String,
 }
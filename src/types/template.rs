@@ -0,0 +1,296 @@
+use super::{CheckResult, CheckRunsStatus};
+
+/// Built-in template for the summary of the check-run, listing all considered checks with their state.
+pub const DEFAULT_SUMMARY_TEMPLATE: &str = "Will block merging until all other checks have completed{{#total}}\n\n**Considered checks:**\n{{#checks}}- `{{name}}`: {{state}}\n{{/checks}}{{/total}}";
+
+/// Variables available everywhere in the template
+const VARIABLES: [&str; 7] = [
+    "conclusion",
+    "status",
+    "pending",
+    "failed",
+    "total",
+    "checks",
+    "failed_checks",
+];
+/// Lists of checks, sections over them are repeated for every check
+const LISTS: [&str; 2] = ["checks", "failed_checks"];
+/// Variables of a single check, only available in a section over a list of checks
+const CHECK_VARIABLES: [&str; 3] = ["name", "state", "failed"];
+
+/// Template for the summary of the check-run, using a small subset of the mustache syntax:
+///   - "{{name}}" is replaced with the value of the variable.
+///   - "{{#name}}...{{/name}}" is rendered for every check of a list, or once if the value is not empty, zero or false.
+///   - "{{^name}}...{{/name}}" is rendered once if the value is empty, zero or false.
+///
+/// Available variables are conclusion (empty while pending), status, pending, failed, total and the lists
+/// checks and failed_checks. Inside a section over a list, the check provides name, state and failed.
+#[derive(Debug, Clone, PartialEq)]
+pub struct SummaryTemplate {
+    nodes: Vec<Node>,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+enum Node {
+    Text(String),
+    Variable(String),
+    Section {
+        name: String,
+        inverted: bool,
+        nodes: Vec<Node>,
+    },
+}
+
+/// Value of a variable while rendering
+enum Value<'a> {
+    Text(&'a str),
+    Number(u32),
+    Bool(bool),
+    List(Vec<&'a CheckResult>),
+}
+
+impl Value<'_> {
+    fn is_truthy(&self) -> bool {
+        match self {
+            Value::Text(text) => !text.is_empty(),
+            Value::Number(number) => *number > 0,
+            Value::Bool(value) => *value,
+            Value::List(list) => !list.is_empty(),
+        }
+    }
+}
+
+/// Values of the variables for rendering the template
+struct Context<'a> {
+    status: &'a CheckRunsStatus,
+    run_status: &'a str,
+    conclusion: &'a str,
+}
+
+impl<'a> Context<'a> {
+    fn lookup(&self, name: &str, check: Option<&'a CheckResult>) -> Value<'a> {
+        match (name, check) {
+            ("name", Some(check)) => Value::Text(&check.name),
+            ("state", Some(check)) => Value::Text(&check.state),
+            ("failed", Some(check)) => Value::Bool(check.failed),
+            ("conclusion", _) => Value::Text(self.conclusion),
+            ("status", _) => Value::Text(self.run_status),
+            ("pending", _) => Value::Number(self.status.pending),
+            ("failed", None) => Value::Number(self.status.failed),
+            ("total", _) => Value::Number(self.status.checks.len() as u32),
+            ("checks", _) => Value::List(self.status.checks.iter().collect()),
+            ("failed_checks", _) => {
+                Value::List(self.status.checks.iter().filter(|c| c.failed).collect())
+            }
+            // Unknown variables are rejected when parsing
+            _ => Value::Text(""),
+        }
+    }
+
+    fn render(&self, nodes: &[Node], check: Option<&'a CheckResult>, out: &mut String) {
+        for node in nodes {
+            match node {
+                Node::Text(text) => out.push_str(text),
+                Node::Variable(name) => match self.lookup(name, check) {
+                    Value::Text(text) => out.push_str(text),
+                    Value::Number(number) => out.push_str(&number.to_string()),
+                    Value::Bool(value) => out.push_str(&value.to_string()),
+                    Value::List(list) => out.push_str(&list.len().to_string()),
+                },
+                Node::Section {
+                    name,
+                    inverted,
+                    nodes,
+                } => match self.lookup(name, check) {
+                    Value::List(list) if !inverted => {
+                        for check in list {
+                            self.render(nodes, Some(check), out);
+                        }
+                    }
+                    value => {
+                        if value.is_truthy() != *inverted {
+                            self.render(nodes, check, out);
+                        }
+                    }
+                },
+            }
+        }
+    }
+}
+
+impl SummaryTemplate {
+    /// Parse the template, returns a description of the problem if it is invalid.
+    pub fn parse(template: &str) -> Result<Self, String> {
+        // Open sections with the nodes collected before them, the innermost section is last
+        let mut stack: Vec<(String, bool, Vec<Node>)> = Vec::new();
+        let mut nodes = Vec::new();
+        let mut rest = template;
+
+        while let Some(start) = rest.find("{{") {
+            if start > 0 {
+                nodes.push(Node::Text(rest[..start].to_string()));
+            }
+            let Some(end) = rest[start..].find("}}") else {
+                return Err("unclosed tag, missing '}}'".to_string());
+            };
+            let tag = rest[start + 2..start + end].trim();
+            rest = &rest[start + end + 2..];
+
+            let in_list = stack
+                .iter()
+                .any(|(name, inverted, _)| !inverted && LISTS.contains(&name.as_str()));
+            if let Some(name) = tag.strip_prefix('/') {
+                let name = name.trim();
+                let Some((open, inverted, outer)) = stack.pop() else {
+                    return Err(format!("closing section '{name}' that has not been opened"));
+                };
+                if open != name {
+                    return Err(format!(
+                        "closing section '{name}', but section '{open}' is open"
+                    ));
+                }
+                let section = Node::Section {
+                    name: open,
+                    inverted,
+                    nodes: std::mem::replace(&mut nodes, outer),
+                };
+                nodes.push(section);
+                continue;
+            }
+
+            let (name, section) = match tag.strip_prefix('#') {
+                Some(name) => (name.trim(), Some(false)),
+                None => match tag.strip_prefix('^') {
+                    Some(name) => (name.trim(), Some(true)),
+                    None => (tag, None),
+                },
+            };
+            let known = VARIABLES.contains(&name) || (in_list && CHECK_VARIABLES.contains(&name));
+            if !known {
+                return Err(format!("unknown variable '{name}'"));
+            }
+            match section {
+                Some(inverted) => {
+                    if in_list && LISTS.contains(&name) && !inverted {
+                        return Err(format!("section '{name}' can't be nested in a list"));
+                    }
+                    stack.push((name.to_string(), inverted, std::mem::take(&mut nodes)));
+                }
+                None => nodes.push(Node::Variable(name.to_string())),
+            }
+        }
+        if let Some((name, _, _)) = stack.last() {
+            return Err(format!("section '{name}' is not closed"));
+        }
+        if !rest.is_empty() {
+            nodes.push(Node::Text(rest.to_string()));
+        }
+        Ok(Self { nodes })
+    }
+
+    /// Render the summary for the combined status of the checks.
+    /// The status is the one of the check-run, the conclusion is empty while the check-run is not completed.
+    pub fn render(&self, status: &CheckRunsStatus, run_status: &str, conclusion: &str) -> String {
+        let context = Context {
+            status,
+            run_status,
+            conclusion,
+        };
+        let mut out = String::new();
+        context.render(&self.nodes, None, &mut out);
+        out
+    }
+}
+
+impl Default for SummaryTemplate {
+    fn default() -> Self {
+        Self::parse(DEFAULT_SUMMARY_TEMPLATE).expect("The default summary template should be valid")
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::types::CHECK_RUN_SUMMARY;
+
+    fn status() -> CheckRunsStatus {
+        let mut status = CheckRunsStatus::default();
+        status.add_passed("lint", "success");
+        status.add_failed("build", "failure");
+        status.add_pending("e2e", "in_progress");
+        status
+    }
+
+    #[test]
+    fn test_default_template() {
+        let template = SummaryTemplate::default();
+        assert_eq!(
+            CHECK_RUN_SUMMARY,
+            template.render(&CheckRunsStatus::default(), "queued", ""),
+            "Should only contain the summary without checks"
+        );
+        assert_eq!(
+            format!(
+                "{CHECK_RUN_SUMMARY}\n\n**Considered checks:**\n- `lint`: success\n- `build`: failure\n- `e2e`: in_progress\n"
+            ),
+            template.render(&status(), "completed", "failure")
+        );
+    }
+
+    #[test]
+    fn test_custom_template() {
+        let template = SummaryTemplate::parse(
+            "Guard: {{ status }}{{#conclusion}} ({{conclusion}}){{/conclusion}}, {{failed}} failed, {{pending}} pending\n{{#failed_checks}}* {{name}} ({{state}})\n{{/failed_checks}}{{^failed}}Nothing failed\n{{/failed}}",
+        )
+        .expect("Should parse template");
+
+        assert_eq!(
+            "Guard: completed (failure), 1 failed, 1 pending\n* build (failure)\n",
+            template.render(&status(), "completed", "failure")
+        );
+        assert_eq!(
+            "Guard: queued, 0 failed, 0 pending\nNothing failed\n",
+            template.render(&CheckRunsStatus::default(), "queued", "")
+        );
+    }
+
+    #[test]
+    fn test_check_variables() {
+        let template =
+            SummaryTemplate::parse("{{#checks}}{{name}}{{#failed}}!{{/failed}} {{/checks}}")
+                .expect("Should parse template");
+        assert_eq!(
+            "lint build! e2e ",
+            template.render(&status(), "completed", "failure")
+        );
+    }
+
+    #[test]
+    fn test_parse_errors() {
+        let tests = [
+            ("{{unknown}}", "unknown variable 'unknown'"),
+            ("{{name}}", "unknown variable 'name'"),
+            ("{{#checks}}", "section 'checks' is not closed"),
+            (
+                "{{/checks}}",
+                "closing section 'checks' that has not been opened",
+            ),
+            (
+                "{{#checks}}{{/failed_checks}}",
+                "closing section 'failed_checks', but section 'checks' is open",
+            ),
+            (
+                "{{#checks}}{{#failed_checks}}{{/failed_checks}}{{/checks}}",
+                "section 'failed_checks' can't be nested in a list",
+            ),
+            ("{{conclusion", "unclosed tag, missing '}}'"),
+        ];
+        for (template, expected) in tests {
+            assert_eq!(
+                Err(expected.to_string()),
+                SummaryTemplate::parse(template),
+                "Template: {template}"
+            );
+        }
+    }
+}
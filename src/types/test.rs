@@ -27,6 +27,86 @@ fn parse_pull_request_event() {
     };
 
     assert_eq!("synchronize", event.action);
+    assert_eq!(331, event.pull_request.number);
+    assert_eq!("open", event.pull_request.state);
+    assert!(
+        !event.pull_request.draft,
+        "Draft should default to false when missing"
+    );
+    assert_eq!(
+        "e048a7ada6ed86b47c357bc8006b5052ae239e24", event.pull_request.head.sha,
+        "Should parse the head commit"
+    );
+    assert_eq!(
+        Some(68583790),
+        event.installation.map(|installation| installation.id),
+        "Should parse the installation id"
+    );
+    assert!(
+        event.repository.is_user_owned(),
+        "Repository should be owned by a personal account"
+    );
+}
+
+#[test]
+fn repo_is_user_owned() {
+    let mut repo = Repo {
+        id: 1,
+        name: "test-repo".to_string(),
+        full_name: "test-org/test-repo".to_string(),
+        owner: None,
+        private: false,
+        visibility: String::new(),
+    };
+    assert!(
+        !repo.is_user_owned(),
+        "Repo without owner is not user owned"
+    );
+
+    repo.owner = Some(Account {
+        login: "test-org".to_string(),
+        account_type: "Organization".to_string(),
+    });
+    assert!(!repo.is_user_owned(), "Repo owned by organization");
+
+    repo.owner = Some(Account {
+        login: "test-user".to_string(),
+        account_type: ACCOUNT_TYPE_USER.to_string(),
+    });
+    assert!(repo.is_user_owned(), "Repo owned by user");
+}
+
+#[test]
+fn parse_repo_visibility() {
+    let tests = [
+        (
+            r#"{"private": false, "visibility": "public"}"#,
+            false,
+            "public",
+        ),
+        (
+            r#"{"private": true, "visibility": "private"}"#,
+            true,
+            "private",
+        ),
+        (
+            r#"{"private": true, "visibility": "internal"}"#,
+            true,
+            "internal",
+        ),
+        (r#"{"private": true}"#, true, "private"),
+        (r#"{}"#, false, "public"),
+    ];
+    for (fields, private, visibility) in tests {
+        let mut payload: serde_json::Value = serde_json::from_str(fields).unwrap();
+        payload["id"] = 1.into();
+        payload["name"] = "test-repo".into();
+        payload["full_name"] = "test-org/test-repo".into();
+
+        let repo: Repo = serde_json::from_value(payload).expect("Failed to parse repository");
+        assert_eq!(private, repo.private, "Fields: {fields}");
+        assert_eq!(visibility, repo.visibility(), "Fields: {fields}");
+    }
 }
 
 #[test]
@@ -39,6 +119,55 @@ fn parse_check_run_event() {
     };
 
     assert_eq!("completed", event.action);
+    assert_eq!(
+        Some(68583790),
+        event.installation.map(|installation| installation.id),
+        "Should parse the installation id"
+    );
+}
+
+#[test]
+fn parse_check_suite_event() {
+    let test_body = include_str!("../server/testdata/check-suite-event-completed.json");
+
+    let event: CheckSuiteEvent = match serde_json::from_str(test_body) {
+        Ok(event) => event,
+        Err(e) => panic!("Failed to parse check_suite event: {e}"),
+    };
+
+    assert_eq!("completed", event.action);
+    assert_eq!(
+        "253f31d91db3a05dcf75c0e8135309491fed8669",
+        event.check_suite.head_sha
+    );
+    assert_eq!(Some("success"), event.check_suite.conclusion.as_deref());
+    assert_eq!(
+        Some("unknown-client-id"),
+        event
+            .check_suite
+            .app
+            .as_ref()
+            .map(|app| app.client_id.as_str())
+    );
+}
+
+#[test]
+fn parse_event_without_installation() {
+    let test_body = r#"{
+        "action": "completed",
+        "check_run": {"id": 1, "head_sha": "abc", "name": "test", "status": "completed"},
+        "repository": {"id": 1, "name": "repo", "full_name": "owner/repo"}
+    }"#;
+
+    let event: CheckRunEvent = match serde_json::from_str(test_body) {
+        Ok(event) => event,
+        Err(e) => panic!("Failed to parse check_run event: {e}"),
+    };
+
+    assert!(
+        event.installation.is_none(),
+        "Installation should be optional"
+    );
 }
 
 #[test]
@@ -66,7 +195,10 @@ fn check_run_assert_initial_fields(run: &CheckRun) {
 fn check_run_update_status() {
     let mut run = CheckRun::new("test-sha");
 
-    assert!(run.update_status(0), "Should have changed status");
+    assert!(
+        run.update_status(&CheckRunsStatus::default()),
+        "Should have changed status"
+    );
     assert_eq!(CHECK_RUN_NAME, run.name);
     assert_eq!(CHECK_RUN_COMPLETED_STATUS, run.status);
     assert_eq!(
@@ -83,15 +215,154 @@ fn check_run_update_status() {
         output.summary.as_ref().expect("Should have summary")
     );
 
-    assert!(run.update_status(10), "Should have changed status again");
+    let pending = CheckRunsStatus {
+        pending: 10,
+        ..Default::default()
+    };
+    assert!(
+        run.update_status(&pending),
+        "Should have changed status again"
+    );
     check_run_assert_initial_fields(&run);
 
     assert!(
-        !run.update_status(10),
+        !run.update_status(&pending),
         "Should not have changed status again"
     );
 }
 
+#[test]
+fn check_run_update_status_pending_as() {
+    let mut run = CheckRun::new("test-sha");
+    run.status = CHECK_RUN_IN_PROGRESS_STATUS.to_string();
+    let pending = CheckRunsStatus {
+        pending: 1,
+        ..Default::default()
+    };
+
+    run.update_status_pending_as(&pending, CHECK_RUN_IN_PROGRESS_STATUS);
+    assert_eq!(CHECK_RUN_IN_PROGRESS_STATUS, run.status);
+    assert!(
+        !run.update_status_pending_as(&pending, CHECK_RUN_IN_PROGRESS_STATUS),
+        "Should keep the pending status"
+    );
+
+    run.update_status_pending_as(&CheckRunsStatus::default(), CHECK_RUN_IN_PROGRESS_STATUS);
+    assert_eq!(CHECK_RUN_COMPLETED_STATUS, run.status);
+    assert!(
+        run.update_status_pending_as(&pending, CHECK_RUN_IN_PROGRESS_STATUS),
+        "Should reset the completed check-run"
+    );
+    assert_eq!(CHECK_RUN_IN_PROGRESS_STATUS, run.status);
+}
+
+#[test]
+fn check_run_update_status_failed() {
+    let mut run = CheckRun::new("test-sha");
+
+    let failed = CheckRunsStatus {
+        pending: 3,
+        failed: 1,
+        ..Default::default()
+    };
+    assert!(run.update_status(&failed), "Should have changed status");
+    assert_eq!(CHECK_RUN_COMPLETED_STATUS, run.status);
+    assert_eq!(
+        CHECK_RUN_FAILURE,
+        run.conclusion.as_ref().expect("Should have conclusion")
+    );
+
+    let pending = CheckRunsStatus {
+        pending: 1,
+        ..Default::default()
+    };
+    assert!(
+        run.update_status(&pending),
+        "Should go back to pending when failed checks are re-run"
+    );
+    check_run_assert_initial_fields(&run);
+}
+
+#[test]
+fn check_runs_status_running_excludes_missing() {
+    let mut status = CheckRunsStatus::default();
+    status.add_pending("e2e", "in_progress");
+    status.add_pending("ci/legacy", "pending");
+    status.add_missing("label:qa-approved", "missing");
+    status.add_missing("build", "not reported");
+
+    assert_eq!(4, status.pending, "Missing checks should count as pending");
+    assert_eq!(2, status.missing);
+    assert_eq!(2, status.running(), "Only reported checks are running");
+}
+
+#[test]
+fn check_run_update_status_summary() {
+    let mut run = CheckRun::new("test-sha");
+
+    let mut status = CheckRunsStatus::default();
+    status.add_passed("lint", "success");
+    status.add_failed("build", "failure");
+    status.add_pending("e2e", "in_progress");
+    status.add_failed("ci/legacy", "error");
+    assert_eq!(1, status.pending);
+    assert_eq!(2, status.failed);
+
+    assert!(run.update_status(&status), "Should have changed status");
+    let output = run.output.as_ref().expect("Should have output");
+    assert_eq!(
+        Some("2 other checks have failed: build, ci/legacy".to_string()),
+        output.title
+    );
+    let summary = output.summary.as_ref().expect("Should have summary");
+    for line in [
+        "- `lint`: success",
+        "- `build`: failure",
+        "- `e2e`: in_progress",
+        "- `ci/legacy`: error",
+    ] {
+        assert!(
+            summary.contains(line),
+            "Summary should contain '{line}', got:\n{summary}"
+        );
+    }
+
+    status.checks[1].state = "cancelled".to_string();
+    assert!(
+        run.update_status(&status),
+        "Should update the summary when only a conclusion changed"
+    );
+}
+
+#[test]
+fn check_run_set_timed_out() {
+    let mut run = CheckRun::new("test-commit");
+    run.set_timed_out(2, std::time::Duration::from_secs(3600));
+
+    assert_eq!(CHECK_RUN_COMPLETED_STATUS, run.status);
+    assert_eq!(Some(CHECK_RUN_FAILURE.to_string()), run.conclusion);
+    let output = run.output.as_ref().expect("Should have output");
+    assert_eq!(
+        Some("Timed out waiting for 2 other checks to complete".to_string()),
+        output.title
+    );
+    assert!(
+        output.summary.as_ref().is_some_and(|s| s.contains("3600s")),
+        "Summary should explain the timeout: {:?}",
+        output.summary
+    );
+
+    let pending = CheckRunsStatus {
+        pending: 2,
+        ..Default::default()
+    };
+    assert!(
+        run.update_status(&pending),
+        "Should go back to pending on the next refresh"
+    );
+    assert_eq!(CHECK_RUN_INITIAL_STATUS, run.status);
+}
+
 #[test]
 fn parse_token_response() {
     let test_body = include_str!("testdata/token-response.json");
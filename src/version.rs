@@ -1,3 +1,4 @@
+use serde::Serialize;
 use std::process;
 
 #[cfg(test)]
@@ -6,6 +7,22 @@ mod test;
 pub const NAME: &str = env!("CARGO_PKG_NAME");
 pub const VERSION: &str = env!("CARGO_PKG_VERSION");
 pub const COMMIT: Option<&str> = option_env!("CI_COMMIT_SHA");
+/// Version of the compiler used for the build, set by the build script
+pub const RUST_VERSION: &str = env!("RUSTC_VERSION");
+
+/// Build information printed by the version command in JSON format and served on /version
+#[derive(Serialize)]
+pub struct VersionInfo {
+    name: &'static str,
+    version: &'static str,
+    commit: &'static str,
+    rust_version: &'static str,
+}
+
+/// Default User-Agent for requests to the GitHub API, e.g. "cerberus-mergeguard/0.5.2"
+pub fn user_agent() -> String {
+    format!("{NAME}/{VERSION}")
+}
 
 fn version_information() -> String {
     let mut info = format!("{NAME}:\n    Version: v{VERSION}\n");
@@ -18,7 +35,25 @@ fn version_information() -> String {
     info
 }
 
-pub fn print_version_and_exit() {
-    println!("{}", version_information());
+/// Build information of the running binary, with the full commit SHA.
+pub fn version_info() -> VersionInfo {
+    VersionInfo {
+        name: NAME,
+        version: VERSION,
+        commit: COMMIT.unwrap_or("unknown"),
+        rust_version: RUST_VERSION,
+    }
+}
+
+/// Build information as a JSON object, with the full commit SHA.
+fn version_json() -> String {
+    serde_json::to_string(&version_info()).expect("Failed to serialize version information")
+}
+
+pub fn print_version_and_exit(output: crate::VersionOutput) {
+    match output {
+        crate::VersionOutput::Text => println!("{}", version_information()),
+        crate::VersionOutput::Json => println!("{}", version_json()),
+    }
     process::exit(0);
 }
@@ -9,3 +9,21 @@ fn test_version_information() {
     assert!(lines[1].contains("Version:"));
     assert!(lines[2].contains("Commit:"));
 }
+
+#[test]
+fn test_version_json() {
+    let info: serde_json::Value =
+        serde_json::from_str(&version_json()).expect("Should be valid JSON");
+    let info = info.as_object().expect("Should be a JSON object");
+
+    let mut keys: Vec<&str> = info.keys().map(String::as_str).collect();
+    keys.sort();
+    assert_eq!(vec!["commit", "name", "rust_version", "version"], keys);
+    assert_eq!(NAME, info["name"]);
+    assert_eq!(VERSION, info["version"]);
+    assert_eq!(COMMIT.unwrap_or("unknown"), info["commit"]);
+    assert!(
+        !info["rust_version"].as_str().unwrap().is_empty(),
+        "Should contain the rust version"
+    );
+}